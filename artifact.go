@@ -0,0 +1,516 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/ns"
+)
+
+var (
+	// ErrInvalidArtifact is returned when an artifact cannot be decoded,
+	// or is not of type 0x0004
+	ErrInvalidArtifact = errors.New("invalid artifact")
+	// ErrUnknownArtifact is returned when an artifact was never issued,
+	// has expired, has already been resolved, or is being resolved by
+	// an entity other than its intended recipient
+	ErrUnknownArtifact = errors.New("unknown artifact")
+)
+
+// ArtifactTypeCode is the type code of the artifacts defined by SAML 2.0
+const ArtifactTypeCode uint16 = 0x0004
+
+// artifactLength is the length of a decoded type 0x0004 artifact: the
+// type code, the endpoint index, the source ID and the message handle
+const artifactLength = 2 + 2 + 20 + 20
+
+// DefaultArtifactMaxAge is how long MemoryArtifactStore keeps messages
+// around when MaxAge is not set
+const DefaultArtifactMaxAge = 5 * time.Minute
+
+// ArtifactSourceID computes the SourceID of artifacts issued by the
+// entity with the given ID
+func ArtifactSourceID(entityID string) [20]byte {
+	return sha1.Sum([]byte(entityID))
+}
+
+// NewArtifact creates an artifact with a random message handle, issued
+// by the entity with the given ID. endpointIndex is the index of the
+// issuer's ArtifactResolutionService that will resolve it
+func NewArtifact(entityID string, endpointIndex uint16) (*Artifact, error) {
+	a := &Artifact{
+		EndpointIndex: endpointIndex,
+		SourceID:      ArtifactSourceID(entityID),
+	}
+	if _, err := io.ReadFull(rand.Reader, a.MessageHandle[:]); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ParseArtifact decodes the base64 encoded artifact in s
+func ParseArtifact(s string) (*Artifact, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != artifactLength {
+		return nil, ErrInvalidArtifact
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != ArtifactTypeCode {
+		return nil, ErrInvalidArtifact
+	}
+
+	a := &Artifact{
+		EndpointIndex: binary.BigEndian.Uint16(b[2:4]),
+	}
+	copy(a.SourceID[:], b[4:24])
+	copy(a.MessageHandle[:], b[24:44])
+	return a, nil
+}
+
+// String returns the base64 encoded form of the artifact, as sent in
+// the SAMLart parameter and the samlp:Artifact element
+func (a Artifact) String() string {
+	b := make([]byte, artifactLength)
+	binary.BigEndian.PutUint16(b[0:2], ArtifactTypeCode)
+	binary.BigEndian.PutUint16(b[2:4], a.EndpointIndex)
+	copy(b[4:24], a.SourceID[:])
+	copy(b[24:44], a.MessageHandle[:])
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// IssuedBy returns true if the artifact's SourceID matches the entity
+// with the given ID. This is how the receiver of an artifact finds the
+// entity that can resolve it
+func (a Artifact) IssuedBy(entityID string) bool {
+	id := ArtifactSourceID(entityID)
+	return bytes.Equal(a.SourceID[:], id[:])
+}
+
+// ArtifactStore keeps the messages referred to by issued artifacts
+// until they are resolved. Implementations must be safe for concurrent
+// use
+type ArtifactStore interface {
+	// Store records msg, the XML of the message that a refers to, to be
+	// resolved by the entity with the ID recipient
+	Store(a *Artifact, recipient string, msg []byte) error
+	// Resolve removes and returns the message that a refers to.
+	// ErrUnknownArtifact is returned if there is no such message, if it
+	// has expired, or if requester is not the recipient it was stored
+	// for
+	Resolve(a *Artifact, requester string) ([]byte, error)
+}
+
+type artifactEntry struct {
+	recipient string
+	msg       []byte
+	issued    time.Time
+}
+
+// MemoryArtifactStore is an ArtifactStore that keeps messages in
+// memory. Messages older than MaxAge can not be resolved, and are
+// evicted periodically
+type MemoryArtifactStore struct {
+	// MaxAge is how long messages are kept. If zero,
+	// DefaultArtifactMaxAge is used
+	MaxAge time.Duration
+	// Now returns the current time. If nil, time.Now is used
+	Now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]artifactEntry
+	lastSweep time.Time
+}
+
+// NewMemoryArtifactStore creates an empty MemoryArtifactStore
+func NewMemoryArtifactStore() *MemoryArtifactStore {
+	return &MemoryArtifactStore{
+		entries: make(map[string]artifactEntry),
+	}
+}
+
+func (s *MemoryArtifactStore) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *MemoryArtifactStore) maxAge() time.Duration {
+	if s.MaxAge > 0 {
+		return s.MaxAge
+	}
+	return DefaultArtifactMaxAge
+}
+
+func (s *MemoryArtifactStore) expired(e artifactEntry, now time.Time) bool {
+	return !now.Before(e.issued.Add(s.maxAge()))
+}
+
+func (s *MemoryArtifactStore) Store(a *Artifact, recipient string, msg []byte) error {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries == nil {
+		s.entries = make(map[string]artifactEntry)
+	}
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		for k, e := range s.entries {
+			if s.expired(e, now) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.entries[string(a.MessageHandle[:])] = artifactEntry{
+		recipient: recipient,
+		msg:       msg,
+		issued:    now,
+	}
+	return nil
+}
+
+func (s *MemoryArtifactStore) Resolve(a *Artifact, requester string) ([]byte, error) {
+	now := s.now()
+	key := string(a.MessageHandle[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, ErrUnknownArtifact
+	}
+	// A wrong requester does not consume the artifact, so that it can
+	// not be used to prevent the recipient from resolving it
+	if subtle.ConstantTimeCompare([]byte(e.recipient), []byte(requester)) != 1 {
+		return nil, ErrUnknownArtifact
+	}
+	delete(s.entries, key)
+
+	if s.expired(e, now) {
+		return nil, ErrUnknownArtifact
+	}
+	return e.msg, nil
+}
+
+// Len returns the number of messages currently stored
+func (s *MemoryArtifactStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// IssueArtifact stores msg, signed by signer if it is non-nil, and
+// returns an artifact referring to it. issuer is the entity ID of the
+// sender, endpointIndex the index of its ArtifactResolutionService and
+// recipient the entity ID of the party allowed to resolve the artifact
+func IssueArtifact(store ArtifactStore, issuer string, endpointIndex uint16, recipient string, msg ProtocolMessage, signer *Signer) (*Artifact, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.IssueArtifact")
+		defer g.IRelease("END saml.IssueArtifact")
+	}
+
+	xmlbuf, err := SignedXML(msg, signer)
+	if err != nil {
+		return nil, errors.New("failed to serialize message: " + err.Error())
+	}
+
+	a, err := NewArtifact(issuer, endpointIndex)
+	if err != nil {
+		return nil, errors.New("failed to create artifact: " + err.Error())
+	}
+
+	if err := store.Store(a, recipient, xmlbuf); err != nil {
+		return nil, errors.New("failed to store message: " + err.Error())
+	}
+	return a, nil
+}
+
+// ArtifactURL returns the URL that sends the artifact to this endpoint
+// using the HTTP-Artifact binding, by way of a redirect
+func (e Endpoint) ArtifactURL(a *Artifact, relayState string) (*url.URL, error) {
+	if v := e.ProtocolBinding; v != "" && v != binding.HTTPArtifact {
+		return nil, errors.New("endpoint does not support the HTTP-Artifact binding: " + v.String())
+	}
+
+	u, err := url.Parse(e.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	q.Set(ParamSAMLart, a.String())
+	if relayState != "" {
+		q.Set(ParamRelayState, relayState)
+	}
+	u.RawQuery = q.Encode()
+	return u, nil
+}
+
+// DecodeArtifactRequest extracts the artifact sent via the
+// HTTP-Artifact binding, in either the query string or a form, along
+// with the RelayState
+func DecodeArtifactRequest(r *http.Request) (*Artifact, string, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.DecodeArtifactRequest")
+		defer g.IRelease("END saml.DecodeArtifactRequest")
+	}
+
+	var values url.Values
+	switch r.Method {
+	case "GET":
+		values = r.URL.Query()
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			return nil, "", errors.New("failed to parse form: " + err.Error())
+		}
+		values = r.PostForm
+	default:
+		return nil, "", errors.New("unsupported method " + r.Method)
+	}
+
+	for _, k := range []string{ParamSAMLart, ParamRelayState} {
+		if len(values[k]) > 1 {
+			return nil, "", errors.New("duplicate parameter " + k)
+		}
+	}
+	s := values.Get(ParamSAMLart)
+	if s == "" {
+		return nil, "", errors.New("no " + ParamSAMLart + " present")
+	}
+
+	a, err := ParseArtifact(s)
+	if err != nil {
+		return nil, "", err
+	}
+	return a, values.Get(ParamRelayState), nil
+}
+
+// NewArtifactResolve creates an ArtifactResolve for the artifact
+func NewArtifactResolve(a *Artifact) *ArtifactResolve {
+	ar := &ArtifactResolve{Artifact: a.String()}
+	ar.Request.Message.Initialize()
+	return ar
+}
+
+func (ar ArtifactResolve) Serialize() (string, error) {
+	return serialize(ar)
+}
+
+func ParseArtifactResolve(src []byte) (*ArtifactResolve, error) {
+	doc, err := ParseXML(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return nil, errors.New("failed to fetch document element: " + err.Error())
+	}
+
+	ar := &ArtifactResolve{}
+	if err := ar.PopulateFromXML(root); err != nil {
+		return nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return ar, nil
+}
+
+func (ar *ArtifactResolve) PopulateFromXML(n types.Node) error {
+	if err := ar.Request.PopulateFromXML(n); err != nil {
+		return err
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	ar.Artifact = strings.TrimSpace(xpath.String(xpc.Find(ns.SAMLP.AddPrefix("Artifact"))))
+	if ar.Artifact == "" {
+		return errors.New("missing samlp:Artifact")
+	}
+	return nil
+}
+
+func (ar ArtifactResolve) MakeXMLNode(d types.Document) (types.Node, error) {
+	oarxml, err := ar.Request.MakeXMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+	arxml := oarxml.(types.Element)
+
+	arxml.MakeMortal()
+	defer arxml.AutoFree()
+
+	arxml.SetNodeName("ArtifactResolve")
+	arxml.SetNamespace(ns.SAML.URI, ns.SAML.Prefix, false)
+	arxml.SetNamespace(ns.SAMLP.URI, ns.SAMLP.Prefix, true)
+
+	axml, err := d.CreateElement(ns.SAMLP.AddPrefix("Artifact"))
+	if err != nil {
+		return nil, err
+	}
+	axml.AppendText(ar.Artifact)
+	arxml.AddChild(axml)
+
+	arxml.MakePersistent()
+	return arxml, nil
+}
+
+func NewArtifactResponse() *ArtifactResponse {
+	res := &ArtifactResponse{}
+	res.Message.Initialize()
+	return res
+}
+
+func (res ArtifactResponse) Serialize() (string, error) {
+	return serialize(res)
+}
+
+func ParseArtifactResponse(src []byte) (*ArtifactResponse, error) {
+	doc, err := ParseXML(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return nil, errors.New("failed to fetch document element: " + err.Error())
+	}
+
+	res := &ArtifactResponse{}
+	if err := res.PopulateFromXML(root); err != nil {
+		return nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return res, nil
+}
+
+func (res *ArtifactResponse) PopulateFromXML(n types.Node) error {
+	if err := res.Message.PopulateFromXML(n); err != nil {
+		return err
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	res.InResponseTo = xpath.String(xpc.Find("@InResponseTo"))
+	res.Status, res.SubStatus, err = parseStatus(xpc)
+	if err != nil {
+		return err
+	}
+
+	// The message is the only element that is not part of the
+	// StatusResponseType
+	payload := xpath.NodeList(xpc.Find("*[not(self::saml:Issuer or self::ds:Signature or self::samlp:Extensions or self::samlp:Status)]"))
+	switch len(payload) {
+	case 0:
+		res.Payload = nil
+	case 1:
+		s, err := StandaloneXML(payload[0])
+		if err != nil {
+			return errors.New("failed to extract message: " + err.Error())
+		}
+		res.Payload = []byte(s)
+	default:
+		return errors.New("multiple messages in samlp:ArtifactResponse")
+	}
+	return nil
+}
+
+func (res ArtifactResponse) MakeXMLNode(d types.Document) (types.Node, error) {
+	oresxml, err := res.Message.MakeXMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+
+	resxml := oresxml.(types.Element)
+	resxml.MakeMortal()
+	defer resxml.AutoFree()
+
+	resxml.SetNodeName("ArtifactResponse")
+	resxml.SetNamespace(ns.SAMLP.URI, ns.SAMLP.Prefix, true)
+	resxml.SetNamespace(ns.SAML.URI, ns.SAML.Prefix, false)
+
+	if v := res.InResponseTo; v != "" {
+		resxml.SetAttribute("InResponseTo", v)
+	}
+	st, err := makeStatusXMLNode(d, res.Status, res.SubStatus)
+	if err != nil {
+		return nil, err
+	}
+	resxml.AddChild(st)
+
+	if len(res.Payload) > 0 {
+		pdoc, err := ParseXML(res.Payload)
+		if err != nil {
+			return nil, errors.New("failed to parse payload: " + err.Error())
+		}
+		defer pdoc.Free()
+
+		proot, err := pdoc.DocumentElement()
+		if err != nil {
+			return nil, err
+		}
+		pnode, err := d.ImportNode(proot, true)
+		if err != nil {
+			return nil, err
+		}
+		resxml.AddChild(pnode)
+	}
+
+	resxml.MakePersistent()
+	return resxml, nil
+}
+
+// ResolveArtifact answers req using the messages in store. issuer is
+// the entity ID of the party answering, and requester the entity ID of
+// the party asking. The Issuer of req is not trusted: requester must
+// have been authenticated by the caller, such as by verifying req using
+// Verifier.VerifyArtifactResolve with the keys of the requester. As
+// required by SAML core, an artifact that cannot be resolved results in
+// a successful response without a message
+func ResolveArtifact(store ArtifactStore, req *ArtifactResolve, issuer, requester string) *ArtifactResponse {
+	res := NewArtifactResponse()
+	res.Issuer = issuer
+	res.InResponseTo = req.ID
+	res.Status = StatusSuccess
+
+	a, err := ParseArtifact(req.Artifact)
+	if err != nil {
+		res.Status = ErrRequester
+		return res
+	}
+	if !a.IssuedBy(issuer) {
+		return res
+	}
+
+	msg, err := store.Resolve(a, requester)
+	if err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("saml.ResolveArtifact: %s", err)
+		}
+		return res
+	}
+	res.Payload = msg
+	return res
+}
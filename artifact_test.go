@@ -0,0 +1,111 @@
+package saml
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifact(t *testing.T) {
+	const idp = "https://idp.example.com/saml/metadata"
+
+	a, err := NewArtifact(idp, 2)
+	if !assert.NoError(t, err, "NewArtifact succeeds") {
+		return
+	}
+	s := a.String()
+	if !assert.Len(t, s, 60, "artifact is 44 bytes, base64 encoded") {
+		return
+	}
+
+	parsed, err := ParseArtifact(s)
+	if !assert.NoError(t, err, "ParseArtifact succeeds") {
+		return
+	}
+	if !assert.Equal(t, a, parsed, "artifact round trips") {
+		return
+	}
+	if !assert.True(t, parsed.IssuedBy(idp), "SourceID matches the issuer") {
+		return
+	}
+	if !assert.False(t, parsed.IssuedBy("https://other.example.com"), "SourceID does not match others") {
+		return
+	}
+
+	for _, bad := range []string{"", "!!!", "AAQAAA==", strings.Replace(s, "AAQ", "AAU", 1)} {
+		_, err := ParseArtifact(bad)
+		if !assert.Equal(t, ErrInvalidArtifact, err, "%q is rejected", bad) {
+			return
+		}
+	}
+
+	ep := Endpoint{ProtocolBinding: binding.HTTPArtifact, Location: "https://sp.example.com/saml/acs"}
+	u, err := ep.ArtifactURL(a, "/home")
+	if !assert.NoError(t, err, "ArtifactURL succeeds") {
+		return
+	}
+	got, relayState, err := DecodeArtifactRequest(httptest.NewRequest("GET", u.String(), nil))
+	if !assert.NoError(t, err, "DecodeArtifactRequest succeeds") {
+		return
+	}
+	if !assert.Equal(t, a, got, "artifact matches") || !assert.Equal(t, "/home", relayState, "RelayState matches") {
+		return
+	}
+
+	ep.ProtocolBinding = binding.HTTPPost
+	if _, err := ep.ArtifactURL(a, ""); !assert.Error(t, err, "ArtifactURL requires the HTTP-Artifact binding") {
+		return
+	}
+}
+
+func TestMemoryArtifactStore(t *testing.T) {
+	const (
+		idp = "https://idp.example.com/saml/metadata"
+		sp  = "https://sp.example.com/saml/metadata"
+	)
+
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryArtifactStore()
+	store.Now = func() time.Time { return now }
+
+	a, err := NewArtifact(idp, 0)
+	if !assert.NoError(t, err, "NewArtifact succeeds") {
+		return
+	}
+	if !assert.NoError(t, store.Store(a, sp, []byte("<samlp:Response/>")), "Store succeeds") {
+		return
+	}
+
+	_, err = store.Resolve(a, "https://evil.example.com")
+	if !assert.Equal(t, ErrUnknownArtifact, err, "other entities can not resolve the artifact") {
+		return
+	}
+	msg, err := store.Resolve(a, sp)
+	if !assert.NoError(t, err, "recipient resolves the artifact") || !assert.Equal(t, "<samlp:Response/>", string(msg), "message matches") {
+		return
+	}
+	_, err = store.Resolve(a, sp)
+	if !assert.Equal(t, ErrUnknownArtifact, err, "artifact can only be resolved once") {
+		return
+	}
+
+	a, err = NewArtifact(idp, 0)
+	if !assert.NoError(t, err, "NewArtifact succeeds") {
+		return
+	}
+	if !assert.NoError(t, store.Store(a, sp, []byte("<samlp:Response/>")), "Store succeeds") {
+		return
+	}
+	now = now.Add(DefaultArtifactMaxAge)
+	_, err = store.Resolve(a, sp)
+	if !assert.Equal(t, ErrUnknownArtifact, err, "expired artifact is rejected") {
+		return
+	}
+	if !assert.Equal(t, 0, store.Len(), "store is empty") {
+		return
+	}
+}
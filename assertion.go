@@ -1,21 +1,70 @@
 package saml
 
 import (
+	"errors"
 	"time"
 
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
 	"github.com/lestrrat/go-saml/nameid"
-	"github.com/satori/go.uuid"
+	"github.com/lestrrat/go-saml/ns"
 )
 
 func NewAssertion() *Assertion {
 	a := &Assertion{}
 	a.Version = "2.0"
 	a.Conditions.SetNotBefore(time.Now())
-	a.ID = uuid.NewV5(uuid.NamespaceDNS, UUIDURL).String()
+	a.ID = newID()
 
 	return a
 }
 
+// PopulateFromXML fills the Assertion from a <saml:Assertion> element
+func (a *Assertion) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	a.ID = xpath.String(xpc.Find("@ID"))
+	a.Version = xpath.String(xpc.Find("@Version"))
+	if s := xpath.String(xpc.Find("@IssueInstant")); s != "" {
+		t, err := ParseTime(s)
+		if err != nil {
+			return err
+		}
+		a.IssueInstant = t
+	}
+	a.Issuer = xpath.String(xpc.Find(ns.SAML.AddPrefix("Issuer")))
+
+	if node := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("Subject"))).First(); node != nil {
+		if err := a.Subject.PopulateFromXML(node); err != nil {
+			return err
+		}
+	}
+
+	if node := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("Conditions"))).First(); node != nil {
+		if err := a.Conditions.PopulateFromXML(node); err != nil {
+			return err
+		}
+	}
+
+	if node := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("AuthnStatement"))).First(); node != nil {
+		if err := a.AuthnStatement.PopulateFromXML(node); err != nil {
+			return err
+		}
+	}
+
+	// We only have room for one AttributeStatement, so attributes from
+	// all of them are collected into a.AttributeStatement
+	for _, node := range xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("AttributeStatement"))) {
+		if err := a.AttributeStatement.PopulateFromXML(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (am AuthenticationMethod) String() string {
 	return string(am)
 }
@@ -24,6 +73,39 @@ func (cm ConfirmationMethod) String() string {
 	return string(cm)
 }
 
+func ParseAssertion(src []byte) (*Assertion, error) {
+	doc, err := ParseXML(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return constructAssertion(doc)
+}
+
+func ParseAssertionString(src string) (*Assertion, error) {
+	doc, err := ParseXMLString(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return constructAssertion(doc)
+}
+
+func constructAssertion(doc types.Document) (*Assertion, error) {
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return nil, errors.New("failed to fetch document element: " + err.Error())
+	}
+
+	a := &Assertion{}
+	if err := a.PopulateFromXML(root); err != nil {
+		return nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return a, nil
+}
+
 func (a *Assertion) AddAttribute(att Attribute) error {
 	a.AttributeStatement.Attributes = append(a.AttributeStatement.Attributes, att)
 	return nil
@@ -0,0 +1,107 @@
+package saml
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-saml/ns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAssertion(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	a := NewAssertion()
+	a.IssueInstant = now
+	a.Issuer = "https://idp.example.org/SAML2"
+	a.Conditions.SetNotBefore(now)
+	a.Conditions.AddAudience("https://sp.example.com/SAML2")
+	a.Subject = Subject{
+		NameID: NameID{
+			Format: nameid.Transient,
+			Value:  "3f7b3dcf-1674-4ecd-92c8-1544f346baf8",
+		},
+		SubjectConfirmation: SubjectConfirmation{
+			Method:       Bearer,
+			InResponseTo: "aaf23196-1773-2113-474a-fe114412ab72",
+			Recipient:    "https://sp.example.com/SAML2/SSO/POST",
+			NotOnOrAfter: now.Add(5 * time.Minute),
+		},
+	}
+	a.AuthnStatement = AuthnStatement{
+		AuthnInstant: now,
+		SessionIndex: "b07b804c-7c29-ea16-7300-4f3d6f7928ac",
+		AuthnContext: AuthnContext{
+			AuthnContextClassRef: PasswordProtectedTransport,
+		},
+	}
+	a.AddAttribute(Attribute{
+		Attrs: map[string]string{
+			"xmlns:" + ns.X500.Prefix:     ns.X500.URI,
+			ns.X500.AddPrefix("Encoding"): "LDAP",
+			"NameFormat":                  ns.NameFormatURI,
+		},
+		Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
+		FriendlyName: "eduPersonAffiliation",
+		Values: []AttributeValue{
+			AttributeValue{
+				Type:  ns.XMLSchema.AddPrefix("string"),
+				Value: "member",
+			},
+			AttributeValue{
+				Type:  ns.XMLSchema.AddPrefix("string"),
+				Value: "staff",
+			},
+		},
+	})
+
+	xmlstr, err := a.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+
+	parsed, err := ParseAssertionString(xmlstr)
+	if !assert.NoError(t, err, "ParseAssertionString succeeds") {
+		return
+	}
+
+	if !assert.Equal(t, a.ID, parsed.ID, "ID matches") {
+		return
+	}
+	if !assert.Equal(t, a.Issuer, parsed.Issuer, "Issuer matches") {
+		return
+	}
+	if !assert.True(t, a.IssueInstant.Equal(parsed.IssueInstant), "IssueInstant matches") {
+		return
+	}
+	if !assert.Equal(t, a.Subject.NameID, parsed.Subject.NameID, "NameID matches") {
+		return
+	}
+	if !assert.Equal(t, a.Subject.SubjectConfirmation.Recipient, parsed.Subject.SubjectConfirmation.Recipient, "Recipient matches") {
+		return
+	}
+	if !assert.True(t, a.Subject.SubjectConfirmation.NotOnOrAfter.Equal(parsed.Subject.SubjectConfirmation.NotOnOrAfter), "SubjectConfirmation.NotOnOrAfter matches") {
+		return
+	}
+	if !assert.True(t, a.Conditions.NotBefore.Equal(parsed.Conditions.NotBefore), "Conditions.NotBefore matches") {
+		return
+	}
+	if !assert.True(t, a.Conditions.NotOnOrAfter.Equal(parsed.Conditions.NotOnOrAfter), "Conditions.NotOnOrAfter matches") {
+		return
+	}
+	if !assert.Equal(t, a.Conditions.AudienceRestrictions, parsed.Conditions.AudienceRestrictions, "AudienceRestrictions match") {
+		return
+	}
+	if !assert.Equal(t, a.Conditions.AudienceRestrictions[0], parsed.Conditions.AudienceRestriction, "deprecated AudienceRestriction holds the first one") {
+		return
+	}
+	if !assert.Equal(t, a.AuthnStatement.SessionIndex, parsed.AuthnStatement.SessionIndex, "SessionIndex matches") {
+		return
+	}
+	if !assert.Equal(t, a.AuthnStatement.AuthnContext, parsed.AuthnStatement.AuthnContext, "AuthnContext matches") {
+		return
+	}
+	if !assert.Equal(t, a.AttributeStatement, parsed.AttributeStatement, "AttributeStatement matches") {
+		return
+	}
+}
@@ -0,0 +1,142 @@
+package saml
+
+import (
+	"errors"
+
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/lestrrat/go-saml/ns"
+)
+
+func NewAttributeQuery() *AttributeQuery {
+	aq := &AttributeQuery{}
+	aq.Request.Message.Initialize()
+	return aq
+}
+
+func (aq AttributeQuery) Serialize() (string, error) {
+	return serialize(aq)
+}
+
+func ParseAttributeQuery(src []byte) (*AttributeQuery, error) {
+	doc, err := ParseXML(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return nil, errors.New("failed to fetch document element: " + err.Error())
+	}
+
+	aq := &AttributeQuery{}
+	if err := aq.PopulateFromXML(root); err != nil {
+		return nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return aq, nil
+}
+
+func (aq *AttributeQuery) PopulateFromXML(n types.Node) error {
+	if err := aq.Request.PopulateFromXML(n); err != nil {
+		return err
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	node := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("Subject") + "/" + ns.SAML.AddPrefix("NameID"))).First()
+	if node == nil {
+		return errors.New("missing saml:Subject/saml:NameID")
+	}
+	if err := aq.NameID.PopulateFromXML(node); err != nil {
+		return err
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("Attribute"))) {
+		attr := Attribute{}
+		if err := attr.PopulateFromXML(node); err != nil {
+			return err
+		}
+		aq.Attributes = append(aq.Attributes, attr)
+	}
+	return nil
+}
+
+func (aq AttributeQuery) MakeXMLNode(d types.Document) (types.Node, error) {
+	oaqxml, err := aq.Request.MakeXMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+	aqxml := oaqxml.(types.Element)
+
+	aqxml.MakeMortal()
+	defer aqxml.AutoFree()
+
+	aqxml.SetNodeName("AttributeQuery")
+	aqxml.SetNamespace(ns.SAML.URI, ns.SAML.Prefix, false)
+	aqxml.SetNamespace(ns.SAMLP.URI, ns.SAMLP.Prefix, true)
+
+	sub, err := d.CreateElement(ns.SAML.AddPrefix("Subject"))
+	if err != nil {
+		return nil, err
+	}
+	aqxml.AddChild(sub)
+
+	nidxml, err := aq.NameID.MakeXMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+	sub.AddChild(nidxml)
+
+	for _, attr := range aq.Attributes {
+		attrxml, err := attr.MakeXMLNode(d)
+		if err != nil {
+			return nil, err
+		}
+		aqxml.AddChild(attrxml)
+	}
+
+	aqxml.MakePersistent()
+	return aqxml, nil
+}
+
+// SelectAttributes picks the attributes in available that were asked
+// for in requested, matching them by Name. When a requested attribute
+// lists values, only those values are returned. If requested is empty,
+// all of available is returned
+func SelectAttributes(available, requested []Attribute) []Attribute {
+	if len(requested) == 0 {
+		return available
+	}
+
+	var selected []Attribute
+	for _, attr := range available {
+		for _, req := range requested {
+			if req.Name != attr.Name {
+				continue
+			}
+
+			if len(req.Values) > 0 {
+				var values []AttributeValue
+				for _, av := range attr.Values {
+					for _, rv := range req.Values {
+						if av.Value == rv.Value {
+							values = append(values, av)
+							break
+						}
+					}
+				}
+				if len(values) == 0 {
+					break
+				}
+				attr.Values = values
+			}
+			selected = append(selected, attr)
+			break
+		}
+	}
+	return selected
+}
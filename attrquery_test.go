@@ -0,0 +1,84 @@
+package saml
+
+import (
+	"testing"
+
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttributeQuery(t *testing.T) {
+	aq := NewAttributeQuery()
+	aq.Issuer = "http://sp.example.com/metadata"
+	aq.Destination = "http://idp.example.com/aa"
+	aq.NameID = NameID{Format: nameid.Transient, Value: "alice"}
+	aq.Attributes = []Attribute{
+		Attribute{Name: "mail"},
+		Attribute{Name: "role", Values: []AttributeValue{{Type: "xs:string", Value: "admin"}}},
+	}
+
+	xmlstr, err := aq.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	if !assert.Contains(t, xmlstr, "<samlp:AttributeQuery", "AttributeQuery exists") {
+		return
+	}
+
+	parsed, err := ParseAttributeQuery([]byte(xmlstr))
+	if !assert.NoError(t, err, "ParseAttributeQuery succeeds") {
+		return
+	}
+	if !assert.Equal(t, aq.ID, parsed.ID, "ID matches") {
+		return
+	}
+	if !assert.Equal(t, aq.Issuer, parsed.Issuer, "Issuer matches") {
+		return
+	}
+	if !assert.Equal(t, aq.NameID, parsed.NameID, "NameID matches") {
+		return
+	}
+	if !assert.Len(t, parsed.Attributes, 2, "2 attributes") {
+		return
+	}
+	if !assert.Equal(t, "admin", parsed.Attributes[1].Values[0].Value, "value matches") {
+		return
+	}
+}
+
+func TestSelectAttributes(t *testing.T) {
+	available := []Attribute{
+		Attribute{Name: "mail", Values: []AttributeValue{{Value: "alice@example.com"}}},
+		Attribute{Name: "role", Values: []AttributeValue{{Value: "admin"}, {Value: "staff"}}},
+		Attribute{Name: "phone", Values: []AttributeValue{{Value: "555-1234"}}},
+	}
+
+	if !assert.Equal(t, available, SelectAttributes(available, nil), "everything is returned when nothing is requested") {
+		return
+	}
+
+	selected := SelectAttributes(available, []Attribute{
+		Attribute{Name: "mail"},
+		Attribute{Name: "role", Values: []AttributeValue{{Value: "staff"}, {Value: "guest"}}},
+		Attribute{Name: "unknown"},
+	})
+	if !assert.Len(t, selected, 2, "2 attributes are selected") {
+		return
+	}
+	if !assert.Equal(t, available[0], selected[0], "mail is returned as is") {
+		return
+	}
+	if !assert.Equal(t, []AttributeValue{{Value: "staff"}}, selected[1].Values, "only requested values are returned") {
+		return
+	}
+	if !assert.Len(t, available[1].Values, 2, "available attributes are left untouched") {
+		return
+	}
+
+	selected = SelectAttributes(available, []Attribute{
+		Attribute{Name: "role", Values: []AttributeValue{{Value: "guest"}}},
+	})
+	if !assert.Empty(t, selected, "attribute without matching values is left out") {
+		return
+	}
+}
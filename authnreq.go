@@ -2,20 +2,17 @@ package saml
 
 import (
 	"bytes"
-	"compress/flate"
-	"encoding/base64"
 	"errors"
 	"io"
+	"strconv"
 	"strings"
 
-	"github.com/lestrrat/go-libxml2/parser"
 	"github.com/lestrrat/go-libxml2/types"
 	"github.com/lestrrat/go-libxml2/xpath"
 	"github.com/lestrrat/go-pdebug"
 	"github.com/lestrrat/go-saml/binding"
 	"github.com/lestrrat/go-saml/ns"
 	"github.com/lestrrat/go-xmlsec/crypto"
-	"github.com/lestrrat/go-xmlsec/dsig"
 )
 
 func NewAuthnRequest() *AuthnRequest {
@@ -28,81 +25,53 @@ func NewAuthnRequest() *AuthnRequest {
 // deflates it, and base64 encodes it. URL encoding is done in the HTTP
 // protocol.
 // If the key value is not nil, it will attempt to generate a signature
-// using that specified key
+// using that specified key and the default algorithms. The key is
+// freed by signing, as described for Signer
 func (ar AuthnRequest) Encode(key *crypto.Key) ([]byte, error) {
+	return ar.EncodeWithSigner(keySigner(key))
+}
+
+// EncodeWithSigner is the same as Encode, but allows the signature and
+// digest algorithms to be configured via the Signer
+func (ar AuthnRequest) EncodeWithSigner(signer *Signer) ([]byte, error) {
 	if pdebug.Enabled {
 		g := pdebug.IPrintf("START AuthnRequest.Encode")
 		defer g.IRelease("END AuthnRequest.Encode")
 	}
 
-	return encode(ar, key, true)
+	return encode(ar, signer, true)
 }
 
 // DecodeAuthnRequestString takes in a byte buffer, decodes it from base64,
 // inflates it, and then parses the resulting XML.
-// If verify is true, it looks for the signature in the payload and
-// does signature validation using go-xmlsec.
-func DecodeAuthnRequestString(s string, verify bool) (*AuthnRequest, error) {
+// The signature is not verified. To do so, use DecodeRedirectRequest
+// with the sender's key, or pass the XML to Verifier.VerifyAuthnRequest
+func DecodeAuthnRequestString(s string) (*AuthnRequest, error) {
 	if pdebug.Enabled {
 		g := pdebug.IPrintf("START saml.DecodeAuthnRequestString '%.30s...' (%d bytes)", s, len(s))
 		defer g.IRelease("END saml.DecodeAuthnRequestString")
 	}
-	return decodeAuthnRequest(strings.NewReader(s), verify)
+	return decodeAuthnRequest(strings.NewReader(s))
 }
 
 // DecodeAuthnRequest takes in a byte buffer, decodes it from base64,
 // inflates it, and then parses the resulting XML.
-// If verify is true, it looks for the signature in the payload and
-// does signature validation using go-xmlsec.
-func DecodeAuthnRequest(b []byte, verify bool) (*AuthnRequest, error) {
+// The signature is not verified. To do so, use DecodeRedirectRequest
+// with the sender's key, or pass the XML to Verifier.VerifyAuthnRequest
+func DecodeAuthnRequest(b []byte) (*AuthnRequest, error) {
 	if pdebug.Enabled {
 		g := pdebug.IPrintf("START saml.DecodeAuthnRequest '%.30s...' (%d bytes)", b, len(b))
 		defer g.IRelease("END saml.DecodeAuthnRequest")
 	}
-	return decodeAuthnRequest(bytes.NewReader(b), verify)
+	return decodeAuthnRequest(bytes.NewReader(b))
 }
 
-func decodeAuthnRequest(in io.Reader, verify bool) (*AuthnRequest, error) {
-	r := flate.NewReader(base64.NewDecoder(b64enc, in))
-
-	buf := bytes.Buffer{}
-	if _, err := io.Copy(&buf, r); err != nil {
-		if pdebug.Enabled {
-			pdebug.Printf("Failed to copy from flate.Reader to bytes.Buffer: %s", err)
-		}
-		return nil, err
-	}
-
-	if err := r.Close(); err != nil {
-		if pdebug.Enabled {
-			pdebug.Printf("Failed to Close() flat.Reader: %s", err)
-		}
+func decodeAuthnRequest(in io.Reader) (*AuthnRequest, error) {
+	xmlbytes, err := decode(in, true)
+	if err != nil {
 		return nil, err
 	}
 
-	if buf.Len() <= 0 {
-		if pdebug.Enabled {
-			pdebug.Printf("buf.Len() is 0")
-		}
-		return nil, errors.New("empty request")
-	}
-
-	xmlbytes := buf.Bytes()
-	if verify {
-		verifier, err := dsig.NewSignatureVerify()
-		if err != nil {
-			return nil, err
-		}
-
-		if err := verifier.Verify(xmlbytes); err != nil {
-			return nil, err
-		}
-	}
-
-	if pdebug.Enabled {
-		pdebug.Printf("base64 decode/uncompress/xml signature verification complete")
-	}
-
 	return ParseAuthnRequest(xmlbytes)
 }
 
@@ -111,21 +80,21 @@ func (ar AuthnRequest) Serialize() (string, error) {
 }
 
 func ParseAuthnRequest(src []byte) (*AuthnRequest, error) {
-	p := parser.New(parser.XMLParseDTDLoad | parser.XMLParseDTDAttr | parser.XMLParseNoEnt)
-	doc, err := p.Parse(src)
+	doc, err := ParseXML(src)
 	if err != nil {
-		return nil, errors.New("failed to parse xml: " + err.Error())
+		return nil, err
 	}
+	defer doc.Free()
 
 	return constructAuthnRequest(doc)
 }
 
 func ParseAuthnRequestString(src string) (*AuthnRequest, error) {
-	p := parser.New(parser.XMLParseDTDLoad | parser.XMLParseDTDAttr | parser.XMLParseNoEnt)
-	doc, err := p.ParseString(src)
+	doc, err := ParseXMLString(src)
 	if err != nil {
-		return nil, errors.New("failed to parse xml: " + err.Error())
+		return nil, err
 	}
+	defer doc.Free()
 
 	return constructAuthnRequest(doc)
 }
@@ -158,15 +127,19 @@ func (ar *AuthnRequest) PopulateFromXML(n types.Node) error {
 	}
 
 	ar.ProviderName = xpath.String(xpc.Find("@ProviderName"))
-	// Check if we have a proper ProtocolBinding
-	switch proto := binding.Protocol(xpath.String(xpc.Find("@ProtocolBinding"))); proto {
-	case binding.HTTPPost, binding.HTTPRedirect:
-		ar.ProtocolBinding = proto
-	default:
-		return errors.New("invalid protocol binding")
-	}
+	// ProtocolBinding is optional, in which case the IdP picks the
+	// binding based on the metadata of the SP. Whether the binding is
+	// supported is up to the IdP, as profiles such as ECP use bindings
+	// other than HTTP-POST
+	ar.ProtocolBinding = binding.Protocol(xpath.String(xpc.Find("@ProtocolBinding")))
 
 	ar.AssertionConsumerServiceURL = xpath.String(xpc.Find("@AssertionConsumerServiceURL"))
+	if ar.AssertionConsumerServiceIndex, err = parseIndex(xpc, "AssertionConsumerServiceIndex"); err != nil {
+		return err
+	}
+	if ar.AttributeConsumingServiceIndex, err = parseIndex(xpc, "AttributeConsumingServiceIndex"); err != nil {
+		return err
+	}
 	if node := xpath.NodeList(xpc.Find("NameIDPolicy")).First(); node != nil {
 		nip := &NameIDPolicy{}
 		if err := nip.PopulateFromXML(node.(types.Element)); err != nil {
@@ -178,6 +151,21 @@ func (ar *AuthnRequest) PopulateFromXML(n types.Node) error {
 	return nil
 }
 
+// parseIndex parses the optional index attribute called `name`. An
+// absent attribute is returned as 0
+func parseIndex(xpc *xpath.Context, name string) (uint8, error) {
+	s := xpath.String(xpc.Find("@" + name))
+	if s == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, errors.New("invalid " + name + ": " + err.Error())
+	}
+	return uint8(i), nil
+}
+
 func (ar AuthnRequest) MakeXMLNode(d types.Document) (types.Node, error) {
 	oarxml, err := ar.Request.MakeXMLNode(d)
 	if err != nil {
@@ -193,8 +181,16 @@ func (ar AuthnRequest) MakeXMLNode(d types.Document) (types.Node, error) {
 	arxml.SetNamespace(ns.SAMLP.URI, ns.SAMLP.Prefix, true)
 
 	arxml.SetAttribute("ProviderName", ar.ProviderName)
-	arxml.SetAttribute("ProtocolBinding", ar.ProtocolBinding.String())
+	if v := ar.ProtocolBinding; v != "" {
+		arxml.SetAttribute("ProtocolBinding", v.String())
+	}
 	arxml.SetAttribute("AssertionConsumerServiceURL", ar.AssertionConsumerServiceURL)
+	if v := ar.AssertionConsumerServiceIndex; v != 0 {
+		arxml.SetAttribute("AssertionConsumerServiceIndex", strconv.Itoa(int(v)))
+	}
+	if v := ar.AttributeConsumingServiceIndex; v != 0 {
+		arxml.SetAttribute("AttributeConsumingServiceIndex", strconv.Itoa(int(v)))
+	}
 
 	if nip := ar.NameIDPolicy; nip != nil {
 		nipxml, err := nip.MakeXMLNode(d)
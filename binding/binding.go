@@ -5,6 +5,9 @@ type Protocol string
 const (
 	HTTPPost     Protocol = `urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST`
 	HTTPRedirect Protocol = `urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect`
+	HTTPArtifact Protocol = `urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact`
+	SOAP         Protocol = `urn:oasis:names:tc:SAML:2.0:bindings:SOAP`
+	PAOS         Protocol = `urn:oasis:names:tc:SAML:2.0:bindings:PAOS`
 )
 
 func (p Protocol) String() string {
@@ -8,6 +8,42 @@ func (c *Conditions) SetNotBefore(t time.Time) {
 	c.NotOnOrAfter = t.Add(11 * time.Minute)
 }
 
+// AddAudience adds s to the first AudienceRestriction, creating it if
+// necessary
 func (c *Conditions) AddAudience(s string) {
-	c.AudienceRestriction.Audience = append(c.AudienceRestriction.Audience, s)
+	if len(c.AudienceRestrictions) == 0 {
+		c.AudienceRestrictions = append(c.AudienceRestrictions, AudienceRestriction{})
+	}
+	c.AudienceRestrictions[0].Audience = append(c.AudienceRestrictions[0].Audience, s)
+}
+
+// AddAudienceRestriction adds a separate AudienceRestriction holding
+// the given audiences
+func (c *Conditions) AddAudienceRestriction(audiences ...string) {
+	c.AudienceRestrictions = append(c.AudienceRestrictions, AudienceRestriction{Audience: audiences})
+}
+
+// audienceRestrictions returns AudienceRestrictions, preceded by the
+// deprecated AudienceRestriction if it is set and is not already the
+// first of them, as it is after parsing
+func (c Conditions) audienceRestrictions() []AudienceRestriction {
+	if len(c.AudienceRestriction.Audience) == 0 {
+		return c.AudienceRestrictions
+	}
+	if len(c.AudienceRestrictions) > 0 && sameAudiences(c.AudienceRestrictions[0], c.AudienceRestriction) {
+		return c.AudienceRestrictions
+	}
+	return append([]AudienceRestriction{c.AudienceRestriction}, c.AudienceRestrictions...)
+}
+
+func sameAudiences(a, b AudienceRestriction) bool {
+	if len(a.Audience) != len(b.Audience) {
+		return false
+	}
+	for i := range a.Audience {
+		if a.Audience[i] != b.Audience[i] {
+			return false
+		}
+	}
+	return true
 }
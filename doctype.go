@@ -0,0 +1,22 @@
+package saml
+
+/*
+#cgo pkg-config: libxml-2.0
+#include <stdint.h>
+#include <libxml/tree.h>
+
+static int saml_has_dtd(uintptr_t docptr) {
+	xmlDocPtr doc = (xmlDocPtr) docptr;
+	return doc->intSubset != NULL || doc->extSubset != NULL;
+}
+*/
+import "C"
+
+import "github.com/lestrrat/go-libxml2/types"
+
+// hasDTD reports whether doc declares a DTD. This catches DOCTYPE
+// declarations that were hidden from the byte level check in ParseXML
+// by using an encoding that libxml2 detects on its own
+func hasDTD(doc types.Document) bool {
+	return C.saml_has_dtd(C.uintptr_t(doc.Pointer())) != 0
+}
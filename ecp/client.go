@@ -0,0 +1,163 @@
+package ecp
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml/soap"
+)
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Get fetches url, logging in if the SP asks for it
+func (c *Client) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends req to the SP, advertising ECP support. If the SP answers
+// with an AuthnRequest, it is relayed to the IdP, and the IdP's Response
+// is relayed back to the SP. The SP's answer to the Response, usually a
+// redirect to the resource that was originally requested, is followed
+// and returned
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START ecp.Client.Do %s", req.URL)
+		defer g.IRelease("END ecp.Client.Do")
+	}
+
+	SetRequestHeaders(req)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), ContentType) {
+		// No login is required
+		return res, nil
+	}
+
+	env, err := soap.ReadEnvelope(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, errors.New("failed to read PAOS request: " + err.Error())
+	}
+
+	spheaders, err := ParseHeaders(env)
+	if err != nil {
+		return nil, err
+	}
+	if spheaders.PAOSRequest == nil || spheaders.Request == nil {
+		return nil, errors.New("SP did not send an ECP request")
+	}
+
+	if c.IdPURL == "" {
+		return nil, errors.New("IdPURL is not set")
+	}
+
+	// The SP's header blocks are meant for the ECP only
+	idpenv, err := c.authenticate(c.IdPURL, &soap.Envelope{Body: env.Body})
+	if err != nil {
+		return nil, err
+	}
+	idpheaders, err := ParseHeaders(idpenv)
+	if err != nil {
+		return nil, err
+	}
+	if idpheaders.Response == nil {
+		return nil, errors.New("IdP did not send an ecp:Response")
+	}
+
+	acsURL := spheaders.PAOSRequest.ResponseConsumerURL
+	if idpheaders.Response.AssertionConsumerServiceURL != acsURL {
+		// Let the SP know that the exchange failed, without handing over
+		// the Response
+		fault := &soap.Envelope{Fault: soap.NewFault(soap.FaultClient, ErrACSMismatch.Error())}
+		if res, err := c.post(acsURL, fault); err == nil {
+			res.Body.Close()
+		}
+		return nil, ErrACSMismatch
+	}
+
+	spenv := &soap.Envelope{Body: idpenv.Body}
+	var blocks []makeXMLNoder
+	if v := spheaders.PAOSRequest.MessageID; v != "" {
+		blocks = append(blocks, PAOSResponse{RefToMessageID: v})
+	}
+	if v := spheaders.RelayState; v != "" {
+		blocks = append(blocks, relayStateHeader(v))
+	}
+	for _, b := range blocks {
+		h, err := headerXML(b)
+		if err != nil {
+			return nil, err
+		}
+		spenv.Header = append(spenv.Header, h)
+	}
+	return c.post(acsURL, spenv)
+}
+
+// authenticate sends the AuthnRequest in env to the IdP along with the
+// credentials, and returns the IdP's answer
+func (c *Client) authenticate(url string, env *soap.Envelope) (*soap.Envelope, error) {
+	s, err := env.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(s))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", soap.ContentType)
+	req.Header.Set("SOAPAction", `"`+soap.SOAPAction+`"`)
+	req.SetBasicAuth(c.Username, c.Password)
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusInternalServerError:
+	case http.StatusUnauthorized:
+		return nil, ErrAuthenticationFailed
+	default:
+		return nil, errors.New("unexpected status " + strconv.Itoa(res.StatusCode) + " from IdP")
+	}
+
+	idpenv, err := soap.ReadEnvelope(res.Body)
+	if err != nil {
+		return nil, errors.New("failed to read IdP response: " + err.Error())
+	}
+	if idpenv.Fault != nil {
+		return nil, idpenv.Fault
+	}
+	return idpenv, nil
+}
+
+// post sends env to the SP as a PAOS message
+func (c *Client) post(url string, env *soap.Envelope) (*http.Response, error) {
+	s, err := env.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(s))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	return c.httpClient().Do(req)
+}
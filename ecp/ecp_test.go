@@ -0,0 +1,112 @@
+package ecp_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/ecp"
+	"github.com/lestrrat/go-saml/idp"
+	"github.com/lestrrat/go-saml/internal/testutil"
+	"github.com/lestrrat/go-saml/md"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-saml/sp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestECP(t *testing.T) {
+	idpkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	idpcert := testutil.MakeCertificate(t, idpkey)
+	if idpcert == nil {
+		return
+	}
+
+	idpmux := http.NewServeMux()
+	idpsrv := httptest.NewServer(idpmux)
+	defer idpsrv.Close()
+	spmux := http.NewServeMux()
+	spsrv := httptest.NewServer(spmux)
+	defer spsrv.Close()
+
+	sessions := sp.NewStoreSessionManager(sp.NewMemorySessionStore())
+	sessions.Insecure = true
+	s := &sp.ServiceProvider{
+		EntityID: spsrv.URL + "/saml/metadata",
+		ACSURL:   spsrv.URL + "/saml/acs",
+		Sessions: sessions,
+	}
+	i := &idp.IdentityProvider{
+		EntityID:    idpsrv.URL + "/saml/metadata",
+		SSOURL:      idpsrv.URL + "/saml/sso",
+		ECPURL:      idpsrv.URL + "/saml/ecp",
+		Key:         idpkey,
+		Certificate: idpcert,
+		BasicAuthenticator: idp.BasicAuthenticatorFunc(func(r *http.Request, req *idp.AuthnRequest, username, password string) (*idp.Session, error) {
+			if username != "alice" || password != "secret" {
+				return nil, nil
+			}
+			return &idp.Session{
+				ID:     "session-1",
+				NameID: saml.NameID{Format: nameid.Transient, Value: "alice"},
+			}, nil
+		}),
+	}
+	s.IdP = i.Metadata()
+	i.ServiceProviders = idp.NewMetadataStore(&md.Metadata{EntityDescriptors: []md.EntityDescriptor{s.Metadata()}})
+
+	idpmux.Handle("/", i)
+	spmux.Handle("/saml/", s)
+	spmux.Handle("/resource", s.RequireSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := sp.SessionFromContext(r.Context())
+		w.Write([]byte("hello " + session.NameID.Value))
+	})))
+
+	jar, err := cookiejar.New(nil)
+	if !assert.NoError(t, err, "cookiejar.New succeeds") {
+		return
+	}
+	c := &ecp.Client{
+		HTTPClient: &http.Client{Jar: jar},
+		IdPURL:     i.ECPURL,
+		Username:   "alice",
+		Password:   "wrong",
+	}
+
+	_, err = c.Get(spsrv.URL + "/resource")
+	if !assert.Equal(t, ecp.ErrAuthenticationFailed, err, "wrong password is rejected") {
+		return
+	}
+
+	c.Password = "secret"
+	res, err := c.Get(spsrv.URL + "/resource")
+	if !assert.NoError(t, err, "Get succeeds") {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if !assert.NoError(t, err, "ReadAll succeeds") {
+		return
+	}
+	if !assert.Equal(t, "hello alice", string(body), "resource is served after login") {
+		return
+	}
+
+	// The session is kept, so that no further login is needed
+	c.Password = "wrong"
+	res, err = c.Get(spsrv.URL + "/resource")
+	if !assert.NoError(t, err, "Get succeeds") {
+		return
+	}
+	res.Body.Close()
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "resource is served") {
+		return
+	}
+}
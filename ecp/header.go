@@ -0,0 +1,250 @@
+package ecp
+
+import (
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat/go-libxml2/dom"
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/ns"
+	"github.com/lestrrat/go-saml/soap"
+)
+
+type makeXMLNoder interface {
+	MakeXMLNode(types.Document) (types.Node, error)
+}
+
+// IsECPRequest returns true if r comes from an ECP client, which
+// advertises that it accepts PAOS messages
+func IsECPRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), ContentType) &&
+		strings.Contains(r.Header.Get("PAOS"), Service)
+}
+
+// IsPAOSMessage returns true if the body of r is a PAOS message, such
+// as the Response relayed to the SP by an ECP client
+func IsPAOSMessage(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), ContentType)
+}
+
+// SetRequestHeaders adds the headers advertising ECP support to req
+func SetRequestHeaders(req *http.Request) {
+	req.Header.Set("Accept", "text/html; "+ContentType)
+	req.Header.Set("PAOS", PAOSHeader)
+}
+
+// NewRequestEnvelope wraps ar in the PAOS envelope that the SP sends to
+// an ECP client. If key is not nil, ar is signed with it
+func NewRequestEnvelope(ar *saml.AuthnRequest, relayState string, key *rsa.PrivateKey) (*soap.Envelope, error) {
+	env, err := soap.NewEnvelope(ar, key)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []makeXMLNoder{
+		PAOSRequest{ResponseConsumerURL: ar.AssertionConsumerServiceURL, MessageID: ar.ID},
+		Request{Issuer: ar.Issuer, ProviderName: ar.ProviderName, IsPassive: ar.IsPassive},
+	}
+	if relayState != "" {
+		blocks = append(blocks, relayStateHeader(relayState))
+	}
+	for _, b := range blocks {
+		h, err := headerXML(b)
+		if err != nil {
+			return nil, err
+		}
+		env.Header = append(env.Header, h)
+	}
+	return env, nil
+}
+
+// NewResponseEnvelope wraps res in the envelope that the IdP sends to
+// an ECP client, telling it to relay res to acsURL. If key is not nil,
+// res is signed with it
+func NewResponseEnvelope(res *saml.Response, acsURL string, key *rsa.PrivateKey) (*soap.Envelope, error) {
+	env, err := soap.NewEnvelope(res, key)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := headerXML(Response{AssertionConsumerServiceURL: acsURL})
+	if err != nil {
+		return nil, err
+	}
+	env.Header = append(env.Header, h)
+	return env, nil
+}
+
+// headerXML serializes a header block
+func headerXML(n makeXMLNoder) ([]byte, error) {
+	d := dom.CreateDocument()
+	defer d.Free()
+	root, err := n.MakeXMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.SetDocumentElement(root); err != nil {
+		return nil, err
+	}
+	s, err := dom.C14NSerialize{}.Serialize(d)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// makeHeaderBlock creates a header block that must be understood by the
+// next SOAP node
+func makeHeaderBlock(d types.Document, namespace *ns.Namespace, name string) (types.Element, error) {
+	e, err := d.CreateElementNS(namespace.URI, namespace.AddPrefix(name))
+	if err != nil {
+		return nil, err
+	}
+	e.SetNamespace(ns.SOAPEnvelope.URI, ns.SOAPEnvelope.Prefix, false)
+	e.SetAttribute(ns.SOAPEnvelope.AddPrefix("mustUnderstand"), "1")
+	e.SetAttribute(ns.SOAPEnvelope.AddPrefix("actor"), Actor)
+	return e, nil
+}
+
+func (r PAOSRequest) MakeXMLNode(d types.Document) (types.Node, error) {
+	e, err := makeHeaderBlock(d, ns.PAOS, "Request")
+	if err != nil {
+		return nil, err
+	}
+	e.SetAttribute("responseConsumerURL", r.ResponseConsumerURL)
+	e.SetAttribute("service", Service)
+	if v := r.MessageID; v != "" {
+		e.SetAttribute("messageID", v)
+	}
+	return e, nil
+}
+
+func (r PAOSResponse) MakeXMLNode(d types.Document) (types.Node, error) {
+	e, err := makeHeaderBlock(d, ns.PAOS, "Response")
+	if err != nil {
+		return nil, err
+	}
+	if v := r.RefToMessageID; v != "" {
+		e.SetAttribute("refToMessageID", v)
+	}
+	return e, nil
+}
+
+func (r Request) MakeXMLNode(d types.Document) (types.Node, error) {
+	e, err := makeHeaderBlock(d, ns.ECP, "Request")
+	if err != nil {
+		return nil, err
+	}
+	if v := r.ProviderName; v != "" {
+		e.SetAttribute("ProviderName", v)
+	}
+	e.SetAttribute("IsPassive", strconv.FormatBool(r.IsPassive))
+
+	iss, err := d.CreateElementNS(ns.SAML.URI, ns.SAML.AddPrefix("Issuer"))
+	if err != nil {
+		return nil, err
+	}
+	iss.AppendText(r.Issuer)
+	e.AddChild(iss)
+	return e, nil
+}
+
+func (r Response) MakeXMLNode(d types.Document) (types.Node, error) {
+	e, err := makeHeaderBlock(d, ns.ECP, "Response")
+	if err != nil {
+		return nil, err
+	}
+	e.SetAttribute("AssertionConsumerServiceURL", r.AssertionConsumerServiceURL)
+	return e, nil
+}
+
+type relayStateHeader string
+
+func (r relayStateHeader) MakeXMLNode(d types.Document) (types.Node, error) {
+	e, err := makeHeaderBlock(d, ns.ECP, "RelayState")
+	if err != nil {
+		return nil, err
+	}
+	e.AppendText(string(r))
+	return e, nil
+}
+
+// ParseHeaders extracts the ECP and PAOS header blocks from env. Other
+// header blocks are ignored
+func ParseHeaders(env *soap.Envelope) (*Headers, error) {
+	h := &Headers{}
+	for _, src := range env.Header {
+		if err := h.parse(src); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *Headers) parse(src []byte) error {
+	doc, err := saml.ParseXML(src)
+	if err != nil {
+		return err
+	}
+	defer doc.Free()
+
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return errors.New("failed to fetch document element: " + err.Error())
+	}
+
+	xpc, err := xpath.NewContext(root)
+	if err != nil {
+		return errors.New("failed to create xpath context: " + err.Error())
+	}
+	defer xpc.Free()
+	if err := xpc.RegisterNS(ns.SAML.Prefix, ns.SAML.URI); err != nil {
+		return errors.New("failed to register namespace for xpath context: " + err.Error())
+	}
+
+	switch root.NamespaceURI() {
+	case ns.PAOS.URI:
+		switch root.LocalName() {
+		case "Request":
+			if svc := xpath.String(xpc.Find("@service")); svc != Service {
+				return errors.New("unsupported PAOS service " + svc)
+			}
+			h.PAOSRequest = &PAOSRequest{
+				ResponseConsumerURL: xpath.String(xpc.Find("@responseConsumerURL")),
+				MessageID:           xpath.String(xpc.Find("@messageID")),
+			}
+			if h.PAOSRequest.ResponseConsumerURL == "" {
+				return errors.New("paos:Request has no responseConsumerURL")
+			}
+		case "Response":
+			h.PAOSResponse = &PAOSResponse{
+				RefToMessageID: xpath.String(xpc.Find("@refToMessageID")),
+			}
+		}
+	case ns.ECP.URI:
+		switch root.LocalName() {
+		case "Request":
+			passive := xpath.String(xpc.Find("@IsPassive"))
+			h.Request = &Request{
+				Issuer:       strings.TrimSpace(xpath.String(xpc.Find(ns.SAML.AddPrefix("Issuer")))),
+				ProviderName: xpath.String(xpc.Find("@ProviderName")),
+				IsPassive:    passive == "true" || passive == "1",
+			}
+		case "Response":
+			h.Response = &Response{
+				AssertionConsumerServiceURL: xpath.String(xpc.Find("@AssertionConsumerServiceURL")),
+			}
+			if h.Response.AssertionConsumerServiceURL == "" {
+				return errors.New("ecp:Response has no AssertionConsumerServiceURL")
+			}
+		case "RelayState":
+			h.RelayState = root.TextContent()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Package ecp implements the Enhanced Client or Proxy (ECP) profile,
+// which allows clients other than web browsers to log in to service
+// providers. The SP answers a request from an ECP client with an
+// AuthnRequest wrapped in a PAOS envelope, the client relays it to the
+// IdP using the SOAP binding along with the user's credentials, and
+// relays the IdP's Response back to the SP.
+package ecp
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ContentType is the media type of PAOS messages
+const ContentType = "application/vnd.paos+xml"
+
+// Service identifies the ECP profile in PAOS headers
+const Service = "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"
+
+// PAOSHeader is the value of the PAOS HTTP header sent by ECP clients
+const PAOSHeader = `ver="urn:liberty:paos:2003-08";"` + Service + `"`
+
+// Actor is the SOAP actor of the ECP and PAOS header blocks
+const Actor = "http://schemas.xmlsoap.org/soap/actor/next"
+
+var (
+	// ErrACSMismatch is returned by Client when the IdP sends the
+	// Response to a different AssertionConsumerService than the one
+	// the SP asked for
+	ErrACSMismatch = errors.New("IdP and SP disagree on the assertion consumer service")
+	// ErrAuthenticationFailed is returned by Client when the IdP
+	// rejects the credentials
+	ErrAuthenticationFailed = errors.New("IdP rejected the credentials")
+)
+
+// PAOSRequest is the paos:Request header block sent by the SP. It tells
+// the ECP where to send the response
+type PAOSRequest struct {
+	ResponseConsumerURL string
+	MessageID           string
+}
+
+// PAOSResponse is the paos:Response header block sent by the ECP to
+// the SP, referring to the MessageID of the PAOSRequest
+type PAOSResponse struct {
+	RefToMessageID string
+}
+
+// Request is the ecp:Request header block sent by the SP
+type Request struct {
+	Issuer       string
+	ProviderName string
+	IsPassive    bool
+}
+
+// Response is the ecp:Response header block sent by the IdP. The ECP
+// checks that AssertionConsumerServiceURL matches the
+// ResponseConsumerURL of the PAOSRequest
+type Response struct {
+	AssertionConsumerServiceURL string
+}
+
+// Headers are the ECP and PAOS header blocks found in a SOAP envelope.
+// Blocks that are not present are nil
+type Headers struct {
+	PAOSRequest  *PAOSRequest
+	PAOSResponse *PAOSResponse
+	Request      *Request
+	Response     *Response
+	// RelayState is the content of the ecp:RelayState header block
+	RelayState string
+}
+
+// Client is an ECP client. It accesses resources on service providers
+// like a regular HTTP client, and logs in to the IdP using HTTP Basic
+// authentication whenever an SP asks for it
+type Client struct {
+	// HTTPClient is used to send requests. It should have a cookie jar
+	// so that the session established by the SP is kept. If nil,
+	// http.DefaultClient is used
+	HTTPClient *http.Client
+	// IdPURL is the URL of the IdP's SingleSignOnService supporting
+	// the SOAP binding. It is never taken from the SP's request, so
+	// that the credentials are only ever sent to the configured IdP
+	IdPURL string
+	// Username and Password are sent to the IdP
+	Username string
+	Password string
+}
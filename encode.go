@@ -4,13 +4,12 @@ import (
 	"bytes"
 	"compress/flate"
 	"encoding/base64"
+	"errors"
 	"io"
+	"io/ioutil"
 	"sync"
 
-	"github.com/lestrrat/go-libxml2/parser"
 	"github.com/lestrrat/go-pdebug"
-	"github.com/lestrrat/go-xmlsec/crypto"
-	"github.com/lestrrat/go-xmlsec/dsig"
 )
 
 var b64enc = base64.StdEncoding
@@ -41,89 +40,104 @@ type serializer interface {
 	Serialize() (string, error)
 }
 
-func encode(s serializer, key *crypto.Key, compress bool) ([]byte, error) {
+// encodeXML serializes s, and signs it if signer is not nil
+func encodeXML(s serializer, signer *Signer) (string, error) {
 	xmlstr, err := s.Serialize()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	if pdebug.Enabled {
 		pdebug.Printf("Generated %d bytes of XML", len(xmlstr))
 	}
 
-	if key != nil {
-		p := parser.New(parser.XMLParseDTDLoad | parser.XMLParseDTDAttr | parser.XMLParseNoEnt)
-		doc, err := p.ParseString(xmlstr)
-		if err != nil {
-			return nil, err
-		}
+	if signer != nil {
+		return signer.sign(xmlstr)
+	}
+	return xmlstr, nil
+}
 
-		root, err := doc.DocumentElement()
-		if err != nil {
-			return nil, err
-		}
+// encode serializes and signs s like encodeXML, deflates the result if
+// compress is true, and base64 encodes it
+func encode(s serializer, signer *Signer, compress bool) ([]byte, error) {
+	xmlstr, err := encodeXML(s, signer)
+	if err != nil {
+		return nil, err
+	}
 
-		// Create a new signature section.
-		sig, err := dsig.NewSignature(root, dsig.ExclC14N, dsig.RsaSha1, "")
-		if err := sig.AddReference(dsig.Sha1, "", "", ""); err != nil {
-			return nil, err
-		}
+	buf := bytes.Buffer{}
+	if compress {
+		w := getFlateWriter()
+		defer releaseFlateWriter(w)
 
-		if err := sig.AddTransform(dsig.Enveloped); err != nil {
+		w.Reset(&buf)
+		if _, err := io.WriteString(w, xmlstr); err != nil {
 			return nil, err
 		}
 
-		if key.HasRsaKey() == nil || key.HasDsaKey() == nil || key.HasEcdsaKey() == nil {
-			if err := sig.AddKeyValue(); err != nil {
-				return nil, err
-			}
-		}
-
-		// If the key is setup using X509, add that node
-		if key.HasX509() == nil {
-			if err := sig.AddX509Data(); err != nil {
-				return nil, err
-			}
-		}
-
-		if pdebug.Enabled {
-			pdebug.Printf("Signing using key %p", key)
-		}
-		if err := sig.Sign(key); err != nil {
+		if err := w.Close(); err != nil {
 			return nil, err
 		}
-
-		xmlstr = doc.Dump(false)
-		if err != nil {
-			return nil, err
+		if pdebug.Enabled {
+			pdebug.Printf("Compressed to %d bytes", buf.Len())
 		}
+	} else {
+		buf.WriteString(xmlstr)
 	}
 
-	if !compress {
-		return []byte(xmlstr), nil
+	ret := make([]byte, b64enc.EncodedLen(buf.Len()))
+	b64enc.Encode(ret, buf.Bytes())
+	if pdebug.Enabled {
+		pdebug.Printf("Encoded into %d bytes of base64", len(ret))
 	}
 
-	buf := bytes.Buffer{}
-
-	w := getFlateWriter()
-	defer releaseFlateWriter(w)
+	return ret, nil
+}
 
-	w.Reset(&buf)
-	if _, err := io.WriteString(w, xmlstr); err != nil {
+// decode is the reverse of encode: it takes the base64 encoded payload,
+// decodes it, inflates it if compressed is true, and returns the
+// resulting XML. The size of both the encoded payload and the result is
+// bounded by MaxEncodedSize and MaxDecodedSize.
+// Signatures are not verified here: use a Verifier on the result, which
+// only trusts configured keys rather than the embedded KeyInfo
+func decode(in io.Reader, compressed bool) ([]byte, error) {
+	encoded, err := ioutil.ReadAll(io.LimitReader(in, MaxEncodedSize+1))
+	if err != nil {
 		return nil, err
 	}
+	if int64(len(encoded)) > MaxEncodedSize {
+		return nil, ErrEncodedTooLarge{Limit: MaxEncodedSize, Size: int64(len(encoded))}
+	}
+
+	var r io.Reader = base64.NewDecoder(b64enc, bytes.NewReader(encoded))
+	if compressed {
+		fr := flate.NewReader(r)
+		defer fr.Close()
+		r = fr
+	}
 
-	if err := w.Close(); err != nil {
+	buf := bytes.Buffer{}
+	n, err := io.Copy(&buf, io.LimitReader(r, MaxDecodedSize+1))
+	if err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("Failed to decode payload: %s", err)
+		}
 		return nil, err
 	}
-	if pdebug.Enabled {
-		pdebug.Printf("Compressed to %d bytes", buf.Len())
+	if n > MaxDecodedSize {
+		return nil, ErrDecodedTooLarge{Limit: MaxDecodedSize, Size: n}
 	}
 
-	ret := make([]byte, b64enc.EncodedLen(buf.Len()))
-	b64enc.Encode(ret, buf.Bytes())
-	if pdebug.Enabled {
-		pdebug.Printf("Encoded into %d bytes of base64", len(ret))
+	if buf.Len() <= 0 {
+		if pdebug.Enabled {
+			pdebug.Printf("buf.Len() is 0")
+		}
+		return nil, errors.New("empty payload")
 	}
 
-	return ret, nil
+	xmlbytes := buf.Bytes()
+
+	if pdebug.Enabled {
+		pdebug.Printf("base64 decode/uncompress complete")
+	}
+	return xmlbytes, nil
 }
@@ -0,0 +1,511 @@
+package saml
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/lestrrat/go-libxml2/dom"
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/lestrrat/go-saml/ns"
+)
+
+// ErrDecryptionFailed is returned when an encrypted element could not be
+// decrypted. The reason is deliberately not disclosed, so that the error
+// cannot be used as a padding oracle
+var ErrDecryptionFailed = errors.New("failed to decrypt element")
+
+// xencElement is the Type of <xenc:EncryptedData> for encrypted elements
+const xencElement = "http://www.w3.org/2001/04/xmlenc#Element"
+
+func (alg EncryptionAlgorithm) String() string {
+	return string(alg)
+}
+
+func (alg KeyTransportAlgorithm) String() string {
+	return string(alg)
+}
+
+// keySize returns the size of the AES key used by the algorithm, and
+// whether it uses GCM
+func (alg EncryptionAlgorithm) keySize() (int, bool, error) {
+	switch alg {
+	case Aes128CBC:
+		return 16, false, nil
+	case Aes256CBC:
+		return 32, false, nil
+	case Aes128GCM:
+		return 16, true, nil
+	case Aes256GCM:
+		return 32, true, nil
+	}
+	return 0, false, errors.New("unsupported encryption algorithm: " + alg.String())
+}
+
+// NewEncrypter creates an Encrypter that encrypts for the owner of cert
+// using the default algorithms
+func NewEncrypter(cert *x509.Certificate) *Encrypter {
+	return &Encrypter{Certificate: cert}
+}
+
+// Encrypt encrypts plaintext, which should be a serialized XML element
+// containing all of its namespace declarations
+func (e Encrypter) Encrypt(plaintext []byte) (*EncryptedElement, error) {
+	pub, ok := e.Certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("encryption requires an RSA certificate")
+	}
+
+	alg := e.EncryptionAlgorithm
+	if alg == "" {
+		alg = Aes256GCM
+	}
+	size, gcm, err := alg.keySize()
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var ciphertext []byte
+	if gcm {
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		ciphertext = aead.Seal(nonce, nonce, plaintext, nil)
+	} else {
+		// XML Encryption only looks at the last byte of the padding
+		padlen := aes.BlockSize - len(plaintext)%aes.BlockSize
+		padded := make([]byte, len(plaintext)+padlen)
+		copy(padded, plaintext)
+		for i := len(plaintext); i < len(padded); i++ {
+			padded[i] = byte(padlen)
+		}
+
+		ciphertext = make([]byte, aes.BlockSize+len(padded))
+		iv := ciphertext[:aes.BlockSize]
+		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+			return nil, err
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext[aes.BlockSize:], padded)
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedElement{
+		EncryptionMethod: alg,
+		EncryptedKey: EncryptedKey{
+			EncryptionMethod: RsaOaepMgf1p,
+			DigestMethod:     Sha1,
+			Certificate:      e.Certificate,
+			CipherValue:      encryptedKey,
+		},
+		CipherValue: ciphertext,
+	}, nil
+}
+
+// Decrypt decrypts the element using key, and returns the serialized
+// XML element
+func (ee EncryptedElement) Decrypt(key *rsa.PrivateKey) ([]byte, error) {
+	ek := ee.EncryptedKey
+	if ek.EncryptionMethod != RsaOaepMgf1p {
+		return nil, errors.New("unsupported key transport algorithm: " + ek.EncryptionMethod.String())
+	}
+	if v := ek.DigestMethod; v != "" && v != Sha1 {
+		return nil, errors.New("unsupported key transport digest algorithm: " + v.String())
+	}
+
+	size, gcm, err := ee.EncryptionMethod.keySize()
+	if err != nil {
+		return nil, err
+	}
+
+	symkey, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, ek.CipherValue, nil)
+	if err != nil || len(symkey) != size {
+		return nil, ErrDecryptionFailed
+	}
+
+	block, err := aes.NewCipher(symkey)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	ciphertext := ee.CipherValue
+	if gcm {
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, ErrDecryptionFailed
+		}
+		if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
+			return nil, ErrDecryptionFailed
+		}
+		plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+		if err != nil {
+			return nil, ErrDecryptionFailed
+		}
+		return plaintext, nil
+	}
+
+	if len(ciphertext) < 2*aes.BlockSize || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrDecryptionFailed
+	}
+	plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, ciphertext[:aes.BlockSize]).CryptBlocks(plaintext, ciphertext[aes.BlockSize:])
+
+	padlen := int(plaintext[len(plaintext)-1])
+	if padlen < 1 || padlen > aes.BlockSize {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext[:len(plaintext)-padlen], nil
+}
+
+// encryptElement serializes n as a standalone element, and encrypts it
+func encryptElement(n MakeXMLNoder, enc *Encrypter) (*EncryptedElement, error) {
+	d := dom.CreateDocument()
+	defer d.Free()
+
+	root, err := n.MakeXMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.SetDocumentElement(root); err != nil {
+		return nil, err
+	}
+
+	// The element is taken out of its context, so the namespaces that
+	// it may depend on must be declared on the element itself
+	if e, ok := root.(types.Element); ok {
+		e.SetNamespace(ns.SAML.URI, ns.SAML.Prefix, true)
+		e.SetNamespace(ns.XMLSchema.URI, ns.XMLSchema.Prefix, false)
+		e.SetNamespace(ns.XMLSchemaInstance.URI, ns.XMLSchemaInstance.Prefix, false)
+	}
+
+	xmlstr, err := dom.C14NSerialize{}.Serialize(d)
+	if err != nil {
+		return nil, err
+	}
+	return enc.Encrypt([]byte(xmlstr))
+}
+
+// decryptElement decrypts ee, makes sure that the result is a
+// saml:<name> element, and populates v from it
+func decryptElement(ee EncryptedElement, key *rsa.PrivateKey, name string, v interface {
+	PopulateFromXML(types.Node) error
+}) error {
+	plaintext, err := ee.Decrypt(key)
+	if err != nil {
+		return err
+	}
+
+	doc, err := ParseXML(plaintext)
+	if err != nil {
+		return err
+	}
+	defer doc.Free()
+
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return errors.New("failed to fetch document element: " + err.Error())
+	}
+	if root.LocalName() != name || root.NamespaceURI() != ns.SAML.URI {
+		return errors.New("expected " + ns.SAML.AddPrefix(name) + " in encrypted element")
+	}
+	return v.PopulateFromXML(root)
+}
+
+// EncryptNameID encrypts NameID for the recipient described by enc, and
+// stores the result in EncryptedID. NameID is cleared
+func (s *Subject) EncryptNameID(enc *Encrypter) error {
+	eid, err := encryptElement(s.NameID, enc)
+	if err != nil {
+		return err
+	}
+	s.NameID = NameID{}
+	s.EncryptedID = eid
+	return nil
+}
+
+// DecryptNameID decrypts EncryptedID using key, and replaces it with
+// the NameID
+func (s *Subject) DecryptNameID(key *rsa.PrivateKey) error {
+	if s.EncryptedID == nil {
+		return errors.New("no encrypted ID")
+	}
+
+	nid := NameID{}
+	if err := decryptElement(*s.EncryptedID, key, "NameID", &nid); err != nil {
+		return err
+	}
+	s.NameID = nid
+	s.EncryptedID = nil
+	return nil
+}
+
+// EncryptAttribute encrypts all attributes called name for the recipient
+// described by enc, and moves them to EncryptedAttributes
+func (as *AttributeStatement) EncryptAttribute(enc *Encrypter, name string) error {
+	attrs := as.Attributes[:0:0]
+	for _, attr := range as.Attributes {
+		if attr.Name != name {
+			attrs = append(attrs, attr)
+			continue
+		}
+
+		ea, err := encryptElement(attr, enc)
+		if err != nil {
+			return err
+		}
+		as.EncryptedAttributes = append(as.EncryptedAttributes, *ea)
+	}
+	as.Attributes = attrs
+	return nil
+}
+
+// DecryptAttributes decrypts all EncryptedAttributes using key, and
+// appends them to Attributes
+func (as *AttributeStatement) DecryptAttributes(key *rsa.PrivateKey) error {
+	for _, ea := range as.EncryptedAttributes {
+		attr := Attribute{}
+		if err := decryptElement(ea, key, "Attribute", &attr); err != nil {
+			return err
+		}
+		as.Attributes = append(as.Attributes, attr)
+	}
+	as.EncryptedAttributes = nil
+	return nil
+}
+
+// DecryptElements decrypts the encrypted identifier and attributes in
+// the assertion, if any
+func (a *Assertion) DecryptElements(key *rsa.PrivateKey) error {
+	if a.Subject.EncryptedID != nil {
+		if err := a.Subject.DecryptNameID(key); err != nil {
+			return err
+		}
+	}
+	if len(a.AttributeStatement.EncryptedAttributes) > 0 {
+		if err := a.AttributeStatement.DecryptAttributes(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PopulateFromXML reads the encrypted data from n, which is the element
+// wrapping <xenc:EncryptedData> (such as <saml:EncryptedAssertion>).
+// The <xenc:EncryptedKey> may either be in the <ds:KeyInfo> of the
+// encrypted data, or be a sibling of it.
+func (ee *EncryptedElement) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	ee.EncryptionMethod = EncryptionAlgorithm(xpath.String(xpc.Find("xenc:EncryptedData/xenc:EncryptionMethod/@Algorithm")))
+	if ee.EncryptionMethod == "" {
+		return errors.New("missing xenc:EncryptionMethod")
+	}
+
+	cv, err := parseCipherValue(xpath.String(xpc.Find("xenc:EncryptedData/xenc:CipherData/xenc:CipherValue")))
+	if err != nil {
+		return err
+	}
+	ee.CipherValue = cv
+
+	node := xpath.NodeList(xpc.Find("xenc:EncryptedData/ds:KeyInfo/xenc:EncryptedKey | xenc:EncryptedKey")).First()
+	if node == nil {
+		return errors.New("missing xenc:EncryptedKey")
+	}
+	return ee.EncryptedKey.PopulateFromXML(node)
+}
+
+// makeXMLNode creates the element called name wrapping the
+// <xenc:EncryptedData>
+func (ee EncryptedElement) makeXMLNode(d types.Document, name string) (types.Node, error) {
+	wrapper, err := d.CreateElementNS(ns.SAML.URI, ns.SAML.AddPrefix(name))
+	if err != nil {
+		return nil, err
+	}
+	wrapper.MakeMortal()
+	defer wrapper.AutoFree()
+
+	edxml, err := d.CreateElementNS(ns.XMLEncryption.URI, ns.XMLEncryption.AddPrefix("EncryptedData"))
+	if err != nil {
+		return nil, err
+	}
+	edxml.SetAttribute("Type", xencElement)
+	wrapper.AddChild(edxml)
+
+	em, err := d.CreateElement(ns.XMLEncryption.AddPrefix("EncryptionMethod"))
+	if err != nil {
+		return nil, err
+	}
+	em.SetAttribute("Algorithm", ee.EncryptionMethod.String())
+	edxml.AddChild(em)
+
+	ki, err := d.CreateElementNS(ns.XMLDSignature.URI, ns.XMLDSignature.AddPrefix("KeyInfo"))
+	if err != nil {
+		return nil, err
+	}
+	edxml.AddChild(ki)
+
+	ekxml, err := ee.EncryptedKey.MakeXMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+	ki.AddChild(ekxml)
+
+	cd, err := makeCipherData(d, ee.CipherValue)
+	if err != nil {
+		return nil, err
+	}
+	edxml.AddChild(cd)
+
+	wrapper.MakePersistent()
+	return wrapper, nil
+}
+
+func (ek *EncryptedKey) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	ek.EncryptionMethod = KeyTransportAlgorithm(xpath.String(xpc.Find("xenc:EncryptionMethod/@Algorithm")))
+	ek.DigestMethod = DigestAlgorithm(xpath.String(xpc.Find("xenc:EncryptionMethod/ds:DigestMethod/@Algorithm")))
+
+	if s := xpath.String(xpc.Find("ds:KeyInfo/ds:X509Data/ds:X509Certificate")); s != "" {
+		der, err := b64enc.DecodeString(stripSpaces(s))
+		if err != nil {
+			return errors.New("failed to decode certificate: " + err.Error())
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errors.New("failed to parse certificate: " + err.Error())
+		}
+		ek.Certificate = cert
+	}
+
+	cv, err := parseCipherValue(xpath.String(xpc.Find("xenc:CipherData/xenc:CipherValue")))
+	if err != nil {
+		return err
+	}
+	ek.CipherValue = cv
+	return nil
+}
+
+func (ek EncryptedKey) MakeXMLNode(d types.Document) (types.Node, error) {
+	ekxml, err := d.CreateElementNS(ns.XMLEncryption.URI, ns.XMLEncryption.AddPrefix("EncryptedKey"))
+	if err != nil {
+		return nil, err
+	}
+	ekxml.MakeMortal()
+	defer ekxml.AutoFree()
+
+	em, err := d.CreateElement(ns.XMLEncryption.AddPrefix("EncryptionMethod"))
+	if err != nil {
+		return nil, err
+	}
+	em.SetAttribute("Algorithm", ek.EncryptionMethod.String())
+	ekxml.AddChild(em)
+
+	if v := ek.DigestMethod; v != "" {
+		dm, err := d.CreateElementNS(ns.XMLDSignature.URI, ns.XMLDSignature.AddPrefix("DigestMethod"))
+		if err != nil {
+			return nil, err
+		}
+		dm.SetAttribute("Algorithm", v.String())
+		em.AddChild(dm)
+	}
+
+	if cert := ek.Certificate; cert != nil {
+		ki, err := d.CreateElementNS(ns.XMLDSignature.URI, ns.XMLDSignature.AddPrefix("KeyInfo"))
+		if err != nil {
+			return nil, err
+		}
+		ekxml.AddChild(ki)
+
+		x509data, err := d.CreateElement(ns.XMLDSignature.AddPrefix("X509Data"))
+		if err != nil {
+			return nil, err
+		}
+		ki.AddChild(x509data)
+
+		certxml, err := d.CreateElement(ns.XMLDSignature.AddPrefix("X509Certificate"))
+		if err != nil {
+			return nil, err
+		}
+		certxml.AppendText(b64enc.EncodeToString(cert.Raw))
+		x509data.AddChild(certxml)
+	}
+
+	cd, err := makeCipherData(d, ek.CipherValue)
+	if err != nil {
+		return nil, err
+	}
+	ekxml.AddChild(cd)
+
+	ekxml.MakePersistent()
+	return ekxml, nil
+}
+
+func makeCipherData(d types.Document, value []byte) (types.Node, error) {
+	cd, err := d.CreateElement(ns.XMLEncryption.AddPrefix("CipherData"))
+	if err != nil {
+		return nil, err
+	}
+
+	cv, err := d.CreateElement(ns.XMLEncryption.AddPrefix("CipherValue"))
+	if err != nil {
+		return nil, err
+	}
+	cv.AppendText(b64enc.EncodeToString(value))
+	cd.AddChild(cv)
+	return cd, nil
+}
+
+func parseCipherValue(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("missing xenc:CipherValue")
+	}
+	v, err := b64enc.DecodeString(stripSpaces(s))
+	if err != nil {
+		return nil, errors.New("failed to decode xenc:CipherValue: " + err.Error())
+	}
+	return v, nil
+}
+
+// stripSpaces removes the line breaks and indentation that are commonly
+// found in base64 encoded element contents
+func stripSpaces(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
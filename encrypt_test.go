@@ -0,0 +1,157 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/lestrrat/go-saml/internal/testutil"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncrypter(t *testing.T) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	otherkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+
+	cert := testutil.MakeCertificate(t, privkey)
+	if cert == nil {
+		return
+	}
+
+	plaintext := []byte(`<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_a1"/>`)
+	for _, alg := range []EncryptionAlgorithm{"", Aes128CBC, Aes256CBC, Aes128GCM, Aes256GCM} {
+		enc := &Encrypter{Certificate: cert, EncryptionAlgorithm: alg}
+		ee, err := enc.Encrypt(plaintext)
+		if !assert.NoError(t, err, "Encrypt succeeds (%s)", alg) {
+			return
+		}
+
+		decrypted, err := ee.Decrypt(privkey)
+		if !assert.NoError(t, err, "Decrypt succeeds (%s)", alg) {
+			return
+		}
+		if !assert.Equal(t, plaintext, decrypted, "plaintext matches (%s)", alg) {
+			return
+		}
+
+		_, err = ee.Decrypt(otherkey)
+		if !assert.Equal(t, ErrDecryptionFailed, err, "Decrypt with wrong key fails (%s)", alg) {
+			return
+		}
+	}
+}
+
+func TestEncryptedAssertion(t *testing.T) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	cert := testutil.MakeCertificate(t, privkey)
+	if cert == nil {
+		return
+	}
+
+	res := NewResponse()
+	res.Issuer = "http://idp.example.com/metadata"
+	res.Status = StatusSuccess
+	res.Assertion = NewAssertion()
+	res.Assertion.Issuer = "http://idp.example.com/metadata"
+
+	if !assert.NoError(t, res.EncryptAssertion(NewEncrypter(cert)), "EncryptAssertion succeeds") {
+		return
+	}
+	if !assert.Nil(t, res.Assertion, "Assertion is replaced") {
+		return
+	}
+
+	xmlstr, err := res.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	if !assert.Contains(t, xmlstr, "<saml:EncryptedAssertion", "EncryptedAssertion is emitted") {
+		return
+	}
+
+	parsed, err := ParseResponseString(xmlstr)
+	if !assert.NoError(t, err, "ParseResponseString succeeds") {
+		return
+	}
+	if !assert.NotNil(t, parsed.EncryptedAssertion, "EncryptedAssertion is parsed") {
+		return
+	}
+
+	if !assert.NoError(t, parsed.DecryptAssertion(privkey), "DecryptAssertion succeeds") {
+		return
+	}
+	if !assert.Equal(t, res.Issuer, parsed.Assertion.Issuer, "Assertion is decrypted") {
+		return
+	}
+}
+
+func TestEncryptedIDAndAttributes(t *testing.T) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	cert := testutil.MakeCertificate(t, privkey)
+	if cert == nil {
+		return
+	}
+	enc := NewEncrypter(cert)
+
+	a := NewAssertion()
+	a.Issuer = "http://idp.example.com/metadata"
+	a.Subject.NameID = NameID{Format: nameid.Unspecified, Value: "secret-id"}
+	a.AttributeStatement.Attributes = []Attribute{
+		{Name: "mail", Values: []AttributeValue{{Type: "xs:string", Value: "alice@example.com"}}},
+		{Name: "ssn", Values: []AttributeValue{{Type: "xs:string", Value: "123-45-6789"}}},
+	}
+
+	if !assert.NoError(t, a.Subject.EncryptNameID(enc), "EncryptNameID succeeds") {
+		return
+	}
+	if !assert.NoError(t, a.AttributeStatement.EncryptAttribute(enc, "ssn"), "EncryptAttribute succeeds") {
+		return
+	}
+
+	xmlstr, err := a.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	for _, secret := range []string{"secret-id", "123-45-6789"} {
+		if !assert.NotContains(t, xmlstr, secret, "cleartext is not present") {
+			return
+		}
+	}
+
+	parsed, err := ParseAssertionString(xmlstr)
+	if !assert.NoError(t, err, "ParseAssertionString succeeds") {
+		return
+	}
+	if !assert.NotNil(t, parsed.Subject.EncryptedID, "EncryptedID is parsed") {
+		return
+	}
+	if !assert.Len(t, parsed.AttributeStatement.EncryptedAttributes, 1, "EncryptedAttribute is parsed") {
+		return
+	}
+
+	if !assert.NoError(t, parsed.DecryptElements(privkey), "DecryptElements succeeds") {
+		return
+	}
+	if !assert.Equal(t, "secret-id", parsed.Subject.NameID.Value, "NameID is decrypted") {
+		return
+	}
+	if !assert.Len(t, parsed.AttributeStatement.Attributes, 2, "attributes are decrypted") {
+		return
+	}
+	if !assert.Equal(t, "ssn", parsed.AttributeStatement.Attributes[1].Name, "attribute name matches") {
+		return
+	}
+}
@@ -0,0 +1,128 @@
+package idp
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/soap"
+	"github.com/lestrrat/go-xmlsec/crypto"
+)
+
+// artifactEndpointIndex is the index of the ArtifactResolutionService
+// published in metadata, which artifacts refer to
+const artifactEndpointIndex = 0
+
+// sendArtifact signs and stores msg, and redirects the user agent to ep
+// with an artifact referring to it, which only recipient can resolve
+func (idp *IdentityProvider) sendArtifact(w http.ResponseWriter, r *http.Request, ep saml.Endpoint, msg saml.ProtocolMessage, relayState, recipient string) error {
+	if idp.Key == nil {
+		return errors.New("a key is required to sign messages")
+	}
+	if idp.Artifacts == nil {
+		return errors.New("Artifacts is not set")
+	}
+
+	key, err := crypto.LoadKeyFromRSAPrivateKey(idp.Key)
+	if err != nil {
+		return err
+	}
+	a, err := saml.IssueArtifact(idp.Artifacts, idp.EntityID, artifactEndpointIndex, recipient, msg, saml.NewSigner(key))
+	if err != nil {
+		return err
+	}
+	u, err := ep.ArtifactURL(a, relayState)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return nil
+}
+
+// ResolveArtifact answers the ArtifactResolve in src, which must be
+// signed by the SP that the artifact was issued to. It is meant to be
+// called by the handler serving ArtifactResolutionURL using the SOAP
+// binding, such as ArtifactResolutionService, which signs the returned
+// ArtifactResponse before sending it. Requests that cannot be authenticated are answered with a
+// RequestDenied status
+func (idp *IdentityProvider) ResolveArtifact(src []byte) (*saml.ArtifactResponse, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START IdentityProvider.ResolveArtifact")
+		defer g.IRelease("END IdentityProvider.ResolveArtifact")
+	}
+
+	if idp.Artifacts == nil {
+		return nil, errors.New("Artifacts is not set")
+	}
+
+	ar, err := saml.ParseArtifactResolve(src)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := idp.resolveArtifact(src, ar)
+	switch status := err.(type) {
+	case nil:
+	case saml.StatusCode:
+		res = saml.NewArtifactResponse()
+		res.Issuer = idp.EntityID
+		res.InResponseTo = ar.ID
+		res.SetStatus(status)
+	default:
+		return nil, err
+	}
+	return res, nil
+}
+
+// resolveArtifact verifies the request in src, and resolves the
+// artifact for the SP that signed it. The request ar is only used to
+// look up the SP before the signature has been verified
+func (idp *IdentityProvider) resolveArtifact(src []byte, ar *saml.ArtifactResolve) (*saml.ArtifactResponse, error) {
+	if idp.ServiceProviders == nil {
+		return nil, saml.ErrRequestDenied
+	}
+	sp, err := idp.ServiceProviders.LookupServiceProvider(ar.Issuer)
+	if err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("IdentityProvider.ResolveArtifact: %s", err)
+		}
+		return nil, saml.ErrRequestDenied
+	}
+
+	// The signature is what ties the request to the SP that the
+	// artifact was issued to
+	ar, _, err = saml.NewVerifier(sp.SigningCertificates()...).VerifyArtifactResolve(src)
+	if err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("IdentityProvider.ResolveArtifact: %s", err)
+		}
+		return nil, saml.ErrRequestDenied
+	}
+	if ar.Destination != "" && ar.Destination != idp.ArtifactResolutionURL {
+		return nil, saml.ErrRequester
+	}
+	return saml.ResolveArtifact(idp.Artifacts, ar, idp.EntityID, sp.ID()), nil
+}
+
+// ProcessSOAP answers the ArtifactResolve in req with a signed
+// ArtifactResponse
+func (s *ArtifactResolutionService) ProcessSOAP(r *http.Request, req *soap.Envelope) (*soap.Envelope, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START ArtifactResolutionService.ProcessSOAP")
+		defer g.IRelease("END ArtifactResolutionService.ProcessSOAP")
+	}
+
+	if s.IdP.Key == nil {
+		return nil, errors.New("a key is required to sign messages")
+	}
+	if _, err := saml.ParseArtifactResolve(req.Body); err != nil {
+		return nil, soap.NewFault(soap.FaultClient, "invalid ArtifactResolve")
+	}
+
+	res, err := s.IdP.ResolveArtifact(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	return soap.NewEnvelope(res, s.IdP.Key)
+}
@@ -0,0 +1,132 @@
+package idp_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/idp"
+	"github.com/lestrrat/go-saml/internal/testutil"
+	"github.com/lestrrat/go-saml/md"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-saml/soap"
+	"github.com/lestrrat/go-saml/sp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactBinding(t *testing.T) {
+	idpkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	idpcert := testutil.MakeCertificate(t, idpkey)
+	if idpcert == nil {
+		return
+	}
+	spkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	spcert := testutil.MakeCertificate(t, spkey)
+	if spcert == nil {
+		return
+	}
+
+	h := soap.NewHandler()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	var principal *sp.Principal
+	s := &sp.ServiceProvider{
+		EntityID:        "http://sp.example.com/metadata",
+		ACSURL:          "http://sp.example.com/acs",
+		Key:             spkey,
+		Certificate:     spcert,
+		ResponseBinding: binding.HTTPArtifact,
+		OnLogin: func(w http.ResponseWriter, r *http.Request, p *sp.Principal) {
+			principal = p
+		},
+	}
+	i := &idp.IdentityProvider{
+		EntityID:              "http://idp.example.com/metadata",
+		SSOURL:                "http://idp.example.com/sso",
+		ArtifactResolutionURL: srv.URL,
+		Key:                   idpkey,
+		Certificate:           idpcert,
+		Artifacts:             saml.NewMemoryArtifactStore(),
+		ServiceProviders:      idp.NewMetadataStore(&md.Metadata{EntityDescriptors: []md.EntityDescriptor{s.Metadata()}}),
+		Authenticator: idp.AuthenticatorFunc(func(w http.ResponseWriter, r *http.Request, req *idp.AuthnRequest) (*idp.Session, error) {
+			return &idp.Session{
+				ID:     "session-1",
+				NameID: saml.NameID{Format: nameid.Transient, Value: "alice"},
+			}, nil
+		}),
+	}
+	h.Handle("ArtifactResolve", &idp.ArtifactResolutionService{IdP: i})
+	s.IdP = i.Metadata()
+	s.BackChannel = &soap.Client{HTTPClient: srv.Client(), Key: spkey}
+
+	// The SP asks for the response to be sent by artifact
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "http://sp.example.com/saml/login?RelayState=%2Fhome", nil))
+	if !assert.Equal(t, http.StatusFound, w.Code, "login redirects") {
+		return
+	}
+	loc, err := w.Result().Location()
+	if !assert.NoError(t, err, "Location is set") {
+		return
+	}
+
+	// The IdP redirects the user back with an artifact
+	w = httptest.NewRecorder()
+	i.ServeHTTP(w, httptest.NewRequest("GET", loc.String(), nil))
+	if !assert.Equal(t, http.StatusFound, w.Code, "SSO redirects to the ACS") {
+		return
+	}
+	loc, err = w.Result().Location()
+	if !assert.NoError(t, err, "Location is set") {
+		return
+	}
+	if !assert.True(t, strings.HasPrefix(loc.String(), s.ACSURL+"?"), "redirects to the ACS") {
+		return
+	}
+	if !assert.NotEmpty(t, loc.Query().Get(saml.ParamSAMLart), "SAMLart is present") {
+		return
+	}
+
+	// Someone else claiming to be the SP can not resolve the artifact
+	other := &sp.ServiceProvider{
+		EntityID:    s.EntityID,
+		ACSURL:      s.ACSURL,
+		IdP:         s.IdP,
+		BackChannel: &soap.Client{HTTPClient: srv.Client(), Key: idpkey},
+	}
+	_, err = other.ParseResponse(httptest.NewRequest("GET", loc.String(), nil))
+	if !assert.Equal(t, saml.ErrRequestDenied, err, "forged ArtifactResolve is denied") {
+		return
+	}
+
+	// The SP resolves the artifact over the back channel
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", loc.String(), nil))
+	if !assert.NotNil(t, principal, "OnLogin is called") {
+		return
+	}
+	if !assert.Equal(t, "alice", principal.NameID.Value, "NameID matches") {
+		return
+	}
+	if !assert.Equal(t, "/home", principal.RelayState, "RelayState is preserved") {
+		return
+	}
+
+	// Artifacts can only be resolved once
+	_, err = s.ParseResponse(httptest.NewRequest("GET", loc.String(), nil))
+	if !assert.Equal(t, saml.ErrUnknownArtifact, err, "artifact is not resolved twice") {
+		return
+	}
+}
@@ -0,0 +1,122 @@
+package idp
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/md"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-saml/soap"
+)
+
+// ProcessSOAP answers the AttributeQuery in req with a signed Response
+func (aa *AttributeAuthority) ProcessSOAP(r *http.Request, req *soap.Envelope) (*soap.Envelope, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START AttributeAuthority.ProcessSOAP")
+		defer g.IRelease("END AttributeAuthority.ProcessSOAP")
+	}
+
+	if aa.IdP.Key == nil {
+		return nil, errors.New("a key is required to sign messages")
+	}
+
+	q, err := saml.ParseAttributeQuery(req.Body)
+	if err != nil {
+		return nil, soap.NewFault(soap.FaultClient, "invalid AttributeQuery")
+	}
+
+	res := saml.NewResponse()
+	res.Issuer = aa.IdP.EntityID
+	res.InResponseTo = q.ID
+
+	switch status := aa.answer(r, req.Body, q, res).(type) {
+	case nil:
+		res.Status = saml.StatusSuccess
+	case saml.StatusCode:
+		res.SetStatus(status)
+	default:
+		return nil, status
+	}
+	return soap.NewEnvelope(res, aa.IdP.Key)
+}
+
+// answer verifies the query in src, and adds an assertion carrying the
+// requested attributes to res. The query q is only used to look up the
+// SP before the signature has been verified
+func (aa *AttributeAuthority) answer(r *http.Request, src []byte, q *saml.AttributeQuery, res *saml.Response) error {
+	sp, err := aa.IdP.ServiceProviders.LookupServiceProvider(q.Issuer)
+	if err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("AttributeAuthority: %s", err)
+		}
+		return saml.ErrRequestDenied
+	}
+
+	// Queries must always be signed, as they disclose personal data
+	q, _, err = saml.NewVerifier(sp.SigningCertificates()...).VerifyAttributeQuery(src)
+	if err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("AttributeAuthority: %s", err)
+		}
+		return saml.ErrRequestDenied
+	}
+	if q.Destination != "" && q.Destination != aa.URL {
+		return saml.ErrRequester
+	}
+
+	if aa.Resolver == nil {
+		return errors.New("Resolver is not set")
+	}
+	attrs, err := aa.Resolver.ResolveAttributes(r, sp, q.NameID)
+	if err != nil {
+		return err
+	}
+	attrs = saml.SelectAttributes(attrs, q.Attributes)
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	a := saml.NewAssertion()
+	a.IssueInstant = now
+	a.Issuer = aa.IdP.EntityID
+	a.Subject.NameID = q.NameID
+	a.Conditions.NotBefore = now
+	a.Conditions.NotOnOrAfter = now.Add(aa.IdP.assertionMaxAge())
+	a.Conditions.AddAudience(sp.ID())
+	a.AttributeStatement.Attributes = attrs
+	res.Assertion = a
+
+	if aa.IdP.EncryptAssertions {
+		if certs := sp.EncryptionCertificates(); len(certs) > 0 {
+			if err := res.EncryptAssertion(saml.NewEncrypter(certs[0])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Metadata returns the metadata describing this attribute authority
+func (aa *AttributeAuthority) Metadata() *md.AttributeAuthorityDescriptor {
+	desc := &md.AttributeAuthorityDescriptor{
+		AttributeService: []saml.Endpoint{
+			{ProtocolBinding: binding.SOAP, Location: aa.URL},
+		},
+		NameIDFormats: []nameid.Format{nameid.Transient},
+	}
+	desc.RoleDescriptor.ID = aa.IdP.EntityID
+
+	if cert := aa.IdP.Certificate; cert != nil {
+		desc.KeyDescriptors = append(desc.KeyDescriptors, md.KeyDescriptor{
+			Use: "signing",
+			Key: md.KeyInfo{Certificates: []*x509.Certificate{cert}},
+		})
+	}
+	return desc
+}
@@ -0,0 +1,120 @@
+package idp_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/idp"
+	"github.com/lestrrat/go-saml/internal/testutil"
+	"github.com/lestrrat/go-saml/md"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-saml/soap"
+	"github.com/lestrrat/go-saml/sp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttributeAuthority(t *testing.T) {
+	idpkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	idpcert := testutil.MakeCertificate(t, idpkey)
+	if idpcert == nil {
+		return
+	}
+	spkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	spcert := testutil.MakeCertificate(t, spkey)
+	if spcert == nil {
+		return
+	}
+
+	h := soap.NewHandler()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	s := &sp.ServiceProvider{
+		EntityID:    "http://sp.example.com/metadata",
+		ACSURL:      "http://sp.example.com/acs",
+		Key:         spkey,
+		Certificate: spcert,
+	}
+	i := &idp.IdentityProvider{
+		EntityID:         "http://idp.example.com/metadata",
+		SSOURL:           "http://idp.example.com/sso",
+		Key:              idpkey,
+		Certificate:      idpcert,
+		ServiceProviders: idp.NewMetadataStore(&md.Metadata{EntityDescriptors: []md.EntityDescriptor{s.Metadata()}}),
+	}
+	aa := &idp.AttributeAuthority{
+		IdP: i,
+		URL: srv.URL,
+		Resolver: idp.AttributeResolverFunc(func(r *http.Request, sp *md.SPDescriptor, nameID saml.NameID) ([]saml.Attribute, error) {
+			if nameID.Value != "alice" {
+				return nil, saml.ErrUnknownPrincipal
+			}
+			return []saml.Attribute{
+				saml.Attribute{Name: "mail", Values: []saml.AttributeValue{{Type: "xs:string", Value: "alice@example.com"}}},
+				saml.Attribute{Name: "role", Values: []saml.AttributeValue{{Type: "xs:string", Value: "admin"}, {Type: "xs:string", Value: "staff"}}},
+			}, nil
+		}),
+	}
+	h.Handle("AttributeQuery", aa)
+	s.AttributeAuthority = aa.Metadata()
+
+	alice := saml.NameID{Format: nameid.Transient, Value: "alice"}
+	attrs, err := s.QueryAttributes(alice)
+	if !assert.NoError(t, err, "QueryAttributes succeeds") {
+		return
+	}
+	if !assert.Len(t, attrs, 2, "all attributes are returned") {
+		return
+	}
+
+	attrs, err = s.QueryAttributes(alice, saml.Attribute{
+		Name:   "role",
+		Values: []saml.AttributeValue{{Value: "staff"}},
+	})
+	if !assert.NoError(t, err, "QueryAttributes succeeds") {
+		return
+	}
+	if !assert.Len(t, attrs, 1, "only the requested attribute is returned") {
+		return
+	}
+	if !assert.Equal(t, "role", attrs[0].Name, "attribute name matches") {
+		return
+	}
+	if !assert.Len(t, attrs[0].Values, 1, "only the requested value is returned") {
+		return
+	}
+
+	attrs, err = s.QueryAttributes(alice, saml.Attribute{Name: "phone"})
+	if !assert.NoError(t, err, "QueryAttributes succeeds") {
+		return
+	}
+	if !assert.Empty(t, attrs, "nothing is returned for unknown attributes") {
+		return
+	}
+
+	_, err = s.QueryAttributes(saml.NameID{Format: nameid.Transient, Value: "bob"})
+	if !assert.Equal(t, saml.ErrUnknownPrincipal, err, "unknown user is reported") {
+		return
+	}
+
+	// Queries signed by someone else are denied
+	other := &sp.ServiceProvider{
+		EntityID:           s.EntityID,
+		Key:                idpkey,
+		AttributeAuthority: s.AttributeAuthority,
+	}
+	_, err = other.QueryAttributes(alice)
+	if !assert.Equal(t, saml.ErrRequestDenied, err, "forged query is denied") {
+		return
+	}
+}
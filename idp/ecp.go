@@ -0,0 +1,124 @@
+package idp
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/ecp"
+	"github.com/lestrrat/go-saml/soap"
+)
+
+// ServeECP is the SingleSignOnService for ECP clients. It accepts an
+// AuthnRequest using the SOAP binding, has the BasicAuthenticator check
+// the credentials sent along with it, and returns the Response to the
+// client, which relays it to the SP's PAOS endpoint
+func (idp *IdentityProvider) ServeECP(w http.ResponseWriter, r *http.Request) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START IdentityProvider.ServeECP")
+		defer g.IRelease("END IdentityProvider.ServeECP")
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := idp.ParseECPRequest(r)
+	if err != nil {
+		idp.fault(w, err, soap.FaultClient)
+		return
+	}
+
+	if idp.BasicAuthenticator == nil {
+		idp.fault(w, errors.New("BasicAuthenticator is not set"), soap.FaultServer)
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		idp.challenge(w)
+		return
+	}
+
+	var res *saml.Response
+	session, err := idp.BasicAuthenticator.AuthenticateBasic(r, req, username, password)
+	switch status := err.(type) {
+	case nil:
+		if session == nil {
+			idp.challenge(w)
+			return
+		}
+		res, err = idp.MakeResponse(req, session)
+		if err != nil {
+			idp.fault(w, err, soap.FaultServer)
+			return
+		}
+		if err := idp.addParticipant(req, session); err != nil {
+			idp.fault(w, err, soap.FaultServer)
+			return
+		}
+	case saml.StatusCode:
+		res = idp.makeResponse(req)
+		res.SetStatus(status)
+	default:
+		idp.fault(w, err, soap.FaultServer)
+		return
+	}
+
+	if idp.Key == nil {
+		idp.fault(w, errors.New("a key is required to sign messages"), soap.FaultServer)
+		return
+	}
+	env, err := ecp.NewResponseEnvelope(res, req.ACS.Location, idp.Key)
+	if err != nil {
+		idp.fault(w, err, soap.FaultServer)
+		return
+	}
+	if err := soap.WriteEnvelope(w, env); err != nil {
+		idp.fault(w, err, soap.FaultServer)
+	}
+}
+
+// ParseECPRequest extracts the AuthnRequest sent by an ECP client
+// using the SOAP binding, looks up the SP that sent it, verifies its
+// signature if present, and picks the PAOS endpoint the response will
+// be sent to
+func (idp *IdentityProvider) ParseECPRequest(r *http.Request) (*AuthnRequest, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START IdentityProvider.ParseECPRequest")
+		defer g.IRelease("END IdentityProvider.ParseECPRequest")
+	}
+
+	env, err := soap.ReadEnvelope(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if env.Fault != nil {
+		return nil, env.Fault
+	}
+	return idp.parseRequest(env.Body, nil, idp.ECPURL, binding.PAOS)
+}
+
+// challenge asks the ECP client for credentials
+func (idp *IdentityProvider) challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(idp.EntityID))
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// fault reports err to the ECP client as a SOAP fault. The details of
+// err are not disclosed
+func (idp *IdentityProvider) fault(w http.ResponseWriter, err error, code string) {
+	if pdebug.Enabled {
+		pdebug.Printf("IdentityProvider: %s", err)
+	}
+
+	f := soap.NewFault(code, "failed to process request")
+	if err := soap.WriteEnvelope(w, &soap.Envelope{Fault: f}); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
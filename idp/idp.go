@@ -0,0 +1,515 @@
+package idp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/md"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-xmlsec/crypto"
+)
+
+var (
+	// ErrUnknownServiceProvider is returned when an AuthnRequest comes
+	// from an SP that has not been registered
+	ErrUnknownServiceProvider = errors.New("unknown service provider")
+	// ErrUnknownACS is returned when the AuthnRequest asks for the
+	// response to be sent to an endpoint that is not in the SP's
+	// metadata, or the SP has no endpoint supporting the binding that
+	// the response is sent with
+	ErrUnknownACS = errors.New("no matching assertion consumer service")
+	// ErrUnsignedRequest is returned when an AuthnRequest is required to
+	// be signed, but is not
+	ErrUnsignedRequest = errors.New("AuthnRequest must be signed")
+	// ErrUnknownSession is returned when a SessionIndex does not
+	// correspond to a known session
+	ErrUnknownSession = errors.New("unknown session")
+)
+
+func (idp *IdentityProvider) metadataPath() string {
+	if idp.MetadataPath != "" {
+		return idp.MetadataPath
+	}
+	return DefaultMetadataPath
+}
+
+func (idp *IdentityProvider) ssoPath() string {
+	u, err := url.Parse(idp.SSOURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+func (idp *IdentityProvider) ecpPath() string {
+	if idp.ECPURL == "" {
+		return ""
+	}
+	u, err := url.Parse(idp.ECPURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+func (idp *IdentityProvider) assertionMaxAge() time.Duration {
+	if idp.AssertionMaxAge > 0 {
+		return idp.AssertionMaxAge
+	}
+	return DefaultAssertionMaxAge
+}
+
+func (idp *IdentityProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case idp.ssoPath():
+		idp.ServeSSO(w, r)
+	case idp.ecpPath():
+		idp.ServeECP(w, r)
+	case idp.metadataPath():
+		idp.ServeMetadata(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (idp *IdentityProvider) error(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if pdebug.Enabled {
+		pdebug.Printf("IdentityProvider: %s", err)
+	}
+
+	if idp.OnError != nil {
+		idp.OnError(w, r, err)
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// ServeSSO is the SingleSignOnService. It parses the AuthnRequest, has
+// the Authenticator log the user in, and sends the Response to the SP
+func (idp *IdentityProvider) ServeSSO(w http.ResponseWriter, r *http.Request) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START IdentityProvider.ServeSSO")
+		defer g.IRelease("END IdentityProvider.ServeSSO")
+	}
+
+	req, err := idp.ParseRequest(r)
+	if err != nil {
+		idp.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if idp.Authenticator == nil {
+		idp.error(w, r, http.StatusInternalServerError, errors.New("Authenticator is not set"))
+		return
+	}
+
+	var res *saml.Response
+	session, err := idp.Authenticator.Authenticate(w, r, req)
+	switch status := err.(type) {
+	case nil:
+		if session == nil {
+			// The Authenticator has taken care of the response
+			return
+		}
+		res, err = idp.MakeResponse(req, session)
+		if err != nil {
+			idp.error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if err := idp.addParticipant(req, session); err != nil {
+			idp.error(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	case saml.StatusCode:
+		res = idp.makeResponse(req)
+		res.SetStatus(status)
+	default:
+		idp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := idp.WriteResponse(w, r, req, res); err != nil {
+		idp.error(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+// ParseRequest extracts the AuthnRequest sent using the HTTP-Redirect
+// or HTTP-POST binding, looks up the SP that sent it, verifies its
+// signature if present, and picks the endpoint the response will be
+// sent to
+func (idp *IdentityProvider) ParseRequest(r *http.Request) (*AuthnRequest, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START IdentityProvider.ParseRequest")
+		defer g.IRelease("END IdentityProvider.ParseRequest")
+	}
+
+	msg, err := decodeMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Param != saml.ParamSAMLRequest {
+		return nil, errors.New("expected " + saml.ParamSAMLRequest)
+	}
+
+	var redirect *http.Request
+	if r.Method == "GET" {
+		redirect = r
+	}
+	req, err := idp.parseRequest(msg.XML, redirect, idp.SSOURL, binding.HTTPPost)
+	if err != nil {
+		return nil, err
+	}
+	req.RelayState = msg.RelayState
+	return req, nil
+}
+
+// parseRequest parses and checks the AuthnRequest in src, which was
+// sent to destination. If the request was sent using the HTTP-Redirect
+// binding, redirect is the HTTP request carrying it, and its signature
+// is checked instead of an XML signature. The response is to be sent
+// using acsBinding
+func (idp *IdentityProvider) parseRequest(src []byte, redirect *http.Request, destination string, acsBinding binding.Protocol) (*AuthnRequest, error) {
+	ar, err := saml.ParseAuthnRequest(src)
+	if err != nil {
+		return nil, err
+	}
+	if ar.Issuer == "" {
+		return nil, errors.New("AuthnRequest has no Issuer")
+	}
+
+	if idp.ServiceProviders == nil {
+		return nil, ErrUnknownServiceProvider
+	}
+	sp, err := idp.ServiceProviders.LookupServiceProvider(ar.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only trust the contents of a signed request once the signature
+	// has been verified against the keys of the SP it claims to be from
+	certs := sp.SigningCertificates()
+	signed := false
+	if redirect != nil {
+		if redirect.URL.Query().Get(saml.ParamSignature) != "" {
+			if err := verifyRedirect(redirect, certs); err != nil {
+				return nil, err
+			}
+			signed = true
+		}
+	} else {
+		verified, _, err := saml.NewVerifier(certs...).VerifyAuthnRequest(src)
+		switch err {
+		case nil:
+			ar = verified
+			signed = true
+		case saml.ErrMissingSignature:
+		default:
+			return nil, err
+		}
+	}
+	if !signed && (idp.WantAuthnRequestsSigned || sp.AuthnRequestsSigned) {
+		return nil, ErrUnsignedRequest
+	}
+
+	if ar.Version != "2.0" {
+		return nil, saml.ErrUnsupportedVersion
+	}
+	if ar.Destination != "" && ar.Destination != destination {
+		return nil, saml.ErrDestinationMismatch
+	}
+
+	// Responses to browser requests are only sent by artifact when the
+	// SP asks for it
+	if acsBinding == binding.HTTPPost && ar.ProtocolBinding == binding.HTTPArtifact && idp.ArtifactResolutionURL != "" {
+		acsBinding = binding.HTTPArtifact
+	}
+
+	acs, err := acsEndpoint(sp, ar, acsBinding)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthnRequest{
+		AuthnRequest:    ar,
+		ServiceProvider: sp,
+		ACS:             *acs,
+		Signed:          signed,
+	}, nil
+}
+
+// decodeMessage extracts the message sent using either the
+// HTTP-Redirect or the HTTP-POST binding, without verifying it
+func decodeMessage(r *http.Request) (*saml.HTTPMessage, error) {
+	switch r.Method {
+	case "GET":
+		return saml.DecodeRedirectRequest(r, nil)
+	case "POST":
+		return saml.DecodePostRequest(r)
+	}
+	return nil, errors.New("unsupported method " + r.Method)
+}
+
+// verifyRedirect checks the signature of a request sent using the
+// HTTP-Redirect binding against each of the certificates
+func verifyRedirect(r *http.Request, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return saml.ErrNoTrustedKeys
+	}
+	for _, cert := range certs {
+		if _, err := saml.DecodeRedirectRequest(r, cert.PublicKey); err == nil {
+			return nil
+		}
+	}
+	return saml.ErrUntrustedSignature
+}
+
+// acsEndpoint picks the AssertionConsumerService of sp supporting
+// want that the response to ar is sent to. An explicitly requested URL
+// must be listed in the metadata. Otherwise the endpoint with the
+// requested index is used, falling back to the default endpoint. As an
+// index of 0 cannot be told apart from an absent index, it selects the
+// default endpoint
+func acsEndpoint(sp *md.SPDescriptor, ar *saml.AuthnRequest, want binding.Protocol) (*saml.IndexedEndpoint, error) {
+	if ar.ProtocolBinding != "" && ar.ProtocolBinding != want {
+		return nil, ErrUnknownACS
+	}
+
+	var def *saml.IndexedEndpoint
+	for i, ep := range sp.AssertionConsumerService {
+		if ep.ProtocolBinding != want {
+			continue
+		}
+
+		switch {
+		case ar.AssertionConsumerServiceURL != "":
+			if ep.Location == ar.AssertionConsumerServiceURL {
+				return &sp.AssertionConsumerService[i], nil
+			}
+		case ar.AssertionConsumerServiceIndex != 0:
+			if ep.Index == int(ar.AssertionConsumerServiceIndex) {
+				return &sp.AssertionConsumerService[i], nil
+			}
+		default:
+			if def == nil || (ep.IsDefault && !def.IsDefault) {
+				def = &sp.AssertionConsumerService[i]
+			}
+		}
+	}
+	if def == nil {
+		return nil, ErrUnknownACS
+	}
+	return def, nil
+}
+
+// addParticipant records that an assertion about session is being
+// issued to the SP of req
+func (idp *IdentityProvider) addParticipant(req *AuthnRequest, session *Session) error {
+	if idp.Participants == nil {
+		return nil
+	}
+	index, err := idp.SessionIndex(session, req.ServiceProvider.ID())
+	if err != nil {
+		return err
+	}
+	return idp.Participants.Add(session.ID, Participant{
+		EntityID:     req.ServiceProvider.ID(),
+		NameID:       session.NameID,
+		SessionIndex: index,
+	})
+}
+
+// SessionIndex returns the SessionIndex sent to the SP with the given
+// entity ID for session. It is an HMAC of the session ID, so that SPs
+// neither learn the ID nor can correlate the sessions of a user. Use
+// ParticipantStore.SessionID to map it back
+func (idp *IdentityProvider) SessionIndex(session *Session, entityID string) (string, error) {
+	key := idp.SessionIndexKey
+	if len(key) == 0 {
+		idp.sessionIndexOnce.Do(func() {
+			idp.sessionIndexKey = make([]byte, 32)
+			_, idp.sessionIndexErr = io.ReadFull(rand.Reader, idp.sessionIndexKey)
+		})
+		if idp.sessionIndexErr != nil {
+			return "", idp.sessionIndexErr
+		}
+		key = idp.sessionIndexKey
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(entityID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(session.ID))
+	return "_" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// makeResponse creates a Response to req, without a status or an
+// assertion
+func (idp *IdentityProvider) makeResponse(req *AuthnRequest) *saml.Response {
+	res := saml.NewResponse()
+	res.Issuer = idp.EntityID
+	res.Destination = req.ACS.Location
+	res.InResponseTo = req.ID
+	return res
+}
+
+// MakeResponse builds a successful Response to req, carrying an
+// assertion about session. The assertion is encrypted if
+// EncryptAssertions is set and the SP has an encryption certificate
+func (idp *IdentityProvider) MakeResponse(req *AuthnRequest, session *Session) (*saml.Response, error) {
+	now := time.Now()
+	expires := now.Add(idp.assertionMaxAge())
+
+	a := saml.NewAssertion()
+	a.IssueInstant = now
+	a.Issuer = idp.EntityID
+	a.Subject.NameID = session.NameID
+	a.Subject.SubjectConfirmation = saml.SubjectConfirmation{
+		Method:       saml.Bearer,
+		InResponseTo: req.ID,
+		Recipient:    req.ACS.Location,
+		NotOnOrAfter: expires,
+	}
+	a.Conditions.NotBefore = now
+	a.Conditions.NotOnOrAfter = expires
+	a.Conditions.AddAudience(req.ServiceProvider.ID())
+
+	a.AuthnStatement.AuthnInstant = session.AuthnInstant
+	if a.AuthnStatement.AuthnInstant.IsZero() {
+		a.AuthnStatement.AuthnInstant = now
+	}
+	index, err := idp.SessionIndex(session, req.ServiceProvider.ID())
+	if err != nil {
+		return nil, err
+	}
+	a.AuthnStatement.SessionIndex = index
+	a.AuthnStatement.AuthnContext.AuthnContextClassRef = session.AuthnContext
+	if a.AuthnStatement.AuthnContext.AuthnContextClassRef == "" {
+		a.AuthnStatement.AuthnContext.AuthnContextClassRef = saml.PasswordProtectedTransport
+	}
+	a.AttributeStatement.Attributes = session.Attributes
+
+	res := idp.makeResponse(req)
+	res.Status = saml.StatusSuccess
+	res.Assertion = a
+
+	if idp.EncryptAssertions {
+		if certs := req.ServiceProvider.EncryptionCertificates(); len(certs) > 0 {
+			if err := res.EncryptAssertion(saml.NewEncrypter(certs[0])); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// WriteResponse signs res and sends it to the ACS of req, using the
+// binding of the ACS. r is the request being answered
+func (idp *IdentityProvider) WriteResponse(w http.ResponseWriter, r *http.Request, req *AuthnRequest, res *saml.Response) error {
+	if req.ACS.ProtocolBinding == binding.HTTPArtifact {
+		return idp.sendArtifact(w, r, req.ACS.Endpoint, res, req.RelayState, req.ServiceProvider.ID())
+	}
+	return idp.send(w, r, req.ACS.Endpoint, res, req.RelayState)
+}
+
+// send signs msg and sends it to ep through the user agent, using the
+// binding of ep, which must be either HTTP-Redirect or HTTP-POST
+func (idp *IdentityProvider) send(w http.ResponseWriter, r *http.Request, ep saml.Endpoint, msg saml.ProtocolMessage, relayState string) error {
+	if idp.Key == nil {
+		return errors.New("a key is required to sign messages")
+	}
+
+	switch ep.ProtocolBinding {
+	case binding.HTTPRedirect:
+		u, err := ep.RedirectURL(msg, relayState, idp.Key, "")
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return nil
+	case binding.HTTPPost:
+		key, err := crypto.LoadKeyFromRSAPrivateKey(idp.Key)
+		if err != nil {
+			return err
+		}
+		return ep.WritePostForm(w, msg, relayState, saml.NewSigner(key))
+	}
+	return errors.New("unsupported binding " + ep.ProtocolBinding.String())
+}
+
+// Metadata returns the metadata describing this identity provider
+func (idp *IdentityProvider) Metadata() *md.IDPDescriptor {
+	desc := &md.IDPDescriptor{
+		WantAuthnRequestsSigned: idp.WantAuthnRequestsSigned,
+		SingleSignOnService: []saml.Endpoint{
+			{ProtocolBinding: binding.HTTPRedirect, Location: idp.SSOURL},
+			{ProtocolBinding: binding.HTTPPost, Location: idp.SSOURL},
+		},
+	}
+	if idp.ECPURL != "" {
+		desc.SingleSignOnService = append(desc.SingleSignOnService, saml.Endpoint{
+			ProtocolBinding: binding.SOAP,
+			Location:        idp.ECPURL,
+		})
+	}
+	if idp.SLOURL != "" {
+		desc.SingleLogoutService = []saml.Endpoint{
+			{ProtocolBinding: binding.HTTPRedirect, Location: idp.SLOURL},
+			{ProtocolBinding: binding.HTTPPost, Location: idp.SLOURL},
+		}
+	}
+	if idp.ArtifactResolutionURL != "" {
+		desc.SSODescriptor.ArtifactResolutionService = []saml.IndexedEndpoint{
+			{
+				Endpoint: saml.Endpoint{
+					ProtocolBinding: binding.SOAP,
+					Location:        idp.ArtifactResolutionURL,
+				},
+				Index:     artifactEndpointIndex,
+				HasIndex:  true,
+				IsDefault: true,
+			},
+		}
+	}
+	desc.RoleDescriptor.ID = idp.EntityID
+	desc.SSODescriptor.NameIDFormats = []nameid.Format{nameid.Transient}
+
+	if cert := idp.Certificate; cert != nil {
+		desc.KeyDescriptors = append(desc.KeyDescriptors, md.KeyDescriptor{
+			Use: "signing",
+			Key: md.KeyInfo{Certificates: []*x509.Certificate{cert}},
+		})
+	}
+	return desc
+}
+
+// ServeMetadata writes the metadata describing this identity provider
+func (idp *IdentityProvider) ServeMetadata(w http.ResponseWriter, r *http.Request) {
+	m := md.Metadata{
+		EntityDescriptors: []md.EntityDescriptor{idp.Metadata()},
+	}
+	xmlstr, err := m.Serialize()
+	if err != nil {
+		idp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	if _, err := w.Write([]byte(xmlstr)); err != nil {
+		// The headers have been sent, so all that can be done is to
+		// let the developer know
+		if pdebug.Enabled {
+			pdebug.Printf("IdentityProvider: failed to write metadata: %s", err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package idp_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/idp"
+	"github.com/lestrrat/go-saml/internal/testutil"
+	"github.com/lestrrat/go-saml/md"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityProvider(t *testing.T) {
+	idpkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	spkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	spcert := testutil.MakeCertificate(t, spkey)
+	if spcert == nil {
+		return
+	}
+
+	const acsURL = "https://sp.example.com/saml/acs"
+	const otherACSURL = "https://sp.example.com/saml/acs2"
+	sp := &md.SPDescriptor{
+		AuthnRequestsSigned: true,
+		AssertionConsumerService: []saml.IndexedEndpoint{
+			{
+				Endpoint:  saml.Endpoint{ProtocolBinding: binding.HTTPPost, Location: acsURL},
+				IsDefault: true,
+			},
+			{
+				Endpoint: saml.Endpoint{ProtocolBinding: binding.HTTPPost, Location: otherACSURL},
+				Index:    2,
+			},
+		},
+	}
+	sp.RoleDescriptor.ID = "https://sp.example.com/saml/metadata"
+	sp.KeyDescriptors = []md.KeyDescriptor{
+		{Use: "signing", Key: md.KeyInfo{Certificates: []*x509.Certificate{spcert}}},
+	}
+
+	var status error
+	s := &idp.IdentityProvider{
+		EntityID:         "https://idp.example.com/saml/metadata",
+		SSOURL:           "https://idp.example.com/saml/sso",
+		Key:              idpkey,
+		ServiceProviders: idp.NewMetadataStore(&md.Metadata{EntityDescriptors: []md.EntityDescriptor{sp}}),
+		Authenticator: idp.AuthenticatorFunc(func(w http.ResponseWriter, r *http.Request, req *idp.AuthnRequest) (*idp.Session, error) {
+			if status != nil {
+				return nil, status
+			}
+			if !req.Signed {
+				t.Errorf("request should be signed")
+			}
+			return &idp.Session{
+				ID:     "session-1",
+				NameID: saml.NameID{Format: nameid.Transient, Value: "alice"},
+			}, nil
+		}),
+	}
+
+	makeRequestWith := func(issuer string, modify func(*saml.AuthnRequest)) *http.Request {
+		ar := saml.NewAuthnRequest()
+		ar.Issuer = issuer
+		ar.Destination = s.SSOURL
+		ar.ProtocolBinding = binding.HTTPPost
+		ar.AssertionConsumerServiceURL = acsURL
+		if modify != nil {
+			modify(ar)
+		}
+
+		ep := saml.Endpoint{ProtocolBinding: binding.HTTPRedirect, Location: s.SSOURL}
+		u, err := ep.RedirectURL(ar, "relay", spkey, "")
+		if !assert.NoError(t, err, "RedirectURL succeeds") {
+			return nil
+		}
+		return httptest.NewRequest("GET", u.String(), nil)
+	}
+	makeRequest := func(issuer string) *http.Request {
+		return makeRequestWith(issuer, nil)
+	}
+
+	// A signed request from a registered SP results in a Response
+	// posted to its ACS
+	r := makeRequest(sp.ID())
+	if r == nil {
+		return
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if !assert.Equal(t, http.StatusOK, w.Code, "SSO succeeds") {
+		return
+	}
+	for _, want := range []string{acsURL, saml.ParamSAMLResponse, "relay"} {
+		if !assert.True(t, strings.Contains(w.Body.String(), want), "form contains %s", want) {
+			return
+		}
+	}
+
+	// ProtocolBinding and AssertionConsumerServiceURL are optional, in
+	// which case the default ACS is used
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, makeRequestWith(sp.ID(), func(ar *saml.AuthnRequest) {
+		ar.ProtocolBinding = ""
+		ar.AssertionConsumerServiceURL = ""
+	}))
+	if !assert.Equal(t, http.StatusOK, w.Code, "SSO without ProtocolBinding succeeds") {
+		return
+	}
+	if !assert.True(t, strings.Contains(w.Body.String(), `"`+acsURL+`"`), "response is sent to the default ACS") {
+		return
+	}
+
+	// The ACS can be selected by its index
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, makeRequestWith(sp.ID(), func(ar *saml.AuthnRequest) {
+		ar.AssertionConsumerServiceURL = ""
+		ar.AssertionConsumerServiceIndex = 2
+	}))
+	if !assert.Equal(t, http.StatusOK, w.Code, "SSO with AssertionConsumerServiceIndex succeeds") {
+		return
+	}
+	if !assert.True(t, strings.Contains(w.Body.String(), otherACSURL), "response is sent to the requested ACS") {
+		return
+	}
+
+	// Failed authentication is reported to the SP
+	status = saml.ErrAuthnFailed
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, makeRequest(sp.ID()))
+	if !assert.Equal(t, http.StatusOK, w.Code, "status is sent to the SP") {
+		return
+	}
+	status = nil
+
+	// Unknown SPs are rejected
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, makeRequest("https://unknown.example.com"))
+	if !assert.Equal(t, http.StatusBadRequest, w.Code, "unknown SP is rejected") {
+		return
+	}
+
+	// Unsigned requests are rejected when the SP signs its requests
+	ar := saml.NewAuthnRequest()
+	ar.Issuer = sp.ID()
+	ep := saml.Endpoint{ProtocolBinding: binding.HTTPRedirect, Location: s.SSOURL}
+	u, err := ep.RedirectURL(ar, "", nil, "")
+	if !assert.NoError(t, err, "RedirectURL succeeds") {
+		return
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", u.String(), nil))
+	if !assert.Equal(t, http.StatusBadRequest, w.Code, "unsigned request is rejected") {
+		return
+	}
+
+	// Responses can also be sent to an ACS using HTTP-Redirect
+	req := &idp.AuthnRequest{
+		AuthnRequest: saml.NewAuthnRequest(),
+		ACS: saml.IndexedEndpoint{
+			Endpoint: saml.Endpoint{ProtocolBinding: binding.HTTPRedirect, Location: acsURL},
+		},
+		RelayState: "relay",
+	}
+	res := saml.NewResponse()
+	res.Status = saml.ErrRequester
+	w = httptest.NewRecorder()
+	if !assert.NoError(t, s.WriteResponse(w, httptest.NewRequest("GET", s.SSOURL, nil), req, res), "WriteResponse succeeds") {
+		return
+	}
+	if !assert.Equal(t, http.StatusFound, w.Code, "response is redirected to the ACS") {
+		return
+	}
+}
+
+func TestSessionIndex(t *testing.T) {
+	newSP := func(id string) *md.SPDescriptor {
+		sp := &md.SPDescriptor{}
+		sp.RoleDescriptor.ID = id
+		return sp
+	}
+	spA := newSP("https://a.example.com/saml/metadata")
+	spB := newSP("https://b.example.com/saml/metadata")
+
+	s := &idp.IdentityProvider{
+		EntityID:        "https://idp.example.com/saml/metadata",
+		SessionIndexKey: []byte("0123456789abcdef0123456789abcdef"),
+	}
+	session := &idp.Session{
+		ID:     "session-1",
+		NameID: saml.NameID{Format: nameid.Transient, Value: "alice"},
+	}
+
+	res, err := s.MakeResponse(&idp.AuthnRequest{
+		AuthnRequest:    saml.NewAuthnRequest(),
+		ServiceProvider: spA,
+	}, session)
+	if !assert.NoError(t, err, "MakeResponse succeeds") {
+		return
+	}
+	index := res.Assertion.AuthnStatement.SessionIndex
+	if !assert.NotEqual(t, session.ID, index, "session ID is not sent to the SP") {
+		return
+	}
+	expected, err := s.SessionIndex(session, spA.ID())
+	if !assert.NoError(t, err, "SessionIndex succeeds") || !assert.Equal(t, expected, index, "SessionIndex is stable") {
+		return
+	}
+	other, err := s.SessionIndex(session, spB.ID())
+	if !assert.NoError(t, err, "SessionIndex succeeds") || !assert.NotEqual(t, index, other, "each SP gets its own SessionIndex") {
+		return
+	}
+
+	store := idp.NewMemoryParticipantStore()
+	if !assert.NoError(t, store.Add(session.ID, idp.Participant{EntityID: spA.ID(), NameID: session.NameID, SessionIndex: index}), "Add succeeds") {
+		return
+	}
+	id, err := store.SessionID(spA.ID(), index)
+	if !assert.NoError(t, err, "SessionID succeeds") || !assert.Equal(t, session.ID, id, "SessionIndex maps back to the session") {
+		return
+	}
+	_, err = store.SessionID(spB.ID(), index)
+	if !assert.Equal(t, idp.ErrUnknownSession, err, "SessionIndex of another SP is not accepted") {
+		return
+	}
+
+	if !assert.NoError(t, store.Delete(session.ID), "Delete succeeds") {
+		return
+	}
+	_, err = store.SessionID(spA.ID(), index)
+	if !assert.Equal(t, idp.ErrUnknownSession, err, "deleted session is gone") {
+		return
+	}
+}
@@ -0,0 +1,312 @@
+package idp
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/md"
+)
+
+// DefaultMetadataPath is the path of the metadata route served by
+// IdentityProvider
+const DefaultMetadataPath = "/saml/metadata"
+
+// DefaultAssertionMaxAge is how long assertions issued by
+// IdentityProvider are valid when AssertionMaxAge is not set
+const DefaultAssertionMaxAge = 5 * time.Minute
+
+// DefaultLogoutTimeout is how long LogoutCoordinator waits for a
+// participant to respond when Timeout is not set
+const DefaultLogoutTimeout = 5 * time.Minute
+
+// AuthnRequest is an AuthnRequest received by the IdP, along with the
+// information that was gathered while processing it
+type AuthnRequest struct {
+	*saml.AuthnRequest
+	// ServiceProvider describes the SP that issued the request
+	ServiceProvider *md.SPDescriptor
+	// ACS is the endpoint the response will be sent to
+	ACS saml.IndexedEndpoint
+	// RelayState is the RelayState that accompanied the request, and
+	// that will be sent back along with the response
+	RelayState string
+	// Signed is true if the request was signed by the SP
+	Signed bool
+}
+
+// Session describes an authenticated user
+type Session struct {
+	// ID identifies the session. It is not sent to SPs: each SP is
+	// sent its own SessionIndex, derived from ID
+	ID string
+	// NameID is the identifier of the user sent to the SP
+	NameID saml.NameID
+	// AuthnInstant is the time the user was authenticated. If zero,
+	// the current time is used
+	AuthnInstant time.Time
+	// AuthnContext is the method used to authenticate the user. If
+	// empty, saml.PasswordProtectedTransport is used
+	AuthnContext saml.AuthenticationMethod
+	// Attributes are sent to the SP in an AttributeStatement
+	Attributes []saml.Attribute
+}
+
+// Authenticator logs users in. Authenticate is called for every valid
+// AuthnRequest, and returns the session of the user. If the user is
+// not logged in yet, it should write a response to w, such as a login
+// form, and return nil without an error. The login form should then be
+// submitted to the SingleSignOnService again, preserving the SAMLRequest
+// and RelayState parameters.
+// If a saml.StatusCode (such as saml.ErrNoPassive or
+// saml.ErrAuthnFailed) is returned as the error, a Response carrying
+// that status is sent to the SP. Any other error is passed to OnError.
+type Authenticator interface {
+	Authenticate(w http.ResponseWriter, r *http.Request, req *AuthnRequest) (*Session, error)
+}
+
+// AuthenticatorFunc is an adapter that allows ordinary functions to be
+// used as Authenticators
+type AuthenticatorFunc func(http.ResponseWriter, *http.Request, *AuthnRequest) (*Session, error)
+
+func (f AuthenticatorFunc) Authenticate(w http.ResponseWriter, r *http.Request, req *AuthnRequest) (*Session, error) {
+	return f(w, r, req)
+}
+
+// BasicAuthenticator logs in users of ECP clients, which send their
+// credentials using HTTP Basic authentication. If the credentials are
+// invalid, AuthenticateBasic should return nil without an error, and
+// the client is asked to authenticate again. As with Authenticator, a
+// saml.StatusCode error results in a Response carrying that status
+type BasicAuthenticator interface {
+	AuthenticateBasic(r *http.Request, req *AuthnRequest, username, password string) (*Session, error)
+}
+
+// BasicAuthenticatorFunc is an adapter that allows ordinary functions
+// to be used as BasicAuthenticators
+type BasicAuthenticatorFunc func(*http.Request, *AuthnRequest, string, string) (*Session, error)
+
+func (f BasicAuthenticatorFunc) AuthenticateBasic(r *http.Request, req *AuthnRequest, username, password string) (*Session, error) {
+	return f(r, req, username, password)
+}
+
+// AttributeResolver looks up the attributes of the user identified by
+// nameID, to be released to sp. Only the attributes that were asked
+// for in the AttributeQuery are sent to the SP. If a saml.StatusCode
+// (such as saml.ErrUnknownPrincipal) is returned as the error, a
+// Response carrying that status is sent to the SP
+type AttributeResolver interface {
+	ResolveAttributes(r *http.Request, sp *md.SPDescriptor, nameID saml.NameID) ([]saml.Attribute, error)
+}
+
+// AttributeResolverFunc is an adapter that allows ordinary functions
+// to be used as AttributeResolvers
+type AttributeResolverFunc func(*http.Request, *md.SPDescriptor, saml.NameID) ([]saml.Attribute, error)
+
+func (f AttributeResolverFunc) ResolveAttributes(r *http.Request, sp *md.SPDescriptor, nameID saml.NameID) ([]saml.Attribute, error) {
+	return f(r, sp, nameID)
+}
+
+// ServiceProviderStore looks up the metadata of registered service
+// providers. Implementations must be safe for concurrent use
+type ServiceProviderStore interface {
+	// LookupServiceProvider returns the SP with the given entity ID, or
+	// ErrUnknownServiceProvider
+	LookupServiceProvider(entityID string) (*md.SPDescriptor, error)
+}
+
+// MetadataStore is a ServiceProviderStore holding the service
+// providers found in metadata documents
+type MetadataStore struct {
+	mu  sync.RWMutex
+	sps map[string]*md.SPDescriptor
+}
+
+// ErrorFunc is called when an AuthnRequest could not be processed, and
+// no response can be sent to the SP
+type ErrorFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// Participant is an SP that has been issued an assertion within a
+// session, and therefore has to be told when the session ends
+type Participant struct {
+	EntityID string
+	NameID   saml.NameID
+	// SessionIndex is the SessionIndex that the SP was sent, which
+	// differs from the ID of the session
+	SessionIndex string
+}
+
+// ParticipantStore keeps track of the participants of each session.
+// Implementations must be safe for concurrent use
+type ParticipantStore interface {
+	// Add records that p has been issued an assertion in the session
+	Add(sessionID string, p Participant) error
+	// Participants returns the participants of the session
+	Participants(sessionID string) ([]Participant, error)
+	// SessionID returns the ID of the session in which the SP with the
+	// given entity ID was sent sessionIndex, or ErrUnknownSession
+	SessionID(entityID, sessionIndex string) (string, error)
+	// Delete forgets about the session
+	Delete(sessionID string) error
+}
+
+// LogoutSender delivers a LogoutRequest to an SP over a back channel,
+// such as the SOAP binding, and returns the SP's LogoutResponse. The
+// request has not been signed yet
+type LogoutSender interface {
+	SendLogoutRequest(ep saml.Endpoint, req *saml.LogoutRequest) (*saml.LogoutResponse, error)
+}
+
+// LogoutFunc is called when an SP asks the IdP to end the session
+// with the given ID. It should end the IdP's own session for the user,
+// such as by clearing the login cookie
+type LogoutFunc func(w http.ResponseWriter, r *http.Request, sessionID string) error
+
+// LogoutCompleteFunc is called when logout initiated by the IdP has
+// been propagated to all participants. err is nil, or ErrPartialLogout
+// if some of the participants could not be logged out
+type LogoutCompleteFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// LogoutCoordinator is an http.Handler implementing the
+// SingleLogoutService of an identity provider, and should be served at
+// the path of IdentityProvider.SLOURL.
+//
+// When a session ends, either because a participant sent a
+// LogoutRequest or because Logout was called, LogoutRequests are sent
+// to all other participants of the session. Participants that have a
+// SOAP endpoint are logged out over the back channel if BackChannel is
+// set. Others are logged out over the front channel, redirecting the
+// user from SP to SP. Once all participants have been dealt with, the
+// SP that initiated the logout receives a LogoutResponse, with the
+// status set to saml.ErrPartialLogout if any participant failed.
+type LogoutCoordinator struct {
+	// IdP is the identity provider whose sessions are coordinated. Its
+	// ServiceProviders, Participants, Key and SLOURL are used
+	IdP *IdentityProvider
+	// BackChannel, if set, is used to log out participants that have a
+	// SingleLogoutService using the SOAP binding
+	BackChannel LogoutSender
+	// Timeout is how long to wait for a participant to answer a
+	// LogoutRequest sent over the front channel. If zero,
+	// DefaultLogoutTimeout is used
+	Timeout time.Duration
+
+	// OnLogout is called when a participant initiates the logout
+	OnLogout LogoutFunc
+	// OnComplete is called when a logout initiated by the IdP has been
+	// completed. If nil, a short message is displayed
+	OnComplete LogoutCompleteFunc
+	// OnError is called when a message could not be processed. If nil,
+	// a generic error is returned to the client
+	OnError ErrorFunc
+
+	mu      sync.Mutex
+	pending map[string]*logoutState
+}
+
+// ArtifactResolutionService is a soap.Processor answering
+// ArtifactResolve requests for the responses that an IdentityProvider
+// sent using the HTTP-Artifact binding. It should be registered as the
+// processor of "ArtifactResolve" with a soap.Handler served at the path
+// of IdP.ArtifactResolutionURL.
+// Requests must be signed by the SP that the response was sent to, and
+// the ArtifactResponse is signed.
+type ArtifactResolutionService struct {
+	// IdP is the identity provider that issued the artifacts. Its
+	// EntityID, ServiceProviders, Key, ArtifactResolutionURL and
+	// Artifacts are used
+	IdP *IdentityProvider
+}
+
+// AttributeAuthority is a soap.Processor answering AttributeQuery
+// requests, allowing SPs to fetch attributes of a user after SSO
+// without involving the browser. It should be registered as the
+// processor of "AttributeQuery" with a soap.Handler served at the path
+// of URL.
+// Queries must be signed by an SP known to the IdP. The Response is
+// signed, and carries an assertion with the requested attributes, or
+// no assertion at all if there is nothing to release.
+type AttributeAuthority struct {
+	// IdP is the identity provider whose users are described. Its
+	// EntityID, ServiceProviders, Key, Certificate, EncryptAssertions
+	// and AssertionMaxAge are used
+	IdP *IdentityProvider
+	// URL is the absolute URL of the AttributeService
+	URL string
+	// Resolver looks up the attributes of users
+	Resolver AttributeResolver
+}
+
+// IdentityProvider is an http.Handler implementing a SAML identity
+// provider that uses the Web Browser SSO profile. It serves two routes:
+// the path of SSOURL is the SingleSignOnService which accepts
+// AuthnRequests using either the HTTP-Redirect or HTTP-POST binding,
+// and MetadataPath serves the metadata describing this identity
+// provider. Responses are signed, and sent using the HTTP-POST binding,
+// or the HTTP-Artifact binding if the SP asks for it and
+// ArtifactResolutionURL is set. If ECPURL is set, the path of ECPURL
+// serves ECP clients using the SOAP binding.
+type IdentityProvider struct {
+	// EntityID is the entity ID of this identity provider
+	EntityID string
+	// SSOURL is the absolute URL of the SingleSignOnService
+	SSOURL string
+	// ECPURL is the absolute URL of the SingleSignOnService for ECP
+	// clients. If empty, the ECP profile is not supported
+	ECPURL string
+	// SLOURL is the absolute URL of the SingleLogoutService, served by
+	// a LogoutCoordinator. If empty, single logout is not advertised
+	SLOURL string
+	// ArtifactResolutionURL is the absolute URL of the
+	// ArtifactResolutionService, served by a soap.Handler with an
+	// ArtifactResolutionService processor. If empty, the HTTP-Artifact
+	// binding is not supported
+	ArtifactResolutionURL string
+	// MetadataPath is the path of the metadata route. If empty,
+	// DefaultMetadataPath is used
+	MetadataPath string
+
+	// Key is used to sign responses
+	Key *rsa.PrivateKey
+	// Certificate is the certificate for Key, published in metadata
+	Certificate *x509.Certificate
+
+	// ServiceProviders holds the SPs that are allowed to use this IdP
+	ServiceProviders ServiceProviderStore
+	// Artifacts keeps the responses sent using the HTTP-Artifact
+	// binding until they are resolved. It is required if
+	// ArtifactResolutionURL is set
+	Artifacts saml.ArtifactStore
+	// Participants, if set, records the SPs that assertions are issued
+	// to in each session, so that they can be logged out
+	Participants ParticipantStore
+	// SessionIndexKey is the secret used to derive the SessionIndex
+	// sent to each SP from the session ID. If empty, a random key is
+	// generated, so SessionIndexes do not survive a restart of the IdP
+	SessionIndexKey []byte
+	// Authenticator logs users in
+	Authenticator Authenticator
+	// BasicAuthenticator logs in users of ECP clients
+	BasicAuthenticator BasicAuthenticator
+	// WantAuthnRequestsSigned rejects unsigned AuthnRequests. Requests
+	// are also required to be signed if the SP's metadata says it
+	// signs them
+	WantAuthnRequestsSigned bool
+	// EncryptAssertions encrypts assertions for SPs that publish an
+	// encryption certificate in their metadata
+	EncryptAssertions bool
+	// AssertionMaxAge is how long issued assertions are valid. If zero,
+	// DefaultAssertionMaxAge is used
+	AssertionMaxAge time.Duration
+
+	// OnError is called when something goes wrong. If nil, a generic
+	// error is returned to the client
+	OnError ErrorFunc
+
+	sessionIndexOnce sync.Once
+	sessionIndexKey  []byte
+	sessionIndexErr  error
+}
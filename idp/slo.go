@@ -0,0 +1,427 @@
+package idp
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/md"
+)
+
+// ErrUnknownLogout is returned when a LogoutResponse does not answer a
+// LogoutRequest that is still pending
+var ErrUnknownLogout = errors.New("LogoutResponse does not correspond to a pending logout")
+
+// logoutState tracks the propagation of a single logout
+type logoutState struct {
+	sessionID string
+	remaining []Participant
+	failed    bool
+
+	// initiator is the participant that sent the LogoutRequest, or nil
+	// if the IdP initiated the logout
+	initiator  *md.SPDescriptor
+	requestID  string
+	relayState string
+
+	// waitingFor is the participant that the pending LogoutRequest was
+	// sent to
+	waitingFor string
+	expires    time.Time
+}
+
+func (c *LogoutCoordinator) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DefaultLogoutTimeout
+}
+
+func (c *LogoutCoordinator) error(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if pdebug.Enabled {
+		pdebug.Printf("LogoutCoordinator: %s", err)
+	}
+
+	if c.OnError != nil {
+		c.OnError(w, r, err)
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// addPending remembers state until the response to the LogoutRequest
+// with the given ID arrives
+func (c *LogoutCoordinator) addPending(id string, state *logoutState) {
+	now := time.Now()
+	state.expires = now.Add(c.timeout())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending == nil {
+		c.pending = make(map[string]*logoutState)
+	}
+	for k, v := range c.pending {
+		if !now.Before(v.expires) {
+			delete(c.pending, k)
+		}
+	}
+	c.pending[id] = state
+}
+
+// takePending removes and returns the state waiting for the response
+// to the LogoutRequest with the given ID
+func (c *LogoutCoordinator) takePending(id string) *logoutState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, ok := c.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(c.pending, id)
+
+	if !time.Now().Before(state.expires) {
+		return nil
+	}
+	return state
+}
+
+// sloEndpoint returns the first SingleLogoutService of sp that uses one
+// of the bindings, in order of preference
+func sloEndpoint(sp *md.SPDescriptor, bindings ...binding.Protocol) *saml.Endpoint {
+	for _, b := range bindings {
+		for i, ep := range sp.SingleLogoutService {
+			if ep.ProtocolBinding == b {
+				return &sp.SingleLogoutService[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (c *LogoutCoordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START LogoutCoordinator.ServeHTTP")
+		defer g.IRelease("END LogoutCoordinator.ServeHTTP")
+	}
+
+	if c.IdP.ServiceProviders == nil || c.IdP.Participants == nil {
+		c.error(w, r, http.StatusInternalServerError, errors.New("IdentityProvider.ServiceProviders and Participants must be set"))
+		return
+	}
+
+	msg, err := decodeMessage(r)
+	if err != nil {
+		c.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if msg.Param == saml.ParamSAMLRequest {
+		c.handleRequest(w, r, msg)
+	} else {
+		c.handleResponse(w, r, msg)
+	}
+}
+
+// Logout ends the session with the given ID by logging out all of its
+// participants. The IdP's own session must be ended by the caller.
+// OnComplete is called once all participants have been dealt with,
+// which may happen in a later request
+func (c *LogoutCoordinator) Logout(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START LogoutCoordinator.Logout")
+		defer g.IRelease("END LogoutCoordinator.Logout")
+	}
+
+	participants, err := c.takeParticipants(sessionID)
+	if err != nil {
+		c.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.next(w, r, &logoutState{
+		sessionID: sessionID,
+		remaining: participants,
+	})
+}
+
+func (c *LogoutCoordinator) takeParticipants(sessionID string) ([]Participant, error) {
+	store := c.IdP.Participants
+	if store == nil {
+		return nil, errors.New("IdentityProvider.Participants is not set")
+	}
+
+	participants, err := store.Participants(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Delete(sessionID); err != nil {
+		return nil, err
+	}
+	return participants, nil
+}
+
+// handleRequest processes a LogoutRequest sent by a participant. The
+// session to end is found through the SessionIndex that the
+// participant was sent
+func (c *LogoutCoordinator) handleRequest(w http.ResponseWriter, r *http.Request, msg *saml.HTTPMessage) {
+	lr, err := saml.ParseLogoutRequest(msg.XML)
+	if err != nil {
+		c.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	sp, err := c.IdP.ServiceProviders.LookupServiceProvider(lr.Issuer)
+	if err != nil {
+		c.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// LogoutRequests must always be signed, as they end sessions
+	certs := sp.SigningCertificates()
+	if r.Method == "GET" {
+		err = verifyRedirect(r, certs)
+	} else {
+		lr, _, err = saml.NewVerifier(certs...).VerifyLogoutRequest(msg.XML)
+	}
+	if err != nil {
+		c.error(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	if lr.Destination != "" && lr.Destination != c.IdP.SLOURL {
+		c.error(w, r, http.StatusBadRequest, saml.ErrDestinationMismatch)
+		return
+	}
+	if !lr.NotOnOrAfter.IsZero() && !time.Now().Before(lr.NotOnOrAfter) {
+		c.error(w, r, http.StatusBadRequest, saml.ErrExpired)
+		return
+	}
+
+	state := &logoutState{
+		initiator:  sp,
+		requestID:  lr.ID,
+		relayState: msg.RelayState,
+	}
+	if len(lr.SessionIndex) == 0 {
+		c.respond(w, r, state, saml.ErrRequester)
+		return
+	}
+	state.sessionID, err = c.IdP.Participants.SessionID(sp.ID(), lr.SessionIndex[0])
+	switch err {
+	case nil:
+	case ErrUnknownSession:
+		c.respond(w, r, state, saml.ErrUnknownPrincipal)
+		return
+	default:
+		c.respond(w, r, state, saml.ErrResponder)
+		return
+	}
+
+	participants, err := c.IdP.Participants.Participants(state.sessionID)
+	if err != nil {
+		c.respond(w, r, state, saml.ErrResponder)
+		return
+	}
+
+	// The initiator must be a participant of the session, and must
+	// have identified the user the same way it was told to
+	found := false
+	for _, p := range participants {
+		if p.EntityID == sp.ID() && p.NameID.Value == lr.NameID.Value {
+			found = true
+			continue
+		}
+		state.remaining = append(state.remaining, p)
+	}
+	if !found {
+		c.respond(w, r, state, saml.ErrUnknownPrincipal)
+		return
+	}
+
+	if c.OnLogout != nil {
+		if err := c.OnLogout(w, r, state.sessionID); err != nil {
+			c.respond(w, r, state, saml.ErrResponder)
+			return
+		}
+	}
+	if err := c.IdP.Participants.Delete(state.sessionID); err != nil {
+		c.respond(w, r, state, saml.ErrResponder)
+		return
+	}
+
+	c.next(w, r, state)
+}
+
+// handleResponse processes the LogoutResponse of a participant that was
+// logged out over the front channel, and moves on to the next one
+func (c *LogoutCoordinator) handleResponse(w http.ResponseWriter, r *http.Request, msg *saml.HTTPMessage) {
+	res, err := saml.ParseLogoutResponse(msg.XML)
+	if err != nil {
+		c.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	state := c.takePending(res.InResponseTo)
+	if state == nil {
+		c.error(w, r, http.StatusBadRequest, ErrUnknownLogout)
+		return
+	}
+
+	if err := c.checkResponse(r, msg, res, state); err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("LogoutCoordinator: logout of %s failed: %s", state.waitingFor, err)
+		}
+		state.failed = true
+	}
+	c.next(w, r, state)
+}
+
+func (c *LogoutCoordinator) checkResponse(r *http.Request, msg *saml.HTTPMessage, res *saml.LogoutResponse, state *logoutState) error {
+	if res.Issuer != state.waitingFor {
+		return saml.ErrIssuerMismatch
+	}
+
+	sp, err := c.IdP.ServiceProviders.LookupServiceProvider(res.Issuer)
+	if err != nil {
+		return err
+	}
+
+	certs := sp.SigningCertificates()
+	if r.Method == "GET" {
+		err = verifyRedirect(r, certs)
+	} else {
+		res, _, err = saml.NewVerifier(certs...).VerifyLogoutResponse(msg.XML)
+	}
+	if err != nil {
+		return err
+	}
+
+	return res.StatusError()
+}
+
+func (c *LogoutCoordinator) makeLogoutRequest(ep saml.Endpoint, p Participant) *saml.LogoutRequest {
+	lr := saml.NewLogoutRequest()
+	lr.Issuer = c.IdP.EntityID
+	lr.Destination = ep.Location
+	lr.NameID = p.NameID
+	lr.SessionIndex = []string{p.SessionIndex}
+	lr.Reason = saml.LogoutUser
+	lr.NotOnOrAfter = lr.IssueInstant.Add(c.timeout())
+	return lr
+}
+
+// next logs out the remaining participants. Participants that can be
+// logged out over the back channel are handled right away. For the
+// first one that needs the front channel, the user is sent to the SP,
+// and processing continues when its LogoutResponse arrives
+func (c *LogoutCoordinator) next(w http.ResponseWriter, r *http.Request, state *logoutState) {
+	for len(state.remaining) > 0 {
+		p := state.remaining[0]
+		state.remaining = state.remaining[1:]
+
+		sp, err := c.IdP.ServiceProviders.LookupServiceProvider(p.EntityID)
+		if err != nil {
+			state.failed = true
+			continue
+		}
+
+		if c.BackChannel != nil {
+			if ep := sloEndpoint(sp, binding.SOAP); ep != nil {
+				if err := c.sendBackChannel(*ep, p); err != nil {
+					if pdebug.Enabled {
+						pdebug.Printf("LogoutCoordinator: logout of %s failed: %s", p.EntityID, err)
+					}
+					state.failed = true
+				}
+				continue
+			}
+		}
+
+		ep := sloEndpoint(sp, binding.HTTPRedirect, binding.HTTPPost)
+		if ep == nil {
+			state.failed = true
+			continue
+		}
+
+		lr := c.makeLogoutRequest(*ep, p)
+		state.waitingFor = p.EntityID
+		c.addPending(lr.ID, state)
+		if err := c.IdP.send(w, r, *ep, lr, ""); err != nil {
+			c.takePending(lr.ID)
+			state.failed = true
+			continue
+		}
+		return
+	}
+
+	c.finish(w, r, state)
+}
+
+func (c *LogoutCoordinator) sendBackChannel(ep saml.Endpoint, p Participant) error {
+	lr := c.makeLogoutRequest(ep, p)
+	res, err := c.BackChannel.SendLogoutRequest(ep, lr)
+	if err != nil {
+		return err
+	}
+	if res.InResponseTo != lr.ID {
+		return saml.ErrInResponseToMismatch
+	}
+	return res.StatusError()
+}
+
+// finish is called once all participants have been dealt with
+func (c *LogoutCoordinator) finish(w http.ResponseWriter, r *http.Request, state *logoutState) {
+	if state.initiator != nil {
+		status := saml.StatusSuccess
+		if state.failed {
+			status = saml.ErrPartialLogout
+		}
+		c.respond(w, r, state, status)
+		return
+	}
+
+	var err error
+	if state.failed {
+		err = saml.ErrPartialLogout
+	}
+	if c.OnComplete != nil {
+		c.OnComplete(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.Write([]byte("You have been logged out, but some services could not be notified.\n"))
+		return
+	}
+	w.Write([]byte("You have been logged out.\n"))
+}
+
+// respond sends the final LogoutResponse to the participant that
+// initiated the logout
+func (c *LogoutCoordinator) respond(w http.ResponseWriter, r *http.Request, state *logoutState, status saml.StatusCode) {
+	ep := sloEndpoint(state.initiator, binding.HTTPRedirect, binding.HTTPPost)
+	if ep == nil {
+		c.error(w, r, http.StatusBadRequest, errors.New("service provider has no SingleLogoutService for the front channel"))
+		return
+	}
+	target := *ep
+	if target.ResponseLocation != "" {
+		target.Location = target.ResponseLocation
+	}
+
+	res := saml.NewLogoutResponse()
+	res.Issuer = c.IdP.EntityID
+	res.Destination = target.Location
+	res.InResponseTo = state.requestID
+	res.SetStatus(status)
+
+	if err := c.IdP.send(w, r, target, res, state.relayState); err != nil {
+		c.error(w, r, http.StatusInternalServerError, err)
+	}
+}
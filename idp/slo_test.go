@@ -0,0 +1,151 @@
+package idp_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/idp"
+	"github.com/lestrrat/go-saml/internal/testutil"
+	"github.com/lestrrat/go-saml/md"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/stretchr/testify/assert"
+)
+
+type logoutSenderFunc func(saml.Endpoint, *saml.LogoutRequest) (*saml.LogoutResponse, error)
+
+func (f logoutSenderFunc) SendLogoutRequest(ep saml.Endpoint, req *saml.LogoutRequest) (*saml.LogoutResponse, error) {
+	return f(ep, req)
+}
+
+func TestLogoutCoordinator(t *testing.T) {
+	idpkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	spkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	spcert := testutil.MakeCertificate(t, spkey)
+	if spcert == nil {
+		return
+	}
+
+	// spA is logged out over the back channel, spB over the front
+	// channel
+	spA := &md.SPDescriptor{}
+	spA.RoleDescriptor.ID = "https://a.example.com/saml/metadata"
+	spA.SingleLogoutService = []saml.Endpoint{
+		{ProtocolBinding: binding.SOAP, Location: "https://a.example.com/saml/slo"},
+	}
+	spB := &md.SPDescriptor{}
+	spB.RoleDescriptor.ID = "https://b.example.com/saml/metadata"
+	spB.SingleLogoutService = []saml.Endpoint{
+		{ProtocolBinding: binding.HTTPRedirect, Location: "https://b.example.com/saml/slo"},
+	}
+	spB.KeyDescriptors = []md.KeyDescriptor{
+		{Use: "signing", Key: md.KeyInfo{Certificates: []*x509.Certificate{spcert}}},
+	}
+
+	participants := idp.NewMemoryParticipantStore()
+	s := &idp.IdentityProvider{
+		EntityID:         "https://idp.example.com/saml/metadata",
+		SSOURL:           "https://idp.example.com/saml/sso",
+		SLOURL:           "https://idp.example.com/saml/slo",
+		Key:              idpkey,
+		ServiceProviders: idp.NewMetadataStore(&md.Metadata{EntityDescriptors: []md.EntityDescriptor{spA, spB}}),
+		Participants:     participants,
+	}
+
+	backChannelFails := false
+	var completed []error
+	c := &idp.LogoutCoordinator{
+		IdP: s,
+		BackChannel: logoutSenderFunc(func(ep saml.Endpoint, req *saml.LogoutRequest) (*saml.LogoutResponse, error) {
+			if backChannelFails {
+				return nil, errors.New("connection refused")
+			}
+			res := saml.NewLogoutResponse()
+			res.Issuer = spA.ID()
+			res.InResponseTo = req.ID
+			// A second-level code does not make the logout fail
+			res.SetStatus(saml.ErrPartialLogout)
+			return res, nil
+		}),
+		OnComplete: func(w http.ResponseWriter, r *http.Request, err error) {
+			completed = append(completed, err)
+		},
+	}
+
+	nameID := saml.NameID{Format: nameid.Transient, Value: "alice"}
+	for _, sp := range []*md.SPDescriptor{spA, spB} {
+		participants.Add("session-1", idp.Participant{EntityID: sp.ID(), NameID: nameID, SessionIndex: "session-1"})
+	}
+
+	// spA is logged out right away, and the user is sent to spB
+	w := httptest.NewRecorder()
+	c.Logout(w, httptest.NewRequest("GET", "https://idp.example.com/logout", nil), "session-1")
+	if !assert.Equal(t, http.StatusFound, w.Code, "user is redirected to spB") {
+		return
+	}
+	loc, err := w.Result().Location()
+	if !assert.NoError(t, err, "Location is set") {
+		return
+	}
+	if !assert.Equal(t, "b.example.com", loc.Host, "redirects to spB") {
+		return
+	}
+
+	msg, err := saml.DecodeRedirectValues(loc.Query(), &idpkey.PublicKey)
+	if !assert.NoError(t, err, "LogoutRequest is signed by the IdP") {
+		return
+	}
+	lr, err := saml.ParseLogoutRequest(msg.XML)
+	if !assert.NoError(t, err, "ParseLogoutRequest succeeds") {
+		return
+	}
+	if !assert.Equal(t, []string{"session-1"}, lr.SessionIndex, "SessionIndex matches") {
+		return
+	}
+
+	// spB answers, which completes the logout
+	res := saml.NewLogoutResponse()
+	res.Issuer = spB.ID()
+	res.Destination = s.SLOURL
+	res.InResponseTo = lr.ID
+	res.Status = saml.StatusSuccess
+	ep := saml.Endpoint{ProtocolBinding: binding.HTTPRedirect, Location: s.SLOURL}
+	u, err := ep.RedirectURL(res, "", spkey, "")
+	if !assert.NoError(t, err, "RedirectURL succeeds") {
+		return
+	}
+
+	w = httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("GET", u.String(), nil))
+	if !assert.Equal(t, []error{nil}, completed, "logout completed") {
+		return
+	}
+
+	// The same response is not accepted twice
+	w = httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("GET", u.String(), nil))
+	if !assert.Equal(t, http.StatusBadRequest, w.Code, "replayed response is rejected") {
+		return
+	}
+
+	// A failing participant results in a partial logout
+	backChannelFails = true
+	completed = nil
+	participants.Add("session-2", idp.Participant{EntityID: spA.ID(), NameID: nameID, SessionIndex: "session-2"})
+	c.Logout(httptest.NewRecorder(), httptest.NewRequest("GET", "https://idp.example.com/logout", nil), "session-2")
+	if !assert.Equal(t, []error{saml.ErrPartialLogout}, completed, "logout is partial") {
+		return
+	}
+}
@@ -0,0 +1,143 @@
+package idp
+
+import (
+	"sync"
+
+	"github.com/lestrrat/go-saml/md"
+)
+
+// NewMetadataStore creates a MetadataStore holding the service
+// providers described by the given metadata documents
+func NewMetadataStore(list ...*md.Metadata) *MetadataStore {
+	s := &MetadataStore{
+		sps: make(map[string]*md.SPDescriptor),
+	}
+	for _, m := range list {
+		s.AddMetadata(m)
+	}
+	return s
+}
+
+// AddMetadata registers all service providers found in m, including
+// those in nested EntitiesDescriptors. Entities that are not service
+// providers are ignored
+func (s *MetadataStore) AddMetadata(m *md.Metadata) {
+	for _, ed := range m.AllEntityDescriptors() {
+		switch desc := ed.(type) {
+		case md.SPDescriptor:
+			s.Add(&desc)
+		case *md.SPDescriptor:
+			s.Add(desc)
+		}
+	}
+}
+
+// Add registers a single service provider, replacing any previously
+// registered SP with the same entity ID
+func (s *MetadataStore) Add(sp *md.SPDescriptor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sps == nil {
+		s.sps = make(map[string]*md.SPDescriptor)
+	}
+	s.sps[sp.ID()] = sp
+}
+
+// Remove unregisters the service provider with the given entity ID
+func (s *MetadataStore) Remove(entityID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sps, entityID)
+}
+
+func (s *MetadataStore) LookupServiceProvider(entityID string) (*md.SPDescriptor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sp, ok := s.sps[entityID]
+	if !ok {
+		return nil, ErrUnknownServiceProvider
+	}
+	return sp, nil
+}
+
+// MemoryParticipantStore is a ParticipantStore that keeps participants
+// in memory. Sessions are only removed by Delete, so entries for
+// sessions that are never logged out accumulate unless Delete is also
+// called when sessions expire
+type MemoryParticipantStore struct {
+	mu       sync.Mutex
+	sessions map[string][]Participant
+	indexes  map[participantKey]string
+}
+
+// participantKey identifies a participant by the entity ID of the SP
+// and the SessionIndex it was sent
+type participantKey struct {
+	entityID     string
+	sessionIndex string
+}
+
+// NewMemoryParticipantStore creates an empty MemoryParticipantStore
+func NewMemoryParticipantStore() *MemoryParticipantStore {
+	return &MemoryParticipantStore{
+		sessions: make(map[string][]Participant),
+		indexes:  make(map[participantKey]string),
+	}
+}
+
+func (s *MemoryParticipantStore) Add(sessionID string, p Participant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[string][]Participant)
+	}
+	if s.indexes == nil {
+		s.indexes = make(map[participantKey]string)
+	}
+
+	list := s.sessions[sessionID]
+	for i, existing := range list {
+		if existing.EntityID == p.EntityID {
+			delete(s.indexes, participantKey{existing.EntityID, existing.SessionIndex})
+			s.indexes[participantKey{p.EntityID, p.SessionIndex}] = sessionID
+			list[i] = p
+			return nil
+		}
+	}
+	s.indexes[participantKey{p.EntityID, p.SessionIndex}] = sessionID
+	s.sessions[sessionID] = append(list, p)
+	return nil
+}
+
+func (s *MemoryParticipantStore) SessionID(entityID, sessionIndex string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessionID, ok := s.indexes[participantKey{entityID, sessionIndex}]
+	if !ok {
+		return "", ErrUnknownSession
+	}
+	return sessionID, nil
+}
+
+func (s *MemoryParticipantStore) Participants(sessionID string) ([]Participant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Participant(nil), s.sessions[sessionID]...), nil
+}
+
+func (s *MemoryParticipantStore) Delete(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.sessions[sessionID] {
+		delete(s.indexes, participantKey{p.EntityID, p.SessionIndex})
+	}
+	delete(s.sessions, sessionID)
+	return nil
+}
@@ -1,11 +1,13 @@
 package saml
 
 import (
+	"crypto/x509"
 	"time"
 
 	"github.com/lestrrat/go-libxml2/types"
 	"github.com/lestrrat/go-saml/binding"
 	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-xmlsec/crypto"
 )
 
 // MakeXMLNoder defines the interface for things that can marshal
@@ -28,6 +30,26 @@ func (s StatusCode) String() string {
 	return string(s)
 }
 
+// TopLevel returns the top-level status code that s is sent under.
+// Top-level codes are returned as is. Second-level codes that describe
+// a problem with the request are sent under ErrRequester, those about
+// the protocol version under ErrVersionMismatch, and ErrPartialLogout
+// under StatusSuccess, as the logout itself did take place. Everything
+// else, including codes not defined by SAML, is sent under ErrResponder
+func (s StatusCode) TopLevel() StatusCode {
+	switch s {
+	case StatusSuccess, ErrRequester, ErrResponder, ErrVersionMismatch:
+		return s
+	case ErrPartialLogout:
+		return StatusSuccess
+	case ErrRequestVersionDeprecated, ErrRequestVersionTooHigh, ErrRequestVersionTooLow:
+		return ErrVersionMismatch
+	case ErrInvalidAttrNameOrValue, ErrInvalidNameIDPolicy, ErrRequestDenied, ErrRequestUnsupported, ErrResourceNotRecognized, ErrTooManyResponses, ErrUnknownAttrProfile, ErrUnsupportedBinding:
+		return ErrRequester
+	}
+	return ErrResponder
+}
+
 // Top-level status codes
 const (
 	// StatusSuccess means the request succeeded. Additional information MAY
@@ -141,11 +163,126 @@ const (
 	ErrUnsupportedBinding StatusCode = "urn:oasis:names:tc:SAML:2.0:status:UnsupportedBinding"
 )
 
+// SignatureAlgorithm is the URI identifying a signature algorithm, as
+// used in the SigAlg parameter of the HTTP-Redirect binding and the
+// <ds:SignatureMethod> element
+type SignatureAlgorithm string
+
+const (
+	RsaSha1     SignatureAlgorithm = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	RsaSha256   SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	RsaSha384   SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha384"
+	RsaSha512   SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	EcdsaSha256 SignatureAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	DsaSha1     SignatureAlgorithm = "http://www.w3.org/2000/09/xmldsig#dsa-sha1"
+	DsaSha256   SignatureAlgorithm = "http://www.w3.org/2009/xmldsig11#dsa-sha256"
+)
+
+// DigestAlgorithm is the URI identifying a digest algorithm, as used in
+// the <ds:DigestMethod> element
+type DigestAlgorithm string
+
+const (
+	Sha1   DigestAlgorithm = "http://www.w3.org/2000/09/xmldsig#sha1"
+	Sha256 DigestAlgorithm = "http://www.w3.org/2001/04/xmlenc#sha256"
+	Sha384 DigestAlgorithm = "http://www.w3.org/2001/04/xmldsig-more#sha384"
+	Sha512 DigestAlgorithm = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+// Signer holds the key and algorithms used to generate enveloped XML
+// signatures. Empty algorithms are replaced by defaults: SHA-256 for
+// the digest, and the SHA-256 variant of the signature algorithm
+// matching the key type (DSA-SHA1 for DSA keys).
+//
+// The Signer owns Key: go-xmlsec frees it once the signature is made,
+// so a Signer can only sign once, and the key must not be freed or
+// used by the caller afterwards.
+type Signer struct {
+	Key                *crypto.Key
+	SignatureAlgorithm SignatureAlgorithm
+	DigestAlgorithm    DigestAlgorithm
+}
+
+// EncryptionAlgorithm is the block encryption algorithm used for the
+// contents of <xenc:EncryptedData>
+type EncryptionAlgorithm string
+
+const (
+	Aes128CBC EncryptionAlgorithm = "http://www.w3.org/2001/04/xmlenc#aes128-cbc"
+	Aes256CBC EncryptionAlgorithm = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	Aes128GCM EncryptionAlgorithm = "http://www.w3.org/2009/xmlenc11#aes128-gcm"
+	Aes256GCM EncryptionAlgorithm = "http://www.w3.org/2009/xmlenc11#aes256-gcm"
+)
+
+// KeyTransportAlgorithm is the algorithm used to encrypt the symmetric
+// key in <xenc:EncryptedKey>
+type KeyTransportAlgorithm string
+
+const (
+	RsaOaepMgf1p KeyTransportAlgorithm = "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"
+)
+
+// Encrypter holds the recipient's certificate and the algorithm used to
+// encrypt elements. The symmetric key is always transported using
+// RSA-OAEP. If EncryptionAlgorithm is empty, AES-256-GCM is used. Use
+// one of the CBC algorithms for recipients that do not support
+// XML Encryption 1.1.
+type Encrypter struct {
+	Certificate         *x509.Certificate
+	EncryptionAlgorithm EncryptionAlgorithm
+}
+
+// EncryptedKey represents <xenc:EncryptedKey>
+type EncryptedKey struct {
+	EncryptionMethod KeyTransportAlgorithm
+	DigestMethod     DigestAlgorithm
+	Certificate      *x509.Certificate // recipient's certificate, if known
+	CipherValue      []byte
+}
+
+// EncryptedElement represents EncryptedElementType from the SAML
+// specification, which is the content of <saml:EncryptedAssertion>,
+// <saml:EncryptedID> and <saml:EncryptedAttribute>
+type EncryptedElement struct {
+	EncryptionMethod EncryptionAlgorithm
+	EncryptedKey     EncryptedKey
+	CipherValue      []byte
+}
+
+// Names of the parameters used to carry messages in the HTTP bindings
+const (
+	ParamSAMLRequest  = "SAMLRequest"
+	ParamSAMLResponse = "SAMLResponse"
+	ParamRelayState   = "RelayState"
+	ParamSigAlg       = "SigAlg"
+	ParamSignature    = "Signature"
+	ParamSAMLart      = "SAMLart"
+)
+
+// ProtocolMessage is a SAML protocol message that can be transmitted
+// using the HTTP bindings
+type ProtocolMessage interface {
+	Serialize() (string, error)
+	messageParam() string
+}
+
+// HTTPMessage is a message received via one of the HTTP bindings
+type HTTPMessage struct {
+	// Param is either ParamSAMLRequest or ParamSAMLResponse, depending
+	// on which one was used to carry the message
+	Param string
+	// XML is the decoded message
+	XML []byte
+	// RelayState is the RelayState that accompanied the message, if any
+	RelayState string
+}
+
 type AuthenticationMethod string
 type ConfirmationMethod string
 
 const (
 	Bearer                     ConfirmationMethod   = `urn:oasis:names:tc:SAML:2.0:cm:bearer`
+	SenderVouches              ConfirmationMethod   = `urn:oasis:names:tc:SAML:2.0:cm:sender-vouches`
 	PasswordProtectedTransport AuthenticationMethod = `urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport`
 )
 
@@ -162,7 +299,8 @@ type Attribute struct {
 }
 
 type AttributeStatement struct {
-	Attributes []Attribute // Probably multiple attributes allowed?
+	Attributes          []Attribute // Probably multiple attributes allowed?
+	EncryptedAttributes []EncryptedElement
 }
 
 type AuthnContext struct {
@@ -208,9 +346,16 @@ type Message struct {
 
 type Response struct {
 	Message
-	Status       StatusCode
+	// Status is the top-level status code
+	Status StatusCode
+	// SubStatus is the optional second-level status code, such as
+	// ErrAuthnFailed. Use SetStatus to set both levels at once
+	SubStatus    StatusCode
 	InResponseTo string
 	Assertion    *Assertion
+	// EncryptedAssertion is set instead of Assertion when the
+	// assertion is encrypted
+	EncryptedAssertion *EncryptedElement
 }
 
 // Request represents the RequestAbstracttype from SAML specification
@@ -231,11 +376,96 @@ type AuthnRequest struct {
 	RequestedAuthnContext          *RequestedAuthnContext
 }
 
+// LogoutReason indicates the reason for a logout event
+type LogoutReason string
+
+const (
+	// LogoutUser indicates that the user decided to terminate the session
+	LogoutUser LogoutReason = "urn:oasis:names:tc:SAML:2.0:logout:user"
+	// LogoutAdmin indicates that an administrator wishes to terminate
+	// the session
+	LogoutAdmin LogoutReason = "urn:oasis:names:tc:SAML:2.0:logout:admin"
+)
+
+// LogoutRequest is sent by a session participant or session authority
+// to indicate that a session has been terminated
+type LogoutRequest struct {
+	Request
+	NameID NameID
+	// SessionIndex holds the indices of the sessions to terminate. If
+	// empty, all sessions for the principal are terminated
+	SessionIndex []string
+	Reason       LogoutReason
+	// NotOnOrAfter is the time at which the request expires
+	NotOnOrAfter time.Time
+}
+
+// AttributeQuery asks an attribute authority for attributes of the
+// subject identified by NameID. If Attributes is empty, all attributes
+// the requester is allowed to see are returned. Values given for a
+// requested attribute limit the values that are returned
+type AttributeQuery struct {
+	Request
+	NameID     NameID
+	Attributes []Attribute
+}
+
+// LogoutResponse is sent in response to a LogoutRequest
+type LogoutResponse struct {
+	Message
+	// Status is the top-level status code
+	Status StatusCode
+	// SubStatus is the optional second-level status code, such as
+	// ErrPartialLogout. Use SetStatus to set both levels at once
+	SubStatus    StatusCode
+	InResponseTo string
+}
+
+// Artifact is a SAML 2.0 artifact of type 0x0004, which refers to a
+// message that the issuer keeps until it is resolved
+type Artifact struct {
+	// EndpointIndex is the index of the issuer's
+	// ArtifactResolutionService that resolves this artifact
+	EndpointIndex uint16
+	// SourceID is the SHA-1 hash of the issuer's entity ID
+	SourceID [20]byte
+	// MessageHandle is a random value identifying the message
+	MessageHandle [20]byte
+}
+
+// ArtifactResolve is sent over the back channel to obtain the message
+// that an artifact refers to
+type ArtifactResolve struct {
+	Request
+	Artifact string
+}
+
+// ArtifactResponse carries the message that an artifact referred to.
+// If the artifact could not be resolved, Payload is empty
+type ArtifactResponse struct {
+	Message
+	// Status is the top-level status code
+	Status StatusCode
+	// SubStatus is the optional second-level status code. Use SetStatus
+	// to set both levels at once
+	SubStatus    StatusCode
+	InResponseTo string
+	// Payload is the XML of the message that the artifact referred to,
+	// including its signature if it was signed
+	Payload []byte
+}
+
 type Conditions struct {
-	NotBefore           time.Time
-	NotOnOrAfter        time.Time
+	NotBefore    time.Time
+	NotOnOrAfter time.Time
+	// AudienceRestriction is the first AudienceRestriction.
+	// Deprecated: use AudienceRestrictions. If set, it is written and
+	// validated in addition to AudienceRestrictions
 	AudienceRestriction AudienceRestriction
-	Condition           []interface{}
+	// AudienceRestrictions must each include the relying party for the
+	// assertion to be valid
+	AudienceRestrictions []AudienceRestriction
+	Condition            []interface{}
 }
 
 type NameID struct {
@@ -252,6 +482,9 @@ type SubjectConfirmation struct {
 }
 type Subject struct {
 	NameID
+	// EncryptedID is used instead of NameID when the identifier is
+	// encrypted
+	EncryptedID *EncryptedElement
 	SubjectConfirmation
 }
 type Assertion struct {
@@ -274,7 +507,10 @@ type Endpoint struct {
 }
 type IndexedEndpoint struct {
 	Endpoint
-	Index     int
+	Index int
+	// HasIndex marks Index as explicitly set. It is only needed for an
+	// index of 0, as any other value is always taken as explicit
+	HasIndex  bool
 	IsDefault bool
 }
 
@@ -0,0 +1,52 @@
+// Package testutil contains helpers shared by the tests of go-saml
+package testutil
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// MakeCertificate creates a self-signed certificate for privkey that is
+// valid for an hour. nil is returned if the certificate could not be
+// created, in which case the test has already been marked as failed
+func MakeCertificate(t *testing.T, privkey crypto.Signer) *x509.Certificate {
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, privkey.Public(), privkey)
+	if !assert.NoError(t, err, "CreateCertificate succeeds") {
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if !assert.NoError(t, err, "ParseCertificate succeeds") {
+		return nil
+	}
+	return cert
+}
+
+// MakeKeyAndCertificate generates an RSA key, and creates a certificate
+// for it using MakeCertificate
+func MakeKeyAndCertificate(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return nil, nil
+	}
+
+	cert := MakeCertificate(t, privkey)
+	if cert == nil {
+		return nil, nil
+	}
+	return privkey, cert
+}
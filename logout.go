@@ -0,0 +1,331 @@
+package saml
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml/ns"
+	"github.com/lestrrat/go-xmlsec/crypto"
+)
+
+func (lr LogoutReason) String() string {
+	return string(lr)
+}
+
+func NewLogoutRequest() *LogoutRequest {
+	lr := &LogoutRequest{}
+	lr.Request.Message.Initialize()
+	return lr
+}
+
+// Encode takes the LogoutRequest, generates the XML string,
+// deflates it, and base64 encodes it. URL encoding is done in the HTTP
+// protocol.
+// If the key value is not nil, it will attempt to generate a signature
+// using that specified key and the default algorithms. The key is
+// freed by signing, as described for Signer
+func (lr LogoutRequest) Encode(key *crypto.Key) ([]byte, error) {
+	return lr.EncodeWithSigner(keySigner(key))
+}
+
+// EncodeWithSigner is the same as Encode, but allows the signature and
+// digest algorithms to be configured via the Signer
+func (lr LogoutRequest) EncodeWithSigner(signer *Signer) ([]byte, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START LogoutRequest.Encode")
+		defer g.IRelease("END LogoutRequest.Encode")
+	}
+
+	return encode(lr, signer, true)
+}
+
+func (lr LogoutRequest) Serialize() (string, error) {
+	return serialize(lr)
+}
+
+// DecodeLogoutRequestString takes in a string, decodes it from base64,
+// inflates it, and then parses the resulting XML.
+// The signature is not verified. To do so, use DecodeRedirectRequest
+// with the sender's key, or pass the XML to Verifier.VerifyLogoutRequest
+func DecodeLogoutRequestString(s string) (*LogoutRequest, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.DecodeLogoutRequestString '%.30s...' (%d bytes)", s, len(s))
+		defer g.IRelease("END saml.DecodeLogoutRequestString")
+	}
+	return decodeLogoutRequest(strings.NewReader(s))
+}
+
+// DecodeLogoutRequest takes in a byte buffer, decodes it from base64,
+// inflates it, and then parses the resulting XML.
+// The signature is not verified. To do so, use DecodeRedirectRequest
+// with the sender's key, or pass the XML to Verifier.VerifyLogoutRequest
+func DecodeLogoutRequest(b []byte) (*LogoutRequest, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.DecodeLogoutRequest '%.30s...' (%d bytes)", b, len(b))
+		defer g.IRelease("END saml.DecodeLogoutRequest")
+	}
+	return decodeLogoutRequest(bytes.NewReader(b))
+}
+
+func decodeLogoutRequest(in io.Reader) (*LogoutRequest, error) {
+	xmlbytes, err := decode(in, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseLogoutRequest(xmlbytes)
+}
+
+func ParseLogoutRequest(src []byte) (*LogoutRequest, error) {
+	doc, err := ParseXML(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return constructLogoutRequest(doc)
+}
+
+func ParseLogoutRequestString(src string) (*LogoutRequest, error) {
+	doc, err := ParseXMLString(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return constructLogoutRequest(doc)
+}
+
+func constructLogoutRequest(doc types.Document) (*LogoutRequest, error) {
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return nil, errors.New("failed to fetch document element: " + err.Error())
+	}
+
+	lr := &LogoutRequest{}
+	if err := lr.PopulateFromXML(root); err != nil {
+		return nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return lr, nil
+}
+
+func (lr *LogoutRequest) PopulateFromXML(n types.Node) error {
+	if err := lr.Request.PopulateFromXML(n); err != nil {
+		return err
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	lr.Reason = LogoutReason(xpath.String(xpc.Find("@Reason")))
+	if s := xpath.String(xpc.Find("@NotOnOrAfter")); s != "" {
+		t, err := ParseTime(s)
+		if err != nil {
+			return err
+		}
+		lr.NotOnOrAfter = t
+	}
+
+	node := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("NameID"))).First()
+	if node == nil {
+		return errors.New("missing saml:NameID")
+	}
+	if err := lr.NameID.PopulateFromXML(node); err != nil {
+		return err
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find(ns.SAMLP.AddPrefix("SessionIndex"))) {
+		lr.SessionIndex = append(lr.SessionIndex, strings.TrimSpace(node.TextContent()))
+	}
+	return nil
+}
+
+func (lr LogoutRequest) MakeXMLNode(d types.Document) (types.Node, error) {
+	olrxml, err := lr.Request.MakeXMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+	lrxml := olrxml.(types.Element)
+
+	lrxml.MakeMortal()
+	defer lrxml.AutoFree()
+
+	lrxml.SetNodeName("LogoutRequest")
+	lrxml.SetNamespace(ns.SAML.URI, ns.SAML.Prefix, false)
+	lrxml.SetNamespace(ns.SAMLP.URI, ns.SAMLP.Prefix, true)
+
+	if v := lr.Reason; v != "" {
+		lrxml.SetAttribute("Reason", v.String())
+	}
+	if v := lr.NotOnOrAfter; !v.IsZero() {
+		lrxml.SetAttribute("NotOnOrAfter", formatTime(v))
+	}
+
+	nidxml, err := lr.NameID.MakeXMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+	lrxml.AddChild(nidxml)
+
+	for _, idx := range lr.SessionIndex {
+		sixml, err := d.CreateElement(ns.SAMLP.AddPrefix("SessionIndex"))
+		if err != nil {
+			return nil, err
+		}
+		sixml.AppendText(idx)
+		lrxml.AddChild(sixml)
+	}
+
+	lrxml.MakePersistent()
+	return lrxml, nil
+}
+
+func NewLogoutResponse() *LogoutResponse {
+	res := &LogoutResponse{}
+	res.Message.Initialize()
+	return res
+}
+
+// Encode takes the LogoutResponse, generates the XML string,
+// deflates it, and base64 encodes it. URL encoding is done in the HTTP
+// protocol.
+// If the key value is not nil, it will attempt to generate a signature
+// using that specified key and the default algorithms. The key is
+// freed by signing, as described for Signer
+func (res LogoutResponse) Encode(key *crypto.Key) ([]byte, error) {
+	return res.EncodeWithSigner(keySigner(key))
+}
+
+// EncodeWithSigner is the same as Encode, but allows the signature and
+// digest algorithms to be configured via the Signer
+func (res LogoutResponse) EncodeWithSigner(signer *Signer) ([]byte, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START LogoutResponse.Encode")
+		defer g.IRelease("END LogoutResponse.Encode")
+	}
+
+	return encode(res, signer, true)
+}
+
+func (res LogoutResponse) Serialize() (string, error) {
+	return serialize(res)
+}
+
+// DecodeLogoutResponseString takes in a string, decodes it from base64,
+// inflates it, and then parses the resulting XML.
+// The signature is not verified. To do so, use DecodeRedirectRequest
+// with the sender's key, or pass the XML to Verifier.VerifyLogoutResponse
+func DecodeLogoutResponseString(s string) (*LogoutResponse, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.DecodeLogoutResponseString '%.30s...' (%d bytes)", s, len(s))
+		defer g.IRelease("END saml.DecodeLogoutResponseString")
+	}
+	return decodeLogoutResponse(strings.NewReader(s))
+}
+
+// DecodeLogoutResponse takes in a byte buffer, decodes it from base64,
+// inflates it, and then parses the resulting XML.
+// The signature is not verified. To do so, use DecodeRedirectRequest
+// with the sender's key, or pass the XML to Verifier.VerifyLogoutResponse
+func DecodeLogoutResponse(b []byte) (*LogoutResponse, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.DecodeLogoutResponse '%.30s...' (%d bytes)", b, len(b))
+		defer g.IRelease("END saml.DecodeLogoutResponse")
+	}
+	return decodeLogoutResponse(bytes.NewReader(b))
+}
+
+func decodeLogoutResponse(in io.Reader) (*LogoutResponse, error) {
+	xmlbytes, err := decode(in, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseLogoutResponse(xmlbytes)
+}
+
+func ParseLogoutResponse(src []byte) (*LogoutResponse, error) {
+	doc, err := ParseXML(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return constructLogoutResponse(doc)
+}
+
+func ParseLogoutResponseString(src string) (*LogoutResponse, error) {
+	doc, err := ParseXMLString(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return constructLogoutResponse(doc)
+}
+
+func constructLogoutResponse(doc types.Document) (*LogoutResponse, error) {
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return nil, errors.New("failed to fetch document element: " + err.Error())
+	}
+
+	res := &LogoutResponse{}
+	if err := res.PopulateFromXML(root); err != nil {
+		return nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return res, nil
+}
+
+func (res *LogoutResponse) PopulateFromXML(n types.Node) error {
+	if err := res.Message.PopulateFromXML(n); err != nil {
+		return err
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	res.InResponseTo = xpath.String(xpc.Find("@InResponseTo"))
+	res.Status, res.SubStatus, err = parseStatus(xpc)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (res LogoutResponse) MakeXMLNode(d types.Document) (types.Node, error) {
+	oresxml, err := res.Message.MakeXMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+
+	resxml := oresxml.(types.Element)
+	resxml.MakeMortal()
+	defer resxml.AutoFree()
+
+	resxml.SetNodeName("LogoutResponse")
+	resxml.SetNamespace(ns.SAMLP.URI, ns.SAMLP.Prefix, true)
+	resxml.SetNamespace(ns.SAML.URI, ns.SAML.Prefix, false)
+
+	if v := res.InResponseTo; v != "" {
+		resxml.SetAttribute("InResponseTo", v)
+	}
+
+	st, err := makeStatusXMLNode(d, res.Status, res.SubStatus)
+	if err != nil {
+		return nil, err
+	}
+	resxml.AddChild(st)
+
+	resxml.MakePersistent()
+	return resxml, nil
+}
@@ -0,0 +1,119 @@
+package saml
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogoutRequest(t *testing.T) {
+	lr := NewLogoutRequest()
+	lr.Issuer = "http://sp.example.com/metadata"
+	lr.Destination = "http://idp.example.com/slo"
+	lr.Reason = LogoutUser
+	lr.NotOnOrAfter = time.Now().UTC().Add(5 * time.Minute).Truncate(time.Second)
+	lr.NameID = NameID{
+		Format: nameid.Transient,
+		Value:  "3f7b3dcf-1674-4ecd-92c8-1544f346baf8",
+	}
+	lr.SessionIndex = []string{"session-1", "session-2"}
+
+	encoded, err := lr.Encode(nil)
+	if !assert.NoError(t, err, "Encode succeeds") {
+		return
+	}
+
+	decoded, err := DecodeLogoutRequest(encoded)
+	if !assert.NoError(t, err, "DecodeLogoutRequest succeeds") {
+		return
+	}
+
+	if !assert.Equal(t, lr.ID, decoded.ID, "ID matches") {
+		return
+	}
+	if !assert.Equal(t, lr.Issuer, decoded.Issuer, "Issuer matches") {
+		return
+	}
+	if !assert.Equal(t, lr.Destination, decoded.Destination, "Destination matches") {
+		return
+	}
+	if !assert.Equal(t, lr.Reason, decoded.Reason, "Reason matches") {
+		return
+	}
+	if !assert.True(t, lr.NotOnOrAfter.Equal(decoded.NotOnOrAfter), "NotOnOrAfter matches") {
+		return
+	}
+	if !assert.Equal(t, lr.NameID, decoded.NameID, "NameID matches") {
+		return
+	}
+	if !assert.Equal(t, lr.SessionIndex, decoded.SessionIndex, "SessionIndex matches") {
+		return
+	}
+}
+
+func TestLogoutResponse(t *testing.T) {
+	res := NewLogoutResponse()
+	res.Issuer = "http://idp.example.com/metadata"
+	res.Destination = "http://sp.example.com/slo"
+	res.InResponseTo = "809707f0030a5d00620c9d9df97f627afe9dcc24"
+	res.Status = StatusSuccess
+
+	encoded, err := res.Encode(nil)
+	if !assert.NoError(t, err, "Encode succeeds") {
+		return
+	}
+
+	decoded, err := DecodeLogoutResponse(encoded)
+	if !assert.NoError(t, err, "DecodeLogoutResponse succeeds") {
+		return
+	}
+
+	if !assert.Equal(t, res.ID, decoded.ID, "ID matches") {
+		return
+	}
+	if !assert.Equal(t, res.InResponseTo, decoded.InResponseTo, "InResponseTo matches") {
+		return
+	}
+	if !assert.Equal(t, res.Status, decoded.Status, "Status matches") {
+		return
+	}
+}
+
+func TestLogoutResponseSecondLevelStatus(t *testing.T) {
+	res := NewLogoutResponse()
+	res.Issuer = "http://idp.example.com/metadata"
+	res.InResponseTo = "809707f0030a5d00620c9d9df97f627afe9dcc24"
+	res.SetStatus(ErrPartialLogout)
+
+	xmlstr, err := res.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	if !assert.Contains(t, xmlstr, `<samlp:StatusCode Value="`+StatusSuccess.String()+`"><samlp:StatusCode Value="`+ErrPartialLogout.String()+`"/>`, "second-level code is nested under Success") {
+		return
+	}
+
+	parsed, err := ParseLogoutResponseString(xmlstr)
+	if !assert.NoError(t, err, "ParseLogoutResponseString succeeds") {
+		return
+	}
+	if !assert.Equal(t, StatusSuccess, parsed.Status, "top-level status is parsed") {
+		return
+	}
+	if !assert.Equal(t, ErrPartialLogout, parsed.SubStatus, "second-level status is parsed") {
+		return
+	}
+	if !assert.NoError(t, parsed.StatusError(), "StatusError is nil on success") {
+		return
+	}
+	if !assert.Equal(t, ErrResponder, ErrAuthnFailed.TopLevel(), "AuthnFailed is sent under Responder") {
+		return
+	}
+
+	parsed.SetStatus(ErrAuthnFailed)
+	if !assert.Equal(t, ErrAuthnFailed, parsed.StatusError(), "StatusError returns the second-level code") {
+		return
+	}
+}
@@ -1,13 +1,17 @@
 package md
 
 import (
+	"crypto/x509"
 	"time"
 
+	"github.com/lestrrat/go-libxml2/types"
 	"github.com/lestrrat/go-saml"
 	"github.com/lestrrat/go-saml/nameid"
 )
 
 type CommonDescriptor struct {
+	// CacheDuration is the maximum length of time, in seconds, a consumer
+	// should cache the metadata
 	CacheDuration int
 	ID            string
 	Name          string
@@ -17,6 +21,7 @@ type CommonDescriptor struct {
 type RoleDescriptor struct {
 	CommonDescriptor
 	ErrorURL                    string
+	KeyDescriptors              []KeyDescriptor
 	ProtocolSupportEnumerations []string
 }
 
@@ -24,7 +29,11 @@ type SSODescriptor struct {
 	ArtifactResolutionService []saml.IndexedEndpoint
 	SingleLogoutService       []saml.Endpoint
 	ManageNameIDService       []saml.Endpoint
-	NameIDFormat              nameid.Format
+	// NameIDFormat is the first supported name identifier format.
+	// Deprecated: use NameIDFormats. If set, it is written in addition
+	// to the formats listed there
+	NameIDFormat  nameid.Format
+	NameIDFormats []nameid.Format
 }
 
 type IDPDescriptor struct {
@@ -32,6 +41,9 @@ type IDPDescriptor struct {
 	SSODescriptor
 
 	ContactPerson *ContactPerson
+	// KeyDescriptor is the first key of this identity provider.
+	// Deprecated: use RoleDescriptor.KeyDescriptors. If set, it is
+	// written and used in addition to the keys listed there
 	KeyDescriptor *KeyDescriptor
 
 	// WantAuthnRequestsSigned is an optional attribute that indicates a
@@ -77,14 +89,88 @@ type EntityDescriptor interface {
 	ValidUntil() time.Time
 }
 
+// roleDescriptor is implemented by the descriptors of this package, so
+// that several roles of one entity can be written out together
+type roleDescriptor interface {
+	EntityDescriptor
+
+	makeRoleXMLNode(types.Document) (types.Element, error)
+	contactPerson() *ContactPerson
+}
+
 type SPDescriptor struct {
+	RoleDescriptor
+	SSODescriptor
+
+	ContactPerson *ContactPerson
+
+	// AuthnRequestsSigned is an optional attribute that indicates whether
+	// the <samlp:AuthnRequest> messages sent by this service provider
+	// will be signed. If omitted, the value is assumed to be false.
+	AuthnRequestsSigned bool
+	// WantAssertionsSigned is an optional attribute that indicates a
+	// requirement for the <saml:Assertion> elements received by this
+	// service provider to be signed. If omitted, the value is assumed to
+	// be false.
+	WantAssertionsSigned bool
+	// AssertionConsumerService holds one or more elements that describe
+	// indexed endpoints that support the profiles of the Authentication
+	// Request protocol defined in [SAMLProf]. All service providers
+	// support at least one such endpoint, by definition.
+	AssertionConsumerService []saml.IndexedEndpoint
+}
+
+// AttributeAuthorityDescriptor represents an
+// <md:AttributeAuthorityDescriptor> element, which describes an
+// attribute authority answering <samlp:AttributeQuery> requests
+type AttributeAuthorityDescriptor struct {
+	RoleDescriptor
+
+	ContactPerson *ContactPerson
+
+	// AttributeService holds one or more elements of type EndpointType
+	// that describe endpoints that support the profile of the Attribute
+	// Query protocol defined in [SAMLProf]. All attribute authorities
+	// support at least one such endpoint, by definition.
+	AttributeService []saml.Endpoint
+	// AssertionIDRequestService holds zero or more elements of type
+	// EndpointType that describe endpoints that support the profile of
+	// the Assertion Request protocol defined in [SAMLProf] or the
+	// special URI binding for assertion requests defined in [SAMLBind].
+	AssertionIDRequestService []saml.Endpoint
+	// NameIDFormats holds the name identifier formats supported by this
+	// authority
+	NameIDFormats []nameid.Format
+	// AttributeProfile holds zero or more elements of type anyURI that
+	// enumerate the attribute profiles supported by this authority.
+	AttributeProfile []string
+	// Attribute holds zero or more elements that identify the SAML
+	// attributes supported by the authority. Specific values MAY
+	// optionally be included, indicating that only certain values
+	// permitted by the attribute's definition are supported.
+	Attribute []saml.Attribute
+}
+
+// EntitiesDescriptor represents an <md:EntitiesDescriptor> element,
+// which groups multiple entities (and possibly other groups) together.
+// Note that CommonDescriptor.ID is used for the XML ID attribute here,
+// not an entity ID
+type EntitiesDescriptor struct {
 	CommonDescriptor
 
-	Service saml.AssertionConsumerService
+	EntityDescriptors   []EntityDescriptor
+	EntitiesDescriptors []EntitiesDescriptor
 }
 
+// Metadata represents a metadata document. If it contains exactly one
+// entity, it is serialized as an <md:EntityDescriptor>. Otherwise it is
+// serialized as an <md:EntitiesDescriptor>, using CommonDescriptor for
+// its attributes
 type Metadata struct {
-	EntityDescriptors []EntityDescriptor
+	CommonDescriptor
+
+	EntityDescriptors   []EntityDescriptor
+	EntitiesDescriptors []EntitiesDescriptor
 }
 
 type ContactPerson struct {
@@ -100,3 +186,9 @@ type KeyDescriptor struct {
 	Use string
 	Key saml.MakeXMLNoder
 }
+
+// KeyInfo represents a <ds:KeyInfo> element carrying X509 certificates,
+// which is what most metadata documents use to publish keys
+type KeyInfo struct {
+	Certificates []*x509.Certificate
+}
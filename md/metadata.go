@@ -2,12 +2,16 @@ package md
 
 import (
 	"bytes"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
+	"strconv"
 	"time"
 
 	"github.com/lestrrat/go-libxml2/dom"
 	"github.com/lestrrat/go-libxml2/types"
 	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/nameid"
 	"github.com/lestrrat/go-saml/ns"
 )
 
@@ -25,92 +29,404 @@ func (m Metadata) Serialize() (string, error) {
 }
 
 func (m Metadata) MakeXMLNode(doc types.Document) (types.Node, error) {
-	if len(m.EntityDescriptors) == 1 {
-		return m.EntityDescriptors[0].MakeXMLNode(doc)
+	// A single entity is written out as a bare EntityDescriptor, unless
+	// that would lose the attributes of the group. Roles of the same
+	// entity are written out as one EntityDescriptor
+	if m.CommonDescriptor == (CommonDescriptor{}) && len(m.EntitiesDescriptors) == 0 {
+		if groups := groupEntityDescriptors(m.EntityDescriptors); len(groups) == 1 {
+			return makeEntityXMLNode(doc, groups[0])
+		}
+	}
+
+	return EntitiesDescriptor{
+		CommonDescriptor:    m.CommonDescriptor,
+		EntityDescriptors:   m.EntityDescriptors,
+		EntitiesDescriptors: m.EntitiesDescriptors,
+	}.MakeXMLNode(doc)
+}
+
+// AllEntityDescriptors returns all entities in this metadata, including
+// those in nested EntitiesDescriptors
+func (m Metadata) AllEntityDescriptors() []EntityDescriptor {
+	return EntitiesDescriptor{
+		EntityDescriptors:   m.EntityDescriptors,
+		EntitiesDescriptors: m.EntitiesDescriptors,
+	}.AllEntityDescriptors()
+}
+
+// AllEntityDescriptors returns all entities in this group, including
+// those in nested EntitiesDescriptors
+func (ed EntitiesDescriptor) AllEntityDescriptors() []EntityDescriptor {
+	list := append([]EntityDescriptor(nil), ed.EntityDescriptors...)
+	for _, child := range ed.EntitiesDescriptors {
+		list = append(list, child.AllEntityDescriptors()...)
 	}
-	return nil, errors.New("unimplemented")
+	return list
+}
+
+func (ed EntitiesDescriptor) MakeXMLNode(doc types.Document) (types.Node, error) {
+	if len(ed.EntityDescriptors) == 0 && len(ed.EntitiesDescriptors) == 0 {
+		return nil, errors.New("EntitiesDescriptor must contain at least one entity")
+	}
+
+	root, err := doc.CreateElementNS(ns.Metadata.URI, ns.Metadata.AddPrefix("EntitiesDescriptor"))
+	if err != nil {
+		return nil, err
+	}
+	defer root.AutoFree()
+	root.MakeMortal()
+
+	root.SetNamespace(ns.XMLDSignature.URI, ns.XMLDSignature.Prefix, false)
+	if v := ed.CommonDescriptor.ID; v != "" {
+		root.SetAttribute("ID", v)
+	}
+	if v := ed.CommonDescriptor.Name; v != "" {
+		root.SetAttribute("Name", v)
+	}
+	if v := ed.CommonDescriptor.ValidUntil; !v.IsZero() {
+		root.SetAttribute("validUntil", v.UTC().Format(time.RFC3339))
+	}
+	if v := ed.CommonDescriptor.CacheDuration; v > 0 {
+		root.SetAttribute("cacheDuration", formatDuration(v))
+	}
+
+	for _, group := range groupEntityDescriptors(ed.EntityDescriptors) {
+		descnode, err := makeEntityXMLNode(doc, group)
+		if err != nil {
+			return nil, err
+		}
+		root.AddChild(descnode)
+	}
+
+	for _, child := range ed.EntitiesDescriptors {
+		childnode, err := child.MakeXMLNode(doc)
+		if err != nil {
+			return nil, err
+		}
+		root.AddChild(childnode)
+	}
+	root.MakePersistent()
+
+	return root, nil
 }
 
 func (desc IDPDescriptor) SingleLogoutServices() []saml.Endpoint {
 	return desc.SSODescriptor.SingleLogoutService
 }
 
-func (desc IDPDescriptor) MakeXMLNode(doc types.Document) (types.Node, error) {
+// makeEntityDescriptorNode creates the <md:EntityDescriptor> element
+// that wraps each role descriptor
+func makeEntityDescriptorNode(doc types.Document, desc EntityDescriptor) (types.Element, error) {
 	root, err := doc.CreateElementNS(ns.Metadata.URI, ns.Metadata.AddPrefix("EntityDescriptor"))
 	if err != nil {
 		return nil, err
 	}
-	defer root.AutoFree()
-	root.MakeMortal()
 
 	root.SetNamespace(ns.XMLDSignature.URI, ns.XMLDSignature.Prefix, false)
 	root.SetAttribute("entityID", desc.ID())
+	if v := desc.ValidUntil(); !v.IsZero() {
+		root.SetAttribute("validUntil", v.UTC().Format(time.RFC3339))
+	}
+	if v := desc.CacheDuration(); v > 0 {
+		root.SetAttribute("cacheDuration", formatDuration(v))
+	}
+	return root, nil
+}
+
+// groupEntityDescriptors groups role descriptors by entity ID, keeping
+// the order in which each entity first appears
+func groupEntityDescriptors(descs []EntityDescriptor) [][]EntityDescriptor {
+	var groups [][]EntityDescriptor
+	index := map[string]int{}
+	for _, desc := range descs {
+		if i, ok := index[desc.ID()]; ok {
+			groups[i] = append(groups[i], desc)
+			continue
+		}
+		index[desc.ID()] = len(groups)
+		groups = append(groups, []EntityDescriptor{desc})
+	}
+	return groups
+}
 
-	idpdesc, err := doc.CreateElement("md:IDPSSODescriptor")
+// makeEntityXMLNode creates a single <md:EntityDescriptor> holding the
+// roles in group, which must all have the same entity ID. The entity's
+// attributes are taken from the first role, and so is the ContactPerson
+// unless the first role has none
+func makeEntityXMLNode(doc types.Document, group []EntityDescriptor) (types.Node, error) {
+	roles := make([]roleDescriptor, len(group))
+	for i, desc := range group {
+		rd, ok := desc.(roleDescriptor)
+		if !ok {
+			// Descriptors implemented outside of this package can only
+			// be written out on their own
+			if len(group) == 1 {
+				return desc.MakeXMLNode(doc)
+			}
+			return nil, errors.New("cannot combine roles of entity " + desc.ID())
+		}
+		roles[i] = rd
+	}
+
+	root, err := makeEntityDescriptorNode(doc, group[0])
 	if err != nil {
 		return nil, err
 	}
-	root.AddChild(idpdesc)
+	defer root.AutoFree()
+	root.MakeMortal()
 
-	if len(desc.RoleDescriptor.ProtocolSupportEnumerations) == 0 {
-		desc.RoleDescriptor.ProtocolSupportEnumerations = []string{ns.SAMLP.URI}
+	var cp *ContactPerson
+	for _, rd := range roles {
+		rdnode, err := rd.makeRoleXMLNode(doc)
+		if err != nil {
+			return nil, err
+		}
+		root.AddChild(rdnode)
+
+		if cp == nil {
+			cp = rd.contactPerson()
+		}
+	}
+
+	if cp != nil {
+		cpnode, err := cp.MakeXMLNode(doc)
+		if err != nil {
+			return nil, err
+		}
+		root.AddChild(cpnode)
+	}
+	root.MakePersistent()
+
+	return root, nil
+}
+
+// addEndpoints appends an element called `name` for each endpoint
+func addEndpoints(doc types.Document, parent types.Element, name string, eps []saml.Endpoint) error {
+	for _, ep := range eps {
+		ep.Name = name
+		epnode, err := ep.MakeXMLNode(doc)
+		if err != nil {
+			return err
+		}
+		parent.AddChild(epnode)
+	}
+	return nil
+}
+
+// addAttributeNodes appends the <md:AttributeProfile> and
+// <saml:Attribute> elements that IDPSSODescriptor and
+// AttributeAuthorityDescriptor have in common
+func addAttributeNodes(doc types.Document, parent types.Element, profiles []string, attrs []saml.Attribute) error {
+	for _, profile := range profiles {
+		apnode, err := doc.CreateElement(ns.Metadata.AddPrefix("AttributeProfile"))
+		if err != nil {
+			return err
+		}
+		apnode.AppendText(profile)
+		parent.AddChild(apnode)
+	}
+
+	if len(attrs) > 0 {
+		parent.SetNamespace(ns.SAML.URI, ns.SAML.Prefix, false)
+	}
+	for _, attr := range attrs {
+		attrnode, err := attr.MakeXMLNode(doc)
+		if err != nil {
+			return err
+		}
+		parent.AddChild(attrnode)
+	}
+	return nil
+}
+
+// assignIndexes returns a copy of eps where endpoints without an index
+// get the lowest index that is not already taken, as index is required.
+// Duplicate indexes are reported as an error
+func assignIndexes(eps []saml.IndexedEndpoint) ([]saml.IndexedEndpoint, error) {
+	used := map[int]struct{}{}
+	for _, ep := range eps {
+		if !hasIndex(ep) {
+			continue
+		}
+		if _, ok := used[ep.Index]; ok {
+			return nil, errors.New("duplicate index " + strconv.Itoa(ep.Index))
+		}
+		used[ep.Index] = struct{}{}
+	}
+
+	list := make([]saml.IndexedEndpoint, len(eps))
+	next := 0
+	for i, ep := range eps {
+		if !hasIndex(ep) {
+			for {
+				if _, ok := used[next]; !ok {
+					break
+				}
+				next++
+			}
+			ep.Index = next
+			ep.HasIndex = true
+			used[next] = struct{}{}
+		}
+		list[i] = ep
+	}
+	return list, nil
+}
+
+// hasIndex reports whether the index of ep was explicitly set
+func hasIndex(ep saml.IndexedEndpoint) bool {
+	return ep.HasIndex || ep.Index != 0
+}
+
+// makeXMLNode creates the element for a role descriptor named `name`,
+// and populates it with the attributes and elements that are common
+// to all role descriptors
+func (rd RoleDescriptor) makeXMLNode(doc types.Document, name string) (types.Element, error) {
+	rdnode, err := doc.CreateElement(ns.Metadata.AddPrefix(name))
+	if err != nil {
+		return nil, err
+	}
+
+	protos := rd.ProtocolSupportEnumerations
+	if len(protos) == 0 {
+		protos = []string{ns.SAMLP.URI}
 	}
 
 	protobuf := bytes.Buffer{}
-	for i, proto := range desc.RoleDescriptor.ProtocolSupportEnumerations {
+	for i, proto := range protos {
 		protobuf.WriteString(proto)
-		if i != len(desc.RoleDescriptor.ProtocolSupportEnumerations)-1 {
+		if i != len(protos)-1 {
 			protobuf.WriteString(" ")
 		}
 	}
-	idpdesc.SetAttribute("protocolSupportEnumeration", protobuf.String())
+	rdnode.SetAttribute("protocolSupportEnumeration", protobuf.String())
 
-	if k := desc.KeyDescriptor; k != nil {
+	if v := rd.ErrorURL; v != "" {
+		rdnode.SetAttribute("errorURL", v)
+	}
+
+	for _, k := range rd.KeyDescriptors {
 		kdesc, err := k.MakeXMLNode(doc)
 		if err != nil {
 			return nil, err
 		}
-		idpdesc.AddChild(kdesc)
+		rdnode.AddChild(kdesc)
 	}
+	return rdnode, nil
+}
 
-	if v := desc.ErrorURL; v != "" {
-		idpdesc.SetAttribute("errorURL", v)
+// addXMLNodes appends the elements common to IDPSSODescriptor and
+// SPSSODescriptor to the given element
+func (sd SSODescriptor) addXMLNodes(doc types.Document, parent types.Element) error {
+	arslist, err := assignIndexes(sd.ArtifactResolutionService)
+	if err != nil {
+		return errors.New("invalid ArtifactResolutionService: " + err.Error())
 	}
-
-	for _, sls := range desc.SingleLogoutServices() {
+	for _, ars := range arslist {
+		ars.Name = "ArtifactResolutionService"
+		arsdesc, err := ars.MakeXMLNode(doc)
+		if err != nil {
+			return err
+		}
+		parent.AddChild(arsdesc)
+	}
+	for _, sls := range sd.SingleLogoutService {
 		sls.Name = "SingleLogoutService"
 		slsdesc, err := sls.MakeXMLNode(doc)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		idpdesc.AddChild(slsdesc)
+		parent.AddChild(slsdesc)
 	}
-	{
-		nif, err := desc.NameIDFormat.MakeXMLNode(doc)
+	for _, mnis := range sd.ManageNameIDService {
+		mnis.Name = "ManageNameIDService"
+		mnisdesc, err := mnis.MakeXMLNode(doc)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		idpdesc.AddChild(nif)
+		parent.AddChild(mnisdesc)
 	}
-	for _, ssos := range desc.SingleSignOnService {
-		ssos.Name = "SingleSignOnService"
-		ssosdesc, err := ssos.MakeXMLNode(doc)
+	for _, f := range sd.nameIDFormats() {
+		nif, err := f.MakeXMLNode(doc)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		idpdesc.AddChild(ssosdesc)
+		parent.AddChild(nif)
 	}
+	return nil
+}
 
-	if cp := desc.ContactPerson; cp != nil {
-		cpnode, err := cp.MakeXMLNode(doc)
-		if err != nil {
-			return nil, err
-		}
-		root.AddChild(cpnode)
+// nameIDFormats returns NameIDFormats, preceded by the deprecated
+// NameIDFormat if it is set and not already listed first
+func (sd SSODescriptor) nameIDFormats() []nameid.Format {
+	if sd.NameIDFormat == "" || (len(sd.NameIDFormats) > 0 && sd.NameIDFormats[0] == sd.NameIDFormat) {
+		return sd.NameIDFormats
 	}
-	root.MakePersistent()
+	return append([]nameid.Format{sd.NameIDFormat}, sd.NameIDFormats...)
+}
 
-	return root, nil
+// roleDescriptor returns the RoleDescriptor of this identity provider,
+// with the deprecated KeyDescriptor merged into its KeyDescriptors
+func (desc IDPDescriptor) roleDescriptor() RoleDescriptor {
+	rd := desc.RoleDescriptor
+	kd := desc.KeyDescriptor
+	if kd == nil || (len(rd.KeyDescriptors) > 0 && &rd.KeyDescriptors[0] == kd) {
+		return rd
+	}
+	rd.KeyDescriptors = append([]KeyDescriptor{*kd}, rd.KeyDescriptors...)
+	return rd
+}
+
+// SigningCertificates returns the signing certificates of this
+// identity provider, including those in the deprecated KeyDescriptor
+func (desc IDPDescriptor) SigningCertificates() []*x509.Certificate {
+	return desc.roleDescriptor().SigningCertificates()
+}
+
+// EncryptionCertificates returns the encryption certificates of this
+// identity provider, including those in the deprecated KeyDescriptor
+func (desc IDPDescriptor) EncryptionCertificates() []*x509.Certificate {
+	return desc.roleDescriptor().EncryptionCertificates()
+}
+
+func (desc IDPDescriptor) MakeXMLNode(doc types.Document) (types.Node, error) {
+	return makeEntityXMLNode(doc, []EntityDescriptor{desc})
+}
+
+func (desc IDPDescriptor) makeRoleXMLNode(doc types.Document) (types.Element, error) {
+	idpdesc, err := desc.roleDescriptor().makeXMLNode(doc, "IDPSSODescriptor")
+	if err != nil {
+		return nil, err
+	}
+	defer idpdesc.AutoFree()
+	idpdesc.MakeMortal()
+
+	if desc.WantAuthnRequestsSigned {
+		idpdesc.SetAttribute("WantAuthnRequestsSigned", "true")
+	}
+
+	if err := desc.SSODescriptor.addXMLNodes(doc, idpdesc); err != nil {
+		return nil, err
+	}
+	if err := addEndpoints(doc, idpdesc, "SingleSignOnService", desc.SingleSignOnService); err != nil {
+		return nil, err
+	}
+	if err := addEndpoints(doc, idpdesc, "NameIDMappingService", desc.NameIDMappingService); err != nil {
+		return nil, err
+	}
+	if err := addEndpoints(doc, idpdesc, "AssertionIDRequestService", desc.AssertionIDRequestService); err != nil {
+		return nil, err
+	}
+	if err := addAttributeNodes(doc, idpdesc, desc.AttributeProfile, desc.Attribute); err != nil {
+		return nil, err
+	}
+	idpdesc.MakePersistent()
+
+	return idpdesc, nil
+}
+
+func (desc IDPDescriptor) contactPerson() *ContactPerson {
+	return desc.ContactPerson
 }
 
 func (id IDPDescriptor) ID() string {
@@ -133,6 +449,133 @@ func (id IDPDescriptor) ProtocolSupportEnumerations() []string {
 	return id.RoleDescriptor.ProtocolSupportEnumerations
 }
 
+func (desc SPDescriptor) MakeXMLNode(doc types.Document) (types.Node, error) {
+	return makeEntityXMLNode(doc, []EntityDescriptor{desc})
+}
+
+func (desc SPDescriptor) makeRoleXMLNode(doc types.Document) (types.Element, error) {
+	spdesc, err := desc.RoleDescriptor.makeXMLNode(doc, "SPSSODescriptor")
+	if err != nil {
+		return nil, err
+	}
+	defer spdesc.AutoFree()
+	spdesc.MakeMortal()
+
+	spdesc.SetAttribute("AuthnRequestsSigned", strconv.FormatBool(desc.AuthnRequestsSigned))
+	spdesc.SetAttribute("WantAssertionsSigned", strconv.FormatBool(desc.WantAssertionsSigned))
+
+	if err := desc.SSODescriptor.addXMLNodes(doc, spdesc); err != nil {
+		return nil, err
+	}
+
+	if len(desc.AssertionConsumerService) == 0 {
+		return nil, errors.New("at least one AssertionConsumerService is required")
+	}
+
+	acslist, err := assignIndexes(desc.AssertionConsumerService)
+	if err != nil {
+		return nil, errors.New("invalid AssertionConsumerService: " + err.Error())
+	}
+	for _, acs := range acslist {
+		acs.Name = "AssertionConsumerService"
+		acsdesc, err := acs.MakeXMLNode(doc)
+		if err != nil {
+			return nil, err
+		}
+		spdesc.AddChild(acsdesc)
+	}
+	spdesc.MakePersistent()
+
+	return spdesc, nil
+}
+
+func (desc SPDescriptor) contactPerson() *ContactPerson {
+	return desc.ContactPerson
+}
+
+func (sd SPDescriptor) ID() string {
+	return sd.CommonDescriptor.ID
+}
+
+func (sd SPDescriptor) Name() string {
+	return sd.CommonDescriptor.Name
+}
+
+func (sd SPDescriptor) CacheDuration() int {
+	return sd.CommonDescriptor.CacheDuration
+}
+
+func (sd SPDescriptor) ValidUntil() time.Time {
+	return sd.CommonDescriptor.ValidUntil
+}
+
+func (sd SPDescriptor) ProtocolSupportEnumerations() []string {
+	return sd.RoleDescriptor.ProtocolSupportEnumerations
+}
+
+func (desc AttributeAuthorityDescriptor) MakeXMLNode(doc types.Document) (types.Node, error) {
+	return makeEntityXMLNode(doc, []EntityDescriptor{desc})
+}
+
+func (desc AttributeAuthorityDescriptor) makeRoleXMLNode(doc types.Document) (types.Element, error) {
+	if len(desc.AttributeService) == 0 {
+		return nil, errors.New("at least one AttributeService is required")
+	}
+
+	aadesc, err := desc.RoleDescriptor.makeXMLNode(doc, "AttributeAuthorityDescriptor")
+	if err != nil {
+		return nil, err
+	}
+	defer aadesc.AutoFree()
+	aadesc.MakeMortal()
+
+	if err := addEndpoints(doc, aadesc, "AttributeService", desc.AttributeService); err != nil {
+		return nil, err
+	}
+	if err := addEndpoints(doc, aadesc, "AssertionIDRequestService", desc.AssertionIDRequestService); err != nil {
+		return nil, err
+	}
+
+	for _, f := range desc.NameIDFormats {
+		nif, err := f.MakeXMLNode(doc)
+		if err != nil {
+			return nil, err
+		}
+		aadesc.AddChild(nif)
+	}
+
+	if err := addAttributeNodes(doc, aadesc, desc.AttributeProfile, desc.Attribute); err != nil {
+		return nil, err
+	}
+	aadesc.MakePersistent()
+
+	return aadesc, nil
+}
+
+func (desc AttributeAuthorityDescriptor) contactPerson() *ContactPerson {
+	return desc.ContactPerson
+}
+
+func (ad AttributeAuthorityDescriptor) ID() string {
+	return ad.CommonDescriptor.ID
+}
+
+func (ad AttributeAuthorityDescriptor) Name() string {
+	return ad.CommonDescriptor.Name
+}
+
+func (ad AttributeAuthorityDescriptor) CacheDuration() int {
+	return ad.CommonDescriptor.CacheDuration
+}
+
+func (ad AttributeAuthorityDescriptor) ValidUntil() time.Time {
+	return ad.CommonDescriptor.ValidUntil
+}
+
+func (ad AttributeAuthorityDescriptor) ProtocolSupportEnumerations() []string {
+	return ad.RoleDescriptor.ProtocolSupportEnumerations
+}
+
 func (cp ContactPerson) MakeXMLNode(doc types.Document) (types.Node, error) {
 	root, err := doc.CreateElement("md:ContactPerson")
 	if err != nil {
@@ -215,3 +658,71 @@ func (kd KeyDescriptor) MakeXMLNode(doc types.Document) (types.Node, error) {
 
 	return kdnode, nil
 }
+
+// Certificates returns the X509 certificates contained in this
+// KeyDescriptor, if any
+func (kd KeyDescriptor) Certificates() []*x509.Certificate {
+	switch ki := kd.Key.(type) {
+	case KeyInfo:
+		return ki.Certificates
+	case *KeyInfo:
+		return ki.Certificates
+	}
+	return nil
+}
+
+// SigningCertificates returns the certificates from all KeyDescriptors
+// that may be used for signing, i.e. those with use="signing" or
+// without a use attribute
+func (rd RoleDescriptor) SigningCertificates() []*x509.Certificate {
+	var list []*x509.Certificate
+	for _, kd := range rd.KeyDescriptors {
+		if kd.Use != "" && kd.Use != "signing" {
+			continue
+		}
+		list = append(list, kd.Certificates()...)
+	}
+	return list
+}
+
+// EncryptionCertificates returns the certificates from all
+// KeyDescriptors that may be used for encryption, i.e. those with
+// use="encryption" or without a use attribute
+func (rd RoleDescriptor) EncryptionCertificates() []*x509.Certificate {
+	var list []*x509.Certificate
+	for _, kd := range rd.KeyDescriptors {
+		if kd.Use != "" && kd.Use != "encryption" {
+			continue
+		}
+		list = append(list, kd.Certificates()...)
+	}
+	return list
+}
+
+func (ki KeyInfo) MakeXMLNode(doc types.Document) (types.Node, error) {
+	kinode, err := doc.CreateElement(ns.XMLDSignature.AddPrefix("KeyInfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer kinode.AutoFree()
+	kinode.MakeMortal()
+
+	x509node, err := doc.CreateElement(ns.XMLDSignature.AddPrefix("X509Data"))
+	if err != nil {
+		return nil, err
+	}
+	kinode.AddChild(x509node)
+
+	for _, cert := range ki.Certificates {
+		certnode, err := doc.CreateElement(ns.XMLDSignature.AddPrefix("X509Certificate"))
+		if err != nil {
+			return nil, err
+		}
+		certnode.AppendText(base64.StdEncoding.EncodeToString(cert.Raw))
+		x509node.AddChild(certnode)
+	}
+
+	kinode.MakePersistent()
+
+	return kinode, nil
+}
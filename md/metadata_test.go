@@ -3,10 +3,16 @@ package md_test
 import (
 	"crypto/dsa"
 	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/lestrrat/go-saml"
 	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/internal/testutil"
 	"github.com/lestrrat/go-saml/md"
 	"github.com/lestrrat/go-saml/nameid"
 	"github.com/lestrrat/go-xmlsec/key"
@@ -73,4 +79,542 @@ func TestMetadata(t *testing.T) {
 	}
 
 	t.Logf("%s", xmlstr)
+
+	if !assert.Contains(t, xmlstr, `<md:KeyDescriptor use="signing">`, "deprecated KeyDescriptor is written") {
+		return
+	}
+	if !assert.Contains(t, xmlstr, string(nameid.Transient), "deprecated NameIDFormat is written") {
+		return
+	}
+}
+
+func TestParse(t *testing.T) {
+	_, cert := testutil.MakeKeyAndCertificate(t)
+	if cert == nil {
+		return
+	}
+
+	xmlsrc := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" entityID="https://idp.example.com/metadata" validUntil="2030-01-01T00:00:00Z" cacheDuration="P1DT1H">
+  <md:IDPSSODescriptor WantAuthnRequestsSigned="true" protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo>
+        <ds:X509Data>
+          <ds:X509Certificate>
+            %s
+          </ds:X509Certificate>
+        </ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleLogoutService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/slo"/>
+    <md:NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress</md:NameIDFormat>
+    <md:NameIDFormat>urn:oasis:names:tc:SAML:2.0:nameid-format:transient</md:NameIDFormat>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/sso/post"/>
+  </md:IDPSSODescriptor>
+  <md:ContactPerson contactType="technical">
+    <md:GivenName>Daisuke</md:GivenName>
+    <md:EmailAddress>lestrrat@foo.bar.baz</md:EmailAddress>
+  </md:ContactPerson>
+</md:EntityDescriptor>`, base64.StdEncoding.EncodeToString(cert.Raw))
+
+	m, err := md.ParseString(xmlsrc)
+	if !assert.NoError(t, err, "ParseString succeeds") {
+		return
+	}
+
+	if !assert.Len(t, m.EntityDescriptors, 1, "1 entity descriptor") {
+		return
+	}
+
+	idp, ok := m.EntityDescriptors[0].(md.IDPDescriptor)
+	if !assert.True(t, ok, "entity is an IDPDescriptor") {
+		return
+	}
+
+	if !assert.Equal(t, "https://idp.example.com/metadata", idp.ID(), "entityID matches") {
+		return
+	}
+	if !assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), idp.ValidUntil().UTC(), "validUntil matches") {
+		return
+	}
+	if !assert.Equal(t, 25*3600, idp.CacheDuration(), "cacheDuration matches") {
+		return
+	}
+	if !assert.True(t, idp.WantAuthnRequestsSigned, "WantAuthnRequestsSigned is true") {
+		return
+	}
+	if !assert.Equal(t, []nameid.Format{nameid.EmailAddress, nameid.Transient}, idp.NameIDFormats, "NameIDFormats match") {
+		return
+	}
+	if !assert.Equal(t, nameid.EmailAddress, idp.NameIDFormat, "deprecated NameIDFormat holds the first format") {
+		return
+	}
+	if !assert.Len(t, idp.SingleSignOnService, 2, "2 SingleSignOnService endpoints") {
+		return
+	}
+	if !assert.Equal(t, binding.HTTPPost, idp.SingleSignOnService[1].ProtocolBinding, "binding matches") {
+		return
+	}
+	if !assert.Len(t, idp.SingleLogoutService, 1, "1 SingleLogoutService endpoint") {
+		return
+	}
+	if !assert.Len(t, idp.KeyDescriptors, 1, "1 KeyDescriptor") {
+		return
+	}
+	if !assert.Equal(t, "signing", idp.KeyDescriptors[0].Use, "use matches") {
+		return
+	}
+	if !assert.Equal(t, &idp.KeyDescriptors[0], idp.KeyDescriptor, "deprecated KeyDescriptor holds the first key") {
+		return
+	}
+	certs := idp.KeyDescriptors[0].Certificates()
+	if !assert.Len(t, certs, 1, "1 certificate") {
+		return
+	}
+	if !assert.True(t, cert.Equal(certs[0]), "certificate matches") {
+		return
+	}
+	if !assert.NotNil(t, idp.ContactPerson, "ContactPerson is populated") {
+		return
+	}
+	if !assert.Equal(t, "lestrrat@foo.bar.baz", idp.ContactPerson.EmailAddress, "EmailAddress matches") {
+		return
+	}
+}
+
+func TestSPDescriptor(t *testing.T) {
+	_, cert := testutil.MakeKeyAndCertificate(t)
+	if cert == nil {
+		return
+	}
+
+	sp := md.SPDescriptor{
+		RoleDescriptor: md.RoleDescriptor{
+			CommonDescriptor: md.CommonDescriptor{
+				ID: "https://sp.example.com/metadata",
+			},
+			KeyDescriptors: []md.KeyDescriptor{
+				md.KeyDescriptor{
+					Key: md.KeyInfo{Certificates: []*x509.Certificate{cert}},
+					Use: "signing",
+				},
+				md.KeyDescriptor{
+					Key: md.KeyInfo{Certificates: []*x509.Certificate{cert}},
+					Use: "encryption",
+				},
+			},
+		},
+		SSODescriptor: md.SSODescriptor{
+			SingleLogoutService: []saml.Endpoint{
+				saml.Endpoint{
+					ProtocolBinding: binding.HTTPRedirect,
+					Location:        "https://sp.example.com/slo",
+				},
+			},
+			NameIDFormats: []nameid.Format{nameid.Transient, nameid.EmailAddress},
+		},
+		AuthnRequestsSigned:  true,
+		WantAssertionsSigned: true,
+		AssertionConsumerService: []saml.IndexedEndpoint{
+			saml.IndexedEndpoint{
+				Endpoint: saml.Endpoint{
+					ProtocolBinding: binding.HTTPPost,
+					Location:        "https://sp.example.com/acs",
+				},
+				Index:     1,
+				IsDefault: true,
+			},
+			saml.IndexedEndpoint{
+				Endpoint: saml.Endpoint{
+					ProtocolBinding: binding.HTTPRedirect,
+					Location:        "https://sp.example.com/acs/redirect",
+				},
+				Index: 2,
+			},
+		},
+	}
+
+	xmlstr, err := md.Metadata{EntityDescriptors: []md.EntityDescriptor{sp}}.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	if !assert.Contains(t, xmlstr, "<md:SPSSODescriptor", "SPSSODescriptor exists") {
+		return
+	}
+
+	m, err := md.ParseString(xmlstr)
+	if !assert.NoError(t, err, "ParseString succeeds") {
+		return
+	}
+	if !assert.Len(t, m.EntityDescriptors, 1, "1 entity descriptor") {
+		return
+	}
+
+	parsed, ok := m.EntityDescriptors[0].(md.SPDescriptor)
+	if !assert.True(t, ok, "entity is an SPDescriptor") {
+		return
+	}
+
+	if !assert.Equal(t, sp.ID(), parsed.ID(), "entityID matches") {
+		return
+	}
+	if !assert.True(t, parsed.AuthnRequestsSigned, "AuthnRequestsSigned is true") {
+		return
+	}
+	if !assert.True(t, parsed.WantAssertionsSigned, "WantAssertionsSigned is true") {
+		return
+	}
+	if !assert.Equal(t, sp.NameIDFormats, parsed.NameIDFormats, "NameIDFormats match") {
+		return
+	}
+	if !assert.Len(t, parsed.KeyDescriptors, 2, "2 KeyDescriptors") {
+		return
+	}
+	if !assert.Equal(t, "encryption", parsed.KeyDescriptors[1].Use, "use matches") {
+		return
+	}
+	if !assert.Len(t, parsed.AssertionConsumerService, 2, "2 AssertionConsumerService endpoints") {
+		return
+	}
+	for i, acs := range sp.AssertionConsumerService {
+		acs.Name = "AssertionConsumerService"
+		acs.HasIndex = true
+		if !assert.Equal(t, acs, parsed.AssertionConsumerService[i], "AssertionConsumerService matches") {
+			return
+		}
+	}
+}
+
+func TestSPDescriptorACSIndex(t *testing.T) {
+	acs := func(location string, index int) saml.IndexedEndpoint {
+		return saml.IndexedEndpoint{
+			Endpoint: saml.Endpoint{
+				ProtocolBinding: binding.HTTPPost,
+				Location:        location,
+			},
+			Index: index,
+		}
+	}
+	newSP := func(list ...saml.IndexedEndpoint) md.SPDescriptor {
+		sp := md.SPDescriptor{AssertionConsumerService: list}
+		sp.CommonDescriptor.ID = "https://sp.example.com/metadata"
+		return sp
+	}
+
+	sp := newSP(
+		acs("https://sp.example.com/acs/0", 0),
+		acs("https://sp.example.com/acs/1", 1),
+		acs("https://sp.example.com/acs/2", 0),
+	)
+	xmlstr, err := md.Metadata{EntityDescriptors: []md.EntityDescriptor{sp}}.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	m, err := md.ParseString(xmlstr)
+	if !assert.NoError(t, err, "ParseString succeeds") {
+		return
+	}
+	parsed := m.EntityDescriptors[0].(md.SPDescriptor)
+	if !assert.Len(t, parsed.AssertionConsumerService, 3, "3 AssertionConsumerService endpoints") {
+		return
+	}
+	for i, acs := range parsed.AssertionConsumerService {
+		if !assert.Equal(t, i, acs.Index, "unset index does not collide with explicit ones") {
+			return
+		}
+	}
+
+	explicit := acs("https://sp.example.com/acs/0", 0)
+	explicit.HasIndex = true
+	sp = newSP(
+		acs("https://sp.example.com/acs/1", 0),
+		explicit,
+	)
+	xmlstr, err = md.Metadata{EntityDescriptors: []md.EntityDescriptor{sp}}.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	m, err = md.ParseString(xmlstr)
+	if !assert.NoError(t, err, "ParseString succeeds") {
+		return
+	}
+	parsed = m.EntityDescriptors[0].(md.SPDescriptor)
+	if !assert.Len(t, parsed.AssertionConsumerService, 2, "2 AssertionConsumerService endpoints") {
+		return
+	}
+	if !assert.Equal(t, 1, parsed.AssertionConsumerService[0].Index, "unset index does not collide with an explicit 0") {
+		return
+	}
+	if !assert.Equal(t, 0, parsed.AssertionConsumerService[1].Index, "explicit index 0 is kept") {
+		return
+	}
+
+	sp = newSP(
+		acs("https://sp.example.com/acs/a", 1),
+		acs("https://sp.example.com/acs/b", 1),
+	)
+	_, err = md.Metadata{EntityDescriptors: []md.EntityDescriptor{sp}}.Serialize()
+	if !assert.Error(t, err, "duplicate indexes are rejected") {
+		return
+	}
+}
+
+func TestAttributeAuthorityDescriptor(t *testing.T) {
+	_, cert := testutil.MakeKeyAndCertificate(t)
+	if cert == nil {
+		return
+	}
+
+	aa := md.AttributeAuthorityDescriptor{
+		RoleDescriptor: md.RoleDescriptor{
+			CommonDescriptor: md.CommonDescriptor{
+				ID: "https://idp.example.com/metadata",
+			},
+			KeyDescriptors: []md.KeyDescriptor{
+				md.KeyDescriptor{
+					Key: md.KeyInfo{Certificates: []*x509.Certificate{cert}},
+					Use: "signing",
+				},
+			},
+		},
+		AttributeService: []saml.Endpoint{
+			saml.Endpoint{
+				ProtocolBinding: binding.SOAP,
+				Location:        "https://idp.example.com/aa",
+			},
+		},
+		NameIDFormats:    []nameid.Format{nameid.Transient, nameid.EmailAddress},
+		AttributeProfile: []string{"urn:oasis:names:tc:SAML:2.0:profiles:attribute:basic"},
+		Attribute: []saml.Attribute{
+			saml.Attribute{
+				Name:         "urn:oid:0.9.2342.19200300.100.1.3",
+				FriendlyName: "mail",
+			},
+		},
+	}
+
+	xmlstr, err := md.Metadata{EntityDescriptors: []md.EntityDescriptor{aa}}.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	if !assert.Contains(t, xmlstr, "<md:AttributeAuthorityDescriptor", "AttributeAuthorityDescriptor exists") {
+		return
+	}
+
+	m, err := md.ParseString(xmlstr)
+	if !assert.NoError(t, err, "ParseString succeeds") {
+		return
+	}
+	if !assert.Len(t, m.EntityDescriptors, 1, "1 entity descriptor") {
+		return
+	}
+
+	parsed, ok := m.EntityDescriptors[0].(md.AttributeAuthorityDescriptor)
+	if !assert.True(t, ok, "entity is an AttributeAuthorityDescriptor") {
+		return
+	}
+
+	if !assert.Equal(t, aa.ID(), parsed.ID(), "entityID matches") {
+		return
+	}
+	if !assert.Len(t, parsed.AttributeService, 1, "1 AttributeService endpoint") {
+		return
+	}
+	if !assert.Equal(t, binding.SOAP, parsed.AttributeService[0].ProtocolBinding, "binding matches") {
+		return
+	}
+	if !assert.Equal(t, aa.NameIDFormats, parsed.NameIDFormats, "NameIDFormats match") {
+		return
+	}
+	if !assert.Equal(t, aa.AttributeProfile, parsed.AttributeProfile, "AttributeProfile matches") {
+		return
+	}
+	if !assert.Len(t, parsed.Attribute, 1, "1 Attribute") {
+		return
+	}
+	if !assert.Equal(t, "mail", parsed.Attribute[0].FriendlyName, "FriendlyName matches") {
+		return
+	}
+	if !assert.Len(t, parsed.SigningCertificates(), 1, "1 signing certificate") {
+		return
+	}
+
+	_, err = md.Metadata{EntityDescriptors: []md.EntityDescriptor{md.AttributeAuthorityDescriptor{}}}.Serialize()
+	if !assert.Error(t, err, "AttributeService is required") {
+		return
+	}
+}
+
+func TestEntitiesDescriptor(t *testing.T) {
+	newIDP := func(id string) md.IDPDescriptor {
+		return md.IDPDescriptor{
+			RoleDescriptor: md.RoleDescriptor{
+				CommonDescriptor: md.CommonDescriptor{
+					ID: id,
+				},
+			},
+			SingleSignOnService: []saml.Endpoint{
+				saml.Endpoint{
+					ProtocolBinding: binding.HTTPRedirect,
+					Location:        id + "/sso",
+				},
+			},
+		}
+	}
+
+	validUntil := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := md.Metadata{
+		CommonDescriptor: md.CommonDescriptor{
+			ID:            "federation-feed",
+			Name:          "urn:example:federation",
+			ValidUntil:    validUntil,
+			CacheDuration: 3600,
+		},
+		EntityDescriptors: []md.EntityDescriptor{
+			newIDP("https://idp1.example.com"),
+			newIDP("https://idp2.example.com"),
+		},
+		EntitiesDescriptors: []md.EntitiesDescriptor{
+			md.EntitiesDescriptor{
+				CommonDescriptor: md.CommonDescriptor{
+					Name: "urn:example:federation:sub",
+				},
+				EntityDescriptors: []md.EntityDescriptor{
+					newIDP("https://idp3.example.com"),
+				},
+			},
+		},
+	}
+
+	xmlstr, err := m.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	if !assert.Contains(t, xmlstr, "<md:EntitiesDescriptor", "EntitiesDescriptor exists") {
+		return
+	}
+
+	parsed, err := md.ParseString(xmlstr)
+	if !assert.NoError(t, err, "ParseString succeeds") {
+		return
+	}
+
+	if !assert.Equal(t, m.CommonDescriptor.ID, parsed.CommonDescriptor.ID, "ID matches") {
+		return
+	}
+	if !assert.Equal(t, m.CommonDescriptor.Name, parsed.CommonDescriptor.Name, "Name matches") {
+		return
+	}
+	if !assert.Equal(t, validUntil, parsed.CommonDescriptor.ValidUntil.UTC(), "validUntil matches") {
+		return
+	}
+	if !assert.Equal(t, 3600, parsed.CommonDescriptor.CacheDuration, "cacheDuration matches") {
+		return
+	}
+	if !assert.Len(t, parsed.EntityDescriptors, 2, "2 top level entities") {
+		return
+	}
+	if !assert.Len(t, parsed.EntitiesDescriptors, 1, "1 nested EntitiesDescriptor") {
+		return
+	}
+	if !assert.Equal(t, "urn:example:federation:sub", parsed.EntitiesDescriptors[0].CommonDescriptor.Name, "nested Name matches") {
+		return
+	}
+
+	// A single entity keeps the attributes of the group
+	single := md.Metadata{
+		CommonDescriptor:  m.CommonDescriptor,
+		EntityDescriptors: []md.EntityDescriptor{newIDP("https://idp1.example.com")},
+	}
+	xmlstr, err = single.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	singleParsed, err := md.ParseString(xmlstr)
+	if !assert.NoError(t, err, "ParseString succeeds") {
+		return
+	}
+	if !assert.Equal(t, m.CommonDescriptor.Name, singleParsed.CommonDescriptor.Name, "Name of a single entity group matches") {
+		return
+	}
+	if !assert.Len(t, singleParsed.EntityDescriptors, 1, "1 entity") {
+		return
+	}
+
+	all := parsed.AllEntityDescriptors()
+	if !assert.Len(t, all, 3, "3 entities in total") {
+		return
+	}
+	if !assert.Equal(t, "https://idp3.example.com", all[2].ID(), "nested entity is last") {
+		return
+	}
+}
+
+func TestMultiRoleEntity(t *testing.T) {
+	xmlsrc := `<?xml version="1.0" encoding="utf-8"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" entityID="https://idp.example.com/metadata" validUntil="2030-01-01T00:00:00">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+    <md:NameIDMappingService Binding="urn:oasis:names:tc:SAML:2.0:bindings:SOAP" Location="https://idp.example.com/nameid"/>
+    <md:AssertionIDRequestService Binding="urn:oasis:names:tc:SAML:2.0:bindings:URI" Location="https://idp.example.com/assertion"/>
+    <md:AttributeProfile>urn:oasis:names:tc:SAML:2.0:profiles:attribute:basic</md:AttributeProfile>
+    <saml:Attribute Name="mail"/>
+  </md:IDPSSODescriptor>
+  <md:AttributeAuthorityDescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:AttributeService Binding="urn:oasis:names:tc:SAML:2.0:bindings:SOAP" Location="https://idp.example.com/aa"/>
+  </md:AttributeAuthorityDescriptor>
+</md:EntityDescriptor>`
+
+	m, err := md.ParseString(xmlsrc)
+	if !assert.NoError(t, err, "ParseString succeeds") {
+		return
+	}
+	if !assert.Len(t, m.EntityDescriptors, 2, "one descriptor per role") {
+		return
+	}
+
+	idp, ok := m.EntityDescriptors[0].(md.IDPDescriptor)
+	if !assert.True(t, ok, "first role is an IDPDescriptor") {
+		return
+	}
+	if !assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), idp.ValidUntil().UTC(), "validUntil without a time zone is accepted") {
+		return
+	}
+
+	xmlstr, err := m.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	if !assert.Equal(t, 1, strings.Count(xmlstr, "<md:EntityDescriptor"), "roles are written out as one EntityDescriptor") {
+		return
+	}
+
+	parsed, err := md.ParseString(xmlstr)
+	if !assert.NoError(t, err, "ParseString succeeds") {
+		return
+	}
+	if !assert.Len(t, parsed.EntityDescriptors, 2, "both roles survive the round trip") {
+		return
+	}
+	if !assert.IsType(t, md.AttributeAuthorityDescriptor{}, parsed.EntityDescriptors[1], "second role is an AttributeAuthorityDescriptor") {
+		return
+	}
+
+	idp = parsed.EntityDescriptors[0].(md.IDPDescriptor)
+	if !assert.Len(t, idp.NameIDMappingService, 1, "NameIDMappingService survives") {
+		return
+	}
+	if !assert.Len(t, idp.AssertionIDRequestService, 1, "AssertionIDRequestService survives") {
+		return
+	}
+	if !assert.Equal(t, []string{"urn:oasis:names:tc:SAML:2.0:profiles:attribute:basic"}, idp.AttributeProfile, "AttributeProfile survives") {
+		return
+	}
+	if !assert.Len(t, idp.Attribute, 1, "Attribute survives") {
+		return
+	}
+	if !assert.Equal(t, "mail", idp.Attribute[0].Name, "Attribute name matches") {
+		return
+	}
 }
@@ -0,0 +1,506 @@
+package md
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-saml/ns"
+)
+
+// Parse parses a metadata document. The document may either be a
+// single <md:EntityDescriptor>, or an <md:EntitiesDescriptor>, in
+// which case the hierarchy of nested groups is preserved. Use
+// Metadata.AllEntityDescriptors to get a flat list of entities.
+// Each <md:IDPSSODescriptor> and <md:SPSSODescriptor> becomes an
+// IDPDescriptor or SPDescriptor, respectively, and each
+// <md:AttributeAuthorityDescriptor> becomes an AttributeAuthorityDescriptor.
+func Parse(src []byte) (*Metadata, error) {
+	doc, err := saml.ParseXML(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return constructMetadata(doc)
+}
+
+// ParseString is the same as Parse, but takes a string
+func ParseString(src string) (*Metadata, error) {
+	doc, err := saml.ParseXMLString(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return constructMetadata(doc)
+}
+
+func constructMetadata(doc types.Document) (*Metadata, error) {
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return nil, errors.New("failed to fetch document element: " + err.Error())
+	}
+
+	m := &Metadata{}
+	if err := m.PopulateFromXML(root); err != nil {
+		return nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return m, nil
+}
+
+// makeXPathContext wraps a node and creates an XPathContext that has
+// all of the required namespaces registered to handle metadata parsing
+func makeXPathContext(n types.Node) (*xpath.Context, error) {
+	xpc, err := xpath.NewContext(n)
+	if err != nil {
+		return nil, errors.New("failed to create xpath context: " + err.Error())
+	}
+
+	for _, namespace := range []*ns.Namespace{ns.Metadata, ns.SAML, ns.XMLDSignature} {
+		if err := xpc.RegisterNS(namespace.Prefix, namespace.URI); err != nil {
+			return nil, errors.New("failed to register namespace for xpath context: " + err.Error())
+		}
+	}
+	return xpc, nil
+}
+
+// PopulateFromXML populates the Metadata from either an
+// <md:EntityDescriptor> or an <md:EntitiesDescriptor> element
+func (m *Metadata) PopulateFromXML(n types.Node) error {
+	if n.LocalName() == "EntityDescriptor" {
+		descs, err := parseEntityDescriptor(n)
+		if err != nil {
+			return err
+		}
+		m.EntityDescriptors = descs
+		return nil
+	}
+
+	ed := EntitiesDescriptor{}
+	if err := ed.PopulateFromXML(n); err != nil {
+		return err
+	}
+	m.CommonDescriptor = ed.CommonDescriptor
+	m.EntityDescriptors = ed.EntityDescriptors
+	m.EntitiesDescriptors = ed.EntitiesDescriptors
+	return nil
+}
+
+func (ed *EntitiesDescriptor) PopulateFromXML(n types.Node) error {
+	if n.LocalName() != "EntitiesDescriptor" || n.NamespaceURI() != ns.Metadata.URI {
+		return errors.New("expected md:EntitiesDescriptor, got " + n.NodeName())
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	ed.CommonDescriptor.ID = xpath.String(xpc.Find("@ID"))
+	ed.CommonDescriptor.Name = xpath.String(xpc.Find("@Name"))
+	if err := ed.CommonDescriptor.populateFromXML(xpc); err != nil {
+		return err
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find("md:EntityDescriptor")) {
+		descs, err := parseEntityDescriptor(node)
+		if err != nil {
+			return err
+		}
+		ed.EntityDescriptors = append(ed.EntityDescriptors, descs...)
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find("md:EntitiesDescriptor")) {
+		child := EntitiesDescriptor{}
+		if err := child.PopulateFromXML(node); err != nil {
+			return err
+		}
+		ed.EntitiesDescriptors = append(ed.EntitiesDescriptors, child)
+	}
+	return nil
+}
+
+func parseEntityDescriptor(n types.Node) ([]EntityDescriptor, error) {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return nil, err
+	}
+
+	common := CommonDescriptor{
+		ID: xpath.String(xpc.Find("@entityID")),
+	}
+	if common.ID == "" {
+		return nil, errors.New("missing entityID")
+	}
+	if err := common.populateFromXML(xpc); err != nil {
+		return nil, err
+	}
+
+	var cp *ContactPerson
+	if node := xpath.NodeList(xpc.Find("md:ContactPerson")).First(); node != nil {
+		cp = &ContactPerson{}
+		if err := cp.PopulateFromXML(node); err != nil {
+			return nil, err
+		}
+	}
+
+	var descs []EntityDescriptor
+	for _, node := range xpath.NodeList(xpc.Find("md:IDPSSODescriptor")) {
+		desc := IDPDescriptor{ContactPerson: cp}
+		desc.CommonDescriptor = common
+		if err := desc.PopulateFromXML(node); err != nil {
+			return nil, err
+		}
+		descs = append(descs, desc)
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find("md:SPSSODescriptor")) {
+		desc := SPDescriptor{ContactPerson: cp}
+		desc.CommonDescriptor = common
+		if err := desc.PopulateFromXML(node); err != nil {
+			return nil, err
+		}
+		descs = append(descs, desc)
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find("md:AttributeAuthorityDescriptor")) {
+		desc := AttributeAuthorityDescriptor{ContactPerson: cp}
+		desc.CommonDescriptor = common
+		if err := desc.PopulateFromXML(node); err != nil {
+			return nil, err
+		}
+		descs = append(descs, desc)
+	}
+
+	return descs, nil
+}
+
+// populateFromXML reads validUntil and cacheDuration from the element
+// that xpc is pointing to. Values that are already set are only
+// overwritten if the element specifies them.
+func (cd *CommonDescriptor) populateFromXML(xpc *xpath.Context) error {
+	if s := xpath.String(xpc.Find("@validUntil")); s != "" {
+		t, err := saml.ParseTime(s)
+		if err != nil {
+			return errors.New("invalid validUntil: " + err.Error())
+		}
+		cd.ValidUntil = t
+	}
+
+	if s := xpath.String(xpc.Find("@cacheDuration")); s != "" {
+		d, err := parseDuration(s)
+		if err != nil {
+			return err
+		}
+		cd.CacheDuration = d
+	}
+	return nil
+}
+
+func (rd *RoleDescriptor) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	if err := rd.CommonDescriptor.populateFromXML(xpc); err != nil {
+		return err
+	}
+
+	rd.ErrorURL = xpath.String(xpc.Find("@errorURL"))
+	rd.ProtocolSupportEnumerations = strings.Fields(xpath.String(xpc.Find("@protocolSupportEnumeration")))
+
+	for _, node := range xpath.NodeList(xpc.Find("md:KeyDescriptor")) {
+		kd := KeyDescriptor{}
+		if err := kd.PopulateFromXML(node); err != nil {
+			return err
+		}
+		rd.KeyDescriptors = append(rd.KeyDescriptors, kd)
+	}
+	return nil
+}
+
+func (sd *SSODescriptor) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	if sd.ArtifactResolutionService, err = parseIndexedEndpoints(xpc, "ArtifactResolutionService"); err != nil {
+		return err
+	}
+	if sd.SingleLogoutService, err = parseEndpoints(xpc, "SingleLogoutService"); err != nil {
+		return err
+	}
+	if sd.ManageNameIDService, err = parseEndpoints(xpc, "ManageNameIDService"); err != nil {
+		return err
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find("md:NameIDFormat")) {
+		sd.NameIDFormats = append(sd.NameIDFormats, nameid.Format(strings.TrimSpace(node.TextContent())))
+	}
+	if len(sd.NameIDFormats) > 0 {
+		sd.NameIDFormat = sd.NameIDFormats[0]
+	}
+	return nil
+}
+
+func (desc *IDPDescriptor) PopulateFromXML(n types.Node) error {
+	if err := desc.RoleDescriptor.PopulateFromXML(n); err != nil {
+		return err
+	}
+	if err := desc.SSODescriptor.PopulateFromXML(n); err != nil {
+		return err
+	}
+	if len(desc.KeyDescriptors) > 0 {
+		desc.KeyDescriptor = &desc.KeyDescriptors[0]
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	desc.WantAuthnRequestsSigned = xpath.Bool(xpc.Find("@WantAuthnRequestsSigned = 'true' or @WantAuthnRequestsSigned = '1'"))
+	if desc.SingleSignOnService, err = parseEndpoints(xpc, "SingleSignOnService"); err != nil {
+		return err
+	}
+	if desc.NameIDMappingService, err = parseEndpoints(xpc, "NameIDMappingService"); err != nil {
+		return err
+	}
+	if desc.AssertionIDRequestService, err = parseEndpoints(xpc, "AssertionIDRequestService"); err != nil {
+		return err
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find("md:AttributeProfile")) {
+		desc.AttributeProfile = append(desc.AttributeProfile, strings.TrimSpace(node.TextContent()))
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find("saml:Attribute")) {
+		attr := saml.Attribute{}
+		if err := attr.PopulateFromXML(node); err != nil {
+			return err
+		}
+		desc.Attribute = append(desc.Attribute, attr)
+	}
+
+	if node := xpath.NodeList(xpc.Find("md:ContactPerson")).First(); node != nil {
+		cp := &ContactPerson{}
+		if err := cp.PopulateFromXML(node); err != nil {
+			return err
+		}
+		desc.ContactPerson = cp
+	}
+	return nil
+}
+
+func (desc *SPDescriptor) PopulateFromXML(n types.Node) error {
+	if err := desc.RoleDescriptor.PopulateFromXML(n); err != nil {
+		return err
+	}
+	if err := desc.SSODescriptor.PopulateFromXML(n); err != nil {
+		return err
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	desc.AuthnRequestsSigned = xpath.Bool(xpc.Find("@AuthnRequestsSigned = 'true' or @AuthnRequestsSigned = '1'"))
+	desc.WantAssertionsSigned = xpath.Bool(xpc.Find("@WantAssertionsSigned = 'true' or @WantAssertionsSigned = '1'"))
+	if desc.AssertionConsumerService, err = parseIndexedEndpoints(xpc, "AssertionConsumerService"); err != nil {
+		return err
+	}
+
+	if node := xpath.NodeList(xpc.Find("md:ContactPerson")).First(); node != nil {
+		cp := &ContactPerson{}
+		if err := cp.PopulateFromXML(node); err != nil {
+			return err
+		}
+		desc.ContactPerson = cp
+	}
+	return nil
+}
+
+func (desc *AttributeAuthorityDescriptor) PopulateFromXML(n types.Node) error {
+	if err := desc.RoleDescriptor.PopulateFromXML(n); err != nil {
+		return err
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	if desc.AttributeService, err = parseEndpoints(xpc, "AttributeService"); err != nil {
+		return err
+	}
+	if desc.AssertionIDRequestService, err = parseEndpoints(xpc, "AssertionIDRequestService"); err != nil {
+		return err
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find("md:NameIDFormat")) {
+		desc.NameIDFormats = append(desc.NameIDFormats, nameid.Format(strings.TrimSpace(node.TextContent())))
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find("md:AttributeProfile")) {
+		desc.AttributeProfile = append(desc.AttributeProfile, strings.TrimSpace(node.TextContent()))
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find("saml:Attribute")) {
+		attr := saml.Attribute{}
+		if err := attr.PopulateFromXML(node); err != nil {
+			return err
+		}
+		desc.Attribute = append(desc.Attribute, attr)
+	}
+
+	if node := xpath.NodeList(xpc.Find("md:ContactPerson")).First(); node != nil {
+		cp := &ContactPerson{}
+		if err := cp.PopulateFromXML(node); err != nil {
+			return err
+		}
+		desc.ContactPerson = cp
+	}
+	return nil
+}
+
+func (cp *ContactPerson) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	cp.Type = xpath.String(xpc.Find("@contactType"))
+	cp.Company = strings.TrimSpace(xpath.String(xpc.Find("md:Company")))
+	cp.GivenName = strings.TrimSpace(xpath.String(xpc.Find("md:GivenName")))
+	cp.SurName = strings.TrimSpace(xpath.String(xpc.Find("md:SurName")))
+	cp.EmailAddress = strings.TrimSpace(xpath.String(xpc.Find("md:EmailAddress")))
+	cp.TelephoneNumber = strings.TrimSpace(xpath.String(xpc.Find("md:TelephoneNumber")))
+	return nil
+}
+
+func (kd *KeyDescriptor) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	kd.Use = xpath.String(xpc.Find("@use"))
+
+	ki := KeyInfo{}
+	for _, node := range xpath.NodeList(xpc.Find("ds:KeyInfo/ds:X509Data/ds:X509Certificate")) {
+		// Certificates are usually broken into multiple lines
+		data := strings.Join(strings.Fields(node.TextContent()), "")
+		der, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return errors.New("failed to decode certificate: " + err.Error())
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errors.New("failed to parse certificate: " + err.Error())
+		}
+		ki.Certificates = append(ki.Certificates, cert)
+	}
+	kd.Key = ki
+	return nil
+}
+
+func parseEndpoints(xpc *xpath.Context, name string) ([]saml.Endpoint, error) {
+	var list []saml.Endpoint
+	for _, node := range xpath.NodeList(xpc.Find(ns.Metadata.AddPrefix(name))) {
+		e := saml.Endpoint{Name: name}
+		if err := populateEndpoint(&e, node); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+func parseIndexedEndpoints(xpc *xpath.Context, name string) ([]saml.IndexedEndpoint, error) {
+	var list []saml.IndexedEndpoint
+	for _, node := range xpath.NodeList(xpc.Find(ns.Metadata.AddPrefix(name))) {
+		e := saml.IndexedEndpoint{}
+		e.Name = name
+		if err := populateEndpoint(&e.Endpoint, node); err != nil {
+			return nil, err
+		}
+
+		ixpc, err := makeXPathContext(node)
+		if err != nil {
+			return nil, err
+		}
+		if s := xpath.String(ixpc.Find("@index")); s != "" {
+			i, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, errors.New("invalid index for " + name + ": " + err.Error())
+			}
+			e.Index = i
+			e.HasIndex = true
+		}
+		e.IsDefault = xpath.Bool(ixpc.Find("@isDefault = 'true' or @isDefault = '1'"))
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+func populateEndpoint(e *saml.Endpoint, n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	e.ProtocolBinding = binding.Protocol(xpath.String(xpc.Find("@Binding")))
+	e.Location = xpath.String(xpc.Find("@Location"))
+	e.ResponseLocation = xpath.String(xpc.Find("@ResponseLocation"))
+	if e.Location == "" {
+		return errors.New("missing Location for " + e.Name)
+	}
+	return nil
+}
+
+var durationRx = regexp.MustCompile(`^(-)?P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)(?:\.\d+)?S)?)?$`)
+
+// parseDuration parses an xs:duration value into seconds. Years and
+// months do not have a fixed length, so they are approximated as
+// 365 and 30 days, respectively
+func parseDuration(s string) (int, error) {
+	m := durationRx.FindStringSubmatch(s)
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, errors.New("invalid xs:duration value: " + s)
+	}
+
+	var secs int
+	for i, mult := range []int{365 * 86400, 30 * 86400, 86400, 3600, 60, 1} {
+		if m[i+2] == "" {
+			continue
+		}
+		v, err := strconv.Atoi(m[i+2])
+		if err != nil {
+			return 0, errors.New("invalid xs:duration value: " + s)
+		}
+		secs += v * mult
+	}
+
+	if m[1] == "-" {
+		secs = -secs
+	}
+	return secs, nil
+}
+
+// formatDuration formats seconds into a xs:duration value
+func formatDuration(secs int) string {
+	return "PT" + strconv.Itoa(secs) + "S"
+}
@@ -8,10 +8,19 @@ import (
 	"github.com/satori/go.uuid"
 )
 
+// UUIDURL is no longer used. IDs are now generated randomly, as they
+// must be unique per message
 var UUIDURL = "github.com/lestrrat/go-saml"
 
+// newID generates a unique identifier for messages and assertions. The
+// leading underscore makes sure that the ID is a valid xs:ID, which may
+// not start with a digit
+func newID() string {
+	return "_" + uuid.NewV4().String()
+}
+
 func (msg *Message) Initialize() *Message {
-	msg.ID = uuid.NewV5(uuid.NamespaceDNS, UUIDURL).String()
+	msg.ID = newID()
 	msg.Version = "2.0"
 	msg.IssueInstant = time.Now()
 	return msg
@@ -27,7 +36,7 @@ func (m Message) MakeXMLNode(d types.Document) (types.Node, error) {
 
 	mxml.SetAttribute("ID", m.ID)
 	mxml.SetAttribute("Version", m.Version)
-	mxml.SetAttribute("IssueInstant", m.IssueInstant.Format(TimeFormat))
+	mxml.SetAttribute("IssueInstant", formatTime(m.IssueInstant))
 	if v := m.Destination; v != "" {
 		mxml.SetAttribute("Destination", v)
 	}
@@ -47,3 +56,13 @@ func (m Message) MakeXMLNode(d types.Document) (types.Node, error) {
 
 	return mxml, nil
 }
+
+// messageParam returns the name of the parameter used to carry this
+// message in the HTTP bindings. Request overrides this for all requests
+func (m Message) messageParam() string {
+	return ParamSAMLResponse
+}
+
+func (r Request) messageParam() string {
+	return ParamSAMLRequest
+}
@@ -16,6 +16,9 @@ var (
 	XMLSchema         = NewNamespace("xs", "http://www.w3.org/2001/XMLSchema")
 	XMLSchemaInstance = NewNamespace("xsi", "http://www.w3.org/2001/XMLSchema-instance")
 	X500              = NewNamespace("x500", "urn:oasis:names:tc:SAML:2.0:profiles:attribute:X500")
+	SOAPEnvelope      = NewNamespace("SOAP-ENV", "http://schemas.xmlsoap.org/soap/envelope/")
+	ECP               = NewNamespace("ecp", "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp")
+	PAOS              = NewNamespace("paos", "urn:liberty:paos:2003-08")
 )
 
 func NewNamespace(prefix, uri string) *Namespace {
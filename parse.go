@@ -0,0 +1,100 @@
+package saml
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat/go-libxml2/parser"
+	"github.com/lestrrat/go-libxml2/types"
+)
+
+var (
+	// MaxEncodedSize is the maximum number of bytes of base64 encoded
+	// payload that will be accepted when decoding a message
+	MaxEncodedSize int64 = 1 << 20
+	// MaxDecodedSize is the maximum number of bytes of XML that a
+	// payload may expand to after being base64 decoded and inflated
+	MaxDecodedSize int64 = 4 << 20
+)
+
+// ErrEncodedTooLarge is returned when the encoded payload is larger
+// than MaxEncodedSize. Reading stops right after the limit is exceeded,
+// so Size is a lower bound of the actual size
+type ErrEncodedTooLarge struct {
+	Limit int64
+	Size  int64
+}
+
+func (e ErrEncodedTooLarge) Error() string {
+	return "encoded payload of at least " + strconv.FormatInt(e.Size, 10) + " bytes exceeds size limit of " + strconv.FormatInt(e.Limit, 10) + " bytes"
+}
+
+// ErrDecodedTooLarge is returned when the decoded payload is larger
+// than MaxDecodedSize. Reading stops right after the limit is exceeded,
+// so Size is a lower bound of the actual size
+type ErrDecodedTooLarge struct {
+	Limit int64
+	Size  int64
+}
+
+func (e ErrDecodedTooLarge) Error() string {
+	return "decoded payload of at least " + strconv.FormatInt(e.Size, 10) + " bytes exceeds size limit of " + strconv.FormatInt(e.Limit, 10) + " bytes"
+}
+
+var (
+	// ErrDoctype is returned when the XML document contains a DOCTYPE
+	// declaration
+	ErrDoctype = errors.New("DOCTYPE declarations are not allowed")
+	// ErrInvalidEncoding is returned when the XML document is not
+	// encoded in UTF-8
+	ErrInvalidEncoding = errors.New("XML documents must be encoded in UTF-8")
+)
+
+var doctypeDecl = []byte("<!DOCTYPE")
+
+// xmlDeclEncoding matches the encoding declared in the XML declaration
+var xmlDeclEncoding = regexp.MustCompile(`\A\x{FEFF}?<\?xml\s[^>]*?\bencoding\s*=\s*["']([^"']*)["']`)
+
+// xmlParser is configured to never load external DTDs, substitute
+// entities or access the network
+var xmlParser = parser.New(parser.XMLParseNoNet)
+
+// ParseXML parses src using the hardened parser configuration used
+// throughout this package. Documents containing a DOCTYPE declaration
+// are rejected outright, as SAML messages never legitimately need one,
+// and entities are never resolved.
+func ParseXML(src []byte) (types.Document, error) {
+	// A NUL byte means that the document is UTF-16 (or UTF-32), and any
+	// other declared encoding, such as UTF-7, could be used to hide a
+	// DOCTYPE from the check below
+	if bytes.IndexByte(src, 0) >= 0 {
+		return nil, ErrInvalidEncoding
+	}
+	if m := xmlDeclEncoding.FindSubmatch(src); m != nil && !strings.EqualFold(string(m[1]), "UTF-8") {
+		return nil, ErrInvalidEncoding
+	}
+	if bytes.Contains(src, doctypeDecl) {
+		return nil, ErrDoctype
+	}
+
+	doc, err := xmlParser.Parse(src)
+	if err != nil {
+		return nil, errors.New("failed to parse xml: " + err.Error())
+	}
+
+	// libxml2 also detects encodings without a declaration (EBCDIC, for
+	// one), so make sure that no DTD made it through
+	if hasDTD(doc) {
+		doc.Free()
+		return nil, ErrDoctype
+	}
+	return doc, nil
+}
+
+// ParseXMLString is the same as ParseXML, but takes a string
+func ParseXMLString(src string) (types.Document, error) {
+	return ParseXML([]byte(src))
+}
@@ -0,0 +1,91 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseXML(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		src      string
+		expected error
+	}{
+		{
+			name:     "external entity",
+			src:      `<?xml version="1.0"?><!DOCTYPE foo [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><foo>&xxe;</foo>`,
+			expected: ErrDoctype,
+		},
+		{
+			name:     "entity expansion",
+			src:      `<!DOCTYPE lolz [<!ENTITY lol "lol"><!ENTITY lol2 "&lol;&lol;&lol;&lol;">]><lolz>&lol2;</lolz>`,
+			expected: ErrDoctype,
+		},
+		{
+			name:     "UTF-7",
+			src:      `<?xml version="1.0" encoding="UTF-7"?>+ADw-!DOCTYPE foo+AFs-+ADw-!ENTITY xxe SYSTEM +ACI-file:///etc/passwd+ACI-+AD4-+AF0-+AD4-<foo>&xxe;</foo>`,
+			expected: ErrInvalidEncoding,
+		},
+		{
+			name:     "ISO-8859-1",
+			src:      `<?xml version='1.0' encoding='ISO-8859-1'?><foo/>`,
+			expected: ErrInvalidEncoding,
+		},
+		{
+			name:     "EBCDIC without a declaration in ASCII",
+			src:      "\x4c\x6f\xa7\x94\x93\x40\xa5\x85\x99\xa2\x89\x96\x95\x7e\x7f\xf1\x4b\xf0\x7f\x40\x85\x95\x83\x96\x84\x89\x95\x87\x7e\x7f\xc9\xc2\xd4\xf0\xf3\xf7\x7f\x6f\x6e\x4c\x5a\xc4\xd6\xc3\xe3\xe8\xd7\xc5\x40\x86\x96\x96\x40\xe2\xe8\xe2\xe3\xc5\xd4\x40\x7f\x88\xa3\xa3\x97\x7a\x61\x61\x85\xa7\x81\x94\x97\x93\x85\x4b\x83\x96\x94\x61\xa7\x4b\x84\xa3\x84\x7f\x6e\x4c\x86\x96\x96\x61\x6e",
+			expected: ErrDoctype,
+		},
+		{
+			name:     "UTF-16",
+			src:      "\xff\xfe<\x00f\x00o\x00o\x00/\x00>\x00",
+			expected: ErrInvalidEncoding,
+		},
+	} {
+		_, err := ParseXMLString(tc.src)
+		if !assert.Equal(t, tc.expected, err, "ParseXMLString fails (%s)", tc.name) {
+			return
+		}
+	}
+
+	doc, err := ParseXMLString(`<?xml version="1.0" encoding="utf-8"?><foo/>`)
+	if !assert.NoError(t, err, "ParseXMLString succeeds for UTF-8") {
+		return
+	}
+	doc.Free()
+}
+
+func TestDecodeLimits(t *testing.T) {
+	defer func(encoded, decoded int64) {
+		MaxEncodedSize = encoded
+		MaxDecodedSize = decoded
+	}(MaxEncodedSize, MaxDecodedSize)
+
+	MaxEncodedSize = 1024
+	MaxDecodedSize = 4096
+
+	_, err := decode(strings.NewReader(strings.Repeat("A", 2048)), false)
+	if !assert.Equal(t, ErrEncodedTooLarge{Limit: 1024, Size: 1025}, err, "decode fails on large input") {
+		return
+	}
+
+	// A small deflated payload that inflates beyond the limit
+	buf := bytes.Buffer{}
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(bytes.Repeat([]byte{' '}, 256<<10))
+	w.Close()
+
+	encoded := b64enc.EncodeToString(buf.Bytes())
+	if !assert.True(t, int64(len(encoded)) <= MaxEncodedSize, "compressed payload fits in limit") {
+		return
+	}
+
+	_, err = decode(strings.NewReader(encoded), true)
+	if !assert.Equal(t, ErrDecodedTooLarge{Limit: 4096, Size: 4097}, err, "decode fails on large inflated output") {
+		return
+	}
+}
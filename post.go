@@ -0,0 +1,140 @@
+package saml
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml/binding"
+)
+
+var postFormTemplate = template.Must(template.New("post").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+</head>
+<body onload="document.forms[0].submit()">
+<noscript>
+<p><strong>Note:</strong> Since your browser does not support JavaScript, you must press the Continue button once to proceed.</p>
+</noscript>
+<form method="post" action="{{.Action}}">
+<input type="hidden" name="{{.Param}}" value="{{.Payload}}"/>
+{{- if .RelayState}}
+<input type="hidden" name="RelayState" value="{{.RelayState}}"/>
+{{- end}}
+<noscript>
+<input type="submit" value="Continue"/>
+</noscript>
+</form>
+</body>
+</html>
+`))
+
+// PostForm generates an HTML document containing a form that
+// automatically sends msg to this endpoint using the HTTP-POST binding.
+// The message is base64 encoded (but not deflated) into the SAMLRequest
+// or SAMLResponse field.
+// If the signer is not nil, the message is signed using its key and
+// algorithms before being encoded
+func (e Endpoint) PostForm(msg ProtocolMessage, relayState string, signer *Signer) ([]byte, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Endpoint.PostForm")
+		defer g.IRelease("END Endpoint.PostForm")
+	}
+
+	if v := e.ProtocolBinding; v != "" && v != binding.HTTPPost {
+		return nil, errors.New("endpoint does not support the HTTP-POST binding: " + v.String())
+	}
+
+	payload, err := encode(msg, signer, false)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.Buffer{}
+	err = postFormTemplate.Execute(&buf, struct {
+		Action     string
+		Param      string
+		Payload    string
+		RelayState string
+	}{
+		Action:     e.Location,
+		Param:      msg.messageParam(),
+		Payload:    string(payload),
+		RelayState: relayState,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WritePostForm is a convenience wrapper around PostForm that writes
+// the generated HTML to w
+func (e Endpoint) WritePostForm(w http.ResponseWriter, msg ProtocolMessage, relayState string, signer *Signer) error {
+	html, err := e.PostForm(msg, relayState, signer)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Pragma", "no-cache")
+	_, err = w.Write(html)
+	return err
+}
+
+// DecodePostRequest extracts the message sent via the HTTP-POST binding
+// from an incoming HTTP request. The message is base64 decoded, but is
+// not inflated, as the HTTP-POST binding does not use DEFLATE encoding.
+// Verification of any enveloped signature is left to the caller.
+func DecodePostRequest(r *http.Request) (*HTTPMessage, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.DecodePostRequest")
+		defer g.IRelease("END saml.DecodePostRequest")
+	}
+
+	if r.Method != "POST" {
+		return nil, errors.New("HTTP-POST binding requires a POST request")
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, errors.New("failed to parse form: " + err.Error())
+	}
+
+	msg := &HTTPMessage{}
+	req := r.PostForm[ParamSAMLRequest]
+	res := r.PostForm[ParamSAMLResponse]
+	var payload string
+	switch {
+	case len(req) > 0 && len(res) > 0:
+		return nil, errors.New("both SAMLRequest and SAMLResponse present")
+	case len(req) == 1:
+		msg.Param = ParamSAMLRequest
+		payload = req[0]
+	case len(res) == 1:
+		msg.Param = ParamSAMLResponse
+		payload = res[0]
+	case len(req) > 1 || len(res) > 1:
+		return nil, errors.New("duplicate SAMLRequest or SAMLResponse")
+	default:
+		return nil, errors.New("no SAMLRequest or SAMLResponse present")
+	}
+
+	if list := r.PostForm[ParamRelayState]; len(list) > 1 {
+		return nil, errors.New("duplicate parameter " + ParamRelayState)
+	} else if len(list) == 1 {
+		msg.RelayState = list[0]
+	}
+
+	xmlbytes, err := decode(strings.NewReader(payload), false)
+	if err != nil {
+		return nil, err
+	}
+	msg.XML = xmlbytes
+
+	return msg, nil
+}
@@ -0,0 +1,70 @@
+package saml
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostBinding(t *testing.T) {
+	res := NewResponse()
+	res.Issuer = "http://idp.example.com/metadata"
+	res.Destination = "http://sp.example.com/acs"
+	res.Status = StatusSuccess
+
+	e := Endpoint{
+		ProtocolBinding: binding.HTTPPost,
+		Location:        "http://sp.example.com/acs",
+	}
+
+	const relayState = `"><script>alert(1)</script>`
+	html, err := e.PostForm(res, relayState, nil)
+	if !assert.NoError(t, err, "PostForm succeeds") {
+		return
+	}
+
+	if !assert.Contains(t, string(html), `action="http://sp.example.com/acs"`, "form action is the endpoint location") {
+		return
+	}
+	if !assert.Contains(t, string(html), `name="SAMLResponse"`, "form contains SAMLResponse") {
+		return
+	}
+	if !assert.NotContains(t, string(html), relayState, "RelayState is escaped") {
+		return
+	}
+
+	payload, err := res.EncodePost(nil)
+	if !assert.NoError(t, err, "EncodePost succeeds") {
+		return
+	}
+
+	form := url.Values{}
+	form.Set(ParamSAMLResponse, string(payload))
+	form.Set(ParamRelayState, relayState)
+	r := httptest.NewRequest("POST", "http://sp.example.com/acs", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	msg, err := DecodePostRequest(r)
+	if !assert.NoError(t, err, "DecodePostRequest succeeds") {
+		return
+	}
+
+	if !assert.Equal(t, ParamSAMLResponse, msg.Param, "Param matches") {
+		return
+	}
+	if !assert.Equal(t, relayState, msg.RelayState, "RelayState matches") {
+		return
+	}
+
+	decoded, err := ParseResponse(msg.XML)
+	if !assert.NoError(t, err, "ParseResponse succeeds") {
+		return
+	}
+	if !assert.Equal(t, res.ID, decoded.ID, "ID matches") {
+		return
+	}
+}
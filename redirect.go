@@ -0,0 +1,279 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml/binding"
+)
+
+// Hash returns the hash function used by the algorithm for signatures
+// in the HTTP-Redirect binding. The DSA algorithms are not supported
+// there, and return an error
+func (alg SignatureAlgorithm) Hash() (crypto.Hash, error) {
+	switch alg {
+	case RsaSha1:
+		return crypto.SHA1, nil
+	case RsaSha256, EcdsaSha256:
+		return crypto.SHA256, nil
+	case RsaSha384:
+		return crypto.SHA384, nil
+	case RsaSha512:
+		return crypto.SHA512, nil
+	}
+	return 0, errors.New("unsupported signature algorithm: " + alg.String())
+}
+
+// checkKey returns an error unless alg is an algorithm for the type of
+// the public key, so that a signature made with one kind of key is never
+// checked as if it were another
+func (alg SignatureAlgorithm) checkKey(key crypto.PublicKey) error {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		switch alg {
+		case RsaSha1, RsaSha256, RsaSha384, RsaSha512:
+			return nil
+		}
+		return errors.New("cannot use an RSA key with " + alg.String())
+	case *ecdsa.PublicKey:
+		if alg == EcdsaSha256 {
+			return nil
+		}
+		return errors.New("cannot use an ECDSA key with " + alg.String())
+	}
+	return errors.New("unsupported key type for HTTP-Redirect signatures")
+}
+
+// defaultSignatureAlgorithm picks the algorithm to use for key when the
+// user did not specify one
+func defaultSignatureAlgorithm(key interface{}) SignatureAlgorithm {
+	switch key.(type) {
+	case *ecdsa.PrivateKey, *ecdsa.PublicKey:
+		return EcdsaSha256
+	}
+	return RsaSha256
+}
+
+// RedirectURL builds the URL to send msg to this endpoint using the
+// HTTP-Redirect binding. The message is deflated and base64 encoded
+// into the SAMLRequest or SAMLResponse parameter.
+//
+// If key is not nil, the query string is signed as described in
+// section 3.4.4.1 of [SAMLBind], and the SigAlg and Signature parameters
+// are added. If alg is empty, a suitable algorithm for the key is used.
+// Only RSA and ECDSA keys are supported; DSA is not.
+// Note that any XML signature must not be embedded in the message when
+// using this binding.
+func (e Endpoint) RedirectURL(msg ProtocolMessage, relayState string, key crypto.Signer, alg SignatureAlgorithm) (*url.URL, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Endpoint.RedirectURL")
+		defer g.IRelease("END Endpoint.RedirectURL")
+	}
+
+	if v := e.ProtocolBinding; v != "" && v != binding.HTTPRedirect {
+		return nil, errors.New("endpoint does not support the HTTP-Redirect binding: " + v.String())
+	}
+
+	u, err := url.Parse(e.Location)
+	if err != nil {
+		return nil, errors.New("invalid endpoint location: " + err.Error())
+	}
+
+	payload, err := encode(msg, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// The order of the parameters is significant for the signature
+	query := msg.messageParam() + "=" + url.QueryEscape(string(payload))
+	if relayState != "" {
+		query += "&" + ParamRelayState + "=" + url.QueryEscape(relayState)
+	}
+
+	if key != nil {
+		if alg == "" {
+			alg = defaultSignatureAlgorithm(key)
+		}
+		query += "&" + ParamSigAlg + "=" + url.QueryEscape(alg.String())
+
+		sig, err := signRedirectQuery(query, key, alg)
+		if err != nil {
+			return nil, err
+		}
+		query += "&" + ParamSignature + "=" + url.QueryEscape(b64enc.EncodeToString(sig))
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery += "&" + query
+	} else {
+		u.RawQuery = query
+	}
+	return u, nil
+}
+
+func signRedirectQuery(query string, key crypto.Signer, alg SignatureAlgorithm) ([]byte, error) {
+	h, err := alg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := alg.checkKey(key.Public()); err != nil {
+		return nil, err
+	}
+
+	hh := h.New()
+	hh.Write([]byte(query))
+	return key.Sign(rand.Reader, hh.Sum(nil), h)
+}
+
+func verifyRedirectQuery(query string, sig []byte, key crypto.PublicKey, alg SignatureAlgorithm) error {
+	if err := alg.checkKey(key); err != nil {
+		return err
+	}
+
+	h, err := alg.Hash()
+	if err != nil {
+		return err
+	}
+
+	hh := h.New()
+	hh.Write([]byte(query))
+	digest := hh.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, h, digest, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type for HTTP-Redirect signatures")
+}
+
+// DecodeRedirectRequest extracts the message sent via the HTTP-Redirect
+// binding from an incoming HTTP request. The signature is computed over
+// the query string exactly as it was sent, so prefer this over
+// DecodeRedirectValues whenever the original request is available.
+//
+// If key is not nil, the SigAlg and Signature parameters must be present,
+// and the signature must verify against key. Only RSA and ECDSA keys are
+// supported; DSA is not.
+func DecodeRedirectRequest(r *http.Request, key crypto.PublicKey) (*HTTPMessage, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.DecodeRedirectRequest")
+		defer g.IRelease("END saml.DecodeRedirectRequest")
+	}
+
+	raw := map[string]string{}
+	for _, kv := range strings.Split(r.URL.RawQuery, "&") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		switch k := kv[:i]; k {
+		case ParamSAMLRequest, ParamSAMLResponse, ParamRelayState, ParamSigAlg, ParamSignature:
+			if _, ok := raw[k]; ok {
+				return nil, errors.New("duplicate parameter " + k)
+			}
+			raw[k] = kv[i+1:]
+		}
+	}
+
+	return decodeRedirect(raw, key)
+}
+
+// DecodeRedirectValues is the same as DecodeRedirectRequest, but works
+// on already parsed query parameters. As the original encoding of the
+// values is lost, the signed query string is reconstructed by encoding
+// the values using url.QueryEscape, which may not match what the sender
+// did.
+func DecodeRedirectValues(v url.Values, key crypto.PublicKey) (*HTTPMessage, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.DecodeRedirectValues")
+		defer g.IRelease("END saml.DecodeRedirectValues")
+	}
+
+	raw := map[string]string{}
+	for _, k := range []string{ParamSAMLRequest, ParamSAMLResponse, ParamRelayState, ParamSigAlg, ParamSignature} {
+		switch list := v[k]; len(list) {
+		case 0:
+		case 1:
+			raw[k] = url.QueryEscape(list[0])
+		default:
+			return nil, errors.New("duplicate parameter " + k)
+		}
+	}
+
+	return decodeRedirect(raw, key)
+}
+
+func decodeRedirect(raw map[string]string, key crypto.PublicKey) (*HTTPMessage, error) {
+	msg := &HTTPMessage{}
+
+	_, hasRequest := raw[ParamSAMLRequest]
+	_, hasResponse := raw[ParamSAMLResponse]
+	switch {
+	case hasRequest && hasResponse:
+		return nil, errors.New("both SAMLRequest and SAMLResponse present")
+	case hasRequest:
+		msg.Param = ParamSAMLRequest
+	case hasResponse:
+		msg.Param = ParamSAMLResponse
+	default:
+		return nil, errors.New("no SAMLRequest or SAMLResponse present")
+	}
+
+	values := map[string]string{}
+	for k, v := range raw {
+		uv, err := url.QueryUnescape(v)
+		if err != nil {
+			return nil, errors.New("failed to unescape " + k + ": " + err.Error())
+		}
+		values[k] = uv
+	}
+	msg.RelayState = values[ParamRelayState]
+
+	if key != nil {
+		sigb64, ok := values[ParamSignature]
+		if !ok {
+			return nil, errors.New("missing Signature")
+		}
+		alg, ok := values[ParamSigAlg]
+		if !ok {
+			return nil, errors.New("missing SigAlg")
+		}
+
+		sig, err := base64.StdEncoding.DecodeString(sigb64)
+		if err != nil {
+			return nil, errors.New("failed to decode signature: " + err.Error())
+		}
+
+		query := msg.Param + "=" + raw[msg.Param]
+		if v, ok := raw[ParamRelayState]; ok {
+			query += "&" + ParamRelayState + "=" + v
+		}
+		query += "&" + ParamSigAlg + "=" + raw[ParamSigAlg]
+
+		if err := verifyRedirectQuery(query, sig, key, SignatureAlgorithm(alg)); err != nil {
+			return nil, errors.New("failed to verify signature: " + err.Error())
+		}
+	}
+
+	xmlbytes, err := decode(strings.NewReader(values[msg.Param]), true)
+	if err != nil {
+		return nil, err
+	}
+	msg.XML = xmlbytes
+
+	return msg, nil
+}
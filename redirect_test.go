@@ -0,0 +1,125 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectBinding(t *testing.T) {
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+
+	ecdsakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+
+	ar := NewAuthnRequest()
+	ar.Issuer = "http://sp.example.com/metadata"
+	ar.Destination = "http://idp.example.com/sso"
+	ar.ProtocolBinding = binding.HTTPPost
+	ar.AssertionConsumerServiceURL = "http://sp.example.com/acs"
+
+	e := Endpoint{
+		ProtocolBinding: binding.HTTPRedirect,
+		Location:        "http://idp.example.com/sso?foo=bar",
+	}
+
+	for _, tc := range []struct {
+		name   string
+		key    crypto.Signer
+		pubkey crypto.PublicKey
+		alg    SignatureAlgorithm
+	}{
+		{"rsa-sha256", rsakey, &rsakey.PublicKey, ""},
+		{"rsa-sha1", rsakey, &rsakey.PublicKey, RsaSha1},
+		{"ecdsa-sha256", ecdsakey, &ecdsakey.PublicKey, ""},
+	} {
+		ru, err := e.RedirectURL(ar, "relay&state", tc.key, tc.alg)
+		if !assert.NoError(t, err, "RedirectURL succeeds (%s)", tc.name) {
+			return
+		}
+		u := ru.String()
+		pubkey := tc.pubkey
+
+		if !assert.True(t, strings.HasPrefix(u, "http://idp.example.com/sso?foo=bar&SAMLRequest="), "URL is built against the endpoint (%s)", tc.name) {
+			return
+		}
+
+		msg, err := DecodeRedirectRequest(httptest.NewRequest("GET", u, nil), pubkey)
+		if !assert.NoError(t, err, "DecodeRedirectRequest succeeds (%s)", tc.name) {
+			return
+		}
+
+		if !assert.Equal(t, ParamSAMLRequest, msg.Param, "Param matches (%s)", tc.name) {
+			return
+		}
+		if !assert.Equal(t, "relay&state", msg.RelayState, "RelayState matches (%s)", tc.name) {
+			return
+		}
+
+		decoded, err := ParseAuthnRequest(msg.XML)
+		if !assert.NoError(t, err, "ParseAuthnRequest succeeds (%s)", tc.name) {
+			return
+		}
+		if !assert.Equal(t, ar.ID, decoded.ID, "ID matches (%s)", tc.name) {
+			return
+		}
+
+		r := httptest.NewRequest("GET", u, nil)
+		msg, err = DecodeRedirectValues(r.URL.Query(), pubkey)
+		if !assert.NoError(t, err, "DecodeRedirectValues succeeds (%s)", tc.name) {
+			return
+		}
+
+		tampered := strings.Replace(u, "RelayState=relay", "RelayState=evil", 1)
+		_, err = DecodeRedirectRequest(httptest.NewRequest("GET", tampered, nil), pubkey)
+		if !assert.Error(t, err, "DecodeRedirectRequest fails for tampered RelayState (%s)", tc.name) {
+			return
+		}
+	}
+
+	// A valid RSA signature must not be accepted under a SigAlg for
+	// another key type
+	query := ParamSAMLRequest + "=foo&" + ParamSigAlg + "=" + url.QueryEscape(DsaSha1.String())
+	digest := sha1.Sum([]byte(query))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsakey, crypto.SHA1, digest[:])
+	if !assert.NoError(t, err, "SignPKCS1v15 succeeds") {
+		return
+	}
+	_, err = DecodeRedirectValues(url.Values{
+		ParamSAMLRequest: {"foo"},
+		ParamSigAlg:      {DsaSha1.String()},
+		ParamSignature:   {base64.StdEncoding.EncodeToString(sig)},
+	}, &rsakey.PublicKey)
+	if !assert.Error(t, err, "DecodeRedirectValues fails for RSA key with dsa-sha1") {
+		return
+	}
+	if !assert.Contains(t, err.Error(), "cannot use an RSA key", "SigAlg is checked against the key") {
+		return
+	}
+
+	// unsigned URL must be rejected when a key is expected
+	u, err := e.RedirectURL(ar, "", nil, "")
+	if !assert.NoError(t, err, "RedirectURL succeeds") {
+		return
+	}
+	_, err = DecodeRedirectRequest(httptest.NewRequest("GET", u.String(), nil), &rsakey.PublicKey)
+	if !assert.Error(t, err, "DecodeRedirectRequest fails for unsigned request") {
+		return
+	}
+}
@@ -0,0 +1,89 @@
+package saml
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrReplay is reported by Validator when an assertion has already been
+// accepted before
+var ErrReplay = errors.New("assertion has already been used")
+
+// ReplayCache remembers the IDs of assertions that have been accepted,
+// so that bearer assertions can only be used once. Implementations must
+// be safe for concurrent use, and may be backed by shared storage when
+// running multiple instances of a service provider
+type ReplayCache interface {
+	// CheckAndStore atomically checks whether id has already been
+	// stored, and stores it if it has not. The id needs to be
+	// remembered until expires, after which it may be forgotten.
+	// seen is true if id was already present
+	CheckAndStore(id string, expires time.Time) (seen bool, err error)
+}
+
+// sweepInterval is how often MemoryReplayCache evicts expired entries
+const sweepInterval = time.Minute
+
+// MemoryReplayCache is a ReplayCache that keeps the IDs in memory.
+// Expired entries are evicted periodically
+type MemoryReplayCache struct {
+	// Now returns the current time. If nil, time.Now is used
+	Now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryReplayCache creates an empty MemoryReplayCache
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{
+		entries: make(map[string]time.Time),
+	}
+}
+
+func (c *MemoryReplayCache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+func (c *MemoryReplayCache) CheckAndStore(id string, expires time.Time) (bool, error) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]time.Time)
+	}
+
+	if now.Sub(c.lastSweep) >= sweepInterval {
+		c.sweep(now)
+	}
+
+	if exp, ok := c.entries[id]; ok && now.Before(exp) {
+		return true, nil
+	}
+	c.entries[id] = expires
+	return false, nil
+}
+
+// Len returns the number of IDs currently stored
+func (c *MemoryReplayCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// sweep must be called with the lock held
+func (c *MemoryReplayCache) sweep(now time.Time) {
+	for id, exp := range c.entries {
+		if !now.Before(exp) {
+			delete(c.entries, id)
+		}
+	}
+	c.lastSweep = now
+}
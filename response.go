@@ -1,7 +1,14 @@
 package saml
 
 import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"strings"
+
 	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
 	"github.com/lestrrat/go-pdebug"
 	"github.com/lestrrat/go-saml/ns"
 	"github.com/lestrrat/go-xmlsec/crypto"
@@ -34,16 +41,10 @@ func (res Response) MakeXMLNode(d types.Document) (types.Node, error) {
 	if v := res.InResponseTo; v != "" {
 		resxml.SetAttribute("InResponseTo", v)
 	}
-	st, err := d.CreateElement("samlp:Status")
-	if err != nil {
-		return nil, err
-	}
-	stc, err := d.CreateElement("samlp:StatusCode")
+	st, err := makeStatusXMLNode(d, res.Status, res.SubStatus)
 	if err != nil {
 		return nil, err
 	}
-	stc.SetAttribute("Value", res.Status.String())
-	st.AddChild(stc)
 	resxml.AddChild(st)
 
 	if assertion := res.Assertion; assertion != nil {
@@ -53,6 +54,13 @@ func (res Response) MakeXMLNode(d types.Document) (types.Node, error) {
 		}
 
 		resxml.AddChild(axml)
+	} else if ea := res.EncryptedAssertion; ea != nil {
+		eaxml, err := ea.makeXMLNode(d, "EncryptedAssertion")
+		if err != nil {
+			return nil, err
+		}
+
+		resxml.AddChild(eaxml)
 	}
 
 	resxml.MakePersistent()
@@ -60,11 +68,182 @@ func (res Response) MakeXMLNode(d types.Document) (types.Node, error) {
 	return resxml, nil
 }
 
+// Encode takes the Response and generates the XML string.
+// If the key value is not nil, it will attempt to generate a signature
+// using that specified key and the default algorithms. The key is
+// freed by signing, as described for Signer.
+// Use EncodePost to get the payload sent using the HTTP-POST binding
 func (res Response) Encode(key *crypto.Key) ([]byte, error) {
+	return res.EncodeWithSigner(keySigner(key))
+}
+
+// EncodeWithSigner is the same as Encode, but allows the signature and
+// digest algorithms to be configured via the Signer
+func (res Response) EncodeWithSigner(signer *Signer) ([]byte, error) {
 	if pdebug.Enabled {
 		g := pdebug.IPrintf("START Response.Encode")
 		defer g.IRelease("END Response.Encode")
 	}
 
-	return encode(res, key, false)
+	xmlstr, err := encodeXML(res, signer)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(xmlstr), nil
+}
+
+// EncodePost takes the Response, generates the XML string, signs it if
+// signer is not nil, and base64 encodes it, as required by the
+// HTTP-POST binding. The result can be read back using DecodeResponse
+func (res Response) EncodePost(signer *Signer) ([]byte, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Response.EncodePost")
+		defer g.IRelease("END Response.EncodePost")
+	}
+
+	return encode(res, signer, false)
+}
+
+// DecodeResponseString takes in a string, decodes it from base64,
+// and then parses the resulting XML.
+// The signature is not verified. To do so, decode the payload using
+// DecodePostRequest, and pass the XML to Verifier.VerifyResponse
+func DecodeResponseString(s string) (*Response, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.DecodeResponseString '%.30s...' (%d bytes)", s, len(s))
+		defer g.IRelease("END saml.DecodeResponseString")
+	}
+	return decodeResponse(strings.NewReader(s))
+}
+
+// DecodeResponse takes in a byte buffer, decodes it from base64,
+// and then parses the resulting XML. Responses are typically sent
+// via the HTTP-POST binding, so unlike AuthnRequests they are not
+// deflated.
+// The signature is not verified. To do so, decode the payload using
+// DecodePostRequest, and pass the XML to Verifier.VerifyResponse
+func DecodeResponse(b []byte) (*Response, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START saml.DecodeResponse '%.30s...' (%d bytes)", b, len(b))
+		defer g.IRelease("END saml.DecodeResponse")
+	}
+	return decodeResponse(bytes.NewReader(b))
+}
+
+func decodeResponse(in io.Reader) (*Response, error) {
+	xmlbytes, err := decode(in, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseResponse(xmlbytes)
+}
+
+func ParseResponse(src []byte) (*Response, error) {
+	doc, err := ParseXML(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return constructResponse(doc)
+}
+
+func ParseResponseString(src string) (*Response, error) {
+	doc, err := ParseXMLString(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return constructResponse(doc)
+}
+
+func constructResponse(doc types.Document) (*Response, error) {
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return nil, errors.New("failed to fetch document element: " + err.Error())
+	}
+
+	res := &Response{}
+	if err := res.PopulateFromXML(root); err != nil {
+		return nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return res, nil
+}
+
+func (res *Response) PopulateFromXML(n types.Node) error {
+	if err := res.Message.PopulateFromXML(n); err != nil {
+		return err
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	res.InResponseTo = xpath.String(xpc.Find("@InResponseTo"))
+	res.Status, res.SubStatus, err = parseStatus(xpc)
+	if err != nil {
+		return err
+	}
+
+	if node := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("Assertion"))).First(); node != nil {
+		a := &Assertion{}
+		if err := a.PopulateFromXML(node); err != nil {
+			return err
+		}
+		res.Assertion = a
+	}
+
+	if node := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("EncryptedAssertion"))).First(); node != nil {
+		ea := &EncryptedElement{}
+		if err := ea.PopulateFromXML(node); err != nil {
+			return err
+		}
+		res.EncryptedAssertion = ea
+	}
+
+	return nil
+}
+
+// EncryptAssertion encrypts the assertion for the recipient described
+// by enc, and replaces Assertion with EncryptedAssertion. The assertion
+// is not signed before it is encrypted, so the enclosing Response must
+// be signed for the recipient to be able to trust the assertion
+func (res *Response) EncryptAssertion(enc *Encrypter) error {
+	if res.Assertion == nil {
+		return errors.New("no assertion to encrypt")
+	}
+
+	xmlstr, err := res.Assertion.Serialize()
+	if err != nil {
+		return err
+	}
+
+	ea, err := enc.Encrypt([]byte(xmlstr))
+	if err != nil {
+		return err
+	}
+	res.Assertion = nil
+	res.EncryptedAssertion = ea
+	return nil
+}
+
+// DecryptAssertion decrypts EncryptedAssertion using key, and replaces
+// it with the parsed Assertion. No signature verification is performed
+// on the decrypted assertion. Use Verifier.VerifyResponse with a
+// DecryptionKey for that
+func (res *Response) DecryptAssertion(key *rsa.PrivateKey) error {
+	if res.EncryptedAssertion == nil {
+		return errors.New("no encrypted assertion")
+	}
+
+	a := &Assertion{}
+	if err := decryptElement(*res.EncryptedAssertion, key, "Assertion", a); err != nil {
+		return err
+	}
+	res.Assertion = a
+	res.EncryptedAssertion = nil
+	return nil
 }
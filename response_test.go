@@ -0,0 +1,77 @@
+package saml
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseDecode(t *testing.T) {
+	res := NewResponse()
+	res.Issuer = "http://idp.example.com/metadata"
+	res.Destination = "http://sp.example.com/acs"
+	res.InResponseTo = "809707f0030a5d00620c9d9df97f627afe9dcc24"
+	res.Status = StatusSuccess
+	res.Assertion = NewAssertion()
+	res.Assertion.Issuer = "http://idp.example.com/metadata"
+	res.Assertion.IssueInstant = time.Now()
+
+	encoded, err := res.EncodePost(nil)
+	if !assert.NoError(t, err, "EncodePost succeeds") {
+		return
+	}
+
+	decoded, err := DecodeResponse(encoded)
+	if !assert.NoError(t, err, "DecodeResponse succeeds") {
+		return
+	}
+
+	if !assert.Equal(t, res.ID, decoded.ID, "ID matches") {
+		return
+	}
+	if !assert.Equal(t, res.IssueInstant.UTC().Format(TimeFormat), decoded.IssueInstant.Format(TimeFormat), "IssueInstant matches") {
+		return
+	}
+	if !assert.Equal(t, res.Issuer, decoded.Issuer, "Issuer matches") {
+		return
+	}
+	if !assert.Equal(t, res.Destination, decoded.Destination, "Destination matches") {
+		return
+	}
+	if !assert.Equal(t, res.InResponseTo, decoded.InResponseTo, "InResponseTo matches") {
+		return
+	}
+	if !assert.Equal(t, StatusSuccess, decoded.Status, "Status matches") {
+		return
+	}
+	if !assert.NotNil(t, decoded.Assertion, "Assertion is populated") {
+		return
+	}
+	if !assert.Equal(t, res.Assertion.ID, decoded.Assertion.ID, "Assertion.ID matches") {
+		return
+	}
+	if !assert.Equal(t, res.Assertion.Issuer, decoded.Assertion.Issuer, "Assertion.Issuer matches") {
+		return
+	}
+}
+
+func TestResponseEncode(t *testing.T) {
+	res := NewResponse()
+	res.Issuer = "http://idp.example.com/metadata"
+	res.Status = StatusSuccess
+
+	xmlbytes, err := res.Encode(nil)
+	if !assert.NoError(t, err, "Encode succeeds") {
+		return
+	}
+
+	// Encode returns the XML itself, not the HTTP-POST payload
+	parsed, err := ParseResponse(xmlbytes)
+	if !assert.NoError(t, err, "ParseResponse succeeds") {
+		return
+	}
+	if !assert.Equal(t, res.ID, parsed.ID, "ID matches") {
+		return
+	}
+}
@@ -0,0 +1,206 @@
+package saml
+
+import (
+	"errors"
+
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-xmlsec/crypto"
+	"github.com/lestrrat/go-xmlsec/dsig"
+)
+
+func (alg SignatureAlgorithm) String() string {
+	return string(alg)
+}
+
+func (alg DigestAlgorithm) String() string {
+	return string(alg)
+}
+
+// NewSigner creates a Signer that uses the default algorithms for key.
+// The Signer takes ownership of key
+func NewSigner(key *crypto.Key) *Signer {
+	return &Signer{Key: key}
+}
+
+// keySigner is used by the Encode methods that only take a key
+func keySigner(key *crypto.Key) *Signer {
+	if key == nil {
+		return nil
+	}
+	return NewSigner(key)
+}
+
+// signatureTransform returns the go-xmlsec transform for the configured
+// signature algorithm, after making sure that it can be used with the
+// key
+func (s Signer) signatureTransform() (dsig.TransformID, error) {
+	alg := s.SignatureAlgorithm
+	if alg == "" {
+		switch {
+		case s.Key.HasEcdsaKey() == nil:
+			alg = EcdsaSha256
+		case s.Key.HasDsaKey() == nil:
+			alg = DsaSha1
+		default:
+			alg = RsaSha256
+		}
+	}
+
+	var keycheck error
+	var transform dsig.TransformID
+	switch alg {
+	case RsaSha1, RsaSha256, RsaSha384, RsaSha512:
+		keycheck = s.Key.HasRsaKey()
+		switch alg {
+		case RsaSha1:
+			transform = dsig.RsaSha1
+		case RsaSha256:
+			transform = dsig.RsaSha256
+		case RsaSha384:
+			transform = dsig.RsaSha384
+		case RsaSha512:
+			transform = dsig.RsaSha512
+		}
+	case EcdsaSha256:
+		keycheck = s.Key.HasEcdsaKey()
+		transform = dsig.EcdsaSha256
+	case DsaSha1, DsaSha256:
+		keycheck = s.Key.HasDsaKey()
+		if alg == DsaSha1 {
+			transform = dsig.DsaSha1
+		} else {
+			transform = dsig.DsaSha256
+		}
+	default:
+		return transform, errors.New("unsupported signature algorithm: " + alg.String())
+	}
+
+	if keycheck != nil {
+		return transform, errors.New("key cannot be used with " + alg.String() + ": " + keycheck.Error())
+	}
+	return transform, nil
+}
+
+// digestTransform returns the go-xmlsec transform for the configured
+// digest algorithm
+func (s Signer) digestTransform() (transform dsig.TransformID, err error) {
+	switch s.DigestAlgorithm {
+	case Sha1:
+		transform = dsig.Sha1
+	case "", Sha256:
+		transform = dsig.Sha256
+	case Sha384:
+		transform = dsig.Sha384
+	case Sha512:
+		transform = dsig.Sha512
+	default:
+		err = errors.New("unsupported digest algorithm: " + s.DigestAlgorithm.String())
+	}
+	return
+}
+
+// sign adds an enveloped signature to the root element of the XML
+// document in xmlstr, and returns the signed document. The key is
+// handed over to go-xmlsec, which frees it, so it is cleared from the
+// Signer. It is also freed if signing fails before that
+func (s *Signer) sign(xmlstr string) (string, error) {
+	key := s.Key
+	if key == nil {
+		return "", errors.New("signer has no key (a Signer can only sign once)")
+	}
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			key.Free()
+		}
+	}()
+
+	sigalg, err := s.signatureTransform()
+	if err != nil {
+		return "", err
+	}
+	digestalg, err := s.digestTransform()
+	if err != nil {
+		return "", err
+	}
+	s.Key = nil
+
+	doc, err := ParseXMLString(xmlstr)
+	if err != nil {
+		return "", err
+	}
+	defer doc.Free()
+
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return "", err
+	}
+
+	// The reference points at the ID of the root element, which must be
+	// known to libxml2 for xmlsec to resolve it
+	if err := registerID(doc, root); err != nil {
+		return "", err
+	}
+	id, err := root.(types.Element).GetAttribute("ID")
+	if err != nil {
+		return "", err
+	}
+
+	// Create a new signature section.
+	sig, err := dsig.NewSignature(root, dsig.ExclC14N, sigalg, "")
+	if err != nil {
+		return "", err
+	}
+	if err := placeSignature(root); err != nil {
+		return "", err
+	}
+	if err := sig.AddReference(digestalg, "", "#"+id.Value(), ""); err != nil {
+		return "", err
+	}
+
+	if err := sig.AddTransform(dsig.Enveloped); err != nil {
+		return "", err
+	}
+
+	if key.HasRsaKey() == nil || key.HasDsaKey() == nil || key.HasEcdsaKey() == nil {
+		if err := sig.AddKeyValue(); err != nil {
+			return "", err
+		}
+	}
+
+	// If the key is setup using X509, add that node
+	if key.HasX509() == nil {
+		if err := sig.AddX509Data(); err != nil {
+			return "", err
+		}
+	}
+
+	if pdebug.Enabled {
+		pdebug.Printf("Signing using key %p", key)
+	}
+	handedOver = true
+	if err := sig.Sign(key); err != nil {
+		return "", err
+	}
+
+	return doc.Dump(false), nil
+}
+
+// SignedXML serializes msg, and signs it if signer is not nil. This is
+// used where messages are exchanged as plain XML, such as in artifact
+// resolution and the SOAP binding
+func SignedXML(msg ProtocolMessage, signer *Signer) ([]byte, error) {
+	xmlstr, err := msg.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	if signer != nil {
+		xmlstr, err = signer.sign(xmlstr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []byte(xmlstr), nil
+}
@@ -0,0 +1,172 @@
+package saml
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-xmlsec"
+	"github.com/lestrrat/go-xmlsec/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigner(t *testing.T) {
+	xmlsec.Init()
+	defer xmlsec.Shutdown()
+
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+
+	// A Signer frees its key once it has signed, so each one needs a
+	// freshly loaded key
+	loadKey := func() *crypto.Key {
+		key, err := crypto.LoadKeyFromRSAPrivateKey(privkey)
+		if !assert.NoError(t, err, "Load key from RSA private key succeeds") {
+			return nil
+		}
+		return key
+	}
+
+	ar := NewAuthnRequest()
+	ar.Issuer = "http://sp.example.com/metadata"
+	ar.ProtocolBinding = binding.HTTPPost
+	ar.AssertionConsumerServiceURL = "http://sp.example.com/acs"
+
+	for _, tc := range []struct {
+		sigalg SignatureAlgorithm
+		digest DigestAlgorithm
+	}{
+		{"", ""},
+		{RsaSha512, Sha512},
+		{RsaSha1, Sha1},
+	} {
+		key := loadKey()
+		if key == nil {
+			return
+		}
+		signer := &Signer{Key: key, SignatureAlgorithm: tc.sigalg, DigestAlgorithm: tc.digest}
+		encoded, err := ar.EncodeWithSigner(signer)
+		if !assert.NoError(t, err, "EncodeWithSigner succeeds") {
+			return
+		}
+
+		xmlbytes, err := decode(bytes.NewReader(encoded), true)
+		if !assert.NoError(t, err, "decode succeeds") {
+			return
+		}
+
+		sigalg, digest := tc.sigalg, tc.digest
+		if sigalg == "" {
+			sigalg, digest = RsaSha256, Sha256
+		}
+		if !assert.Contains(t, string(xmlbytes), `SignatureMethod Algorithm="`+sigalg.String()+`"`, "SignatureMethod matches") {
+			return
+		}
+		if !assert.Contains(t, string(xmlbytes), `DigestMethod Algorithm="`+digest.String()+`"`, "DigestMethod matches") {
+			return
+		}
+		if !assert.Contains(t, string(xmlbytes), `Reference URI="#`+ar.ID+`"`, "Reference points at the request ID") {
+			return
+		}
+
+		if !assert.Nil(t, signer.Key, "Signer gives up its key after signing") {
+			return
+		}
+		_, err = ar.EncodeWithSigner(signer)
+		if !assert.Error(t, err, "Signer cannot sign twice") {
+			return
+		}
+	}
+
+	key := loadKey()
+	if key == nil {
+		return
+	}
+	_, err = ar.EncodeWithSigner(&Signer{Key: key, SignatureAlgorithm: EcdsaSha256})
+	if !assert.Error(t, err, "ECDSA signature with an RSA key fails") {
+		return
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	xmlsec.Init()
+	defer xmlsec.Shutdown()
+
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	ecdsakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	makeDSAKey := func(size dsa.ParameterSizes) *dsa.PrivateKey {
+		privkey := &dsa.PrivateKey{}
+		if !assert.NoError(t, dsa.GenerateParameters(&privkey.Parameters, rand.Reader, size), "GenerateParameters succeeds") {
+			return nil
+		}
+		if !assert.NoError(t, dsa.GenerateKey(privkey, rand.Reader), "GenerateKey succeeds") {
+			return nil
+		}
+		return privkey
+	}
+	dsa1key := makeDSAKey(dsa.L1024N160)
+	dsa256key := makeDSAKey(dsa.L2048N256)
+	if dsa1key == nil || dsa256key == nil {
+		return
+	}
+
+	ar := NewAuthnRequest()
+	ar.Issuer = "http://sp.example.com/metadata"
+	ar.ProtocolBinding = binding.HTTPPost
+	ar.AssertionConsumerServiceURL = "http://sp.example.com/acs"
+
+	for _, tc := range []struct {
+		sigalg SignatureAlgorithm
+		load   func() (*crypto.Key, error)
+		pubkey gocrypto.PublicKey
+	}{
+		{RsaSha1, func() (*crypto.Key, error) { return crypto.LoadKeyFromRSAPrivateKey(rsakey) }, &rsakey.PublicKey},
+		{RsaSha256, func() (*crypto.Key, error) { return crypto.LoadKeyFromRSAPrivateKey(rsakey) }, &rsakey.PublicKey},
+		{RsaSha384, func() (*crypto.Key, error) { return crypto.LoadKeyFromRSAPrivateKey(rsakey) }, &rsakey.PublicKey},
+		{RsaSha512, func() (*crypto.Key, error) { return crypto.LoadKeyFromRSAPrivateKey(rsakey) }, &rsakey.PublicKey},
+		{DsaSha1, func() (*crypto.Key, error) { return crypto.LoadKeyFromDSAPrivateKey(dsa1key) }, &dsa1key.PublicKey},
+		{DsaSha256, func() (*crypto.Key, error) { return crypto.LoadKeyFromDSAPrivateKey(dsa256key) }, &dsa256key.PublicKey},
+		{EcdsaSha256, func() (*crypto.Key, error) { return crypto.LoadKeyFromECDSAPrivateKey(ecdsakey) }, &ecdsakey.PublicKey},
+	} {
+		key, err := tc.load()
+		if !assert.NoError(t, err, "Load key succeeds (%s)", tc.sigalg) {
+			return
+		}
+
+		signed, err := SignedXML(ar, &Signer{Key: key, SignatureAlgorithm: tc.sigalg})
+		if !assert.NoError(t, err, "SignedXML succeeds (%s)", tc.sigalg) {
+			return
+		}
+
+		v := NewVerifier()
+		if _, err := v.AddPublicKey(tc.pubkey); !assert.NoError(t, err, "AddPublicKey succeeds (%s)", tc.sigalg) {
+			return
+		}
+		parsed, _, err := v.VerifyAuthnRequest(signed)
+		if !assert.NoError(t, err, "VerifyAuthnRequest succeeds (%s)", tc.sigalg) {
+			return
+		}
+		if !assert.Equal(t, ar.ID, parsed.ID, "ID matches (%s)", tc.sigalg) {
+			return
+		}
+
+		tampered := bytes.Replace(signed, []byte("http://sp.example.com/acs"), []byte("http://evil.example.com/acs"), 1)
+		if _, _, err := v.VerifyAuthnRequest(tampered); !assert.Error(t, err, "VerifyAuthnRequest fails for tampered message (%s)", tc.sigalg) {
+			return
+		}
+	}
+}
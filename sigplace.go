@@ -0,0 +1,75 @@
+package saml
+
+/*
+#cgo pkg-config: libxml-2.0
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+#include <libxml/tree.h>
+
+static int saml_is_element(xmlNodePtr n, const char *ns, const char *name) {
+	return n->type == XML_ELEMENT_NODE &&
+		n->ns != NULL &&
+		strcmp((const char *) n->ns->href, ns) == 0 &&
+		strcmp((const char *) n->name, name) == 0;
+}
+
+// saml_place_signature moves the last ds:Signature child of root to
+// directly after its saml:Issuer, or in front of all other child
+// elements if there is no Issuer. Returns -1 if there is no signature
+static int saml_place_signature(uintptr_t rootptr, const char *dsns, const char *samlns) {
+	xmlNodePtr root = (xmlNodePtr) rootptr;
+	xmlNodePtr sig = NULL;
+	xmlNodePtr first = NULL;
+	xmlNodePtr n;
+
+	for (n = root->children; n != NULL; n = n->next) {
+		if (n->type != XML_ELEMENT_NODE) {
+			continue;
+		}
+		if (first == NULL) {
+			first = n;
+		}
+		if (saml_is_element(n, dsns, "Signature")) {
+			sig = n;
+		}
+	}
+	if (sig == NULL) {
+		return -1;
+	}
+
+	if (saml_is_element(first, samlns, "Issuer")) {
+		if (first != sig && first->next != sig) {
+			xmlAddNextSibling(first, sig);
+		}
+	} else if (first != sig) {
+		xmlAddPrevSibling(first, sig);
+	}
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-saml/ns"
+)
+
+// placeSignature moves the signature that was just appended to root to
+// where the SAML schemas expect it, right after the saml:Issuer. This
+// also makes it the first signature in the document when root carries
+// other signed messages, such as the Response in an ArtifactResponse
+func placeSignature(root types.Node) error {
+	dsns := C.CString(ns.XMLDSignature.URI)
+	defer C.free(unsafe.Pointer(dsns))
+	samlns := C.CString(ns.SAML.URI)
+	defer C.free(unsafe.Pointer(samlns))
+
+	if C.saml_place_signature(C.uintptr_t(root.Pointer()), dsns, samlns) != 0 {
+		return errors.New("signature not found")
+	}
+	return nil
+}
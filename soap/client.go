@@ -0,0 +1,111 @@
+package soap
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+)
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Do posts env to the given URL, and returns the envelope sent back.
+// If the response is a fault, it is returned as the error
+func (c *Client) Do(url string, env *Envelope) (*Envelope, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START soap.Client.Do %s", url)
+		defer g.IRelease("END soap.Client.Do")
+	}
+
+	s, err := env.Serialize()
+	if err != nil {
+		return nil, errors.New("failed to serialize envelope: " + err.Error())
+	}
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(s))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("SOAPAction", `"`+SOAPAction+`"`)
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusInternalServerError:
+	default:
+		return nil, errors.New("unexpected status " + strconv.Itoa(res.StatusCode))
+	}
+
+	resenv, _, err := readEnvelope(res.Body)
+	if err != nil {
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.New("unexpected status " + strconv.Itoa(res.StatusCode))
+		}
+		return nil, err
+	}
+	if resenv.Fault != nil {
+		return nil, resenv.Fault
+	}
+	return resenv, nil
+}
+
+// Send signs msg if Key is set, posts it to ep, and returns the XML of
+// the message sent back
+func (c *Client) Send(ep saml.Endpoint, msg saml.ProtocolMessage) ([]byte, error) {
+	if v := ep.ProtocolBinding; v != "" && v != binding.SOAP {
+		return nil, errors.New("endpoint does not support the SOAP binding: " + v.String())
+	}
+
+	env, err := NewEnvelope(msg, c.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Do(ep.Location, env)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// SendLogoutRequest sends req to ep, and returns the LogoutResponse.
+// This allows Client to be used as an idp.LogoutSender
+func (c *Client) SendLogoutRequest(ep saml.Endpoint, req *saml.LogoutRequest) (*saml.LogoutResponse, error) {
+	src, err := c.Send(ep, req)
+	if err != nil {
+		return nil, err
+	}
+	return saml.ParseLogoutResponse(src)
+}
+
+// ResolveArtifact sends req to the ArtifactResolutionService ep, and
+// returns the ArtifactResponse
+func (c *Client) ResolveArtifact(ep saml.Endpoint, req *saml.ArtifactResolve) (*saml.ArtifactResponse, error) {
+	src, err := c.Send(ep, req)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := saml.ParseArtifactResponse(src)
+	if err != nil {
+		return nil, err
+	}
+	if res.InResponseTo != req.ID {
+		return nil, saml.ErrInResponseToMismatch
+	}
+	return res, nil
+}
@@ -0,0 +1,306 @@
+package soap
+
+import (
+	"crypto/rsa"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/lestrrat/go-libxml2/dom"
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/ns"
+	"github.com/lestrrat/go-xmlsec/crypto"
+)
+
+// NewEnvelope wraps msg in an envelope. If key is not nil, msg is
+// signed with it
+func NewEnvelope(msg saml.ProtocolMessage, key *rsa.PrivateKey) (*Envelope, error) {
+	var signer *saml.Signer
+	if key != nil {
+		k, err := crypto.LoadKeyFromRSAPrivateKey(key)
+		if err != nil {
+			return nil, errors.New("failed to load key: " + err.Error())
+		}
+		signer = saml.NewSigner(k)
+	}
+
+	body, err := saml.SignedXML(msg, signer)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{Body: body}, nil
+}
+
+// NewFault creates a fault with the given code and description
+func NewFault(code, s string) *Fault {
+	return &Fault{Code: code, String: s}
+}
+
+func (f *Fault) Error() string {
+	return "soap fault: " + f.Code + ": " + f.String
+}
+
+func (f Fault) MakeXMLNode(d types.Document) (types.Node, error) {
+	fxml, err := d.CreateElementNS(ns.SOAPEnvelope.URI, ns.SOAPEnvelope.AddPrefix("Fault"))
+	if err != nil {
+		return nil, err
+	}
+
+	codexml, err := d.CreateElement("faultcode")
+	if err != nil {
+		return nil, err
+	}
+	codexml.AppendText(ns.SOAPEnvelope.AddPrefix(f.Code))
+	fxml.AddChild(codexml)
+
+	strxml, err := d.CreateElement("faultstring")
+	if err != nil {
+		return nil, err
+	}
+	strxml.AppendText(f.String)
+	fxml.AddChild(strxml)
+
+	if v := f.Actor; v != "" {
+		actorxml, err := d.CreateElement("faultactor")
+		if err != nil {
+			return nil, err
+		}
+		actorxml.AppendText(v)
+		fxml.AddChild(actorxml)
+	}
+	return fxml, nil
+}
+
+// importXML parses src, and appends its document element to parent
+func importXML(d types.Document, parent types.Node, src []byte) error {
+	doc, err := saml.ParseXML(src)
+	if err != nil {
+		return err
+	}
+	defer doc.Free()
+
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return errors.New("failed to fetch document element: " + err.Error())
+	}
+	n, err := d.ImportNode(root, true)
+	if err != nil {
+		return err
+	}
+	return parent.AddChild(n)
+}
+
+func (e Envelope) MakeXMLNode(d types.Document) (types.Node, error) {
+	envxml, err := d.CreateElementNS(ns.SOAPEnvelope.URI, ns.SOAPEnvelope.AddPrefix("Envelope"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(e.Header) > 0 {
+		hxml, err := d.CreateElementNS(ns.SOAPEnvelope.URI, ns.SOAPEnvelope.AddPrefix("Header"))
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range e.Header {
+			if err := importXML(d, hxml, h); err != nil {
+				return nil, errors.New("failed to add header: " + err.Error())
+			}
+		}
+		envxml.AddChild(hxml)
+	}
+
+	bxml, err := d.CreateElementNS(ns.SOAPEnvelope.URI, ns.SOAPEnvelope.AddPrefix("Body"))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case e.Fault != nil:
+		fxml, err := e.Fault.MakeXMLNode(d)
+		if err != nil {
+			return nil, err
+		}
+		bxml.AddChild(fxml)
+	case len(e.Body) > 0:
+		if err := importXML(d, bxml, e.Body); err != nil {
+			return nil, errors.New("failed to add body: " + err.Error())
+		}
+	default:
+		return nil, errors.New("envelope has no body")
+	}
+	envxml.AddChild(bxml)
+
+	return envxml, nil
+}
+
+func (e Envelope) Serialize() (string, error) {
+	d := dom.CreateDocument()
+	defer d.Free()
+	root, err := e.MakeXMLNode(d)
+	if err != nil {
+		return "", err
+	}
+	if err := d.SetDocumentElement(root); err != nil {
+		return "", err
+	}
+	return dom.C14NSerialize{}.Serialize(d)
+}
+
+// ParseEnvelope parses a SOAP 1.1 envelope. If the body holds a fault,
+// it is stored in Fault
+func ParseEnvelope(src []byte) (*Envelope, error) {
+	env, _, err := parseEnvelope(src)
+	return env, err
+}
+
+// envelopeInfo holds what a Handler needs to know about an envelope,
+// besides its contents
+type envelopeInfo struct {
+	// name is the name of the SAMLP element in the body, if any
+	name string
+	// mustUnderstand holds the header blocks marked mustUnderstand="1"
+	mustUnderstand []headerName
+}
+
+// headerName identifies a header block by its namespace URI and local
+// name
+type headerName struct {
+	namespace string
+	name      string
+}
+
+// isMustUnderstand reports whether the header block n is marked with
+// mustUnderstand="1"
+func isMustUnderstand(n types.Node) (bool, error) {
+	xpc, err := xpath.NewContext(n)
+	if err != nil {
+		return false, errors.New("failed to create xpath context: " + err.Error())
+	}
+	defer xpc.Free()
+	if err := xpc.RegisterNS(ns.SOAPEnvelope.Prefix, ns.SOAPEnvelope.URI); err != nil {
+		return false, errors.New("failed to register namespace for xpath context: " + err.Error())
+	}
+
+	switch strings.TrimSpace(xpath.String(xpc.Find("@" + ns.SOAPEnvelope.AddPrefix("mustUnderstand")))) {
+	case "1", "true":
+		return true, nil
+	}
+	return false, nil
+}
+
+// parseEnvelope parses src, and also returns the information needed to
+// dispatch it
+func parseEnvelope(src []byte) (*Envelope, *envelopeInfo, error) {
+	doc, err := saml.ParseXML(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer doc.Free()
+
+	root, err := doc.DocumentElement()
+	if err != nil {
+		return nil, nil, errors.New("failed to fetch document element: " + err.Error())
+	}
+	if root.NamespaceURI() != ns.SOAPEnvelope.URI || root.LocalName() != "Envelope" {
+		return nil, nil, errors.New("document element is not a SOAP 1.1 Envelope")
+	}
+
+	xpc, err := xpath.NewContext(root)
+	if err != nil {
+		return nil, nil, errors.New("failed to create xpath context: " + err.Error())
+	}
+	defer xpc.Free()
+	if err := xpc.RegisterNS(ns.SOAPEnvelope.Prefix, ns.SOAPEnvelope.URI); err != nil {
+		return nil, nil, errors.New("failed to register namespace for xpath context: " + err.Error())
+	}
+
+	env := &Envelope{}
+	info := &envelopeInfo{}
+	for _, h := range xpath.NodeList(xpc.Find(ns.SOAPEnvelope.AddPrefix("Header") + "/*")) {
+		s, err := saml.StandaloneXML(h)
+		if err != nil {
+			return nil, nil, errors.New("failed to extract header: " + err.Error())
+		}
+		env.Header = append(env.Header, []byte(s))
+
+		mu, err := isMustUnderstand(h)
+		if err != nil {
+			return nil, nil, err
+		}
+		if mu {
+			info.mustUnderstand = append(info.mustUnderstand, headerName{namespace: h.NamespaceURI(), name: h.LocalName()})
+		}
+	}
+
+	body := xpath.NodeList(xpc.Find(ns.SOAPEnvelope.AddPrefix("Body") + "/*"))
+	if len(body) != 1 {
+		return nil, nil, errors.New("SOAP Body must contain exactly one element")
+	}
+
+	n := body[0]
+	if n.NamespaceURI() == ns.SOAPEnvelope.URI && n.LocalName() == "Fault" {
+		f := ns.SOAPEnvelope.AddPrefix("Body") + "/" + ns.SOAPEnvelope.AddPrefix("Fault") + "/"
+		code := xpath.String(xpc.Find(f + "faultcode"))
+		if i := strings.IndexByte(code, ':'); i >= 0 {
+			code = code[i+1:]
+		}
+		env.Fault = &Fault{
+			Code:   strings.TrimSpace(code),
+			String: xpath.String(xpc.Find(f + "faultstring")),
+			Actor:  xpath.String(xpc.Find(f + "faultactor")),
+		}
+		return env, info, nil
+	}
+
+	s, err := saml.StandaloneXML(n)
+	if err != nil {
+		return nil, nil, errors.New("failed to extract body: " + err.Error())
+	}
+	env.Body = []byte(s)
+
+	if n.NamespaceURI() == ns.SAMLP.URI {
+		info.name = n.LocalName()
+	}
+	return env, info, nil
+}
+
+// ReadEnvelope reads and parses the envelope in r, refusing documents
+// larger than saml.MaxDecodedSize
+func ReadEnvelope(r io.Reader) (*Envelope, error) {
+	env, _, err := readEnvelope(r)
+	return env, err
+}
+
+// readEnvelope reads and parses the envelope in r, refusing documents
+// larger than saml.MaxDecodedSize
+func readEnvelope(r io.Reader) (*Envelope, *envelopeInfo, error) {
+	src, err := ioutil.ReadAll(io.LimitReader(r, saml.MaxDecodedSize+1))
+	if err != nil {
+		return nil, nil, errors.New("failed to read message: " + err.Error())
+	}
+	if int64(len(src)) > saml.MaxDecodedSize {
+		return nil, nil, saml.ErrDecodedTooLarge{Limit: saml.MaxDecodedSize, Size: int64(len(src))}
+	}
+	return parseEnvelope(src)
+}
+
+// WriteEnvelope sends env as the response to a SOAP request. Envelopes
+// carrying a fault are sent with status 500, as required by SOAP 1.1
+func WriteEnvelope(w http.ResponseWriter, env *Envelope) error {
+	s, err := env.Serialize()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if env.Fault != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_, err = io.WriteString(w, s)
+	return err
+}
@@ -0,0 +1,108 @@
+package soap
+
+import (
+	"net/http"
+
+	"github.com/lestrrat/go-pdebug"
+)
+
+// NewHandler creates a Handler without any processors
+func NewHandler() *Handler {
+	return &Handler{
+		processors: make(map[string]Processor),
+	}
+}
+
+// Handle registers p as the processor of SAML requests whose element
+// has the given name, such as "ArtifactResolve"
+func (h *Handler) Handle(name string, p Processor) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.processors == nil {
+		h.processors = make(map[string]Processor)
+	}
+	h.processors[name] = p
+}
+
+// HandleFunc registers f as the processor of SAML requests whose
+// element has the given name
+func (h *Handler) HandleFunc(name string, f func(*http.Request, *Envelope) (*Envelope, error)) {
+	h.Handle(name, ProcessorFunc(f))
+}
+
+func (h *Handler) processor(name string) Processor {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.processors[name]
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START soap.Handler.ServeHTTP")
+		defer g.IRelease("END soap.Handler.ServeHTTP")
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, info, err := readEnvelope(r.Body)
+	if err != nil {
+		h.fault(w, r, err, NewFault(FaultClient, "invalid SOAP message"))
+		return
+	}
+	if req.Fault != nil {
+		h.fault(w, r, req.Fault, NewFault(FaultClient, "unexpected fault"))
+		return
+	}
+
+	p := h.processor(info.name)
+	if p == nil {
+		h.fault(w, r, nil, NewFault(FaultClient, "unsupported message"))
+		return
+	}
+
+	// Header blocks that must be understood cannot be ignored
+	hp, _ := p.(HeaderProcessor)
+	for _, hn := range info.mustUnderstand {
+		if hp == nil || !hp.UnderstandsHeader(hn.namespace, hn.name) {
+			h.fault(w, r, nil, NewFault(FaultMustUnderstand, "header "+hn.name+" was not understood"))
+			return
+		}
+	}
+
+	res, err := p.ProcessSOAP(r, req)
+	if err != nil {
+		f, ok := err.(*Fault)
+		if !ok {
+			f = NewFault(FaultServer, "failed to process message")
+		}
+		h.fault(w, r, err, f)
+		return
+	}
+
+	if err := WriteEnvelope(w, res); err != nil {
+		h.fault(w, r, err, NewFault(FaultServer, "failed to process message"))
+	}
+}
+
+// fault reports err, and sends f to the requester
+func (h *Handler) fault(w http.ResponseWriter, r *http.Request, err error, f *Fault) {
+	if err == nil {
+		err = f
+	}
+	if pdebug.Enabled {
+		pdebug.Printf("soap.Handler: %s", err)
+	}
+	if h.OnError != nil {
+		h.OnError(r, err)
+	}
+
+	if err := WriteEnvelope(w, &Envelope{Fault: f}); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
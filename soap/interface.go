@@ -0,0 +1,107 @@
+// Package soap implements the SAML SOAP binding, which is used to
+// exchange messages directly between SAML entities over the back
+// channel, such as for artifact resolution, attribute queries and
+// back-channel logout.
+package soap
+
+import (
+	"crypto/rsa"
+	"net/http"
+	"sync"
+)
+
+// ContentType is the media type of SOAP 1.1 messages
+const ContentType = "text/xml; charset=utf-8"
+
+// SOAPAction is the value of the SOAPAction header sent along with SAML
+// requests
+const SOAPAction = "http://www.oasis-open.org/committees/security"
+
+// Fault codes defined by SOAP 1.1
+const (
+	FaultVersionMismatch = "VersionMismatch"
+	FaultMustUnderstand  = "MustUnderstand"
+	FaultClient          = "Client"
+	FaultServer          = "Server"
+)
+
+// Envelope is a SOAP 1.1 envelope. SAML messages are carried as the
+// only element in the body, while profiles such as ECP add their own
+// header blocks
+type Envelope struct {
+	// Header holds the XML of each header block
+	Header [][]byte
+	// Body is the XML of the element in the body. It is empty if the
+	// envelope carries a Fault
+	Body []byte
+	// Fault is the fault carried in the body, if any
+	Fault *Fault
+}
+
+// Fault is a SOAP 1.1 fault. Faults are only used for errors in
+// processing the SOAP message itself: SAML errors are reported in the
+// status of a SAML response
+type Fault struct {
+	// Code is one of the Fault* constants, without the namespace prefix
+	Code   string
+	String string
+	Actor  string
+}
+
+// Processor handles the SAML requests of a given type received by a
+// Handler. ProcessSOAP returns the envelope to send back to the
+// requester, usually created with NewEnvelope. If a *Fault is returned
+// as the error, it is sent as is. Any other error results in a Server
+// fault
+type Processor interface {
+	ProcessSOAP(r *http.Request, req *Envelope) (*Envelope, error)
+}
+
+// ProcessorFunc is an adapter that allows ordinary functions to be
+// used as Processors
+type ProcessorFunc func(*http.Request, *Envelope) (*Envelope, error)
+
+func (f ProcessorFunc) ProcessSOAP(r *http.Request, req *Envelope) (*Envelope, error) {
+	return f(r, req)
+}
+
+// HeaderProcessor is implemented by Processors that process header
+// blocks. A Handler answers requests carrying a header block marked
+// with mustUnderstand="1" with a MustUnderstand fault, unless the
+// Processor is a HeaderProcessor that understands the block
+type HeaderProcessor interface {
+	Processor
+	// UnderstandsHeader reports whether the header block with the given
+	// namespace URI and local name is processed
+	UnderstandsHeader(namespace, name string) bool
+}
+
+// ErrorFunc is called when a Handler could not process a request,
+// before the fault is sent to the requester
+type ErrorFunc func(r *http.Request, err error)
+
+// Handler is an http.Handler that receives SAML requests using the SOAP
+// binding, and dispatches them to the Processor registered for the
+// name of the SAML protocol element in the body, such as
+// "ArtifactResolve" or "LogoutRequest". See HeaderProcessor for header
+// blocks marked with mustUnderstand
+type Handler struct {
+	// OnError, if set, is called when a request fails
+	OnError ErrorFunc
+
+	mu         sync.RWMutex
+	processors map[string]Processor
+}
+
+// Client sends SAML requests using the SOAP binding.
+// As permitted by the binding, responses are authenticated by the TLS
+// server certificate of the endpoint, and their signatures are not
+// checked. Messages carried within responses, such as the Response in
+// an ArtifactResponse, should still be verified before use
+type Client struct {
+	// HTTPClient is used to send requests. If nil, http.DefaultClient
+	// is used
+	HTTPClient *http.Client
+	// Key, if set, is used to sign outgoing requests
+	Key *rsa.PrivateKey
+}
@@ -0,0 +1,186 @@
+package soap_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-saml/soap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSOAP(t *testing.T) {
+	const (
+		idp = "https://idp.example.com/saml/metadata"
+		sp  = "https://sp.example.com/saml/metadata"
+	)
+
+	spkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+
+	store := saml.NewMemoryArtifactStore()
+	res := saml.NewResponse()
+	res.Issuer = idp
+	res.Status = saml.StatusSuccess
+	a, err := saml.IssueArtifact(store, idp, 0, sp, res, nil)
+	if !assert.NoError(t, err, "IssueArtifact succeeds") {
+		return
+	}
+
+	// Only requests signed by the SP are answered, so that the artifact
+	// is resolved for the SP rather than for whoever claims to be it
+	v := saml.NewVerifier()
+	if _, err := v.AddPublicKey(&spkey.PublicKey); !assert.NoError(t, err, "AddPublicKey succeeds") {
+		return
+	}
+
+	var errs []error
+	h := soap.NewHandler()
+	h.OnError = func(r *http.Request, err error) {
+		errs = append(errs, err)
+	}
+	h.HandleFunc("ArtifactResolve", func(r *http.Request, req *soap.Envelope) (*soap.Envelope, error) {
+		ar, _, err := v.VerifyArtifactResolve(req.Body)
+		if err != nil {
+			return nil, soap.NewFault(soap.FaultClient, "invalid ArtifactResolve")
+		}
+		return soap.NewEnvelope(saml.ResolveArtifact(store, ar, idp, sp), nil)
+	})
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	c := &soap.Client{HTTPClient: srv.Client(), Key: spkey}
+	ep := saml.Endpoint{ProtocolBinding: binding.SOAP, Location: srv.URL}
+
+	ar := saml.NewArtifactResolve(a)
+	ar.Issuer = sp
+	ares, err := c.ResolveArtifact(ep, ar)
+	if !assert.NoError(t, err, "ResolveArtifact succeeds") {
+		return
+	}
+	if !assert.Equal(t, saml.StatusSuccess, ares.Status, "status is Success") {
+		return
+	}
+	got, err := saml.ParseResponse(ares.Payload)
+	if !assert.NoError(t, err, "payload is a Response") {
+		return
+	}
+	if !assert.Equal(t, res.ID, got.ID, "payload is the issued Response") {
+		return
+	}
+
+	// Artifacts can only be resolved once
+	ar = saml.NewArtifactResolve(a)
+	ar.Issuer = sp
+	ares, err = c.ResolveArtifact(ep, ar)
+	if !assert.NoError(t, err, "ResolveArtifact succeeds") {
+		return
+	}
+	if !assert.Empty(t, ares.Payload, "no message is returned") {
+		return
+	}
+
+	// Messages without a processor result in a fault
+	lr := saml.NewLogoutRequest()
+	lr.Issuer = sp
+	lr.NameID = saml.NameID{Format: nameid.Transient, Value: "alice"}
+	_, err = c.SendLogoutRequest(ep, lr)
+	f, ok := err.(*soap.Fault)
+	if !assert.True(t, ok, "error is a Fault") {
+		return
+	}
+	if !assert.Equal(t, soap.FaultClient, f.Code, "fault code is Client") {
+		return
+	}
+	if !assert.Len(t, errs, 1, "OnError is called") {
+		return
+	}
+
+	// Unsigned requests are rejected, whatever their Issuer says
+	a, err = saml.IssueArtifact(store, idp, 0, sp, res, nil)
+	if !assert.NoError(t, err, "IssueArtifact succeeds") {
+		return
+	}
+	ar = saml.NewArtifactResolve(a)
+	ar.Issuer = sp
+	_, err = (&soap.Client{HTTPClient: srv.Client()}).ResolveArtifact(ep, ar)
+	if _, ok := err.(*soap.Fault); !assert.True(t, ok, "error is a Fault") {
+		return
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !assert.Equal(t, http.StatusMethodNotAllowed, w.Code, "GET is rejected") {
+		return
+	}
+}
+
+// headerProcessor answers every request with an empty Response, and
+// understands the header blocks in the urn:example namespace
+type headerProcessor struct{}
+
+func (headerProcessor) ProcessSOAP(r *http.Request, req *soap.Envelope) (*soap.Envelope, error) {
+	return soap.NewEnvelope(saml.NewResponse(), nil)
+}
+
+func (headerProcessor) UnderstandsHeader(namespace, name string) bool {
+	return namespace == "urn:example"
+}
+
+func TestMustUnderstand(t *testing.T) {
+	h := soap.NewHandler()
+	h.HandleFunc("ArtifactResolve", func(r *http.Request, req *soap.Envelope) (*soap.Envelope, error) {
+		return soap.NewEnvelope(saml.NewResponse(), nil)
+	})
+	h.Handle("LogoutRequest", headerProcessor{})
+
+	post := func(name, mustUnderstand string) *soap.Envelope {
+		src := `<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/">` +
+			`<S:Header><ex:Block xmlns:ex="urn:example" S:mustUnderstand="` + mustUnderstand + `"/></S:Header>` +
+			`<S:Body><samlp:` + name + ` xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_1" Version="2.0"/></S:Body>` +
+			`</S:Envelope>`
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(src)))
+		env, err := soap.ReadEnvelope(w.Body)
+		if !assert.NoError(t, err, "ReadEnvelope succeeds") {
+			return nil
+		}
+		return env
+	}
+
+	env := post("ArtifactResolve", "1")
+	if env == nil {
+		return
+	}
+	if !assert.NotNil(t, env.Fault, "header that is not understood results in a fault") {
+		return
+	}
+	if !assert.Equal(t, soap.FaultMustUnderstand, env.Fault.Code, "fault code is MustUnderstand") {
+		return
+	}
+
+	env = post("ArtifactResolve", "0")
+	if env == nil {
+		return
+	}
+	if !assert.Nil(t, env.Fault, "optional header is ignored") {
+		return
+	}
+
+	env = post("LogoutRequest", "1")
+	if env == nil {
+		return
+	}
+	if !assert.Nil(t, env.Fault, "header understood by the processor is accepted") {
+		return
+	}
+}
@@ -0,0 +1,81 @@
+package sp
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+)
+
+// isArtifactMessage returns true if r carries an artifact sent using
+// the HTTP-Artifact binding, rather than a message sent using the
+// HTTP-POST binding
+func isArtifactMessage(r *http.Request) bool {
+	switch r.Method {
+	case "GET":
+		return true
+	case "POST":
+		return r.ParseForm() == nil && len(r.PostForm[saml.ParamSAMLart]) > 0
+	}
+	return false
+}
+
+// artifactResolutionEndpoint returns the IdP's ArtifactResolutionService
+// that resolves a
+func (sp *ServiceProvider) artifactResolutionEndpoint(a *saml.Artifact) (*saml.Endpoint, error) {
+	if !a.IssuedBy(sp.IdP.ID()) {
+		return nil, errors.New("artifact was not issued by the IdP")
+	}
+
+	for i, ep := range sp.IdP.ArtifactResolutionService {
+		if ep.ProtocolBinding == binding.SOAP && ep.Index == int(a.EndpointIndex) {
+			return &sp.IdP.ArtifactResolutionService[i].Endpoint, nil
+		}
+	}
+	return nil, errors.New("IdP has no ArtifactResolutionService with index " + strconv.Itoa(int(a.EndpointIndex)))
+}
+
+// resolveArtifact asks the IdP for the message that a refers to, over
+// BackChannel, and returns its XML. The ArtifactResponse must be signed
+// by the IdP
+func (sp *ServiceProvider) resolveArtifact(a *saml.Artifact) ([]byte, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START ServiceProvider.resolveArtifact")
+		defer g.IRelease("END ServiceProvider.resolveArtifact")
+	}
+
+	if sp.BackChannel == nil {
+		return nil, errors.New("BackChannel is not set")
+	}
+	ep, err := sp.artifactResolutionEndpoint(a)
+	if err != nil {
+		return nil, err
+	}
+
+	ar := saml.NewArtifactResolve(a)
+	ar.Issuer = sp.EntityID
+	ar.Destination = ep.Location
+
+	src, err := sp.BackChannel.Send(*ep, ar)
+	if err != nil {
+		return nil, err
+	}
+
+	res, _, err := saml.NewVerifier(sp.IdP.SigningCertificates()...).VerifyArtifactResponse(src)
+	if err != nil {
+		return nil, err
+	}
+	if res.InResponseTo != ar.ID {
+		return nil, saml.ErrInResponseToMismatch
+	}
+	if err := res.StatusError(); err != nil {
+		return nil, err
+	}
+	if len(res.Payload) == 0 {
+		return nil, saml.ErrUnknownArtifact
+	}
+	return res.Payload, nil
+}
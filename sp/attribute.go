@@ -0,0 +1,83 @@
+package sp
+
+import (
+	"errors"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/soap"
+)
+
+// attributeServiceEndpoint returns the AttributeService of the
+// attribute authority that uses the SOAP binding
+func (sp *ServiceProvider) attributeServiceEndpoint() (*saml.Endpoint, error) {
+	if sp.AttributeAuthority == nil {
+		return nil, errors.New("AttributeAuthority is not set")
+	}
+
+	for i, ep := range sp.AttributeAuthority.AttributeService {
+		if ep.ProtocolBinding == binding.SOAP {
+			return &sp.AttributeAuthority.AttributeService[i], nil
+		}
+	}
+	return nil, errors.New("attribute authority does not support the SOAP binding")
+}
+
+// QueryAttributes asks the AttributeAuthority for the attributes of the
+// user identified by nameID, which is usually the NameID of a Principal.
+// If no attributes are given, all attributes that the authority is
+// willing to release are returned. Values given for an attribute limit
+// the values that are returned. The query is signed using Key
+func (sp *ServiceProvider) QueryAttributes(nameID saml.NameID, attrs ...saml.Attribute) ([]saml.Attribute, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START ServiceProvider.QueryAttributes")
+		defer g.IRelease("END ServiceProvider.QueryAttributes")
+	}
+
+	ep, err := sp.attributeServiceEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	if sp.Key == nil {
+		return nil, errors.New("a key is required to sign requests")
+	}
+
+	q := saml.NewAttributeQuery()
+	q.Issuer = sp.EntityID
+	q.Destination = ep.Location
+	q.NameID = nameID
+	q.Attributes = attrs
+
+	c := soap.Client{HTTPClient: sp.HTTPClient, Key: sp.Key}
+	src, err := c.Send(*ep, q)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := saml.NewVerifier(sp.AttributeAuthority.SigningCertificates()...)
+	verifier.DecryptionKey = sp.Key
+	res, _, err := verifier.VerifyResponse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// Let the caller know why the authority declined to answer
+	if err := res.StatusError(); err != nil && res.InResponseTo == q.ID {
+		return nil, err
+	}
+
+	validator := saml.Validator{
+		EntityID:    sp.EntityID,
+		IdPEntityID: sp.AttributeAuthority.ID(),
+		ClockSkew:   sp.ClockSkew,
+	}
+	if err := validator.ValidateAttributeResponse(res, q); err != nil {
+		return nil, err
+	}
+
+	if res.Assertion == nil {
+		return nil, nil
+	}
+	return res.Assertion.AttributeStatement.Attributes, nil
+}
@@ -0,0 +1,167 @@
+package sp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxCookieSize is the size most browsers are willing to store for a
+// single cookie, including its name and attributes
+const maxCookieSize = 4096
+
+// CookieOptions describes the cookie used to keep track of sessions
+type CookieOptions struct {
+	// Name is the name of the cookie. If empty,
+	// DefaultSessionCookieName is used
+	Name   string
+	Domain string
+	// Path defaults to "/"
+	Path string
+	// Insecure allows the cookie to be sent over plain HTTP. It should
+	// only be used for testing
+	Insecure bool
+}
+
+func (o CookieOptions) name() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return DefaultSessionCookieName
+}
+
+func (o CookieOptions) cookie(value string, expires time.Time) *http.Cookie {
+	c := &http.Cookie{
+		Name:     o.name(),
+		Value:    value,
+		Domain:   o.Domain,
+		Path:     o.Path,
+		Expires:  expires,
+		Secure:   !o.Insecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	return c
+}
+
+func (o CookieOptions) set(w http.ResponseWriter, value string, expires time.Time) {
+	http.SetCookie(w, o.cookie(value, expires))
+}
+
+func (o CookieOptions) clear(w http.ResponseWriter) {
+	c := o.cookie("", time.Unix(0, 0))
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+}
+
+func (o CookieOptions) value(r *http.Request) (string, error) {
+	c, err := r.Cookie(o.name())
+	if err != nil || c.Value == "" {
+		return "", ErrNoSession
+	}
+	return c.Value, nil
+}
+
+// CookieSessionManager is a SessionManager that keeps the whole session
+// in a cookie. The cookie is encrypted and authenticated using AES-GCM,
+// so that clients can neither read nor modify it. As the cookie must
+// fit in 4KB, sessions carrying many attributes may not be storable
+type CookieSessionManager struct {
+	CookieOptions
+	// Now returns the current time. If nil, time.Now is used
+	Now func() time.Time
+
+	aead cipher.AEAD
+}
+
+// NewCookieSessionManager creates a CookieSessionManager using key,
+// which must be 16, 24 or 32 bytes long
+func NewCookieSessionManager(key []byte) (*CookieSessionManager, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &CookieSessionManager{aead: aead}, nil
+}
+
+func (m *CookieSessionManager) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+func (m *CookieSessionManager) CreateSession(w http.ResponseWriter, r *http.Request, s *Session) error {
+	plaintext, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	// The cookie name is authenticated as well, so that the value can
+	// not be moved to another cookie
+	sealed := m.aead.Seal(nonce, nonce, plaintext, []byte(m.name()))
+	value := base64.RawURLEncoding.EncodeToString(sealed)
+
+	c := m.cookie(value, s.ExpiresAt)
+	if len(c.String()) > maxCookieSize {
+		return errors.New("session is too large to be stored in a cookie")
+	}
+	http.SetCookie(w, c)
+	return nil
+}
+
+func (m *CookieSessionManager) GetSession(r *http.Request) (*Session, error) {
+	value, err := m.value(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidSession
+	}
+	n := m.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, ErrInvalidSession
+	}
+	plaintext, err := m.aead.Open(nil, sealed[:n], sealed[n:], []byte(m.name()))
+	if err != nil {
+		return nil, ErrInvalidSession
+	}
+
+	s := &Session{}
+	if err := json.Unmarshal(plaintext, s); err != nil {
+		return nil, ErrInvalidSession
+	}
+
+	if expired(s, m.now()) {
+		return nil, ErrNoSession
+	}
+	return s, nil
+}
+
+// DeleteSession removes the session cookie. As the session is not
+// recorded anywhere else, a copy of the cookie remains valid until it
+// expires
+func (m *CookieSessionManager) DeleteSession(w http.ResponseWriter, r *http.Request) error {
+	m.clear(w)
+	return nil
+}
@@ -0,0 +1,89 @@
+package sp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/ecp"
+	"github.com/lestrrat/go-saml/soap"
+)
+
+// ecpEndpoint returns the IdP's SingleSignOnService for ECP clients
+func (sp *ServiceProvider) ecpEndpoint() (*saml.Endpoint, error) {
+	for i, ep := range sp.IdP.SingleSignOnService {
+		if ep.ProtocolBinding == binding.SOAP {
+			return &sp.IdP.SingleSignOnService[i], nil
+		}
+	}
+	return nil, errors.New("IdP does not support the ECP profile")
+}
+
+// loginECP answers an ECP client with an AuthnRequest wrapped in a PAOS
+// envelope, asking for the response to be relayed to the ACS
+func (sp *ServiceProvider) loginECP(w http.ResponseWriter, r *http.Request, relayState string) {
+	ep, err := sp.ecpEndpoint()
+	if err != nil {
+		sp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	ar := saml.NewAuthnRequest()
+	ar.Issuer = sp.EntityID
+	ar.Destination = ep.Location
+	ar.ProtocolBinding = binding.PAOS
+	ar.AssertionConsumerServiceURL = sp.ACSURL
+
+	if err := sp.tracker().Track(ar, sp.IdP.ID(), relayState); err != nil {
+		sp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	key := sp.Key
+	if !sp.SignRequests && !sp.IdP.WantAuthnRequestsSigned {
+		key = nil
+	} else if key == nil {
+		sp.error(w, r, http.StatusInternalServerError, errors.New("a key is required to sign requests"))
+		return
+	}
+
+	env, err := ecp.NewRequestEnvelope(ar, relayState, key)
+	if err != nil {
+		sp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s, err := env.Serialize()
+	if err != nil {
+		sp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", ecp.ContentType)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Pragma", "no-cache")
+	io.WriteString(w, s)
+}
+
+// readECPResponse extracts the Response relayed by an ECP client using
+// the PAOS binding, along with the RelayState
+func readECPResponse(r *http.Request) ([]byte, string, error) {
+	if r.Method != "POST" {
+		return nil, "", errors.New("unsupported method " + r.Method)
+	}
+
+	env, err := soap.ReadEnvelope(r.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if env.Fault != nil {
+		return nil, "", env.Fault
+	}
+
+	h, err := ecp.ParseHeaders(env)
+	if err != nil {
+		return nil, "", err
+	}
+	return env.Body, h.RelayState, nil
+}
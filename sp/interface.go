@@ -0,0 +1,130 @@
+package sp
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/md"
+)
+
+// Default paths of the routes served by ServiceProvider
+const (
+	DefaultLoginPath    = "/saml/login"
+	DefaultMetadataPath = "/saml/metadata"
+)
+
+// Principal is the authenticated user, as described by the assertion
+// received from the IdP
+type Principal struct {
+	NameID       saml.NameID
+	SessionIndex string
+	IdPEntityID  string
+	Attributes   []saml.Attribute
+	// RelayState is the value that was passed to the login route, or
+	// that was sent by the IdP for unsolicited responses
+	RelayState string
+	// Assertion is the assertion the principal was taken from
+	Assertion *saml.Assertion
+}
+
+// LoginFunc is called when a user has been successfully authenticated.
+// It is responsible for writing the response, usually by establishing
+// a session and redirecting the user
+type LoginFunc func(w http.ResponseWriter, r *http.Request, p *Principal)
+
+// MessageSender sends a message to an endpoint of the IdP over a back
+// channel, such as the SOAP binding, and returns the XML of the message
+// that the IdP sent back. The message has not been signed yet
+type MessageSender interface {
+	Send(ep saml.Endpoint, msg saml.ProtocolMessage) ([]byte, error)
+}
+
+// ErrorFunc is called when the login could not be initiated, or the
+// response from the IdP was rejected
+type ErrorFunc func(w http.ResponseWriter, r *http.Request, err error)
+
+// ServiceProvider is an http.Handler implementing a SAML service
+// provider that uses the Web Browser SSO profile with a single IdP.
+// It serves three routes: LoginPath initiates login by sending an
+// AuthnRequest to the IdP (the RelayState query parameter is passed
+// through), the path of ACSURL is the AssertionConsumerService which
+// accepts responses using the HTTP-POST or HTTP-Artifact binding, and
+// MetadataPath serves the metadata describing this service provider.
+// Clients that advertise support for the ECP profile are sent the
+// AuthnRequest directly instead of being redirected to the IdP, and
+// relay the response to the ACS using the PAOS binding.
+type ServiceProvider struct {
+	// EntityID is the entity ID of this service provider
+	EntityID string
+	// ACSURL is the absolute URL of the AssertionConsumerService
+	ACSURL string
+	// LoginPath is the path of the login route. If empty,
+	// DefaultLoginPath is used
+	LoginPath string
+	// MetadataPath is the path of the metadata route. If empty,
+	// DefaultMetadataPath is used
+	MetadataPath string
+
+	// Key is used to sign requests and to decrypt assertions
+	Key *rsa.PrivateKey
+	// Certificate is the certificate for Key, published in metadata
+	Certificate *x509.Certificate
+
+	// IdP describes the identity provider
+	IdP *md.IDPDescriptor
+	// Binding is the binding used to send AuthnRequests to the IdP. If
+	// empty, HTTP-Redirect is used. If the IdP does not support it,
+	// any other supported binding is used
+	Binding binding.Protocol
+	// ResponseBinding is the binding the IdP is asked to send responses
+	// with, either HTTP-POST or HTTP-Artifact. If empty, HTTP-POST is
+	// used
+	ResponseBinding binding.Protocol
+	// BackChannel sends ArtifactResolve requests to the IdP, signing
+	// them with the key of this service provider, such as a *soap.Client
+	// with Key set. It is required if ResponseBinding is HTTP-Artifact
+	BackChannel MessageSender
+	// SignRequests forces AuthnRequests to be signed. Requests are
+	// always signed if the IdP wants them to be
+	SignRequests bool
+	// AttributeAuthority describes the attribute authority queried by
+	// QueryAttributes, which is usually run by the IdP
+	AttributeAuthority *md.AttributeAuthorityDescriptor
+	// HTTPClient is used to send requests over the back channel. If
+	// nil, http.DefaultClient is used
+	HTTPClient *http.Client
+
+	// RequestStore keeps track of outstanding AuthnRequests. If nil,
+	// a saml.MemoryRequestStore is used
+	RequestStore saml.RequestStore
+	// AllowUnsolicited allows IdP-initiated logins
+	AllowUnsolicited bool
+	// ReplayCache is used to reject replayed assertions. If nil, a
+	// saml.MemoryReplayCache is used
+	ReplayCache saml.ReplayCache
+	// ClockSkew is the allowed difference between the clocks of the IdP
+	// and this service provider
+	ClockSkew time.Duration
+
+	// Sessions manages the local sessions of logged in users. It is
+	// used by RequireSession, and by ServeACS when OnLogin is not set
+	Sessions SessionManager
+	// SessionMaxAge is how long sessions created by ServeACS last. If
+	// zero, DefaultSessionMaxAge is used
+	SessionMaxAge time.Duration
+
+	// OnLogin is called for successful logins. If nil, a session is
+	// created using Sessions, and the user is redirected to the
+	// RelayState
+	OnLogin LoginFunc
+	// OnError is called when something goes wrong. If nil, a generic
+	// error is returned to the client
+	OnError ErrorFunc
+
+	initOnce sync.Once
+}
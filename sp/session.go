@@ -0,0 +1,159 @@
+package sp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml"
+)
+
+var (
+	// ErrNoSession is returned when the request does not carry a
+	// session, or the session has expired
+	ErrNoSession = errors.New("no session")
+	// ErrInvalidSession is returned when the session cookie has been
+	// tampered with, or cannot be decoded
+	ErrInvalidSession = errors.New("invalid session")
+)
+
+// DefaultSessionCookieName is the name of the session cookie when
+// CookieOptions.Name is not set
+const DefaultSessionCookieName = "saml_session"
+
+// DefaultSessionMaxAge is how long sessions created by ServiceProvider
+// last when SessionMaxAge is not set
+const DefaultSessionMaxAge = time.Hour
+
+// Session is the local session of a user that logged in through the
+// IdP. It records what is needed to take part in single logout
+type Session struct {
+	// ID identifies the session in a SessionStore. It is empty for
+	// sessions kept in cookies
+	ID           string
+	NameID       saml.NameID
+	SessionIndex string
+	IdPEntityID  string
+	Attributes   []saml.Attribute
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+// NewSession creates a session for the principal, valid for maxAge
+func NewSession(p *Principal, maxAge time.Duration) *Session {
+	now := time.Now()
+	return &Session{
+		NameID:       p.NameID,
+		SessionIndex: p.SessionIndex,
+		IdPEntityID:  p.IdPEntityID,
+		Attributes:   p.Attributes,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(maxAge),
+	}
+}
+
+// Attribute returns the values of the attribute with the given name
+func (s *Session) Attribute(name string) []string {
+	for _, attr := range s.Attributes {
+		if attr.Name != name && attr.FriendlyName != name {
+			continue
+		}
+		values := make([]string, len(attr.Values))
+		for i, v := range attr.Values {
+			values[i] = v.Value
+		}
+		return values
+	}
+	return nil
+}
+
+// SessionManager establishes and retrieves sessions. Implementations
+// must be safe for concurrent use
+type SessionManager interface {
+	// CreateSession stores s, and arranges for it to be returned by
+	// GetSession for subsequent requests from the same client
+	CreateSession(w http.ResponseWriter, r *http.Request, s *Session) error
+	// GetSession returns the session of the client. ErrNoSession is
+	// returned if there is none, or if it has expired
+	GetSession(r *http.Request) (*Session, error)
+	// DeleteSession ends the session of the client
+	DeleteSession(w http.ResponseWriter, r *http.Request) error
+}
+
+type sessionContextKey struct{}
+
+// WithSession returns a copy of ctx carrying s
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, s)
+}
+
+// SessionFromContext returns the session injected by
+// ServiceProvider.RequireSession, if any
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	s, ok := ctx.Value(sessionContextKey{}).(*Session)
+	return s, ok
+}
+
+// RequireSession wraps h so that it is only called for requests that
+// carry a session, which is made available via SessionFromContext.
+// Other GET requests start the login, returning to the requested URL
+// afterwards. As other methods cannot be replayed after the login,
+// they are rejected with 401 Unauthorized
+func (sp *ServiceProvider) RequireSession(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sp.Sessions == nil {
+			sp.error(w, r, http.StatusInternalServerError, errors.New("Sessions is not set"))
+			return
+		}
+
+		s, err := sp.Sessions.GetSession(r)
+		if err == nil {
+			h.ServeHTTP(w, r.WithContext(WithSession(r.Context(), s)))
+			return
+		}
+		if pdebug.Enabled {
+			pdebug.Printf("ServiceProvider.RequireSession: %s", err)
+		}
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		sp.login(w, r, r.URL.RequestURI())
+	})
+}
+
+// startSession is used in place of OnLogin when it is not set. It
+// creates a session for p, and redirects to the RelayState if it is a
+// local path
+func (sp *ServiceProvider) startSession(w http.ResponseWriter, r *http.Request, p *Principal) {
+	maxAge := sp.SessionMaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultSessionMaxAge
+	}
+
+	if err := sp.Sessions.CreateSession(w, r, NewSession(p, maxAge)); err != nil {
+		sp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	target := "/"
+	if isLocalPath(p.RelayState) {
+		target = p.RelayState
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// isLocalPath makes sure that redirecting to s does not lead to
+// another site
+func isLocalPath(s string) bool {
+	if len(s) == 0 || s[0] != '/' {
+		return false
+	}
+	if len(s) > 1 && (s[1] == '/' || s[1] == '\\') {
+		return false
+	}
+	return true
+}
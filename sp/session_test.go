@@ -0,0 +1,182 @@
+package sp_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-saml/sp"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestSession() *sp.Session {
+	return sp.NewSession(&sp.Principal{
+		NameID:       saml.NameID{Format: nameid.Transient, Value: "alice"},
+		SessionIndex: "session-1",
+		IdPEntityID:  "https://idp.example.com/metadata",
+		Attributes: []saml.Attribute{
+			{Name: "mail", Values: []saml.AttributeValue{{Value: "alice@example.com"}}},
+		},
+	}, time.Hour)
+}
+
+// roundTrip creates a session using m, and returns a request carrying
+// the cookies that were set
+func roundTrip(t *testing.T, m sp.SessionManager, s *sp.Session) *http.Request {
+	w := httptest.NewRecorder()
+	if !assert.NoError(t, m.CreateSession(w, httptest.NewRequest("GET", "/", nil), s), "CreateSession succeeds") {
+		return nil
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestCookieSessionManager(t *testing.T) {
+	m, err := sp.NewCookieSessionManager([]byte("0123456789abcdef0123456789abcdef"))
+	if !assert.NoError(t, err, "NewCookieSessionManager succeeds") {
+		return
+	}
+
+	_, err = m.GetSession(httptest.NewRequest("GET", "/", nil))
+	if !assert.Equal(t, sp.ErrNoSession, err, "no cookie means no session") {
+		return
+	}
+
+	r := roundTrip(t, m, makeTestSession())
+	if r == nil {
+		return
+	}
+	s, err := m.GetSession(r)
+	if !assert.NoError(t, err, "GetSession succeeds") {
+		return
+	}
+	if !assert.Equal(t, "alice", s.NameID.Value, "NameID matches") {
+		return
+	}
+	if !assert.Equal(t, "session-1", s.SessionIndex, "SessionIndex matches") {
+		return
+	}
+	if !assert.Equal(t, []string{"alice@example.com"}, s.Attribute("mail"), "attribute matches") {
+		return
+	}
+
+	// Tampering with the cookie invalidates it
+	c, _ := r.Cookie(sp.DefaultSessionCookieName)
+	value := []byte(c.Value)
+	value[len(value)-1] ^= 1
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sp.DefaultSessionCookieName, Value: string(value)})
+	_, err = m.GetSession(r)
+	if !assert.Equal(t, sp.ErrInvalidSession, err, "tampered cookie is rejected") {
+		return
+	}
+
+	// Expired sessions are ignored
+	m.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = m.GetSession(roundTrip(t, m, makeTestSession()))
+	if !assert.Equal(t, sp.ErrNoSession, err, "expired session is ignored") {
+		return
+	}
+}
+
+func TestStoreSessionManager(t *testing.T) {
+	store := sp.NewMemorySessionStore()
+	m := sp.NewStoreSessionManager(store)
+
+	r := roundTrip(t, m, makeTestSession())
+	if r == nil {
+		return
+	}
+	if !assert.Equal(t, 1, store.Len(), "session is stored") {
+		return
+	}
+
+	s, err := m.GetSession(r)
+	if !assert.NoError(t, err, "GetSession succeeds") {
+		return
+	}
+	if !assert.NotEmpty(t, s.ID, "session has an ID") {
+		return
+	}
+
+	// Sessions can be ended on the server side
+	if !assert.NoError(t, store.Delete(s.ID), "Delete succeeds") {
+		return
+	}
+	_, err = m.GetSession(r)
+	if !assert.Equal(t, sp.ErrNoSession, err, "deleted session is gone") {
+		return
+	}
+
+	// Back-channel logout finds sessions by principal and SessionIndex
+	r = roundTrip(t, m, makeTestSession())
+	if r == nil {
+		return
+	}
+	lr := saml.NewLogoutRequest()
+	lr.Issuer = "https://idp.example.com/metadata"
+	lr.NameID = saml.NameID{Format: nameid.Transient, Value: "alice"}
+	lr.SessionIndex = []string{"session-2"}
+	n, err := m.EndSessions(lr)
+	if !assert.NoError(t, err, "EndSessions succeeds") {
+		return
+	}
+	if !assert.Equal(t, 0, n, "other SessionIndex does not match") {
+		return
+	}
+
+	lr.SessionIndex = []string{"session-1"}
+	n, err = m.EndSessions(lr)
+	if !assert.NoError(t, err, "EndSessions succeeds") {
+		return
+	}
+	if !assert.Equal(t, 1, n, "session is ended") {
+		return
+	}
+	_, err = m.GetSession(r)
+	if !assert.Equal(t, sp.ErrNoSession, err, "ended session is gone") {
+		return
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	store := sp.NewMemorySessionStore()
+	s := &sp.ServiceProvider{
+		Sessions: sp.NewStoreSessionManager(store),
+	}
+
+	var got *sp.Session
+	h := s.RequireSession(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = sp.SessionFromContext(r.Context())
+	}))
+
+	// Requests that cannot be replayed after login are rejected
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/private", nil))
+	if !assert.Equal(t, http.StatusUnauthorized, w.Code, "POST without session is rejected") {
+		return
+	}
+
+	r := roundTrip(t, s.Sessions, makeTestSession())
+	if r == nil {
+		return
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !assert.Equal(t, http.StatusOK, w.Code, "request with session succeeds") {
+		return
+	}
+	if !assert.NotNil(t, got, "session is in the context") {
+		return
+	}
+	if !assert.Equal(t, "alice", got.NameID.Value, "NameID matches") {
+		return
+	}
+}
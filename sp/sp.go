@@ -0,0 +1,355 @@
+package sp
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/ecp"
+	"github.com/lestrrat/go-saml/md"
+	"github.com/lestrrat/go-saml/nameid"
+	"github.com/lestrrat/go-xmlsec/crypto"
+)
+
+func (sp *ServiceProvider) init() {
+	sp.initOnce.Do(func() {
+		if sp.RequestStore == nil {
+			sp.RequestStore = saml.NewMemoryRequestStore()
+		}
+		if sp.ReplayCache == nil {
+			sp.ReplayCache = saml.NewMemoryReplayCache()
+		}
+	})
+}
+
+func (sp *ServiceProvider) loginPath() string {
+	if sp.LoginPath != "" {
+		return sp.LoginPath
+	}
+	return DefaultLoginPath
+}
+
+func (sp *ServiceProvider) metadataPath() string {
+	if sp.MetadataPath != "" {
+		return sp.MetadataPath
+	}
+	return DefaultMetadataPath
+}
+
+func (sp *ServiceProvider) acsPath() string {
+	u, err := url.Parse(sp.ACSURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+func (sp *ServiceProvider) responseBinding() binding.Protocol {
+	if sp.ResponseBinding != "" {
+		return sp.ResponseBinding
+	}
+	return binding.HTTPPost
+}
+
+func (sp *ServiceProvider) tracker() saml.RequestTracker {
+	return saml.RequestTracker{
+		Store:            sp.RequestStore,
+		AllowUnsolicited: sp.AllowUnsolicited,
+	}
+}
+
+func (sp *ServiceProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sp.init()
+
+	switch r.URL.Path {
+	case sp.loginPath():
+		sp.ServeLogin(w, r)
+	case sp.acsPath():
+		sp.ServeACS(w, r)
+	case sp.metadataPath():
+		sp.ServeMetadata(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (sp *ServiceProvider) error(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if pdebug.Enabled {
+		pdebug.Printf("ServiceProvider: %s", err)
+	}
+
+	if sp.OnError != nil {
+		sp.OnError(w, r, err)
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// ssoEndpoint picks the IdP's SingleSignOnService to send the
+// AuthnRequest to
+func (sp *ServiceProvider) ssoEndpoint() (*saml.Endpoint, error) {
+	want := sp.Binding
+	if want == "" {
+		want = binding.HTTPRedirect
+	}
+
+	var fallback *saml.Endpoint
+	for i, ep := range sp.IdP.SingleSignOnService {
+		switch ep.ProtocolBinding {
+		case want:
+			return &sp.IdP.SingleSignOnService[i], nil
+		case binding.HTTPRedirect, binding.HTTPPost:
+			if fallback == nil {
+				fallback = &sp.IdP.SingleSignOnService[i]
+			}
+		}
+	}
+	if fallback == nil {
+		return nil, errors.New("IdP has no supported SingleSignOnService")
+	}
+	return fallback, nil
+}
+
+// ServeLogin sends an AuthnRequest to the IdP
+func (sp *ServiceProvider) ServeLogin(w http.ResponseWriter, r *http.Request) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START ServiceProvider.ServeLogin")
+		defer g.IRelease("END ServiceProvider.ServeLogin")
+	}
+	sp.login(w, r, r.URL.Query().Get(saml.ParamRelayState))
+}
+
+// login sends an AuthnRequest to the IdP, remembering relayState. ECP
+// clients receive the AuthnRequest directly
+func (sp *ServiceProvider) login(w http.ResponseWriter, r *http.Request, relayState string) {
+	sp.init()
+
+	if ecp.IsECPRequest(r) {
+		sp.loginECP(w, r, relayState)
+		return
+	}
+
+	ep, err := sp.ssoEndpoint()
+	if err != nil {
+		sp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	ar := saml.NewAuthnRequest()
+	ar.Issuer = sp.EntityID
+	ar.Destination = ep.Location
+	ar.ProtocolBinding = sp.responseBinding()
+	ar.AssertionConsumerServiceURL = sp.ACSURL
+
+	if err := sp.tracker().Track(ar, sp.IdP.ID(), relayState); err != nil {
+		sp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	sign := sp.SignRequests || sp.IdP.WantAuthnRequestsSigned
+	if sign && sp.Key == nil {
+		sp.error(w, r, http.StatusInternalServerError, errors.New("a key is required to sign requests"))
+		return
+	}
+
+	if ep.ProtocolBinding == binding.HTTPPost {
+		var signer *saml.Signer
+		if sign {
+			key, err := crypto.LoadKeyFromRSAPrivateKey(sp.Key)
+			if err != nil {
+				sp.error(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			signer = saml.NewSigner(key)
+		}
+
+		if err := ep.WritePostForm(w, ar, relayState, signer); err != nil {
+			sp.error(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	var u *url.URL
+	if sign {
+		u, err = ep.RedirectURL(ar, relayState, sp.Key, "")
+	} else {
+		u, err = ep.RedirectURL(ar, relayState, nil, "")
+	}
+	if err != nil {
+		sp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// ServeACS receives the Response from the IdP, verifies and validates
+// it, and passes the principal to OnLogin
+func (sp *ServiceProvider) ServeACS(w http.ResponseWriter, r *http.Request) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START ServiceProvider.ServeACS")
+		defer g.IRelease("END ServiceProvider.ServeACS")
+	}
+	sp.init()
+
+	p, err := sp.ParseResponse(r)
+	if err != nil {
+		sp.error(w, r, http.StatusForbidden, err)
+		return
+	}
+
+	switch {
+	case sp.OnLogin != nil:
+		sp.OnLogin(w, r, p)
+	case sp.Sessions != nil:
+		sp.startSession(w, r, p)
+	default:
+		sp.error(w, r, http.StatusInternalServerError, errors.New("neither OnLogin nor Sessions is set"))
+	}
+}
+
+// ParseResponse extracts the Response sent to the ACS using the
+// HTTP-POST binding, resolves the artifact sent using the HTTP-Artifact
+// binding, or extracts the Response relayed by an ECP client using the
+// PAOS binding. It then makes sure that the Response is signed by the
+// IdP, decrypts it, validates it, and returns the principal
+func (sp *ServiceProvider) ParseResponse(r *http.Request) (*Principal, error) {
+	sp.init()
+
+	if ecp.IsPAOSMessage(r) {
+		src, relayState, err := readECPResponse(r)
+		if err != nil {
+			return nil, err
+		}
+		return sp.parseResponse(src, relayState)
+	}
+
+	if isArtifactMessage(r) {
+		a, relayState, err := saml.DecodeArtifactRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		src, err := sp.resolveArtifact(a)
+		if err != nil {
+			return nil, err
+		}
+		return sp.parseResponse(src, relayState)
+	}
+
+	msg, err := saml.DecodePostRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Param != saml.ParamSAMLResponse {
+		return nil, errors.New("expected " + saml.ParamSAMLResponse)
+	}
+	return sp.parseResponse(msg.XML, msg.RelayState)
+}
+
+// parseResponse verifies, decrypts and validates the Response in src,
+// and returns the principal. relayState is the RelayState that came
+// with the response
+func (sp *ServiceProvider) parseResponse(src []byte, relayState string) (*Principal, error) {
+	verifier := saml.NewVerifier(sp.IdP.SigningCertificates()...)
+	verifier.DecryptionKey = sp.Key
+	res, _, err := verifier.VerifyResponse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := sp.tracker().Match(res)
+	if err != nil {
+		return nil, err
+	}
+
+	var requestID string
+	if req != nil {
+		requestID = req.ID
+		relayState = req.RelayState
+	}
+
+	validator := saml.Validator{
+		EntityID:    sp.EntityID,
+		ACSURL:      sp.ACSURL,
+		IdPEntityID: sp.IdP.ID(),
+		ClockSkew:   sp.ClockSkew,
+		ReplayCache: sp.ReplayCache,
+	}
+	if err := validator.ValidateResponse(res, requestID); err != nil {
+		return nil, err
+	}
+
+	a := res.Assertion
+	return &Principal{
+		NameID:       a.Subject.NameID,
+		SessionIndex: a.AuthnStatement.SessionIndex,
+		IdPEntityID:  a.Issuer,
+		Attributes:   a.AttributeStatement.Attributes,
+		RelayState:   relayState,
+		Assertion:    a,
+	}, nil
+}
+
+// Metadata returns the metadata describing this service provider
+func (sp *ServiceProvider) Metadata() *md.SPDescriptor {
+	// WantAssertionsSigned is not advertised, as a signature on the
+	// Response alone is accepted
+	desc := &md.SPDescriptor{
+		AuthnRequestsSigned: sp.SignRequests,
+		AssertionConsumerService: []saml.IndexedEndpoint{
+			{
+				Endpoint: saml.Endpoint{
+					ProtocolBinding: binding.HTTPPost,
+					Location:        sp.ACSURL,
+				},
+				IsDefault: true,
+			},
+			{
+				Endpoint: saml.Endpoint{
+					ProtocolBinding: binding.PAOS,
+					Location:        sp.ACSURL,
+				},
+				Index: 1,
+			},
+		},
+	}
+	if sp.responseBinding() == binding.HTTPArtifact {
+		desc.AssertionConsumerService = append(desc.AssertionConsumerService, saml.IndexedEndpoint{
+			Endpoint: saml.Endpoint{
+				ProtocolBinding: binding.HTTPArtifact,
+				Location:        sp.ACSURL,
+			},
+			Index: 2,
+		})
+	}
+	desc.RoleDescriptor.ID = sp.EntityID
+	desc.SSODescriptor.NameIDFormats = []nameid.Format{nameid.Transient}
+
+	if cert := sp.Certificate; cert != nil {
+		for _, use := range []string{"signing", "encryption"} {
+			desc.KeyDescriptors = append(desc.KeyDescriptors, md.KeyDescriptor{
+				Use: use,
+				Key: md.KeyInfo{Certificates: []*x509.Certificate{cert}},
+			})
+		}
+	}
+	return desc
+}
+
+// ServeMetadata writes the metadata describing this service provider
+func (sp *ServiceProvider) ServeMetadata(w http.ResponseWriter, r *http.Request) {
+	m := md.Metadata{
+		EntityDescriptors: []md.EntityDescriptor{sp.Metadata()},
+	}
+	xmlstr, err := m.Serialize()
+	if err != nil {
+		sp.error(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write([]byte(xmlstr))
+}
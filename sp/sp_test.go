@@ -0,0 +1,253 @@
+package sp_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat/go-saml"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/internal/testutil"
+	"github.com/lestrrat/go-saml/md"
+	"github.com/lestrrat/go-saml/sp"
+	"github.com/lestrrat/go-xmlsec"
+	"github.com/lestrrat/go-xmlsec/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceProvider(t *testing.T) {
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	cert := testutil.MakeCertificate(t, privkey)
+	if cert == nil {
+		return
+	}
+
+	idp := &md.IDPDescriptor{
+		SingleSignOnService: []saml.Endpoint{
+			{ProtocolBinding: binding.HTTPRedirect, Location: "https://idp.example.com/sso"},
+		},
+	}
+	idp.RoleDescriptor.ID = "https://idp.example.com/metadata"
+
+	store := saml.NewMemoryRequestStore()
+	s := &sp.ServiceProvider{
+		EntityID:     "https://sp.example.com/saml/metadata",
+		ACSURL:       "https://sp.example.com/saml/acs",
+		Key:          privkey,
+		Certificate:  cert,
+		IdP:          idp,
+		SignRequests: true,
+		RequestStore: store,
+		OnLogin: func(w http.ResponseWriter, r *http.Request, p *sp.Principal) {
+			t.Errorf("OnLogin should not be called")
+		},
+	}
+
+	// Login redirects to the IdP with a signed AuthnRequest
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://sp.example.com/saml/login?RelayState=%2Fhome", nil))
+	if !assert.Equal(t, http.StatusFound, w.Code, "login redirects") {
+		return
+	}
+
+	loc, err := w.Result().Location()
+	if !assert.NoError(t, err, "Location is set") {
+		return
+	}
+	if !assert.Equal(t, "idp.example.com", loc.Host, "redirects to the IdP") {
+		return
+	}
+	for _, param := range []string{saml.ParamSAMLRequest, saml.ParamRelayState, saml.ParamSigAlg, saml.ParamSignature} {
+		if !assert.NotEmpty(t, loc.Query().Get(param), "%s is present", param) {
+			return
+		}
+	}
+	if !assert.Equal(t, 1, store.Len(), "request is tracked") {
+		return
+	}
+
+	msg, err := saml.DecodeRedirectValues(loc.Query(), &privkey.PublicKey)
+	if !assert.NoError(t, err, "DecodeRedirectValues succeeds") {
+		return
+	}
+	ar, err := saml.ParseAuthnRequest(msg.XML)
+	if !assert.NoError(t, err, "ParseAuthnRequest succeeds") {
+		return
+	}
+	if !assert.Equal(t, s.ACSURL, ar.AssertionConsumerServiceURL, "ACS URL matches") {
+		return
+	}
+
+	// Metadata describes the SP
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://sp.example.com/saml/metadata", nil))
+	if !assert.Equal(t, http.StatusOK, w.Code, "metadata is served") {
+		return
+	}
+	if !assert.True(t, strings.Contains(w.Body.String(), s.ACSURL), "metadata contains ACS URL") {
+		return
+	}
+	if !assert.False(t, s.Metadata().WantAssertionsSigned, "metadata does not claim that assertions must be signed") {
+		return
+	}
+
+	// The ACS rejects anything that is not a valid response
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "https://sp.example.com/saml/acs", nil))
+	if !assert.Equal(t, http.StatusForbidden, w.Code, "ACS rejects GET") {
+		return
+	}
+}
+
+func TestServiceProviderACS(t *testing.T) {
+	xmlsec.Init()
+	defer xmlsec.Shutdown()
+
+	idpkey, idpcert := testutil.MakeKeyAndCertificate(t)
+	if idpcert == nil {
+		return
+	}
+
+	idp := &md.IDPDescriptor{
+		SingleSignOnService: []saml.Endpoint{
+			{ProtocolBinding: binding.HTTPRedirect, Location: "https://idp.example.com/sso"},
+		},
+	}
+	idp.RoleDescriptor.ID = "https://idp.example.com/metadata"
+	idp.RoleDescriptor.KeyDescriptors = []md.KeyDescriptor{
+		{Use: "signing", Key: md.KeyInfo{Certificates: []*x509.Certificate{idpcert}}},
+	}
+
+	var principal *sp.Principal
+	var lastErr error
+	s := &sp.ServiceProvider{
+		EntityID: "https://sp.example.com/saml/metadata",
+		ACSURL:   "https://sp.example.com/saml/acs",
+		IdP:      idp,
+		OnLogin: func(w http.ResponseWriter, r *http.Request, p *sp.Principal) {
+			principal = p
+		},
+		OnError: func(w http.ResponseWriter, r *http.Request, err error) {
+			lastErr = err
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		},
+	}
+
+	// login returns the ID of a new AuthnRequest tracked by the SP
+	login := func() string {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "https://sp.example.com/saml/login?RelayState=%2Fhome", nil))
+		loc, err := w.Result().Location()
+		if !assert.NoError(t, err, "Location is set") {
+			return ""
+		}
+		msg, err := saml.DecodeRedirectValues(loc.Query(), nil)
+		if !assert.NoError(t, err, "DecodeRedirectValues succeeds") {
+			return ""
+		}
+		ar, err := saml.ParseAuthnRequest(msg.XML)
+		if !assert.NoError(t, err, "ParseAuthnRequest succeeds") {
+			return ""
+		}
+		return ar.ID
+	}
+
+	// post sends a Response signed by the IdP to the ACS
+	post := func(assertionID, inResponseTo, audience string) int {
+		now := time.Now()
+		a := saml.NewAssertion()
+		a.ID = assertionID
+		a.IssueInstant = now
+		a.Issuer = idp.ID()
+		a.Subject.NameID = saml.NameID{Value: "alice"}
+		a.Subject.SubjectConfirmation = saml.SubjectConfirmation{
+			Method:       saml.Bearer,
+			InResponseTo: inResponseTo,
+			Recipient:    s.ACSURL,
+			NotOnOrAfter: now.Add(5 * time.Minute),
+		}
+		a.Conditions.NotBefore = now.Add(-time.Minute)
+		a.Conditions.NotOnOrAfter = now.Add(5 * time.Minute)
+		a.Conditions.AddAudienceRestriction(audience)
+		a.AuthnStatement.AuthnInstant = now
+
+		res := saml.NewResponse()
+		res.Issuer = idp.ID()
+		res.Destination = s.ACSURL
+		res.InResponseTo = inResponseTo
+		res.Status = saml.StatusSuccess
+		res.Assertion = a
+
+		key, err := crypto.LoadKeyFromRSAPrivateKey(idpkey)
+		if !assert.NoError(t, err, "Load key from RSA private key succeeds") {
+			return 0
+		}
+		encoded, err := res.EncodePost(saml.NewSigner(key))
+		if !assert.NoError(t, err, "EncodePost succeeds") {
+			return 0
+		}
+
+		form := url.Values{saml.ParamSAMLResponse: {string(encoded)}}
+		r := httptest.NewRequest("POST", s.ACSURL, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		principal, lastErr = nil, nil
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	id := login()
+	if id == "" {
+		return
+	}
+	if !assert.Equal(t, http.StatusOK, post("_a1", id, s.EntityID), "signed response is accepted") {
+		return
+	}
+	if !assert.NotNil(t, principal, "OnLogin is called") {
+		return
+	}
+	if !assert.Equal(t, "alice", principal.NameID.Value, "NameID matches") {
+		return
+	}
+	if !assert.Equal(t, "/home", principal.RelayState, "RelayState is restored") {
+		return
+	}
+
+	for _, tc := range []struct {
+		name        string
+		assertionID string
+		tracked     bool
+		audience    string
+		expected    error
+	}{
+		{"wrong audience", "_a2", true, "https://other.example.com/metadata", saml.ErrAudienceMismatch},
+		{"replayed assertion", "_a1", true, s.EntityID, saml.ErrReplay},
+		{"unknown InResponseTo", "_a3", false, s.EntityID, saml.ErrUnknownRequest},
+	} {
+		inResponseTo := "_unknown"
+		if tc.tracked {
+			if inResponseTo = login(); inResponseTo == "" {
+				return
+			}
+		}
+		if !assert.Equal(t, http.StatusForbidden, post(tc.assertionID, inResponseTo, tc.audience), "response is rejected (%s)", tc.name) {
+			return
+		}
+		if !assert.Nil(t, principal, "OnLogin is not called (%s)", tc.name) {
+			return
+		}
+		if !assert.True(t, errors.Is(lastErr, tc.expected), "error matches (%s): %v", tc.name, lastErr) {
+			return
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package sp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lestrrat/go-saml"
+)
+
+// SessionStore keeps sessions on the server side, keyed by Session.ID.
+// Implementations must be safe for concurrent use
+type SessionStore interface {
+	// Save stores s under s.ID, replacing any existing session
+	Save(s *Session) error
+	// Load returns the session with the given ID, or ErrNoSession
+	Load(id string) (*Session, error)
+	// Delete removes the session with the given ID. Deleting a session
+	// that does not exist is not an error
+	Delete(id string) error
+	// FindSessions returns the sessions of the principal identified by
+	// nameID at the IdP idpEntityID. If sessionIndex is not empty, only
+	// the sessions with that SessionIndex are returned
+	FindSessions(idpEntityID string, nameID saml.NameID, sessionIndex string) ([]*Session, error)
+}
+
+// MemorySessionStore is a SessionStore that keeps sessions in memory.
+// Expired sessions are evicted periodically
+type MemorySessionStore struct {
+	// Now returns the current time. If nil, time.Now is used
+	Now func() time.Time
+
+	mu        sync.Mutex
+	sessions  map[string]*Session
+	lastSweep time.Time
+}
+
+// NewMemorySessionStore creates an empty MemorySessionStore
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (s *MemorySessionStore) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *MemorySessionStore) Save(session *Session) error {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]*Session)
+	}
+	if now.Sub(s.lastSweep) >= time.Minute {
+		s.sweep(now)
+	}
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *MemorySessionStore) Load(id string) (*Session, error) {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrNoSession
+	}
+	if expired(session, now) {
+		delete(s.sessions, id)
+		return nil, ErrNoSession
+	}
+	return session, nil
+}
+
+func (s *MemorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *MemorySessionStore) FindSessions(idpEntityID string, nameID saml.NameID, sessionIndex string) ([]*Session, error) {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []*Session
+	for _, session := range s.sessions {
+		if expired(session, now) || !session.matches(idpEntityID, nameID, sessionIndex) {
+			continue
+		}
+		list = append(list, session)
+	}
+	return list, nil
+}
+
+// Len returns the number of sessions currently stored
+func (s *MemorySessionStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// sweep must be called with the lock held
+func (s *MemorySessionStore) sweep(now time.Time) {
+	for id, session := range s.sessions {
+		if expired(session, now) {
+			delete(s.sessions, id)
+		}
+	}
+	s.lastSweep = now
+}
+
+func expired(s *Session, now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+// matches reports whether s belongs to the principal identified by
+// nameID at the IdP idpEntityID, and has the given SessionIndex unless
+// it is empty. The name ID formats are only compared if both are known
+func (s *Session) matches(idpEntityID string, nameID saml.NameID, sessionIndex string) bool {
+	if s.IdPEntityID != idpEntityID || s.NameID.Value != nameID.Value {
+		return false
+	}
+	if s.NameID.Format != "" && nameID.Format != "" && s.NameID.Format != nameID.Format {
+		return false
+	}
+	return sessionIndex == "" || s.SessionIndex == sessionIndex
+}
+
+// StoreSessionManager is a SessionManager that keeps sessions in a
+// SessionStore, and only sends a random session ID to the client.
+// Unlike CookieSessionManager, sessions can be ended on the server
+// side using EndSessions, which is required for back-channel single
+// logout
+type StoreSessionManager struct {
+	CookieOptions
+	Store SessionStore
+}
+
+// NewStoreSessionManager creates a StoreSessionManager using store
+func NewStoreSessionManager(store SessionStore) *StoreSessionManager {
+	return &StoreSessionManager{Store: store}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CreateSession assigns a new ID to s, and saves it in Store
+func (m *StoreSessionManager) CreateSession(w http.ResponseWriter, r *http.Request, s *Session) error {
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	s.ID = id
+
+	if err := m.Store.Save(s); err != nil {
+		return err
+	}
+	m.set(w, id, s.ExpiresAt)
+	return nil
+}
+
+func (m *StoreSessionManager) GetSession(r *http.Request) (*Session, error) {
+	id, err := m.value(r)
+	if err != nil {
+		return nil, err
+	}
+	return m.Store.Load(id)
+}
+
+func (m *StoreSessionManager) DeleteSession(w http.ResponseWriter, r *http.Request) error {
+	m.clear(w)
+
+	id, err := m.value(r)
+	if err != nil {
+		return nil
+	}
+	return m.Store.Delete(id)
+}
+
+// EndSessions deletes the sessions that lr, a LogoutRequest from the
+// IdP, refers to, and returns how many were deleted. It is meant for
+// back-channel single logout, where the request does not come from the
+// browser of the user, and the session cookie is not available
+func (m *StoreSessionManager) EndSessions(lr *saml.LogoutRequest) (int, error) {
+	indexes := lr.SessionIndex
+	if len(indexes) == 0 {
+		indexes = []string{""}
+	}
+
+	count := 0
+	for _, index := range indexes {
+		list, err := m.Store.FindSessions(lr.Issuer, lr.NameID, index)
+		if err != nil {
+			return count, err
+		}
+		for _, s := range list {
+			if err := m.Store.Delete(s.ID); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,59 @@
+package saml
+
+// splitStatus returns the top-level and second-level codes that code
+// is sent as. The second-level code is empty if code is a top-level code
+func splitStatus(code StatusCode) (StatusCode, StatusCode) {
+	top := code.TopLevel()
+	if top == code {
+		return code, ""
+	}
+	return top, code
+}
+
+// statusError returns nil if top is StatusSuccess. Otherwise the most
+// specific of top and sub is returned
+func statusError(top, sub StatusCode) error {
+	if top == StatusSuccess {
+		return nil
+	}
+	if sub != "" {
+		return sub
+	}
+	return top
+}
+
+// SetStatus sets Status to the top-level code that code is sent under,
+// and SubStatus to code if it is a second-level code
+func (res *Response) SetStatus(code StatusCode) {
+	res.Status, res.SubStatus = splitStatus(code)
+}
+
+// StatusError returns nil if the top-level status is StatusSuccess,
+// and the most specific status code otherwise
+func (res Response) StatusError() error {
+	return statusError(res.Status, res.SubStatus)
+}
+
+// SetStatus sets Status to the top-level code that code is sent under,
+// and SubStatus to code if it is a second-level code
+func (res *LogoutResponse) SetStatus(code StatusCode) {
+	res.Status, res.SubStatus = splitStatus(code)
+}
+
+// StatusError returns nil if the top-level status is StatusSuccess,
+// and the most specific status code otherwise
+func (res LogoutResponse) StatusError() error {
+	return statusError(res.Status, res.SubStatus)
+}
+
+// SetStatus sets Status to the top-level code that code is sent under,
+// and SubStatus to code if it is a second-level code
+func (res *ArtifactResponse) SetStatus(code StatusCode) {
+	res.Status, res.SubStatus = splitStatus(code)
+}
+
+// StatusError returns nil if the top-level status is StatusSuccess,
+// and the most specific status code otherwise
+func (res ArtifactResponse) StatusError() error {
+	return statusError(res.Status, res.SubStatus)
+}
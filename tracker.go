@@ -0,0 +1,177 @@
+package saml
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownRequest is returned when a response refers to a request
+	// that was never issued, has expired, or has already been answered
+	ErrUnknownRequest = errors.New("response does not correspond to an outstanding request")
+	// ErrUnsolicitedResponse is returned when a response without
+	// InResponseTo arrives, and unsolicited responses are not allowed
+	ErrUnsolicitedResponse = errors.New("unsolicited responses are not allowed")
+)
+
+// DefaultRequestMaxAge is how long MemoryRequestStore keeps requests
+// around when MaxAge is not set
+const DefaultRequestMaxAge = 10 * time.Minute
+
+// OutstandingRequest records an AuthnRequest that has been sent to an
+// IdP, and is waiting for a response
+type OutstandingRequest struct {
+	ID           string
+	IssueInstant time.Time
+	IdPEntityID  string
+	RelayState   string
+}
+
+// RequestStore keeps track of outstanding requests. Implementations must
+// be safe for concurrent use
+type RequestStore interface {
+	// Store records req
+	Store(req OutstandingRequest) error
+	// Consume atomically removes the request with the given ID and
+	// returns it. ErrUnknownRequest is returned if there is no such
+	// request, or if it has expired
+	Consume(id string) (*OutstandingRequest, error)
+}
+
+// MemoryRequestStore is a RequestStore that keeps requests in memory.
+// Requests older than MaxAge are treated as unknown, and are evicted
+// periodically
+type MemoryRequestStore struct {
+	// MaxAge is how long requests are kept. If zero,
+	// DefaultRequestMaxAge is used
+	MaxAge time.Duration
+	// Now returns the current time. If nil, time.Now is used
+	Now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]OutstandingRequest
+	lastSweep time.Time
+}
+
+// NewMemoryRequestStore creates an empty MemoryRequestStore
+func NewMemoryRequestStore() *MemoryRequestStore {
+	return &MemoryRequestStore{
+		entries: make(map[string]OutstandingRequest),
+	}
+}
+
+func (s *MemoryRequestStore) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+func (s *MemoryRequestStore) maxAge() time.Duration {
+	if s.MaxAge > 0 {
+		return s.MaxAge
+	}
+	return DefaultRequestMaxAge
+}
+
+func (s *MemoryRequestStore) Store(req OutstandingRequest) error {
+	if req.ID == "" {
+		return errors.New("request ID is required")
+	}
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries == nil {
+		s.entries = make(map[string]OutstandingRequest)
+	}
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+	s.entries[req.ID] = req
+	return nil
+}
+
+func (s *MemoryRequestStore) Consume(id string) (*OutstandingRequest, error) {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req, ok := s.entries[id]
+	if !ok {
+		return nil, ErrUnknownRequest
+	}
+	delete(s.entries, id)
+
+	if s.expired(req, now) {
+		return nil, ErrUnknownRequest
+	}
+	return &req, nil
+}
+
+// Len returns the number of requests currently stored
+func (s *MemoryRequestStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *MemoryRequestStore) expired(req OutstandingRequest, now time.Time) bool {
+	return !now.Before(req.IssueInstant.Add(s.maxAge()))
+}
+
+// sweep must be called with the lock held
+func (s *MemoryRequestStore) sweep(now time.Time) {
+	for id, req := range s.entries {
+		if s.expired(req, now) {
+			delete(s.entries, id)
+		}
+	}
+	s.lastSweep = now
+}
+
+// RequestTracker correlates responses with the AuthnRequests that were
+// sent out
+type RequestTracker struct {
+	Store RequestStore
+	// AllowUnsolicited allows responses without InResponseTo, such as
+	// those sent in IdP-initiated SSO
+	AllowUnsolicited bool
+}
+
+// Track records ar as sent to the IdP identified by idp, along with the
+// RelayState that was sent with it
+func (t RequestTracker) Track(ar *AuthnRequest, idp, relayState string) error {
+	return t.Store.Store(OutstandingRequest{
+		ID:           ar.ID,
+		IssueInstant: ar.IssueInstant,
+		IdPEntityID:  idp,
+		RelayState:   relayState,
+	})
+}
+
+// Match consumes the outstanding request that res responds to. For
+// unsolicited responses, nil is returned if they are allowed. The ID of
+// the returned request (or the empty string) should be passed to
+// Validator.ValidateResponse
+func (t RequestTracker) Match(res *Response) (*OutstandingRequest, error) {
+	if res.InResponseTo == "" {
+		if t.AllowUnsolicited {
+			return nil, nil
+		}
+		return nil, ErrUnsolicitedResponse
+	}
+
+	req, err := t.Store.Consume(res.InResponseTo)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.IdPEntityID != "" && res.Issuer != "" && req.IdPEntityID != res.Issuer {
+		return nil, ErrIssuerMismatch
+	}
+	return req, nil
+}
@@ -0,0 +1,69 @@
+package saml
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestTracker(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryRequestStore()
+	store.Now = func() time.Time { return now }
+	tracker := RequestTracker{Store: store}
+
+	ar := &AuthnRequest{}
+	ar.ID = "_req1"
+	ar.IssueInstant = now
+	if !assert.NoError(t, tracker.Track(ar, "http://idp.example.com/metadata", "/home"), "Track succeeds") {
+		return
+	}
+
+	res := &Response{InResponseTo: "_req1"}
+	res.Issuer = "http://idp.example.com/metadata"
+
+	// Only one of the concurrent consumers may win
+	var wg sync.WaitGroup
+	results := make(chan *OutstandingRequest, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if req, err := tracker.Match(res); err == nil {
+				results <- req
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	if !assert.Len(t, results, 1, "request is consumed exactly once") {
+		return
+	}
+	req := <-results
+	if !assert.Equal(t, "/home", req.RelayState, "RelayState matches") {
+		return
+	}
+
+	_, err := tracker.Match(&Response{})
+	if !assert.Equal(t, ErrUnsolicitedResponse, err, "unsolicited response is rejected") {
+		return
+	}
+	tracker.AllowUnsolicited = true
+	req, err = tracker.Match(&Response{})
+	if !assert.NoError(t, err, "unsolicited response is allowed") || !assert.Nil(t, req, "no request is returned") {
+		return
+	}
+
+	ar.ID = "_req2"
+	if !assert.NoError(t, tracker.Track(ar, "", ""), "Track succeeds") {
+		return
+	}
+	now = now.Add(DefaultRequestMaxAge)
+	_, err = tracker.Match(&Response{InResponseTo: "_req2"})
+	if !assert.Equal(t, ErrUnknownRequest, err, "expired request is rejected") {
+		return
+	}
+}
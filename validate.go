@@ -0,0 +1,291 @@
+package saml
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Errors wrapped by ValidationError, describing why a check failed
+var (
+	ErrMissing              = errors.New("required value is missing")
+	ErrUnsupportedVersion   = errors.New("unsupported SAML version")
+	ErrStatus               = errors.New("status is not success")
+	ErrNotYetValid          = errors.New("not yet valid")
+	ErrExpired              = errors.New("expired")
+	ErrAudienceMismatch     = errors.New("audience does not include this entity")
+	ErrRecipientMismatch    = errors.New("recipient does not match")
+	ErrDestinationMismatch  = errors.New("destination does not match")
+	ErrInResponseToMismatch = errors.New("InResponseTo does not match")
+	ErrIssuerMismatch       = errors.New("issuer does not match")
+	ErrConfirmationMethod   = errors.New("unsupported subject confirmation method")
+	ErrSubjectMismatch      = errors.New("subject does not match")
+)
+
+// ValidationError describes a single check that failed
+type ValidationError struct {
+	// Element is the element or attribute that failed the check, such
+	// as "Assertion/Conditions/@NotOnOrAfter"
+	Element string
+	// Err is the reason the check failed, such as ErrExpired
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Element + ": " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors is the list of failed checks returned by Validator
+type ValidationErrors []*ValidationError
+
+func (list ValidationErrors) Error() string {
+	msgs := make([]string, len(list))
+	for i, e := range list {
+		msgs[i] = e.Error()
+	}
+	return "validation failed: " + strings.Join(msgs, ", ")
+}
+
+// Unwrap allows errors.Is and errors.As to look into the individual
+// failures
+func (list ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(list))
+	for i, e := range list {
+		errs[i] = e
+	}
+	return errs
+}
+
+func (list *ValidationErrors) add(element string, err error) {
+	*list = append(*list, &ValidationError{Element: element, Err: err})
+}
+
+// Validator checks parsed responses and assertions against the
+// processing rules of SAML core and the Web Browser SSO profile.
+// Signatures are not checked here: use Verifier for that.
+type Validator struct {
+	// EntityID is the entity ID of this service provider, which must
+	// be included in the audience restriction
+	EntityID string
+	// ACSURL is the location of the assertion consumer service that
+	// received the response. It is compared against the Destination
+	// and the subject confirmation's Recipient
+	ACSURL string
+	// IdPEntityID is the expected issuer. If empty, the issuer is not
+	// checked
+	IdPEntityID string
+	// ClockSkew is the amount of time that clocks of the IdP and this
+	// service provider are allowed to differ by
+	ClockSkew time.Duration
+	// Now returns the current time. If nil, time.Now is used
+	Now func() time.Time
+	// ReplayCache, if set, is used to reject assertions that have
+	// already been accepted. An assertion is only stored once all other
+	// checks have passed
+	ReplayCache ReplayCache
+}
+
+func (v Validator) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+// ValidateResponse checks the response and its assertion. requestID is
+// the ID of the AuthnRequest that the response is expected to answer,
+// or the empty string for unsolicited responses. The returned error is
+// of type ValidationErrors if any of the checks failed
+func (v Validator) ValidateResponse(res *Response, requestID string) error {
+	var errs ValidationErrors
+	now := v.now()
+
+	if res.Version != "2.0" {
+		errs.add("Response/@Version", ErrUnsupportedVersion)
+	}
+	if res.Status != StatusSuccess {
+		errs.add("Response/Status", ErrStatus)
+	}
+	if res.IssueInstant.IsZero() {
+		errs.add("Response/@IssueInstant", ErrMissing)
+	} else if res.IssueInstant.After(now.Add(v.ClockSkew)) {
+		errs.add("Response/@IssueInstant", ErrNotYetValid)
+	}
+	if res.Destination != "" && res.Destination != v.ACSURL {
+		errs.add("Response/@Destination", ErrDestinationMismatch)
+	}
+	if res.InResponseTo != requestID {
+		errs.add("Response/@InResponseTo", ErrInResponseToMismatch)
+	}
+	if v.IdPEntityID != "" && res.Issuer != "" && res.Issuer != v.IdPEntityID {
+		errs.add("Response/Issuer", ErrIssuerMismatch)
+	}
+
+	if res.Assertion == nil {
+		errs.add("Response/Assertion", ErrMissing)
+	} else {
+		v.validateAssertion(&errs, res.Assertion, requestID, now)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateAssertion checks the assertion. requestID is the same as in
+// ValidateResponse. The returned error is of type ValidationErrors if
+// any of the checks failed
+func (v Validator) ValidateAssertion(a *Assertion, requestID string) error {
+	var errs ValidationErrors
+	v.validateAssertion(&errs, a, requestID, v.now())
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (v Validator) validateAssertion(errs *ValidationErrors, a *Assertion, requestID string, now time.Time) {
+	if a.Version != "2.0" {
+		errs.add("Assertion/@Version", ErrUnsupportedVersion)
+	}
+	if a.Issuer == "" {
+		errs.add("Assertion/Issuer", ErrMissing)
+	} else if v.IdPEntityID != "" && a.Issuer != v.IdPEntityID {
+		errs.add("Assertion/Issuer", ErrIssuerMismatch)
+	}
+
+	// The Web Browser SSO profile requires an audience restriction
+	// containing the service provider
+	c := a.Conditions
+	v.validateConditions(errs, c, now)
+
+	sc := a.Subject.SubjectConfirmation
+	if sc.Method != Bearer {
+		errs.add("Assertion/Subject/SubjectConfirmation/@Method", ErrConfirmationMethod)
+	}
+	if sc.Recipient != v.ACSURL {
+		errs.add("Assertion/Subject/SubjectConfirmation/SubjectConfirmationData/@Recipient", ErrRecipientMismatch)
+	}
+	if sc.NotOnOrAfter.IsZero() {
+		errs.add("Assertion/Subject/SubjectConfirmation/SubjectConfirmationData/@NotOnOrAfter", ErrMissing)
+	} else if !now.Add(-v.ClockSkew).Before(sc.NotOnOrAfter) {
+		errs.add("Assertion/Subject/SubjectConfirmation/SubjectConfirmationData/@NotOnOrAfter", ErrExpired)
+	}
+	if sc.InResponseTo != requestID {
+		errs.add("Assertion/Subject/SubjectConfirmation/SubjectConfirmationData/@InResponseTo", ErrInResponseToMismatch)
+	}
+
+	if a.AuthnStatement.AuthnInstant.IsZero() {
+		errs.add("Assertion/AuthnStatement", ErrMissing)
+	}
+
+	if v.ReplayCache == nil {
+		return
+	}
+	if a.ID == "" {
+		errs.add("Assertion/@ID", ErrMissing)
+		return
+	}
+	if len(*errs) > 0 {
+		return
+	}
+
+	// Remember the assertion for as long as it could be accepted
+	expires := sc.NotOnOrAfter
+	if c.NotOnOrAfter.After(expires) {
+		expires = c.NotOnOrAfter
+	}
+	seen, err := v.ReplayCache.CheckAndStore(a.ID, expires.Add(v.ClockSkew))
+	switch {
+	case err != nil:
+		errs.add("Assertion/@ID", err)
+	case seen:
+		errs.add("Assertion/@ID", ErrReplay)
+	}
+}
+
+// validateConditions checks the validity period of the assertion, and
+// that its audience restriction includes EntityID
+func (v Validator) validateConditions(errs *ValidationErrors, c Conditions, now time.Time) {
+	if !c.NotBefore.IsZero() && now.Add(v.ClockSkew).Before(c.NotBefore) {
+		errs.add("Assertion/Conditions/@NotBefore", ErrNotYetValid)
+	}
+	if !c.NotOnOrAfter.IsZero() && !now.Add(-v.ClockSkew).Before(c.NotOnOrAfter) {
+		errs.add("Assertion/Conditions/@NotOnOrAfter", ErrExpired)
+	}
+
+	// Every AudienceRestriction must include this entity
+	restrictions := c.audienceRestrictions()
+	if len(restrictions) == 0 {
+		errs.add("Assertion/Conditions/AudienceRestriction", ErrMissing)
+	}
+	for _, ar := range restrictions {
+		if !containsString(ar.Audience, v.EntityID) {
+			errs.add("Assertion/Conditions/AudienceRestriction", ErrAudienceMismatch)
+			break
+		}
+	}
+}
+
+// ValidateAttributeResponse checks a response to the AttributeQuery q,
+// received over a back channel. ACSURL is not used. The response may
+// carry no assertion if the authority has no attributes to release.
+// Otherwise the assertion must be about the subject of q, and need not
+// have a subject confirmation nor an AuthnStatement. The returned error
+// is of type ValidationErrors if any of the checks failed
+func (v Validator) ValidateAttributeResponse(res *Response, q *AttributeQuery) error {
+	var errs ValidationErrors
+	now := v.now()
+
+	if res.Version != "2.0" {
+		errs.add("Response/@Version", ErrUnsupportedVersion)
+	}
+	if res.Status != StatusSuccess {
+		errs.add("Response/Status", ErrStatus)
+	}
+	if res.IssueInstant.IsZero() {
+		errs.add("Response/@IssueInstant", ErrMissing)
+	} else if res.IssueInstant.After(now.Add(v.ClockSkew)) {
+		errs.add("Response/@IssueInstant", ErrNotYetValid)
+	}
+	if res.InResponseTo != q.ID {
+		errs.add("Response/@InResponseTo", ErrInResponseToMismatch)
+	}
+	if v.IdPEntityID != "" && res.Issuer != "" && res.Issuer != v.IdPEntityID {
+		errs.add("Response/Issuer", ErrIssuerMismatch)
+	}
+
+	if a := res.Assertion; a != nil {
+		if a.Version != "2.0" {
+			errs.add("Assertion/@Version", ErrUnsupportedVersion)
+		}
+		if a.Issuer == "" {
+			errs.add("Assertion/Issuer", ErrMissing)
+		} else if v.IdPEntityID != "" && a.Issuer != v.IdPEntityID {
+			errs.add("Assertion/Issuer", ErrIssuerMismatch)
+		}
+		v.validateConditions(&errs, a.Conditions, now)
+		if a.Subject.NameID.Value != q.NameID.Value || a.Subject.NameID.Format != q.NameID.Format {
+			errs.add("Assertion/Subject/NameID", ErrSubjectMismatch)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
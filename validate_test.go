@@ -0,0 +1,296 @@
+package saml
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeValidResponse(now time.Time) *Response {
+	a := &Assertion{
+		ID:           "_a1",
+		Version:      "2.0",
+		IssueInstant: now,
+		Issuer:       "http://idp.example.com/metadata",
+		Subject: Subject{
+			NameID: NameID{Value: "alice"},
+			SubjectConfirmation: SubjectConfirmation{
+				Method:       Bearer,
+				InResponseTo: "_req1",
+				Recipient:    "http://sp.example.com/acs",
+				NotOnOrAfter: now.Add(5 * time.Minute),
+			},
+		},
+		Conditions: Conditions{
+			NotBefore:            now.Add(-time.Minute),
+			NotOnOrAfter:         now.Add(5 * time.Minute),
+			AudienceRestrictions: []AudienceRestriction{{Audience: []string{"http://sp.example.com/metadata"}}},
+		},
+		AuthnStatement: AuthnStatement{AuthnInstant: now},
+	}
+
+	res := &Response{
+		Status:       StatusSuccess,
+		InResponseTo: "_req1",
+		Assertion:    a,
+	}
+	res.ID = "_r1"
+	res.Version = "2.0"
+	res.IssueInstant = now
+	res.Issuer = "http://idp.example.com/metadata"
+	res.Destination = "http://sp.example.com/acs"
+	return res
+}
+
+func TestValidator(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	v := Validator{
+		EntityID:    "http://sp.example.com/metadata",
+		ACSURL:      "http://sp.example.com/acs",
+		IdPEntityID: "http://idp.example.com/metadata",
+		ClockSkew:   30 * time.Second,
+		Now:         func() time.Time { return now },
+	}
+
+	if !assert.NoError(t, v.ValidateResponse(makeValidResponse(now), "_req1"), "valid response passes") {
+		return
+	}
+
+	for _, tc := range []struct {
+		name     string
+		modify   func(*Response)
+		expected []error
+	}{
+		{
+			name:     "expired",
+			modify:   func(res *Response) { res.Assertion.Conditions.NotOnOrAfter = now.Add(-time.Minute) },
+			expected: []error{ErrExpired},
+		},
+		{
+			name:   "within clock skew",
+			modify: func(res *Response) { res.Assertion.Conditions.NotBefore = now.Add(20 * time.Second) },
+		},
+		{
+			name:     "not yet valid",
+			modify:   func(res *Response) { res.Assertion.Conditions.NotBefore = now.Add(time.Minute) },
+			expected: []error{ErrNotYetValid},
+		},
+		{
+			name: "wrong audience",
+			modify: func(res *Response) {
+				res.Assertion.Conditions.AudienceRestrictions[0].Audience = []string{"http://other.example.com"}
+			},
+			expected: []error{ErrAudienceMismatch},
+		},
+		{
+			name: "every audience restriction includes this entity",
+			modify: func(res *Response) {
+				res.Assertion.Conditions.AddAudienceRestriction("http://sp.example.com/metadata", "http://other.example.com")
+			},
+		},
+		{
+			name: "deprecated AudienceRestriction is also checked",
+			modify: func(res *Response) {
+				res.Assertion.Conditions.AudienceRestriction = AudienceRestriction{Audience: []string{"http://other.example.com"}}
+			},
+			expected: []error{ErrAudienceMismatch},
+		},
+		{
+			name: "deprecated AudienceRestriction on its own",
+			modify: func(res *Response) {
+				res.Assertion.Conditions.AudienceRestriction = res.Assertion.Conditions.AudienceRestrictions[0]
+				res.Assertion.Conditions.AudienceRestrictions = nil
+			},
+		},
+		{
+			name: "one of the audience restrictions excludes this entity",
+			modify: func(res *Response) {
+				res.Assertion.Conditions.AddAudienceRestriction("http://other.example.com")
+			},
+			expected: []error{ErrAudienceMismatch},
+		},
+		{
+			name: "wrong recipient and destination",
+			modify: func(res *Response) {
+				res.Destination = "http://evil.example.com/acs"
+				res.Assertion.Subject.SubjectConfirmation.Recipient = "http://evil.example.com/acs"
+			},
+			expected: []error{ErrDestinationMismatch, ErrRecipientMismatch},
+		},
+		{
+			name: "unsolicited",
+			modify: func(res *Response) {
+				res.InResponseTo = ""
+				res.Assertion.Subject.SubjectConfirmation.InResponseTo = ""
+			},
+			expected: []error{ErrInResponseToMismatch, ErrInResponseToMismatch},
+		},
+		{
+			name:   "success with a second-level code",
+			modify: func(res *Response) { res.SetStatus(ErrPartialLogout) },
+		},
+		{
+			name:     "failed status",
+			modify:   func(res *Response) { res.Status = ErrRequester },
+			expected: []error{ErrStatus},
+		},
+	} {
+		res := makeValidResponse(now)
+		tc.modify(res)
+
+		err := v.ValidateResponse(res, "_req1")
+		if len(tc.expected) == 0 {
+			if !assert.NoError(t, err, "ValidateResponse succeeds (%s)", tc.name) {
+				return
+			}
+			continue
+		}
+
+		var list ValidationErrors
+		if !assert.True(t, errors.As(err, &list), "error is ValidationErrors (%s)", tc.name) {
+			return
+		}
+		if !assert.Len(t, list, len(tc.expected), "number of failures matches (%s)", tc.name) {
+			t.Logf("%s", err)
+			return
+		}
+		for i, expected := range tc.expected {
+			if !assert.True(t, errors.Is(list[i], expected), "failure matches (%s): %s", tc.name, list[i]) {
+				return
+			}
+		}
+	}
+}
+
+func TestValidatorLocalTime(t *testing.T) {
+	// Times are created in the local time zone, which must not matter
+	// once they have been written out and parsed again
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	time.Local = time.FixedZone("UTC-5", -5*60*60)
+
+	now := time.Now()
+	xmlstr, err := makeValidResponse(now).Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	res, err := ParseResponseString(xmlstr)
+	if !assert.NoError(t, err, "ParseResponseString succeeds") {
+		return
+	}
+
+	v := Validator{
+		EntityID:    "http://sp.example.com/metadata",
+		ACSURL:      "http://sp.example.com/acs",
+		IdPEntityID: "http://idp.example.com/metadata",
+	}
+	if !assert.NoError(t, v.ValidateResponse(res, "_req1"), "response created in local time passes") {
+		return
+	}
+
+	lr := NewLogoutRequest()
+	lr.Issuer = "http://sp.example.com/metadata"
+	lr.NameID = NameID{Value: "alice"}
+	lr.NotOnOrAfter = now.Add(time.Minute)
+	xmlstr, err = lr.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+	parsed, err := ParseLogoutRequestString(xmlstr)
+	if !assert.NoError(t, err, "ParseLogoutRequestString succeeds") {
+		return
+	}
+	if !assert.True(t, parsed.NotOnOrAfter.Equal(lr.NotOnOrAfter.Truncate(time.Second)), "NotOnOrAfter survives the round trip") {
+		return
+	}
+}
+
+func TestValidatorReplay(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	cache := NewMemoryReplayCache()
+	cache.Now = clock
+	v := Validator{
+		EntityID:    "http://sp.example.com/metadata",
+		ACSURL:      "http://sp.example.com/acs",
+		Now:         clock,
+		ReplayCache: cache,
+	}
+
+	// An invalid response must not burn the assertion ID
+	res := makeValidResponse(now)
+	res.Destination = "http://evil.example.com/acs"
+	if !assert.Error(t, v.ValidateResponse(res, "_req1"), "invalid response fails") {
+		return
+	}
+	if !assert.Equal(t, 0, cache.Len(), "nothing is stored") {
+		return
+	}
+
+	if !assert.NoError(t, v.ValidateResponse(makeValidResponse(now), "_req1"), "first use succeeds") {
+		return
+	}
+
+	err := v.ValidateResponse(makeValidResponse(now), "_req1")
+	if !assert.True(t, errors.Is(err, ErrReplay), "replay is rejected") {
+		return
+	}
+
+	// Entries are evicted once the assertion has expired
+	now = now.Add(10 * time.Minute)
+	seen, err := cache.CheckAndStore("_other", now.Add(time.Minute))
+	if !assert.NoError(t, err, "CheckAndStore succeeds") {
+		return
+	}
+	if !assert.False(t, seen, "new ID is not seen") {
+		return
+	}
+	if !assert.Equal(t, 1, cache.Len(), "expired entry is evicted") {
+		return
+	}
+}
+
+func TestValidateAttributeResponse(t *testing.T) {
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	v := Validator{
+		EntityID:    "http://sp.example.com/metadata",
+		IdPEntityID: "http://idp.example.com/metadata",
+		Now:         func() time.Time { return now },
+	}
+
+	q := &AttributeQuery{NameID: NameID{Value: "alice"}}
+	q.ID = "_req1"
+
+	// Attribute assertions have no subject confirmation nor AuthnStatement
+	res := makeValidResponse(now)
+	res.Destination = ""
+	res.Assertion.Subject.SubjectConfirmation = SubjectConfirmation{}
+	res.Assertion.AuthnStatement = AuthnStatement{}
+	if !assert.NoError(t, v.ValidateAttributeResponse(res, q), "valid response passes") {
+		return
+	}
+
+	res.Assertion = nil
+	if !assert.NoError(t, v.ValidateAttributeResponse(res, q), "response without assertion passes") {
+		return
+	}
+
+	res = makeValidResponse(now)
+	res.Assertion.Subject.NameID.Value = "bob"
+	res.Assertion.Conditions.AudienceRestrictions = nil
+	err := v.ValidateAttributeResponse(res, q)
+	if !assert.True(t, errors.Is(err, ErrSubjectMismatch), "other subject is rejected") {
+		return
+	}
+	if !assert.True(t, errors.Is(err, ErrMissing), "missing audience is rejected") {
+		return
+	}
+
+	q.ID = "_req2"
+	err = v.ValidateAttributeResponse(makeValidResponse(now), q)
+	if !assert.True(t, errors.Is(err, ErrInResponseToMismatch), "response to another query is rejected") {
+		return
+	}
+}
@@ -0,0 +1,606 @@
+package saml
+
+import (
+	gocrypto "crypto"
+	"crypto/dsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+
+	"github.com/lestrrat/go-libxml2/types"
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/lestrrat/go-pdebug"
+	"github.com/lestrrat/go-saml/ns"
+	"github.com/lestrrat/go-xmlsec/crypto"
+	"github.com/lestrrat/go-xmlsec/dsig"
+)
+
+var (
+	// ErrNoTrustedKeys is returned when verification is attempted on a
+	// Verifier without any keys
+	ErrNoTrustedKeys = errors.New("no trusted keys configured")
+	// ErrUntrustedSignature is returned when the signature did not
+	// validate against any of the trusted keys
+	ErrUntrustedSignature = errors.New("signature did not verify against any trusted key")
+	// ErrMissingSignature is returned when the element that is required
+	// to be signed does not carry a signature
+	ErrMissingSignature = errors.New("element is not signed")
+	// ErrSignatureReference is returned when the signature does not
+	// reference exactly the element that it is attached to
+	ErrSignatureReference = errors.New("signature does not reference the signed element")
+	// ErrDuplicateID is returned when more than one element in the
+	// document has the same ID
+	ErrDuplicateID = errors.New("duplicate ID in document")
+	// ErrMultipleAssertions is returned when a Response contains more
+	// than one assertion
+	ErrMultipleAssertions = errors.New("multiple assertions in response")
+)
+
+// TrustedKey is a key that a Verifier accepts signatures from
+type TrustedKey struct {
+	// Certificate is the certificate the key was taken from. It is nil
+	// if the key was added using Verifier.AddPublicKey
+	Certificate *x509.Certificate
+	// PublicKey is the public key itself. It can also be used to verify
+	// HTTP-Redirect binding signatures
+	PublicKey gocrypto.PublicKey
+
+	// The key is kept in its serialized form, because go-xmlsec takes
+	// ownership of the keys that it is given. A fresh key is loaded
+	// each time a signature is verified
+	data   []byte
+	format crypto.KeyDataFormat
+}
+
+// Verifier verifies enveloped XML signatures against an explicit set of
+// trusted keys. Any key material embedded in the message (such as
+// <ds:KeyInfo>) is ignored, so only messages signed by one of the
+// trusted keys are accepted.
+type Verifier struct {
+	// DecryptionKey is used to decrypt <saml:EncryptedAssertion>,
+	// <saml:EncryptedID> and <saml:EncryptedAttribute>. If it is nil,
+	// encrypted elements are left as is
+	DecryptionKey *rsa.PrivateKey
+
+	keys []*TrustedKey
+}
+
+// NewVerifier creates a Verifier that trusts the given certificates,
+// for example those returned by md.RoleDescriptor.SigningCertificates
+func NewVerifier(certs ...*x509.Certificate) *Verifier {
+	v := &Verifier{}
+	for _, cert := range certs {
+		v.AddCertificate(cert)
+	}
+	return v
+}
+
+// AddCertificate adds the key contained in cert to the list of trusted
+// keys. Note that the certificate's validity period and chain are not
+// checked, as is customary for certificates published in metadata
+func (v *Verifier) AddCertificate(cert *x509.Certificate) *TrustedKey {
+	tk := &TrustedKey{
+		Certificate: cert,
+		PublicKey:   cert.PublicKey,
+		data:        pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		format:      crypto.KeyDataFormatCertPem,
+	}
+	v.keys = append(v.keys, tk)
+	return tk
+}
+
+// AddPublicKey adds a bare public key (*rsa.PublicKey, *dsa.PublicKey
+// or *ecdsa.PublicKey) to the list of trusted keys
+func (v *Verifier) AddPublicKey(pub gocrypto.PublicKey) (*TrustedKey, error) {
+	var der []byte
+	var err error
+	if dsapub, ok := pub.(*dsa.PublicKey); ok {
+		der, err = marshalDSAPublicKey(dsapub)
+	} else {
+		der, err = x509.MarshalPKIXPublicKey(pub)
+	}
+	if err != nil {
+		return nil, errors.New("failed to marshal public key: " + err.Error())
+	}
+
+	tk := &TrustedKey{
+		PublicKey: pub,
+		data:      pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		format:    crypto.KeyDataFormatPem,
+	}
+	v.keys = append(v.keys, tk)
+	return tk, nil
+}
+
+// oidPublicKeyDSA is the algorithm identifier of DSA public keys, as
+// defined in RFC 3279
+var oidPublicKeyDSA = asn1.ObjectIdentifier{1, 2, 840, 10040, 4, 1}
+
+// marshalDSAPublicKey encodes pub as a SubjectPublicKeyInfo, which
+// crypto/x509 can parse but not create
+func marshalDSAPublicKey(pub *dsa.PublicKey) ([]byte, error) {
+	params, err := asn1.Marshal(struct{ P, Q, G *big.Int }{pub.P, pub.Q, pub.G})
+	if err != nil {
+		return nil, err
+	}
+	y, err := asn1.Marshal(pub.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPublicKeyDSA,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		PublicKey: asn1.BitString{Bytes: y, BitLength: 8 * len(y)},
+	})
+}
+
+// Keys returns the list of trusted keys
+func (v *Verifier) Keys() []*TrustedKey {
+	return v.keys
+}
+
+// Verify verifies the enveloped signature in the XML document src,
+// and returns the key that the signature validated against.
+// Note that Verify does not check which part of the document was
+// signed. Use VerifyAuthnRequest, VerifyResponse or VerifyAssertion
+// when the contents of the message are going to be used.
+func (v *Verifier) Verify(src []byte) (*TrustedKey, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Verifier.Verify")
+		defer g.IRelease("END Verifier.Verify")
+	}
+
+	if len(v.keys) == 0 {
+		return nil, ErrNoTrustedKeys
+	}
+
+	doc, err := ParseXML(src)
+	if err != nil {
+		return nil, err
+	}
+	defer doc.Free()
+
+	return v.verifyDocument(doc)
+}
+
+func (v *Verifier) verifyDocument(doc types.Document) (*TrustedKey, error) {
+	if len(v.keys) == 0 {
+		return nil, ErrNoTrustedKeys
+	}
+
+	for _, tk := range v.keys {
+		err := tk.verify(doc)
+		if err == nil {
+			return tk, nil
+		}
+		if pdebug.Enabled {
+			pdebug.Printf("Verification using key %p failed: %s", tk, err)
+		}
+	}
+	return nil, ErrUntrustedSignature
+}
+
+func (tk *TrustedKey) verify(doc types.Document) error {
+	key, err := crypto.LoadKeyFromBytes(tk.data, tk.format)
+	if err != nil {
+		return errors.New("failed to load key: " + err.Error())
+	}
+
+	ctx, err := dsig.NewCtx(nil)
+	if err != nil {
+		key.Free()
+		return err
+	}
+	defer ctx.Free()
+
+	// Setting the key explicitly prevents xmlsec from looking up keys
+	// from <ds:KeyInfo>. The context owns the key from here on
+	ctx.SetKey(key)
+	return ctx.Verify(doc)
+}
+
+// VerifyAuthnRequest verifies the signature of the AuthnRequest in src,
+// and parses it. The signature must be attached to and reference the
+// samlp:AuthnRequest element itself
+func (v *Verifier) VerifyAuthnRequest(src []byte) (*AuthnRequest, *TrustedKey, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Verifier.VerifyAuthnRequest")
+		defer g.IRelease("END Verifier.VerifyAuthnRequest")
+	}
+
+	doc, root, err := parseSigned(src, ns.SAMLP, "AuthnRequest")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer doc.Free()
+
+	tk, err := v.verifySignedElement(doc, root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ar := &AuthnRequest{}
+	if err := ar.PopulateFromXML(root); err != nil {
+		return nil, nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return ar, tk, nil
+}
+
+// VerifyLogoutRequest verifies the signature of the LogoutRequest in
+// src, and parses it. The signature must be attached to and reference
+// the samlp:LogoutRequest element itself
+func (v *Verifier) VerifyLogoutRequest(src []byte) (*LogoutRequest, *TrustedKey, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Verifier.VerifyLogoutRequest")
+		defer g.IRelease("END Verifier.VerifyLogoutRequest")
+	}
+
+	doc, root, err := parseSigned(src, ns.SAMLP, "LogoutRequest")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer doc.Free()
+
+	tk, err := v.verifySignedElement(doc, root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lr := &LogoutRequest{}
+	if err := lr.PopulateFromXML(root); err != nil {
+		return nil, nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return lr, tk, nil
+}
+
+// VerifyLogoutResponse verifies the signature of the LogoutResponse in
+// src, and parses it. The signature must be attached to and reference
+// the samlp:LogoutResponse element itself
+func (v *Verifier) VerifyLogoutResponse(src []byte) (*LogoutResponse, *TrustedKey, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Verifier.VerifyLogoutResponse")
+		defer g.IRelease("END Verifier.VerifyLogoutResponse")
+	}
+
+	doc, root, err := parseSigned(src, ns.SAMLP, "LogoutResponse")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer doc.Free()
+
+	tk, err := v.verifySignedElement(doc, root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := &LogoutResponse{}
+	if err := res.PopulateFromXML(root); err != nil {
+		return nil, nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return res, tk, nil
+}
+
+// VerifyArtifactResolve verifies the signature of the ArtifactResolve
+// in src, and parses it. The signature must be attached to and
+// reference the samlp:ArtifactResolve element itself
+func (v *Verifier) VerifyArtifactResolve(src []byte) (*ArtifactResolve, *TrustedKey, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Verifier.VerifyArtifactResolve")
+		defer g.IRelease("END Verifier.VerifyArtifactResolve")
+	}
+
+	doc, root, err := parseSigned(src, ns.SAMLP, "ArtifactResolve")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer doc.Free()
+
+	tk, err := v.verifySignedElement(doc, root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ar := &ArtifactResolve{}
+	if err := ar.PopulateFromXML(root); err != nil {
+		return nil, nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return ar, tk, nil
+}
+
+// VerifyArtifactResponse verifies the signature of the ArtifactResponse
+// in src, and parses it. The signature must be attached to and
+// reference the samlp:ArtifactResponse element itself. The message
+// carried in the Payload is not verified, and should be verified on
+// its own before use
+func (v *Verifier) VerifyArtifactResponse(src []byte) (*ArtifactResponse, *TrustedKey, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Verifier.VerifyArtifactResponse")
+		defer g.IRelease("END Verifier.VerifyArtifactResponse")
+	}
+
+	doc, root, err := parseSigned(src, ns.SAMLP, "ArtifactResponse")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer doc.Free()
+
+	tk, err := v.verifySignedElement(doc, root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := &ArtifactResponse{}
+	if err := res.PopulateFromXML(root); err != nil {
+		return nil, nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return res, tk, nil
+}
+
+// VerifyAttributeQuery verifies the signature of the AttributeQuery
+// in src, and parses it. The signature must be attached to and
+// reference the samlp:AttributeQuery element itself
+func (v *Verifier) VerifyAttributeQuery(src []byte) (*AttributeQuery, *TrustedKey, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Verifier.VerifyAttributeQuery")
+		defer g.IRelease("END Verifier.VerifyAttributeQuery")
+	}
+
+	doc, root, err := parseSigned(src, ns.SAMLP, "AttributeQuery")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer doc.Free()
+
+	tk, err := v.verifySignedElement(doc, root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aq := &AttributeQuery{}
+	if err := aq.PopulateFromXML(root); err != nil {
+		return nil, nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+	return aq, tk, nil
+}
+
+// VerifyResponse verifies the signature of the Response in src, and
+// parses it. Either the samlp:Response element or its only
+// saml:Assertion must be signed. When only the assertion is signed,
+// the values taken from the Response element itself (such as Status
+// and InResponseTo) are not covered by the signature.
+// If DecryptionKey is set, an encrypted assertion is decrypted, and
+// its signature is verified unless the response itself is signed.
+func (v *Verifier) VerifyResponse(src []byte) (*Response, *TrustedKey, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Verifier.VerifyResponse")
+		defer g.IRelease("END Verifier.VerifyResponse")
+	}
+
+	doc, root, err := parseSigned(src, ns.SAMLP, "Response")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer doc.Free()
+
+	xpc, err := makeXPathContext(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The assertion must be a direct child of the Response, and it
+	// must be the only one in the whole document, encrypted or not
+	total := xpath.Number(xpc.Find("count(//" + ns.SAML.AddPrefix("Assertion") + " | //" + ns.SAML.AddPrefix("EncryptedAssertion") + ")"))
+	if total > 1 {
+		return nil, nil, ErrMultipleAssertions
+	}
+	assertions := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("Assertion") + " | " + ns.SAML.AddPrefix("EncryptedAssertion")))
+	if int(total) != len(assertions) {
+		return nil, nil, errors.New("assertion is not a child of the response")
+	}
+
+	var tk *TrustedKey
+	signed := xpath.Bool(xpc.Find(ns.XMLDSignature.AddPrefix("Signature")))
+	switch {
+	case signed:
+		tk, err = v.verifySignedElement(doc, root)
+	case len(assertions) == 0:
+		err = ErrMissingSignature
+	case assertions[0].LocalName() == "Assertion":
+		tk, err = v.verifySignedElement(doc, assertions[0])
+	case v.DecryptionKey == nil:
+		// The signature is inside the encrypted assertion
+		err = errors.New("decryption key required to verify encrypted assertion")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := &Response{}
+	if err := res.PopulateFromXML(root); err != nil {
+		return nil, nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+
+	if v.DecryptionKey == nil {
+		return res, tk, nil
+	}
+
+	switch {
+	case res.EncryptedAssertion == nil:
+	case signed:
+		// The encrypted assertion is covered by the signature of the
+		// response, so there is no need for it to be signed itself
+		if err := res.DecryptAssertion(v.DecryptionKey); err != nil {
+			return nil, nil, err
+		}
+	default:
+		plaintext, err := res.EncryptedAssertion.Decrypt(v.DecryptionKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		// VerifyAssertion takes care of the encrypted elements
+		a, atk, err := v.VerifyAssertion(plaintext)
+		if err != nil {
+			return nil, nil, err
+		}
+		res.Assertion = a
+		res.EncryptedAssertion = nil
+		return res, atk, nil
+	}
+
+	if res.Assertion != nil {
+		if err := res.Assertion.DecryptElements(v.DecryptionKey); err != nil {
+			return nil, nil, err
+		}
+	}
+	return res, tk, nil
+}
+
+// VerifyAssertion verifies the signature of the standalone Assertion in
+// src, and parses it. The signature must be attached to and reference
+// the saml:Assertion element itself
+func (v *Verifier) VerifyAssertion(src []byte) (*Assertion, *TrustedKey, error) {
+	if pdebug.Enabled {
+		g := pdebug.IPrintf("START Verifier.VerifyAssertion")
+		defer g.IRelease("END Verifier.VerifyAssertion")
+	}
+
+	doc, root, err := parseSigned(src, ns.SAML, "Assertion")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer doc.Free()
+
+	tk, err := v.verifySignedElement(doc, root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a := &Assertion{}
+	if err := a.PopulateFromXML(root); err != nil {
+		return nil, nil, errors.New("failed to populate from xml: " + err.Error())
+	}
+
+	if v.DecryptionKey != nil {
+		if err := a.DecryptElements(v.DecryptionKey); err != nil {
+			return nil, nil, err
+		}
+	}
+	return a, tk, nil
+}
+
+// parseSigned parses src, and makes sure that the document element is
+// the expected one, and that IDs are unique within the document
+func parseSigned(src []byte, namespace *ns.Namespace, name string) (types.Document, types.Node, error) {
+	doc, err := ParseXML(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root, err := doc.DocumentElement()
+	if err != nil {
+		doc.Free()
+		return nil, nil, errors.New("failed to fetch document element: " + err.Error())
+	}
+
+	if root.LocalName() != name || root.NamespaceURI() != namespace.URI {
+		doc.Free()
+		return nil, nil, errors.New("expected " + namespace.AddPrefix(name) + " as document element")
+	}
+
+	if err := checkUniqueIDs(root); err != nil {
+		doc.Free()
+		return nil, nil, err
+	}
+	return doc, root, nil
+}
+
+// checkUniqueIDs makes sure that no two elements share an ID, as
+// otherwise the element the signature references may not be the one
+// that is consumed
+func checkUniqueIDs(root types.Node) error {
+	xpc, err := makeXPathContext(root)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]struct{}{}
+	for _, attr := range xpath.NodeList(xpc.Find("//@ID | //@Id | //@id")) {
+		id := attr.NodeValue()
+		if _, ok := seen[id]; ok {
+			return ErrDuplicateID
+		}
+		seen[id] = struct{}{}
+	}
+	return nil
+}
+
+// verifySignedElement makes sure that target carries exactly one
+// signature, that the signature has a single Reference which points at
+// target, and that it is the signature that go-xmlsec will check. Only
+// then is the signature verified against the trusted keys
+func (v *Verifier) verifySignedElement(doc types.Document, target types.Node) (*TrustedKey, error) {
+	xpc, err := makeXPathContext(target)
+	if err != nil {
+		return nil, err
+	}
+
+	sigs := xpath.NodeList(xpc.Find(ns.XMLDSignature.AddPrefix("Signature")))
+	switch len(sigs) {
+	case 0:
+		return nil, ErrMissingSignature
+	case 1:
+	default:
+		return nil, errors.New("multiple signatures on element")
+	}
+
+	sigxpc, err := makeXPathContext(sigs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// go-xmlsec verifies the first signature in the document, so make
+	// sure that it is the one we have been looking at
+	if !xpath.Bool(sigxpc.Find("count(preceding::" + ns.XMLDSignature.AddPrefix("Signature") + " | ancestor::" + ns.XMLDSignature.AddPrefix("Signature") + ") = 0")) {
+		return nil, errors.New("unexpected signature preceding the signed element")
+	}
+
+	refs := xpath.NodeList(sigxpc.Find(ns.XMLDSignature.AddPrefix("SignedInfo") + "/" + ns.XMLDSignature.AddPrefix("Reference")))
+	if len(refs) != 1 {
+		return nil, ErrSignatureReference
+	}
+
+	refxpc, err := makeXPathContext(refs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty URI references the whole document, which is only
+	// acceptable when the signed element is the document element
+	switch uri := xpath.String(refxpc.Find("@URI")); uri {
+	case "":
+		if xpath.Bool(xpc.Find("count(ancestor::*) = 0")) {
+			break
+		}
+		return nil, ErrSignatureReference
+	default:
+		id := xpath.String(xpc.Find("@ID"))
+		if id == "" || uri != "#"+id {
+			return nil, ErrSignatureReference
+		}
+		if err := registerID(doc, target); err != nil {
+			return nil, err
+		}
+	}
+
+	return v.verifyDocument(doc)
+}
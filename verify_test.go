@@ -0,0 +1,226 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/go-libxml2/xpath"
+	"github.com/lestrrat/go-saml/binding"
+	"github.com/lestrrat/go-saml/internal/testutil"
+	"github.com/lestrrat/go-saml/ns"
+	"github.com/lestrrat/go-xmlsec"
+	"github.com/lestrrat/go-xmlsec/crypto"
+	"github.com/lestrrat/go-xmlsec/dsig"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifier(t *testing.T) {
+	xmlsec.Init()
+	defer xmlsec.Shutdown()
+
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	otherkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+
+	key, err := crypto.LoadKeyFromRSAPrivateKey(privkey)
+	if !assert.NoError(t, err, "Load key from RSA private key succeeds") {
+		return
+	}
+
+	ar := NewAuthnRequest()
+	ar.Issuer = "http://sp.example.com/metadata"
+	ar.ProtocolBinding = binding.HTTPPost
+	ar.AssertionConsumerServiceURL = "http://sp.example.com/acs"
+
+	encoded, err := ar.Encode(key)
+	if !assert.NoError(t, err, "Encode succeeds") {
+		return
+	}
+	xmlbytes, err := decode(bytes.NewReader(encoded), true)
+	if !assert.NoError(t, err, "decode succeeds") {
+		return
+	}
+
+	_, err = NewVerifier().Verify(xmlbytes)
+	if !assert.Equal(t, ErrNoTrustedKeys, err, "Verify fails without keys") {
+		return
+	}
+
+	cert := testutil.MakeCertificate(t, privkey)
+	othercert := testutil.MakeCertificate(t, otherkey)
+	if cert == nil || othercert == nil {
+		return
+	}
+
+	_, err = NewVerifier(othercert).Verify(xmlbytes)
+	if !assert.Equal(t, ErrUntrustedSignature, err, "Verify fails with untrusted key") {
+		return
+	}
+
+	v := NewVerifier(othercert, cert)
+	tk, err := v.Verify(xmlbytes)
+	if !assert.NoError(t, err, "Verify succeeds") {
+		return
+	}
+	if !assert.Equal(t, cert, tk.Certificate, "matching certificate is returned") {
+		return
+	}
+
+	v = NewVerifier()
+	expected, err := v.AddPublicKey(&privkey.PublicKey)
+	if !assert.NoError(t, err, "AddPublicKey succeeds") {
+		return
+	}
+	tk, err = v.Verify(xmlbytes)
+	if !assert.NoError(t, err, "Verify succeeds") {
+		return
+	}
+	if !assert.Equal(t, expected, tk, "matching key is returned") {
+		return
+	}
+}
+
+func TestVerifierWrapping(t *testing.T) {
+	xmlsec.Init()
+	defer xmlsec.Shutdown()
+
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	cert := testutil.MakeCertificate(t, privkey)
+	if cert == nil {
+		return
+	}
+	v := NewVerifier(cert)
+
+	const sig = `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo><ds:Reference URI="%s"/></ds:SignedInfo></ds:Signature>`
+	for _, tc := range []struct {
+		name     string
+		src      string
+		expected error
+	}{
+		{
+			name:     "unsigned",
+			src:      `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_r1"/>`,
+			expected: ErrMissingSignature,
+		},
+		{
+			name:     "duplicate IDs",
+			src:      `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_r1">` + fmt.Sprintf(sig, "#_r1") + `<samlp:Extensions><saml:Assertion ID="_r1"/></samlp:Extensions></samlp:Response>`,
+			expected: ErrDuplicateID,
+		},
+		{
+			name:     "reference to another element",
+			src:      `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_r1">` + fmt.Sprintf(sig, "#_a1") + `<saml:Assertion ID="_a1"/></samlp:Response>`,
+			expected: ErrSignatureReference,
+		},
+		{
+			name:     "multiple assertions",
+			src:      `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_r1"><saml:Assertion ID="_a1">` + fmt.Sprintf(sig, "#_a1") + `</saml:Assertion><saml:Assertion ID="_a2"/></samlp:Response>`,
+			expected: ErrMultipleAssertions,
+		},
+	} {
+		_, _, err := v.VerifyResponse([]byte(tc.src))
+		if !assert.Equal(t, tc.expected, err, "VerifyResponse fails (%s)", tc.name) {
+			return
+		}
+	}
+}
+
+func TestVerifierIDReference(t *testing.T) {
+	xmlsec.Init()
+	defer xmlsec.Shutdown()
+
+	privkey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err, "GenerateKey succeeds") {
+		return
+	}
+	cert := testutil.MakeCertificate(t, privkey)
+	if cert == nil {
+		return
+	}
+	key, err := crypto.LoadKeyFromRSAPrivateKey(privkey)
+	if !assert.NoError(t, err, "Load key from RSA private key succeeds") {
+		return
+	}
+
+	res := NewResponse()
+	res.Issuer = "http://idp.example.com/metadata"
+	res.Status = StatusSuccess
+	res.Assertion = NewAssertion()
+	res.Assertion.Issuer = "http://idp.example.com/metadata"
+	res.Assertion.Subject.NameID = NameID{Value: "alice"}
+
+	xmlstr, err := res.Serialize()
+	if !assert.NoError(t, err, "Serialize succeeds") {
+		return
+	}
+
+	// Sign the assertion the way most IdPs do, with a reference to its ID
+	doc, err := ParseXMLString(xmlstr)
+	if !assert.NoError(t, err, "ParseXMLString succeeds") {
+		return
+	}
+	defer doc.Free()
+
+	root, err := doc.DocumentElement()
+	if !assert.NoError(t, err, "DocumentElement succeeds") {
+		return
+	}
+	xpc, err := makeXPathContext(root)
+	if !assert.NoError(t, err, "makeXPathContext succeeds") {
+		return
+	}
+	anode := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("Assertion"))).First()
+	if !assert.NotNil(t, anode, "Assertion exists") {
+		return
+	}
+	if !assert.NoError(t, registerID(doc, anode), "registerID succeeds") {
+		return
+	}
+
+	sig, err := dsig.NewSignature(anode, dsig.ExclC14N, dsig.RsaSha256, "")
+	if !assert.NoError(t, err, "NewSignature succeeds") {
+		return
+	}
+	if !assert.NoError(t, sig.AddReference(dsig.Sha256, "", "#"+res.Assertion.ID, ""), "AddReference succeeds") {
+		return
+	}
+	if !assert.NoError(t, sig.AddTransform(dsig.Enveloped), "AddTransform succeeds") {
+		return
+	}
+	if !assert.NoError(t, sig.Sign(key), "Sign succeeds") {
+		return
+	}
+	signed := doc.Dump(false)
+	if !assert.Contains(t, signed, `URI="#`+res.Assertion.ID+`"`, "signature references the assertion ID") {
+		return
+	}
+
+	parsed, tk, err := NewVerifier(cert).VerifyResponse([]byte(signed))
+	if !assert.NoError(t, err, "VerifyResponse succeeds") {
+		return
+	}
+	if !assert.Equal(t, cert, tk.Certificate, "matching certificate is returned") {
+		return
+	}
+	if !assert.Equal(t, res.Assertion.ID, parsed.Assertion.ID, "Assertion ID matches") {
+		return
+	}
+
+	tampered := strings.Replace(signed, ">alice<", ">mallory<", 1)
+	_, _, err = NewVerifier(cert).VerifyResponse([]byte(tampered))
+	if !assert.Error(t, err, "VerifyResponse fails for tampered assertion") {
+		return
+	}
+}
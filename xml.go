@@ -43,7 +43,7 @@ func (a Assertion) MakeXMLNode(d types.Document) (types.Node, error) {
 	axml.SetNamespace(ns.XMLSchemaInstance.URI, ns.XMLSchemaInstance.Prefix, false)
 	axml.SetAttribute("ID", a.ID)
 	axml.SetAttribute("Version", a.Version)
-	axml.SetAttribute("IssueInstant", a.IssueInstant.Format(TimeFormat))
+	axml.SetAttribute("IssueInstant", formatTime(a.IssueInstant))
 
 	iss, err := d.CreateElementNS(ns.SAML.URI, ns.SAML.AddPrefix("Issuer"))
 	if err != nil {
@@ -52,7 +52,15 @@ func (a Assertion) MakeXMLNode(d types.Document) (types.Node, error) {
 	iss.AppendText(a.Issuer)
 	axml.AddChild(iss)
 
-	for _, noder := range []MakeXMLNoder{a.Subject, a.Conditions, a.AuthnStatement, a.AttributeStatement} {
+	// Assertions that do not record an authentication, such as those
+	// returned by attribute authorities, have no AuthnStatement
+	noders := []MakeXMLNoder{a.Subject, a.Conditions}
+	if !a.AuthnStatement.AuthnInstant.IsZero() {
+		noders = append(noders, a.AuthnStatement)
+	}
+	noders = append(noders, a.AttributeStatement)
+
+	for _, noder := range noders {
 		n, err := noder.MakeXMLNode(d)
 		if err != nil {
 			return nil, err
@@ -71,24 +79,82 @@ func (s Subject) MakeXMLNode(d types.Document) (types.Node, error) {
 	sub.MakeMortal()
 	defer sub.AutoFree()
 
-	for _, noder := range []MakeXMLNoder{s.NameID, s.SubjectConfirmation} {
-		n, err := noder.MakeXMLNode(d)
+	var idxml types.Node
+	if eid := s.EncryptedID; eid != nil {
+		idxml, err = eid.makeXMLNode(d, "EncryptedID")
+	} else {
+		idxml, err = s.NameID.MakeXMLNode(d)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sub.AddChild(idxml)
+
+	// An empty SubjectConfirmation is left out altogether
+	if s.SubjectConfirmation != (SubjectConfirmation{}) {
+		scxml, err := s.SubjectConfirmation.MakeXMLNode(d)
 		if err != nil {
 			return nil, err
 		}
-		sub.AddChild(n)
+		sub.AddChild(scxml)
 	}
 
 	sub.MakePersistent()
 	return sub, nil
 }
 
+// MakeXMLNode creates a <samlp:Status> element containing the
+// status code. Second-level codes are nested inside the <samlp:StatusCode>
+// of their top-level code
+func (s StatusCode) MakeXMLNode(d types.Document) (types.Node, error) {
+	return makeStatusXMLNode(d, s, "")
+}
+
+// makeStatusXMLNode creates a <samlp:Status> element with the top-level
+// code top, and the second-level code sub nested inside it. If sub is
+// empty and top is a second-level code, top is nested under its
+// top-level code instead
+func makeStatusXMLNode(d types.Document, top, sub StatusCode) (types.Node, error) {
+	if sub == "" {
+		top, sub = splitStatus(top)
+	}
+
+	st, err := d.CreateElement(ns.SAMLP.AddPrefix("Status"))
+	if err != nil {
+		return nil, err
+	}
+	st.MakeMortal()
+	defer st.AutoFree()
+
+	stc, err := d.CreateElement(ns.SAMLP.AddPrefix("StatusCode"))
+	if err != nil {
+		return nil, err
+	}
+	stc.SetAttribute("Value", top.String())
+	st.AddChild(stc)
+
+	if sub != "" {
+		substc, err := d.CreateElement(ns.SAMLP.AddPrefix("StatusCode"))
+		if err != nil {
+			return nil, err
+		}
+		substc.SetAttribute("Value", sub.String())
+		stc.AddChild(substc)
+	}
+
+	st.MakePersistent()
+	return st, nil
+}
+
 func (n NameID) MakeXMLNode(d types.Document) (types.Node, error) {
 	nameid, err := d.CreateElement(ns.SAML.AddPrefix("NameID"))
 	if err != nil {
 		return nil, err
 	}
 	nameid.SetAttribute("Format", n.Format.String())
+	if v := n.SPNameQualifier; v != "" {
+		nameid.SetAttribute("SPNameQualifier", v)
+	}
 	nameid.AppendText(n.Value)
 	return nameid, nil
 }
@@ -114,7 +180,7 @@ func (sc SubjectConfirmation) MakeXMLNode(d types.Document) (types.Node, error)
 	}
 	scd.SetAttribute("InResponseTo", sc.InResponseTo)
 	scd.SetAttribute("Recipient", sc.Recipient)
-	scd.SetAttribute("NotOnOrAfter", sc.NotOnOrAfter.Format(TimeFormat))
+	scd.SetAttribute("NotOnOrAfter", formatTime(sc.NotOnOrAfter))
 
 	scxml.AddChild(scd)
 	scxml.MakePersistent()
@@ -129,15 +195,16 @@ func (c Conditions) MakeXMLNode(d types.Document) (types.Node, error) {
 	cxml.MakeMortal()
 	defer cxml.AutoFree()
 
-	// XXX shobosso says to use RFC3339
-	cxml.SetAttribute("NotBefore", c.NotBefore.Format(time.RFC3339))
-	cxml.SetAttribute("NotOnOrAfter", c.NotOnOrAfter.Format(time.RFC3339))
+	cxml.SetAttribute("NotBefore", formatTime(c.NotBefore))
+	cxml.SetAttribute("NotOnOrAfter", formatTime(c.NotOnOrAfter))
 
-	arxml, err := c.AudienceRestriction.MakeXMLNode(d)
-	if err != nil {
-		return nil, err
+	for _, ar := range c.audienceRestrictions() {
+		arxml, err := ar.MakeXMLNode(d)
+		if err != nil {
+			return nil, err
+		}
+		cxml.AddChild(arxml)
 	}
-	cxml.AddChild(arxml)
 	cxml.MakePersistent()
 	return cxml, err
 }
@@ -170,7 +237,7 @@ func (as AuthnStatement) MakeXMLNode(d types.Document) (types.Node, error) {
 	asxml.MakeMortal()
 	defer asxml.AutoFree()
 
-	asxml.SetAttribute("AuthnInstant", as.AuthnInstant.Format(TimeFormat))
+	asxml.SetAttribute("AuthnInstant", formatTime(as.AuthnInstant))
 	asxml.SetAttribute("SessionIndex", as.SessionIndex)
 	acxml, err := as.AuthnContext.MakeXMLNode(d)
 	if err != nil {
@@ -216,6 +283,14 @@ func (as AttributeStatement) MakeXMLNode(d types.Document) (types.Node, error) {
 		asxml.AddChild(attrxml)
 	}
 
+	for _, ea := range as.EncryptedAttributes {
+		eaxml, err := ea.makeXMLNode(d, "EncryptedAttribute")
+		if err != nil {
+			return nil, err
+		}
+		asxml.AddChild(eaxml)
+	}
+
 	asxml.MakePersistent()
 	return asxml, nil
 }
@@ -268,8 +343,8 @@ func (a Attribute) MakeXMLNode(d types.Document) (types.Node, error) {
 			if _, err := axml.LookupNamespaceURI(k[:i]); err != nil {
 				return nil, err
 			}
-			axml.SetAttribute(k, v)
 		}
+		axml.SetAttribute(k, v)
 	}
 
 	if v := a.FriendlyName; v != "" {
@@ -348,29 +423,271 @@ func makeXPathContext(n types.Node) (*xpath.Context, error) {
 		return nil, errors.New("failed to create xpath context: " + err.Error())
 	}
 
-	if err := xpc.RegisterNS(ns.SAML.Prefix, ns.SAML.URI); err != nil {
-		return nil, errors.New("failed to register namespace for xpath context: " + err.Error())
+	for _, namespace := range []*ns.Namespace{ns.SAML, ns.SAMLP, ns.XMLSchemaInstance, ns.XMLDSignature, ns.XMLEncryption} {
+		if err := xpc.RegisterNS(namespace.Prefix, namespace.URI); err != nil {
+			return nil, errors.New("failed to register namespace for xpath context: " + err.Error())
+		}
 	}
 	return xpc, nil
 }
 
+// timeFormatNoZone is xs:dateTime without a time zone
+const timeFormatNoZone = "2006-01-02T15:04:05.999999999"
+
+// utcTimeFormat is TimeFormat with the "Z" suffix, as SAML requires
+// times to be in UTC
+const utcTimeFormat = TimeFormat + "Z"
+
+// formatTime formats t using utcTimeFormat. t is converted to UTC first,
+// so that times created with time.Now are written out correctly
+func formatTime(t time.Time) string {
+	return t.UTC().Format(utcTimeFormat)
+}
+
+// ParseTime parses xs:dateTime values. Some IdPs in the wild omit the
+// time zone, in which case the value is taken to be in UTC
+func ParseTime(s string) (time.Time, error) {
+	for _, f := range []string{time.RFC3339Nano, timeFormatNoZone} {
+		if t, err := time.Parse(f, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("invalid xs:dateTime value: " + s)
+}
+
+// parseStatus returns the top-level and, if present, second-level
+// status codes in the <samlp:Status> element of the message that xpc
+// points at
+func parseStatus(xpc *xpath.Context) (StatusCode, StatusCode, error) {
+	top := StatusCode(xpath.String(xpc.Find("samlp:Status/samlp:StatusCode/@Value")))
+	if top == "" {
+		return "", "", errors.New("missing samlp:Status")
+	}
+	sub := StatusCode(xpath.String(xpc.Find("samlp:Status/samlp:StatusCode/samlp:StatusCode/@Value")))
+	return top, sub, nil
+}
+
+func (m *Message) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	m.ID = xpath.String(xpc.Find("@ID"))
+	m.Version = xpath.String(xpc.Find("@Version"))
+	m.Destination = xpath.String(xpc.Find("@Destination"))
+	m.Consent = xpath.String(xpc.Find("@Consent"))
+	if s := xpath.String(xpc.Find("@IssueInstant")); s != "" {
+		t, err := ParseTime(s)
+		if err != nil {
+			return err
+		}
+		m.IssueInstant = t
+	}
+
+	m.Issuer = xpath.String(xpc.Find(ns.SAML.AddPrefix("Issuer")))
+	return nil
+}
+
 func (r *Request) PopulateFromXML(n types.Node) error {
+	return r.Message.PopulateFromXML(n)
+}
+
+func (s *Subject) PopulateFromXML(n types.Node) error {
 	xpc, err := makeXPathContext(n)
 	if err != nil {
 		return err
 	}
 
-	r.ID = xpath.String(xpc.Find("@ID"))
-	r.Version = xpath.String(xpc.Find("@Version"))
-	s := xpath.String(xpc.Find("@IssueInstant"))
-	if s == "" {
-		t, err := time.Parse(TimeFormat, s)
-		if err == nil {
-			r.IssueInstant = t
+	if node := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("NameID"))).First(); node != nil {
+		if err := s.NameID.PopulateFromXML(node); err != nil {
+			return err
 		}
 	}
 
-	r.Issuer = xpath.String(xpc.Find(ns.SAML.AddPrefix("Issuer")))
+	if node := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("EncryptedID"))).First(); node != nil {
+		eid := &EncryptedElement{}
+		if err := eid.PopulateFromXML(node); err != nil {
+			return err
+		}
+		s.EncryptedID = eid
+	}
+
+	if node := xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("SubjectConfirmation"))).First(); node != nil {
+		if err := s.SubjectConfirmation.PopulateFromXML(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *NameID) PopulateFromXML(node types.Node) error {
+	xpc, err := makeXPathContext(node)
+	if err != nil {
+		return err
+	}
+
+	n.Format = nameid.Format(xpath.String(xpc.Find("@Format")))
+	n.SPNameQualifier = xpath.String(xpc.Find("@SPNameQualifier"))
+	n.Value = strings.TrimSpace(node.TextContent())
+	return nil
+}
+
+func (sc *SubjectConfirmation) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	sc.Method = ConfirmationMethod(xpath.String(xpc.Find("@Method")))
+	sc.InResponseTo = xpath.String(xpc.Find("saml:SubjectConfirmationData/@InResponseTo"))
+	sc.Recipient = xpath.String(xpc.Find("saml:SubjectConfirmationData/@Recipient"))
+	if s := xpath.String(xpc.Find("saml:SubjectConfirmationData/@NotOnOrAfter")); s != "" {
+		t, err := ParseTime(s)
+		if err != nil {
+			return err
+		}
+		sc.NotOnOrAfter = t
+	}
+	return nil
+}
+
+func (c *Conditions) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	if s := xpath.String(xpc.Find("@NotBefore")); s != "" {
+		t, err := ParseTime(s)
+		if err != nil {
+			return err
+		}
+		c.NotBefore = t
+	}
+	if s := xpath.String(xpc.Find("@NotOnOrAfter")); s != "" {
+		t, err := ParseTime(s)
+		if err != nil {
+			return err
+		}
+		c.NotOnOrAfter = t
+	}
+
+	// Each <saml:AudienceRestriction> is kept separately, as all of
+	// them have to be satisfied
+	for _, node := range xpath.NodeList(xpc.Find("saml:AudienceRestriction")) {
+		arxpc, err := makeXPathContext(node)
+		if err != nil {
+			return err
+		}
+
+		ar := AudienceRestriction{}
+		for _, audnode := range xpath.NodeList(arxpc.Find("saml:Audience")) {
+			ar.Audience = append(ar.Audience, strings.TrimSpace(audnode.TextContent()))
+		}
+		c.AudienceRestrictions = append(c.AudienceRestrictions, ar)
+	}
+	if len(c.AudienceRestrictions) > 0 {
+		c.AudienceRestriction = c.AudienceRestrictions[0]
+	}
+	return nil
+}
+
+func (as *AuthnStatement) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	if s := xpath.String(xpc.Find("@AuthnInstant")); s != "" {
+		t, err := ParseTime(s)
+		if err != nil {
+			return err
+		}
+		as.AuthnInstant = t
+	}
+	as.SessionIndex = xpath.String(xpc.Find("@SessionIndex"))
+	as.AuthnContext.AuthnContextClassRef = AuthenticationMethod(strings.TrimSpace(xpath.String(xpc.Find("saml:AuthnContext/saml:AuthnContextClassRef"))))
+	return nil
+}
+
+func (as *AttributeStatement) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("Attribute"))) {
+		attr := Attribute{}
+		if err := attr.PopulateFromXML(node); err != nil {
+			return err
+		}
+		as.Attributes = append(as.Attributes, attr)
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("EncryptedAttribute"))) {
+		ea := EncryptedElement{}
+		if err := ea.PopulateFromXML(node); err != nil {
+			return err
+		}
+		as.EncryptedAttributes = append(as.EncryptedAttributes, ea)
+	}
+	return nil
+}
+
+func (a *Attribute) PopulateFromXML(n types.Node) error {
+	e, ok := n.(types.Element)
+	if !ok {
+		return errors.New("saml:Attribute must be an element")
+	}
+
+	attrs, err := e.Attributes()
+	if err != nil {
+		return err
+	}
+
+	for _, attr := range attrs {
+		switch name := attr.NodeName(); name {
+		case "Name":
+			a.Name = attr.Value()
+		case "FriendlyName":
+			a.FriendlyName = attr.Value()
+		default:
+			if a.Attrs == nil {
+				a.Attrs = make(map[string]string)
+			}
+			// Keep the namespace declaration around for prefixed
+			// attributes, so that MakeXMLNode can reproduce them
+			if i := strings.IndexByte(name, ':'); i > 0 {
+				a.Attrs["xmlns:"+name[:i]] = attr.NamespaceURI()
+			}
+			a.Attrs[name] = attr.Value()
+		}
+	}
+
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range xpath.NodeList(xpc.Find(ns.SAML.AddPrefix("AttributeValue"))) {
+		av := AttributeValue{}
+		if err := av.PopulateFromXML(node); err != nil {
+			return err
+		}
+		a.Values = append(a.Values, av)
+	}
+	return nil
+}
+
+func (av *AttributeValue) PopulateFromXML(n types.Node) error {
+	xpc, err := makeXPathContext(n)
+	if err != nil {
+		return err
+	}
+
+	av.Type = xpath.String(xpc.Find("@xsi:type"))
+	av.Value = n.TextContent()
 	return nil
 }
 
@@ -393,6 +710,20 @@ func (e Endpoint) MakeXMLNode(doc types.Document) (types.Node, error) {
 	return root, nil
 }
 
+func (e IndexedEndpoint) MakeXMLNode(doc types.Document) (types.Node, error) {
+	n, err := e.Endpoint.MakeXMLNode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	root := n.(types.Element)
+	root.SetAttribute("index", strconv.Itoa(e.Index))
+	if e.IsDefault {
+		root.SetAttribute("isDefault", "true")
+	}
+	return root, nil
+}
+
 func (s AssertionConsumerService) MakeXMLNode(doc types.Document) (types.Node, error) {
 	root, err := doc.CreateElement("md:AssertionConsumerService")
 	if err != nil {
@@ -408,3 +739,20 @@ func (s AssertionConsumerService) MakeXMLNode(doc types.Document) (types.Node, e
 	root.MakePersistent()
 	return root, nil
 }
+
+// StandaloneXML returns n as a document of its own. Copying the node
+// into a new document declares the namespaces it inherited from its
+// ancestors, which serializing it in place would lose
+func StandaloneXML(n types.Node) (string, error) {
+	d := dom.CreateDocument()
+	defer d.Free()
+
+	c, err := d.ImportNode(n, true)
+	if err != nil {
+		return "", err
+	}
+	if err := d.SetDocumentElement(c); err != nil {
+		return "", err
+	}
+	return d.Dump(false), nil
+}
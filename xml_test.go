@@ -284,7 +284,7 @@ uruUEt5gXJrdbUpiUAGnHg==</SignatureValue>
 
 	t.Logf("%s", encoded)
 
-	decoded, err := DecodeAuthnRequest(encoded, false)
+	decoded, err := DecodeAuthnRequest(encoded)
 	if !assert.NoError(t, err, "Decode succeeds") {
 		return
 	}
@@ -0,0 +1,63 @@
+package saml
+
+/*
+#cgo pkg-config: libxml-2.0
+#include <stdint.h>
+#include <libxml/tree.h>
+#include <libxml/valid.h>
+
+// saml_register_id declares attr as an ID attribute of doc, so that
+// same-document references can be resolved. Returns -1 if another
+// attribute is already registered with the same value
+static int saml_register_id(uintptr_t docptr, uintptr_t attrptr) {
+	xmlDocPtr doc = (xmlDocPtr) docptr;
+	xmlAttrPtr attr = (xmlAttrPtr) attrptr;
+	xmlAttrPtr existing;
+	xmlChar *value;
+	int ret = 0;
+
+	value = xmlNodeListGetString(doc, attr->children, 1);
+	if (value == NULL) {
+		return -1;
+	}
+
+	existing = xmlGetID(doc, value);
+	if (existing == NULL) {
+		if (xmlAddID(NULL, doc, value, attr) == NULL) {
+			ret = -1;
+		}
+	} else if (existing != attr) {
+		ret = -1;
+	}
+	xmlFree(value);
+	return ret;
+}
+*/
+import "C"
+
+import (
+	"errors"
+
+	"github.com/lestrrat/go-libxml2/types"
+)
+
+// registerID declares the ID attribute of elem as an XML ID. SAML
+// schemas are not loaded when parsing, so libxml2 does not know that
+// ID is of type xs:ID, and signatures that reference "#<ID>" could not
+// be resolved otherwise
+func registerID(doc types.Document, elem types.Node) error {
+	e, ok := elem.(types.Element)
+	if !ok {
+		return errors.New("node is not an element")
+	}
+
+	attr, err := e.GetAttribute("ID")
+	if err != nil {
+		return errors.New("missing ID attribute: " + err.Error())
+	}
+
+	if C.saml_register_id(C.uintptr_t(doc.Pointer()), C.uintptr_t(attr.Pointer())) != 0 {
+		return ErrDuplicateID
+	}
+	return nil
+}